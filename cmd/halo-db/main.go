@@ -2,16 +2,28 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"halo-db/pkg/constants"
+	dberrors "halo-db/pkg/errors"
+	"halo-db/pkg/iterator"
 	"halo-db/pkg/partition"
 	"halo-db/pkg/types"
 	"os"
 	"strings"
+	"time"
 	"unicode"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		if err := serve(os.Args[2:]); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	pm, err := partition.NewPartitionManager(constants.NumPartitions, constants.DataDir)
 	if err != nil {
 		fmt.Printf("Failed to initialize partition manager: %v\n", err)
@@ -25,7 +37,7 @@ func main() {
 	}()
 
 	fmt.Printf("HaloDB - Partitioned Key-Value Store (%d partitions)\n", constants.NumPartitions)
-	fmt.Println("Commands: put <key> <value>, get <key>, delete <key>, list, clear, stats, tree, quit")
+	fmt.Println("Commands: put <key> <value> [ttl], get <key>, delete <key>, list, scan [start] [end], prefix <prefix>, clear, stats, tree, quit")
 	fmt.Println("Note: Use quotes for values with spaces: put key \"value with spaces\"")
 	fmt.Println()
 
@@ -51,14 +63,26 @@ func main() {
 		case "quit", "exit":
 			return
 		case "put":
-			if len(parts) != 3 {
-				fmt.Println("Usage: put <key> <value>")
+			if len(parts) != 3 && len(parts) != 4 {
+				fmt.Println("Usage: put <key> <value> [ttl]")
 				fmt.Println("Example: put user:1925 \"Halil Bülent Orhon\"")
+				fmt.Println("Example: put session:42 token 30m")
 				continue
 			}
 			key := parts[1]
 			value := types.Value(parts[2])
-			if err := pm.Put(key, value); err != nil {
+			var err error
+			if len(parts) == 4 {
+				ttl, parseErr := time.ParseDuration(parts[3])
+				if parseErr != nil {
+					fmt.Printf("Error: invalid ttl: %v\n", parseErr)
+					continue
+				}
+				err = pm.PutWithTTL(key, value, ttl)
+			} else {
+				err = pm.Put(key, value)
+			}
+			if err != nil {
 				fmt.Printf("Error: %v\n", err)
 			} else {
 				fmt.Println("OK")
@@ -70,7 +94,9 @@ func main() {
 			}
 			key := parts[1]
 			value, err := pm.Get(key)
-			if err != nil {
+			if errors.Is(err, dberrors.ErrNotFound) {
+				fmt.Println("(not found)")
+			} else if err != nil {
 				fmt.Printf("Error: %v\n", err)
 			} else {
 				fmt.Printf("%s\n", string(value))
@@ -95,6 +121,25 @@ func main() {
 					fmt.Println(key)
 				}
 			}
+		case "scan":
+			if len(parts) > 3 {
+				fmt.Println("Usage: scan [start] [end]")
+				continue
+			}
+			var start, end types.Key
+			if len(parts) > 1 {
+				start = parts[1]
+			}
+			if len(parts) > 2 {
+				end = parts[2]
+			}
+			printIterator(pm.Scan(start, end))
+		case "prefix":
+			if len(parts) != 2 {
+				fmt.Println("Usage: prefix <prefix>")
+				continue
+			}
+			printIterator(pm.ScanPrefix(parts[1]))
 		case "clear":
 			if err := pm.Clear(); err != nil {
 				fmt.Printf("Error: %v\n", err)
@@ -116,6 +161,23 @@ func main() {
 	}
 }
 
+func printIterator(it iterator.Iterator) {
+	defer func() { _ = it.Close() }()
+
+	count := 0
+	for ; it.Valid(); it.Next() {
+		fmt.Printf("%s = %s\n", it.Key(), string(it.Value()))
+		count++
+	}
+	if err := it.Err(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	if count == 0 {
+		fmt.Println("No keys found")
+	}
+}
+
 func parseCommand(input string) []string {
 	var parts []string
 	var current strings.Builder
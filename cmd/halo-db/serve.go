@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"halo-db/pkg/constants"
+	"halo-db/pkg/httpapi"
+	"halo-db/pkg/options"
+	"halo-db/pkg/partition"
+	"halo-db/pkg/resp"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const shutdownTimeout = 10 * time.Second
+
+type listener struct {
+	name     string
+	addr     string
+	serve    func(addr string) error
+	shutdown func(ctx context.Context) error
+	closed   error
+}
+
+// serve runs HaloDB as a network server until it receives SIGINT or SIGTERM.
+// An empty address disables that listener.
+func serve(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	respAddr := flags.String("resp", ":6380", "address for the RESP (Redis protocol) listener")
+	httpAddr := flags.String("http", "", "address for the HTTP JSON API listener")
+	dataDir := flags.String("data", constants.DataDir, "data directory")
+	opts := options.Default()
+	flags.IntVar(&opts.NumPartitions, "partitions", opts.NumPartitions, "number of partitions; must match an existing data directory")
+	flags.StringVar(&opts.Router, "router", opts.Router, "partition router: modulo, consistent or range; must match an existing data directory")
+	flags.StringVar(&opts.HashFunction, "hash", opts.HashFunction, "routing hash: md5 or fnv1a; must match an existing data directory")
+	flags.StringVar(&opts.Engine, "engine", opts.Engine, "storage engine: btree or lsm; must match an existing data directory")
+	flags.IntVar(&opts.MemtableSize, "memtable-size", opts.MemtableSize, "entries per memtable before it is flushed")
+	flags.Int64Var(&opts.MemtableBytes, "memtable-bytes", opts.MemtableBytes, "bytes per memtable before it is flushed")
+	flags.Int64Var(&opts.MemoryLimit, "memory-limit", opts.MemoryLimit, "bytes all memtables may hold before writes wait; 0 for no limit")
+	flags.StringVar(&opts.MemtableType, "memtable-type", opts.MemtableType, "memtable implementation: skiplist or slice")
+	flags.IntVar(&opts.MaxImmutableMemtables, "max-immutable-memtables", opts.MaxImmutableMemtables, "full memtables queued for flushing before writes stall")
+	flags.StringVar(&opts.SyncMode, "sync", opts.SyncMode, "WAL sync mode: always, group, interval or none")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *respAddr == "" && *httpAddr == "" {
+		return errors.New("at least one of --resp and --http must be set")
+	}
+
+	pm, err := partition.NewPartitionManagerWithOptions(*dataDir, opts)
+	if err != nil {
+		return fmt.Errorf("failed to initialize partition manager: %w", err)
+	}
+	defer func() {
+		if err := pm.Close(); err != nil {
+			fmt.Printf("Error closing partition manager: %v\n", err)
+		}
+	}()
+
+	var listeners []listener
+	if *respAddr != "" {
+		srv := resp.NewServer(pm)
+		listeners = append(listeners, listener{"RESP", *respAddr, srv.ListenAndServe, srv.Shutdown, resp.ErrServerClosed})
+	}
+	if *httpAddr != "" {
+		srv := httpapi.NewServer(pm)
+		listeners = append(listeners, listener{"HTTP", *httpAddr, srv.ListenAndServe, srv.Shutdown, httpapi.ErrServerClosed})
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l listener) {
+			err := l.serve(l.addr)
+			if errors.Is(err, l.closed) {
+				err = nil
+			}
+			errs <- err
+		}(l)
+		fmt.Printf("HaloDB serving %s on %s (%d partitions)\n", l.name, l.addr, opts.NumPartitions)
+	}
+
+	var serveErr error
+	pending := len(listeners)
+	select {
+	case serveErr = <-errs:
+		pending--
+	case <-ctx.Done():
+	}
+
+	fmt.Println("Shutting down...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, l := range listeners {
+		if err := l.shutdown(shutdownCtx); err != nil && serveErr == nil {
+			serveErr = fmt.Errorf("failed to shut down %s server: %w", l.name, err)
+		}
+	}
+	for ; pending > 0; pending-- {
+		if err := <-errs; err != nil && serveErr == nil {
+			serveErr = err
+		}
+	}
+	return serveErr
+}
@@ -0,0 +1,48 @@
+package batch
+
+import (
+	"halo-db/pkg/types"
+)
+
+type OpType byte
+
+const (
+	OpPut OpType = iota + 1
+	OpDelete
+)
+
+type Op struct {
+	Type  OpType
+	Key   types.Key
+	Value types.Value
+}
+
+type WriteBatch struct {
+	ops []Op
+}
+
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+func (b *WriteBatch) Put(key types.Key, value types.Value) {
+	copied := make(types.Value, len(value))
+	copy(copied, value)
+	b.ops = append(b.ops, Op{Type: OpPut, Key: key, Value: copied})
+}
+
+func (b *WriteBatch) Delete(key types.Key) {
+	b.ops = append(b.ops, Op{Type: OpDelete, Key: key})
+}
+
+func (b *WriteBatch) Clear() {
+	b.ops = nil
+}
+
+func (b *WriteBatch) Len() int {
+	return len(b.ops)
+}
+
+func (b *WriteBatch) Ops() []Op {
+	return b.ops
+}
@@ -0,0 +1,41 @@
+package batch
+
+import (
+	"halo-db/pkg/types"
+	"testing"
+)
+
+func TestWriteBatchOps(t *testing.T) {
+	b := NewWriteBatch()
+
+	value := types.Value("value1")
+	b.Put("key1", value)
+	b.Delete("key2")
+	b.Put("key3", types.Value{})
+
+	value[0] = 'X'
+
+	ops := b.Ops()
+	if b.Len() != 3 || len(ops) != 3 {
+		t.Fatalf("Expected 3 ops, got %d", b.Len())
+	}
+	if ops[0].Type != OpPut || ops[0].Key != "key1" || string(ops[0].Value) != "value1" {
+		t.Errorf("Unexpected first op: %+v", ops[0])
+	}
+	if ops[1].Type != OpDelete || ops[1].Key != "key2" {
+		t.Errorf("Unexpected second op: %+v", ops[1])
+	}
+	if ops[2].Value == nil {
+		t.Error("Expected empty value to stay non-nil")
+	}
+}
+
+func TestWriteBatchClear(t *testing.T) {
+	b := NewWriteBatch()
+	b.Put("key1", types.Value("value1"))
+	b.Clear()
+
+	if b.Len() != 0 {
+		t.Errorf("Expected empty batch after clear, got %d ops", b.Len())
+	}
+}
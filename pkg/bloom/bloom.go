@@ -1,6 +1,8 @@
 package bloom
 
 import (
+	"encoding/binary"
+	"errors"
 	"hash/fnv"
 	"math"
 )
@@ -9,6 +11,7 @@ type BloomFilter interface {
 	Add(key string)
 	Contains(key string) bool
 	Clear()
+	MarshalBinary() ([]byte, error)
 }
 
 type bloomFilter struct {
@@ -48,6 +51,38 @@ func (bf *bloomFilter) Clear() {
 	}
 }
 
+// MarshalBinary encodes the filter as its size and number of hash functions,
+// each a big-endian uint64, followed by the bits packed eight to a byte.
+func (bf *bloomFilter) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 16+(bf.size+7)/8)
+	binary.BigEndian.PutUint64(data[0:8], uint64(bf.size))
+	binary.BigEndian.PutUint64(data[8:16], uint64(bf.hashFunc))
+	for i, set := range bf.bits {
+		if set {
+			data[16+i/8] |= 1 << (i % 8)
+		}
+	}
+	return data, nil
+}
+
+// UnmarshalBloomFilter decodes a filter encoded by MarshalBinary.
+func UnmarshalBloomFilter(data []byte) (BloomFilter, error) {
+	if len(data) < 16 {
+		return nil, errors.New("bloom filter encoding too short")
+	}
+	size := binary.BigEndian.Uint64(data[0:8])
+	hashFunc := binary.BigEndian.Uint64(data[8:16])
+	if size == 0 || uint64(len(data)-16) != (size+7)/8 {
+		return nil, errors.New("bloom filter encoding has the wrong length")
+	}
+
+	bf := &bloomFilter{bits: make([]bool, size), size: uint(size), hashFunc: uint(hashFunc)}
+	for i := range bf.bits {
+		bf.bits[i] = data[16+i/8]&(1<<(i%8)) != 0
+	}
+	return bf, nil
+}
+
 func (bf *bloomFilter) hash(key string, seed uint) uint {
 	h := fnv.New64a()
 	h.Write([]byte(key))
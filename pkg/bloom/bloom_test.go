@@ -86,3 +86,28 @@ func TestBloomFilterEstimateHashFunctions(t *testing.T) {
 		t.Error("Estimated hash functions should not be zero")
 	}
 }
+
+func TestBloomFilterMarshal(t *testing.T) {
+	bf := NewBloomFilter(1001, 4)
+	for _, key := range []string{"key1", "key2", "key3"} {
+		bf.Add(key)
+	}
+
+	data, err := bf.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Failed to marshal bloom filter: %v", err)
+	}
+	decoded, err := UnmarshalBloomFilter(data)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal bloom filter: %v", err)
+	}
+	for _, key := range []string{"key1", "key2", "key3", "key4", "other"} {
+		if decoded.Contains(key) != bf.Contains(key) {
+			t.Errorf("Decoded filter disagrees with the original on %s", key)
+		}
+	}
+
+	if _, err := UnmarshalBloomFilter(data[:len(data)-1]); err == nil {
+		t.Error("Expected an error for a truncated encoding")
+	}
+}
@@ -2,154 +2,517 @@ package btree
 
 import (
 	"errors"
+	"fmt"
+	"halo-db/pkg/constants"
+	dberrors "halo-db/pkg/errors"
+	"halo-db/pkg/options"
 	"halo-db/pkg/types"
+	"time"
 )
 
-var ErrKeyNotFound = errors.New("key not found")
+var ErrKeyNotFound = dberrors.ErrNotFound
 
 type BTree interface {
 	Insert(key types.Key, value types.Value) error
+	InsertWithExpiry(key types.Key, value types.Value, expiresAt int64) error
 	Find(key types.Key) (types.Value, error)
+	FindWithExpiry(key types.Key) (types.Value, int64, error)
 	Delete(key types.Key) error
 	List() []types.Key
+	Scan(start, end types.Key, fn func(types.Key, types.Value) bool) error
+	Seek(key types.Key) Cursor
+	SeekRange(start, end types.Key) Cursor
+	Min() (types.Key, types.Value, error)
+	Max() (types.Key, types.Value, error)
+	Floor(key types.Key) (types.Key, types.Value, error)
+	Ceiling(key types.Key) (types.Key, types.Value, error)
+	Expired(now int64) []types.Key
+	Sync() error
+	Clear() error
+	Close() error
+	Stats() map[string]interface{}
 }
 
 type bPlusTree struct {
-	root *node
+	pager *pager
+	order int
 }
 
 func NewBPlusTree() BTree {
-	return &bPlusTree{}
+	return &bPlusTree{pager: newMemPager(constants.PageSize), order: constants.MaxKeys}
+}
+
+func OpenBPlusTree(path string) (BTree, error) {
+	return OpenBPlusTreeWithOptions(path, options.Default())
+}
+
+// OpenBPlusTreeWithOptions uses the page size, page cache size and order
+// (maximum keys per node) from opts. Nodes written with a different order
+// are still read correctly and are split to the new order as they fill up.
+func OpenBPlusTreeWithOptions(path string, opts options.Options) (BTree, error) {
+	p, err := openPager(path, opts.PageSize, opts.PageCacheSize)
+	if err != nil {
+		return nil, err
+	}
+	return &bPlusTree{pager: p, order: opts.TreeOrder}, nil
 }
 
 func (t *bPlusTree) Insert(key types.Key, value types.Value) error {
-	if t.root == nil {
-		t.root = newLeafNode()
-		t.root.InsertKeyValue(key, value)
+	return t.InsertWithExpiry(key, value, 0)
+}
+
+// InsertWithExpiry stores an entry that Find, List and Scan stop returning
+// once expiresAt, in Unix nanoseconds, has passed. Expired entries stay in
+// the tree until they are deleted.
+func (t *bPlusTree) InsertWithExpiry(key types.Key, value types.Value, expiresAt int64) error {
+	rootID := t.pager.root()
+	if rootID == 0 {
+		id, err := t.pager.allocate()
+		if err != nil {
+			return err
+		}
+		root := newLeafNode(id)
+		root.InsertKeyValue(key, value, expiresAt)
+		if err := t.writeNode(root); err != nil {
+			return err
+		}
+		t.pager.setRoot(id)
 		return nil
 	}
 
-	leaf := t.findLeaf(key)
-	if leaf == nil {
-		return errors.New("failed to find leaf")
+	leaf, path, err := t.findLeaf(key)
+	if err != nil {
+		return err
 	}
 
-	if !leaf.IsFull() {
-		leaf.InsertKeyValue(key, value)
-		return nil
+	if _, _, found := leaf.GetValue(key); found || !leaf.IsFull(t.order) {
+		leaf.InsertKeyValue(key, value, expiresAt)
+		return t.writeNode(leaf)
 	}
 
-	return t.insertIntoLeafAfterSplitting(leaf, key, value)
+	return t.insertIntoLeafAfterSplitting(leaf, path, key, value, expiresAt)
 }
 
 func (t *bPlusTree) Find(key types.Key) (types.Value, error) {
-	if t.root == nil {
-		return nil, ErrKeyNotFound
+	value, _, err := t.FindWithExpiry(key)
+	return value, err
+}
+
+// FindWithExpiry is Find that also returns when the entry expires, or 0 if
+// it does not.
+func (t *bPlusTree) FindWithExpiry(key types.Key) (types.Value, int64, error) {
+	if t.pager.root() == 0 {
+		return nil, 0, ErrKeyNotFound
 	}
-	leaf := t.findLeaf(key)
-	if leaf == nil {
-		return nil, ErrKeyNotFound
+	leaf, _, err := t.findLeaf(key)
+	if err != nil {
+		return nil, 0, err
 	}
 
-	value, found := leaf.GetValue(key)
-	if !found {
-		return nil, ErrKeyNotFound
+	value, expiresAt, found := leaf.GetValue(key)
+	if !found || types.Expired(expiresAt, time.Now().UnixNano()) {
+		return nil, 0, ErrKeyNotFound
 	}
-	return value, nil
+	return value, expiresAt, nil
 }
 
 func (t *bPlusTree) Delete(key types.Key) error {
-	if t.root == nil {
+	if t.pager.root() == 0 {
 		return ErrKeyNotFound
 	}
-	leaf := t.findLeaf(key)
-	if leaf == nil {
-		return ErrKeyNotFound
+	leaf, path, err := t.findLeaf(key)
+	if err != nil {
+		return err
 	}
 
-	if leaf.DeleteKey(key) {
-		return nil
+	if !leaf.DeleteKey(key) {
+		return ErrKeyNotFound
+	}
+	if err := t.rebalance(leaf, path); err != nil {
+		return err
 	}
-	return ErrKeyNotFound
+	return t.replaceSeparator(key)
 }
 
 func (t *bPlusTree) List() []types.Key {
-	if t.root == nil {
-		return []types.Key{}
+	keys := []types.Key{}
+	for c := t.Seek(""); c.Valid(); c.Next() {
+		keys = append(keys, c.Key())
 	}
-	return t.collectAllKeys(t.root)
+	return keys
+}
+
+func (t *bPlusTree) Scan(start, end types.Key, fn func(types.Key, types.Value) bool) error {
+	c := t.SeekRange(start, end)
+	for ; c.Valid(); c.Next() {
+		if !fn(c.Key(), c.Value()) {
+			return nil
+		}
+	}
+	return c.Err()
 }
 
-func (t *bPlusTree) collectAllKeys(node *node) []types.Key {
+func (t *bPlusTree) Expired(now int64) []types.Key {
 	var keys []types.Key
+	if t.pager.root() == 0 {
+		return keys
+	}
 
-	if node.isLeaf {
-		keys = append(keys, node.keys...)
-	} else {
-		for _, child := range node.children {
-			keys = append(keys, t.collectAllKeys(child)...)
+	leaf, _, err := t.findLeaf("")
+	for err == nil {
+		for i, key := range leaf.keys {
+			if types.Expired(leaf.expiries[i], now) {
+				keys = append(keys, key)
+			}
+		}
+		if leaf.next == 0 {
+			break
 		}
+		leaf, err = t.readNode(leaf.next)
 	}
-
 	return keys
 }
 
-func (t *bPlusTree) findLeaf(key types.Key) *node {
-	if t.root == nil {
-		return nil
+func (t *bPlusTree) Sync() error {
+	return t.pager.commit()
+}
+
+func (t *bPlusTree) Clear() error {
+	return t.pager.reset()
+}
+
+func (t *bPlusTree) Close() error {
+	return t.pager.close()
+}
+
+func (t *bPlusTree) Stats() map[string]interface{} {
+	numPages, dirtyPages := t.pager.stats()
+	return map[string]interface{}{
+		"pages":       numPages,
+		"dirty_pages": dirtyPages,
+		"page_size":   t.pager.pageSize,
+	}
+}
+
+func (t *bPlusTree) findLeaf(key types.Key) (*node, []*node, error) {
+	var path []*node
+	current, err := t.readNode(t.pager.root())
+	if err != nil {
+		return nil, nil, err
 	}
-	current := t.root
 	for !current.isLeaf {
+		path = append(path, current)
 		childIndex := current.FindChildIndex(key)
-		current = current.children[childIndex]
+		current, err = t.readNode(current.children[childIndex])
+		if err != nil {
+			return nil, nil, err
+		}
 	}
-	return current
+	return current, path, nil
 }
 
-func (t *bPlusTree) insertIntoLeafAfterSplitting(leaf *node, key types.Key, value types.Value) error {
-	newLeaf, promotedKey := leaf.SplitWithKey(key, value)
+func (t *bPlusTree) insertIntoLeafAfterSplitting(leaf *node, path []*node, key types.Key, value types.Value, expiresAt int64) error {
+	newID, err := t.pager.allocate()
+	if err != nil {
+		return err
+	}
+
+	newLeaf, promotedKey := leaf.SplitWithKey(key, value, expiresAt, newID)
 	if newLeaf == nil {
 		return errors.New("failed to split leaf")
 	}
+	if err := t.writeNode(leaf); err != nil {
+		return err
+	}
+	if err := t.writeNode(newLeaf); err != nil {
+		return err
+	}
 
-	return t.insertIntoParent(leaf, promotedKey, newLeaf)
+	return t.insertIntoParent(leaf, path, promotedKey, newLeaf)
 }
 
-func (t *bPlusTree) insertIntoParent(left *node, key types.Key, right *node) error {
-	if left.parent == nil {
+func (t *bPlusTree) insertIntoParent(left *node, path []*node, key types.Key, right *node) error {
+	if len(path) == 0 {
 		return t.insertIntoNewRoot(left, key, right)
 	}
 
-	parent := left.parent
-	leftIndex := parent.GetLeftIndex(parent, left)
+	parent := path[len(path)-1]
+	leftIndex := parent.GetLeftIndex(left.id)
 
-	if !parent.IsFull() {
-		return parent.InsertIntoNode(leftIndex, key, right)
+	if !parent.IsFull(t.order) {
+		parent.InsertIntoNode(leftIndex, key, right.id)
+		return t.writeNode(parent)
 	}
 
-	return t.insertIntoNodeAfterSplitting(parent, leftIndex, key, right)
+	return t.insertIntoNodeAfterSplitting(parent, path[:len(path)-1], leftIndex, key, right)
 }
 
 func (t *bPlusTree) insertIntoNewRoot(left *node, key types.Key, right *node) error {
-	t.root = &node{
+	id, err := t.pager.allocate()
+	if err != nil {
+		return err
+	}
+
+	root := &node{
+		id:       id,
 		isLeaf:   false,
 		keys:     []types.Key{key},
-		children: []*node{left, right},
+		children: []pageID{left.id, right.id},
+	}
+	if err := t.writeNode(root); err != nil {
+		return err
 	}
-	left.parent = t.root
-	right.parent = t.root
+	t.pager.setRoot(id)
 	return nil
 }
 
-func (t *bPlusTree) insertIntoNodeAfterSplitting(oldNode *node, leftIndex int, key types.Key, right *node) error {
-	newNode, promotedKey := oldNode.SplitInternalWithKey(leftIndex, key, right)
+func (t *bPlusTree) insertIntoNodeAfterSplitting(oldNode *node, path []*node, leftIndex int, key types.Key, right *node) error {
+	newID, err := t.pager.allocate()
+	if err != nil {
+		return err
+	}
+
+	newNode, promotedKey := oldNode.SplitInternalWithKey(leftIndex, key, right.id, newID)
 	if newNode == nil {
 		return errors.New("failed to split internal node")
 	}
+	if err := t.writeNode(oldNode); err != nil {
+		return err
+	}
+	if err := t.writeNode(newNode); err != nil {
+		return err
+	}
+
+	return t.insertIntoParent(oldNode, path, promotedKey, newNode)
+}
+
+// minKeys is the fewest keys a node other than the root may hold. Splits
+// never leave less, and a merge of an underfull node with a sibling at the
+// minimum still fits in one node.
+func (t *bPlusTree) minKeys(n *node) int {
+	if n.isLeaf {
+		return (t.order + 1) / 2
+	}
+	return (t.order - 1) / 2
+}
+
+// rebalance writes n, which has just lost a key, and path, its ancestors.
+// If n has too few keys left it borrows one from a sibling that can spare
+// it, preferring the left, or else merges with a sibling and rebalances the
+// parent in turn. Nodes written under a different order may start out
+// underfull; they are brought up to the minimum once they are touched.
+func (t *bPlusTree) rebalance(n *node, path []*node) error {
+	if len(path) == 0 {
+		return t.shrinkRoot(n)
+	}
+	if len(n.keys) >= t.minKeys(n) {
+		return t.writeNode(n)
+	}
+
+	parent := path[len(path)-1]
+	index := parent.GetLeftIndex(n.id)
+
+	var left, right *node
+	var err error
+	if index > 0 {
+		if left, err = t.readNode(parent.children[index-1]); err != nil {
+			return err
+		}
+		if len(left.keys) > t.minKeys(left) {
+			parent.keys[index-1] = n.BorrowFromLeft(left, parent.keys[index-1])
+			return t.writeNodes(left, n, parent)
+		}
+	}
+	if index+1 < len(parent.children) {
+		if right, err = t.readNode(parent.children[index+1]); err != nil {
+			return err
+		}
+		if len(right.keys) > t.minKeys(right) {
+			parent.keys[index] = n.BorrowFromRight(right, parent.keys[index])
+			return t.writeNodes(n, right, parent)
+		}
+	}
+
+	if left != nil {
+		left.MergeWith(n, parent.keys[index-1])
+		parent.RemoveSeparator(index - 1)
+		if err := t.writeNode(left); err != nil {
+			return err
+		}
+		t.freeNode(n)
+	} else {
+		n.MergeWith(right, parent.keys[index])
+		parent.RemoveSeparator(index)
+		if err := t.writeNode(n); err != nil {
+			return err
+		}
+		t.freeNode(right)
+	}
+	return t.rebalance(parent, path[:len(path)-1])
+}
+
+// shrinkRoot writes the root after a delete. An internal root left with a
+// single child is replaced by that child, and an empty leaf root leaves the
+// tree empty.
+func (t *bPlusTree) shrinkRoot(root *node) error {
+	switch {
+	case !root.isLeaf && len(root.keys) == 0:
+		t.pager.setRoot(root.children[0])
+		t.freeNode(root)
+		return nil
+	case root.isLeaf && len(root.keys) == 0:
+		t.pager.setRoot(0)
+		t.freeNode(root)
+		return nil
+	}
+	return t.writeNode(root)
+}
+
+// replaceSeparator makes sure no parent still separates its children with
+// key once it has been deleted. A stale separator does not misroute lookups,
+// since it still lies between its neighbours, but it is replaced by the
+// smallest key to its right so that separators stay keys that exist.
+func (t *bPlusTree) replaceSeparator(key types.Key) error {
+	id := t.pager.root()
+	for id != 0 {
+		n, err := t.readNode(id)
+		if err != nil {
+			return err
+		}
+		if n.isLeaf {
+			return nil
+		}
+
+		index := n.FindChildIndex(key)
+		if index > 0 && n.keys[index-1] == key {
+			smallest, found, err := t.smallestKey(n.children[index])
+			if err != nil || !found {
+				return err
+			}
+			n.keys[index-1] = smallest
+			return t.writeNode(n)
+		}
+		id = n.children[index]
+	}
+	return nil
+}
+
+func (t *bPlusTree) smallestKey(id pageID) (types.Key, bool, error) {
+	for {
+		n, err := t.readNode(id)
+		if err != nil {
+			return "", false, err
+		}
+		if n.isLeaf {
+			if len(n.keys) == 0 {
+				return "", false, nil
+			}
+			return n.keys[0], true, nil
+		}
+		id = n.children[0]
+	}
+}
+
+func (t *bPlusTree) writeNodes(nodes ...*node) error {
+	for _, n := range nodes {
+		if err := t.writeNode(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	return t.insertIntoParent(oldNode, promotedKey, newNode)
+// freeNode returns the pages of a node that is no longer in the tree.
+func (t *bPlusTree) freeNode(n *node) {
+	t.pager.free(n.id)
+	for _, id := range n.overflow {
+		t.pager.free(id)
+	}
+}
+
+func (t *bPlusTree) readNode(id pageID) (*node, error) {
+	var data []byte
+	var overflow []pageID
+
+	current := id
+	for {
+		page, err := t.pager.read(current)
+		if err != nil {
+			return nil, err
+		}
+
+		pageType, next, payload, err := parsePage(current, page)
+		if err != nil {
+			return nil, err
+		}
+
+		expected := pageTypeOverflow
+		if current == id {
+			expected = pageTypeNode
+		}
+		if pageType != expected {
+			return nil, fmt.Errorf("%w: page %d has type %d, expected %d", ErrCorruptPage, current, pageType, expected)
+		}
+		data = append(data, payload...)
+
+		if next == 0 {
+			break
+		}
+		overflow = append(overflow, next)
+		current = next
+	}
+
+	n, err := decodeNode(id, data)
+	if err != nil {
+		return nil, err
+	}
+	n.overflow = overflow
+	return n, nil
+}
+
+func (t *bPlusTree) writeNode(n *node) error {
+	data := n.encode()
+	chunkSize := t.pager.payloadSize()
+
+	pagesNeeded := (len(data) + chunkSize - 1) / chunkSize
+	if pagesNeeded == 0 {
+		pagesNeeded = 1
+	}
+
+	ids := append([]pageID{n.id}, n.overflow...)
+	for len(ids) < pagesNeeded {
+		id, err := t.pager.allocate()
+		if err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+	for _, id := range ids[pagesNeeded:] {
+		t.pager.free(id)
+	}
+	ids = ids[:pagesNeeded]
+	n.overflow = append([]pageID{}, ids[1:]...)
+
+	for i, id := range ids {
+		start := i * chunkSize
+		end := start + chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+
+		pageType := pageTypeOverflow
+		if i == 0 {
+			pageType = pageTypeNode
+		}
+		next := pageID(0)
+		if i+1 < len(ids) {
+			next = ids[i+1]
+		}
+		t.pager.write(id, t.pager.newPage(pageType, next, data[start:end]))
+	}
+	return nil
 }
 
-func newLeafNode() *node {
-	return &node{isLeaf: true}
+func newLeafNode(id pageID) *node {
+	return &node{id: id, isLeaf: true}
 }
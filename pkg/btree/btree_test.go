@@ -1,8 +1,19 @@
 package btree
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	dberrors "halo-db/pkg/errors"
+	"halo-db/pkg/options"
 	"halo-db/pkg/types"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
 	"testing"
+	"time"
 )
 
 func TestBasicInsertAndFind(t *testing.T) {
@@ -104,7 +115,655 @@ func TestDeleteNonExistent(t *testing.T) {
 	tree := NewBPlusTree()
 
 	err := tree.Delete("nonexistent")
-	if err == nil {
-		t.Error("Expected error for deleting non-existent key")
+	if !errors.Is(err, dberrors.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for deleting non-existent key, got %v", err)
+	}
+}
+
+func TestClosedTree(t *testing.T) {
+	tree, err := OpenBPlusTree(filepath.Join(t.TempDir(), "tree.db"))
+	if err != nil {
+		t.Fatalf("Failed to open tree: %v", err)
+	}
+	if err := tree.Insert("key", types.Value("value")); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	if err := tree.Sync(); err != nil {
+		t.Fatalf("Failed to sync: %v", err)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+
+	if _, err := tree.Find("key"); !errors.Is(err, dberrors.ErrClosed) {
+		t.Errorf("Expected ErrClosed from Find, got %v", err)
+	}
+	if err := tree.Insert("other", types.Value("value")); !errors.Is(err, dberrors.ErrClosed) {
+		t.Errorf("Expected ErrClosed from Insert, got %v", err)
+	}
+	if err := tree.Sync(); !errors.Is(err, dberrors.ErrClosed) {
+		t.Errorf("Expected ErrClosed from Sync, got %v", err)
+	}
+	if err := tree.Close(); !errors.Is(err, dberrors.ErrClosed) {
+		t.Errorf("Expected ErrClosed from a second Close, got %v", err)
+	}
+}
+
+func TestPersistAndReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree.db")
+
+	tree, err := OpenBPlusTree(path)
+	if err != nil {
+		t.Fatalf("Failed to open tree: %v", err)
+	}
+
+	for i := 0; i < 500; i++ {
+		key := types.Key(fmt.Sprintf("key_%04d", i))
+		if err := tree.Insert(key, types.Value(fmt.Sprintf("value_%d", i))); err != nil {
+			t.Fatalf("Failed to insert %s: %v", key, err)
+		}
+	}
+	if err := tree.Sync(); err != nil {
+		t.Fatalf("Failed to sync: %v", err)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+
+	reopened, err := OpenBPlusTree(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen tree: %v", err)
+	}
+	defer func() { _ = reopened.Close() }()
+
+	for i := 0; i < 500; i++ {
+		key := types.Key(fmt.Sprintf("key_%04d", i))
+		value, err := reopened.Find(key)
+		if err != nil {
+			t.Fatalf("Failed to find %s after reopen: %v", key, err)
+		}
+		if string(value) != fmt.Sprintf("value_%d", i) {
+			t.Errorf("Expected value_%d for %s, got %s", i, key, value)
+		}
+	}
+
+	if len(reopened.List()) != 500 {
+		t.Errorf("Expected 500 keys after reopen, got %d", len(reopened.List()))
+	}
+}
+
+func TestEmptyValues(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree.db")
+
+	tree, err := OpenBPlusTree(path)
+	if err != nil {
+		t.Fatalf("Failed to open tree: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		if err := tree.Insert(types.Key(fmt.Sprintf("key_%02d", i)), types.Value{}); err != nil {
+			t.Fatalf("Failed to insert: %v", err)
+		}
+	}
+	if err := tree.Sync(); err != nil {
+		t.Fatalf("Failed to sync: %v", err)
+	}
+	_ = tree.Close()
+
+	reopened, err := OpenBPlusTree(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen tree: %v", err)
+	}
+	defer func() { _ = reopened.Close() }()
+
+	for i := 0; i < 20; i++ {
+		value, err := reopened.Find(types.Key(fmt.Sprintf("key_%02d", i)))
+		if err != nil || value == nil || len(value) != 0 {
+			t.Fatalf("Expected an empty non-nil value for key_%02d, got %v (%v)", i, value, err)
+		}
+	}
+	_ = reopened.Scan("", "", func(key types.Key, value types.Value) bool {
+		if value == nil {
+			t.Errorf("Expected scan to return an empty non-nil value for %s", key)
+		}
+		return true
+	})
+}
+
+func TestUnsyncedChangesDiscarded(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree.db")
+
+	tree, err := OpenBPlusTree(path)
+	if err != nil {
+		t.Fatalf("Failed to open tree: %v", err)
+	}
+	if err := tree.Insert("synced", []byte("value")); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	if err := tree.Sync(); err != nil {
+		t.Fatalf("Failed to sync: %v", err)
+	}
+	if err := tree.Insert("unsynced", []byte("value")); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	_ = tree.Close()
+
+	reopened, err := OpenBPlusTree(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen tree: %v", err)
+	}
+	defer func() { _ = reopened.Close() }()
+
+	if _, err := reopened.Find("synced"); err != nil {
+		t.Errorf("Expected synced key to survive reopen: %v", err)
+	}
+	if _, err := reopened.Find("unsynced"); err == nil {
+		t.Error("Expected unsynced key to be discarded")
+	}
+}
+
+func TestLargeValues(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree.db")
+
+	tree, err := OpenBPlusTree(path)
+	if err != nil {
+		t.Fatalf("Failed to open tree: %v", err)
+	}
+
+	large := bytes.Repeat([]byte("x"), 10000)
+	for i := 0; i < 10; i++ {
+		if err := tree.Insert(types.Key(fmt.Sprintf("large_%d", i)), large); err != nil {
+			t.Fatalf("Failed to insert large value: %v", err)
+		}
+	}
+	if err := tree.Insert("large_0", []byte("small")); err != nil {
+		t.Fatalf("Failed to overwrite large value: %v", err)
+	}
+	if err := tree.Sync(); err != nil {
+		t.Fatalf("Failed to sync: %v", err)
+	}
+	_ = tree.Close()
+
+	reopened, err := OpenBPlusTree(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen tree: %v", err)
+	}
+	defer func() { _ = reopened.Close() }()
+
+	if value, err := reopened.Find("large_0"); err != nil || string(value) != "small" {
+		t.Errorf("Expected small value for large_0, got %q (%v)", value, err)
+	}
+	for i := 1; i < 10; i++ {
+		value, err := reopened.Find(types.Key(fmt.Sprintf("large_%d", i)))
+		if err != nil {
+			t.Fatalf("Failed to find large_%d: %v", i, err)
+		}
+		if !bytes.Equal(value, large) {
+			t.Errorf("Large value mismatch for large_%d", i)
+		}
+	}
+}
+
+func TestIncompleteJournalIgnored(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree.db")
+
+	tree, err := OpenBPlusTree(path)
+	if err != nil {
+		t.Fatalf("Failed to open tree: %v", err)
+	}
+	if err := tree.Insert("key1", []byte("value1")); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	if err := tree.Sync(); err != nil {
+		t.Fatalf("Failed to sync: %v", err)
+	}
+	_ = tree.Close()
+
+	if err := os.WriteFile(path+"-journal", []byte("HALOJRNL torn"), 0644); err != nil {
+		t.Fatalf("Failed to write journal: %v", err)
+	}
+
+	reopened, err := OpenBPlusTree(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen tree with torn journal: %v", err)
+	}
+	defer func() { _ = reopened.Close() }()
+
+	if value, err := reopened.Find("key1"); err != nil || string(value) != "value1" {
+		t.Errorf("Expected value1, got %q (%v)", value, err)
+	}
+	if _, err := os.Stat(path + "-journal"); !os.IsNotExist(err) {
+		t.Error("Expected torn journal to be removed")
+	}
+}
+
+func TestScan(t *testing.T) {
+	tree := NewBPlusTree()
+
+	for i := 0; i < 100; i++ {
+		if err := tree.Insert(types.Key(fmt.Sprintf("key_%03d", i)), []byte(fmt.Sprintf("value_%d", i))); err != nil {
+			t.Fatalf("Failed to insert: %v", err)
+		}
+	}
+
+	var keys []types.Key
+	err := tree.Scan("key_010", "key_020", func(key types.Key, value types.Value) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("Failed to scan: %v", err)
+	}
+	if len(keys) != 10 || keys[0] != "key_010" || keys[9] != "key_019" {
+		t.Errorf("Expected key_010..key_019, got %v", keys)
+	}
+
+	count := 0
+	err = tree.Scan("", "", func(key types.Key, value types.Value) bool {
+		count++
+		return count < 25
+	})
+	if err != nil {
+		t.Fatalf("Failed to scan: %v", err)
+	}
+	if count != 25 {
+		t.Errorf("Expected scan to stop after 25 keys, got %d", count)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree.db")
+
+	tree, err := OpenBPlusTree(path)
+	if err != nil {
+		t.Fatalf("Failed to open tree: %v", err)
+	}
+
+	now := time.Now().UnixNano()
+	for i := 0; i < 100; i++ {
+		key := types.Key(fmt.Sprintf("key_%03d", i))
+		expiresAt := int64(0)
+		if i%2 == 0 {
+			expiresAt = now - 1
+		} else if i%5 == 0 {
+			expiresAt = now + int64(time.Hour)
+		}
+		if err := tree.InsertWithExpiry(key, types.Value("value"), expiresAt); err != nil {
+			t.Fatalf("Failed to insert %s: %v", key, err)
+		}
+	}
+	if err := tree.Sync(); err != nil {
+		t.Fatalf("Failed to sync: %v", err)
+	}
+	_ = tree.Close()
+
+	tree, err = OpenBPlusTree(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen tree: %v", err)
+	}
+	defer func() { _ = tree.Close() }()
+
+	if _, err := tree.Find("key_000"); err != ErrKeyNotFound {
+		t.Errorf("Expected expired key to be hidden, got %v", err)
+	}
+	if _, err := tree.Find("key_005"); err != nil {
+		t.Errorf("Expected unexpired key to be found: %v", err)
+	}
+	if keys := tree.List(); len(keys) != 50 {
+		t.Errorf("Expected 50 live keys, got %d", len(keys))
+	}
+
+	count := 0
+	_ = tree.Scan("", "", func(key types.Key, value types.Value) bool {
+		count++
+		return true
+	})
+	if count != 50 {
+		t.Errorf("Expected scan to return 50 live keys, got %d", count)
+	}
+
+	if expired := tree.Expired(now); len(expired) != 50 {
+		t.Errorf("Expected 50 expired keys, got %d", len(expired))
+	}
+	if expired := tree.Expired(now + int64(2*time.Hour)); len(expired) != 60 {
+		t.Errorf("Expected 60 expired keys an hour later, got %d", len(expired))
+	}
+}
+
+func TestReopenWithDifferentOrder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree.db")
+
+	opts := options.Default()
+	opts.TreeOrder = 16
+	tree, err := OpenBPlusTreeWithOptions(path, opts)
+	if err != nil {
+		t.Fatalf("Failed to open tree: %v", err)
+	}
+	for i := 0; i < 300; i++ {
+		if err := tree.Insert(types.Key(fmt.Sprintf("key_%04d", i)), types.Value("value")); err != nil {
+			t.Fatalf("Failed to insert: %v", err)
+		}
+	}
+	if err := tree.Sync(); err != nil {
+		t.Fatalf("Failed to sync: %v", err)
+	}
+	_ = tree.Close()
+
+	opts.TreeOrder = 3
+	tree, err = OpenBPlusTreeWithOptions(path, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen tree: %v", err)
+	}
+	defer func() { _ = tree.Close() }()
+
+	for i := 300; i < 600; i++ {
+		if err := tree.Insert(types.Key(fmt.Sprintf("key_%04d", i)), types.Value("value")); err != nil {
+			t.Fatalf("Failed to insert: %v", err)
+		}
+	}
+	keys := tree.List()
+	if len(keys) != 600 {
+		t.Fatalf("Expected 600 keys, got %d", len(keys))
+	}
+	for i := 0; i < 600; i++ {
+		if _, err := tree.Find(types.Key(fmt.Sprintf("key_%04d", i))); err != nil {
+			t.Fatalf("Failed to find key_%04d: %v", i, err)
+		}
+	}
+}
+
+func TestDeleteRebalances(t *testing.T) {
+	for _, order := range []int{3, 4, 5, 16} {
+		t.Run(fmt.Sprintf("order%d", order), func(t *testing.T) {
+			opts := options.Default()
+			opts.TreeOrder = order
+			tree, err := OpenBPlusTreeWithOptions(filepath.Join(t.TempDir(), "tree.db"), opts)
+			if err != nil {
+				t.Fatalf("Failed to open tree: %v", err)
+			}
+			defer func() { _ = tree.Close() }()
+
+			rng := rand.New(rand.NewPCG(uint64(order), 1))
+			live := make(map[types.Key]bool)
+			for i := 0; i < 3000; i++ {
+				key := types.Key(fmt.Sprintf("key_%04d", rng.IntN(400)))
+				// Deletes slightly outnumber inserts, so the tree grows,
+				// then churns and drains.
+				if i < 1000 || rng.IntN(100) < 45 {
+					if err := tree.Insert(key, types.Value("value")); err != nil {
+						t.Fatalf("Failed to insert %s: %v", key, err)
+					}
+					live[key] = true
+				} else {
+					err := tree.Delete(key)
+					if live[key] && err != nil {
+						t.Fatalf("Failed to delete %s: %v", key, err)
+					}
+					if !live[key] && !errors.Is(err, ErrKeyNotFound) {
+						t.Fatalf("Expected ErrKeyNotFound deleting %s, got %v", key, err)
+					}
+					delete(live, key)
+				}
+				checkTree(t, tree, live)
+			}
+
+			for key := range live {
+				if err := tree.Delete(key); err != nil {
+					t.Fatalf("Failed to delete %s: %v", key, err)
+				}
+				delete(live, key)
+				checkTree(t, tree, live)
+			}
+			if root := tree.(*bPlusTree).pager.root(); root != 0 {
+				t.Errorf("Expected an empty tree to have no root, got page %d", root)
+			}
+		})
+	}
+}
+
+func TestDeleteReusesPages(t *testing.T) {
+	tree := NewBPlusTree()
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 500; i++ {
+			if err := tree.Insert(types.Key(fmt.Sprintf("key_%04d", i)), types.Value("value")); err != nil {
+				t.Fatalf("Failed to insert: %v", err)
+			}
+		}
+		pages := tree.Stats()["pages"]
+		for i := 0; i < 500; i++ {
+			if err := tree.Delete(types.Key(fmt.Sprintf("key_%04d", i))); err != nil {
+				t.Fatalf("Failed to delete: %v", err)
+			}
+		}
+		if round > 0 && tree.Stats()["pages"] != pages {
+			t.Errorf("Expected freed pages to be reused, pages grew to %v", tree.Stats()["pages"])
+		}
+	}
+}
+
+func TestCursor(t *testing.T) {
+	opts := options.Default()
+	opts.TreeOrder = 3
+	tree, err := OpenBPlusTreeWithOptions(filepath.Join(t.TempDir(), "tree.db"), opts)
+	if err != nil {
+		t.Fatalf("Failed to open tree: %v", err)
+	}
+	defer func() { _ = tree.Close() }()
+
+	if _, _, err := tree.Min(); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound for Min of an empty tree, got %v", err)
+	}
+	if c := tree.Seek(""); c.Valid() {
+		t.Errorf("Expected a cursor on an empty tree to be invalid")
+	}
+
+	// Every third key expires and every fifth is deleted again, so the
+	// cursor has to step over gaps both inside and across leaves.
+	past := time.Now().Add(-time.Minute).UnixNano()
+	var live []types.Key
+	for i := 0; i < 300; i++ {
+		key := types.Key(fmt.Sprintf("key_%03d", i*2))
+		expiresAt := int64(0)
+		if i%3 == 0 {
+			expiresAt = past
+		}
+		if err := tree.InsertWithExpiry(key, types.Value(key), expiresAt); err != nil {
+			t.Fatalf("Failed to insert: %v", err)
+		}
+		if i%3 != 0 && i%5 != 0 {
+			live = append(live, key)
+		}
+	}
+	for i := 0; i < 300; i += 5 {
+		if err := tree.Delete(types.Key(fmt.Sprintf("key_%03d", i*2))); err != nil {
+			t.Fatalf("Failed to delete: %v", err)
+		}
+	}
+
+	var forward []types.Key
+	for c := tree.Seek(""); c.Valid(); c.Next() {
+		if string(c.Value()) != string(c.Key()) {
+			t.Fatalf("Expected value %s, got %s", c.Key(), c.Value())
+		}
+		forward = append(forward, c.Key())
+	}
+	if !reflect.DeepEqual(forward, live) {
+		t.Fatalf("Expected %d live keys in order going forward, got %d", len(live), len(forward))
+	}
+
+	var reverse []types.Key
+	c := tree.SeekRange("", "")
+	for c.SeekLast(); c.Valid(); c.Prev() {
+		reverse = append(reverse, c.Key())
+	}
+	slices.Reverse(reverse)
+	if !reflect.DeepEqual(reverse, live) {
+		t.Fatalf("Expected %d live keys in order going back, got %d", len(live), len(reverse))
+	}
+
+	for _, r := range []struct{ start, end types.Key }{
+		{"key_100", "key_200"},
+		{"key_101", "key_199"},
+		{"key_5", ""},
+		{"", "key_050"},
+		{"key_300", "key_300"},
+		{"zzz", ""},
+	} {
+		var want []types.Key
+		for _, key := range live {
+			if key >= r.start && (r.end == "" || key < r.end) {
+				want = append(want, key)
+			}
+		}
+
+		var got []types.Key
+		c := tree.SeekRange(r.start, r.end)
+		for ; c.Valid(); c.Next() {
+			got = append(got, c.Key())
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("Expected %v in [%q, %q), got %v", want, r.start, r.end, got)
+		}
+
+		got = got[:0]
+		for c.SeekLast(); c.Valid(); c.Prev() {
+			got = append(got, c.Key())
+		}
+		slices.Reverse(got)
+		if !slices.Equal(got, want) {
+			t.Errorf("Expected %v in [%q, %q) going back, got %v", want, r.start, r.end, got)
+		}
+	}
+
+	// Turning around midway revisits the key just passed.
+	c = tree.Seek("key_301")
+	first := c.Key()
+	c.Next()
+	c.Prev()
+	if !c.Valid() || c.Key() != first {
+		t.Errorf("Expected Next then Prev to return to %s", first)
+	}
+
+	if key, _, err := tree.Min(); err != nil || key != live[0] {
+		t.Errorf("Expected Min %s, got %s (%v)", live[0], key, err)
+	}
+	if key, _, err := tree.Max(); err != nil || key != live[len(live)-1] {
+		t.Errorf("Expected Max %s, got %s (%v)", live[len(live)-1], key, err)
+	}
+	for i := 0; i < 620; i++ {
+		probe := types.Key(fmt.Sprintf("key_%03d", i))
+		pos, found := slices.BinarySearch(live, probe)
+
+		floor, _, err := tree.Floor(probe)
+		switch {
+		case found && floor != probe:
+			t.Errorf("Expected Floor(%s) to be the key itself, got %s (%v)", probe, floor, err)
+		case !found && pos == 0 && !errors.Is(err, ErrKeyNotFound):
+			t.Errorf("Expected no Floor(%s), got %s (%v)", probe, floor, err)
+		case !found && pos > 0 && floor != live[pos-1]:
+			t.Errorf("Expected Floor(%s) %s, got %s (%v)", probe, live[pos-1], floor, err)
+		}
+
+		ceiling, _, err := tree.Ceiling(probe)
+		switch {
+		case pos == len(live) && !errors.Is(err, ErrKeyNotFound):
+			t.Errorf("Expected no Ceiling(%s), got %s (%v)", probe, ceiling, err)
+		case pos < len(live) && ceiling != live[pos]:
+			t.Errorf("Expected Ceiling(%s) %s, got %s (%v)", probe, live[pos], ceiling, err)
+		}
+	}
+}
+
+// checkTree fails t unless tree holds exactly the keys in want and is a
+// valid B+ tree: leaves all at one depth, nodes other than the root at
+// least half full, keys within each node's separator bounds, every
+// separator the smallest key to its right, and a leaf chain that visits
+// every key in order.
+func checkTree(t *testing.T, tree BTree, want map[types.Key]bool) {
+	t.Helper()
+	bt := tree.(*bPlusTree)
+	root := bt.pager.root()
+	if root == 0 {
+		if len(want) != 0 {
+			t.Fatalf("Expected %d keys in an empty tree", len(want))
+		}
+		return
+	}
+
+	leafDepth := -1
+	var leaves []pageID
+	var walk func(id pageID, depth int, lower, upper types.Key) types.Key
+	walk = func(id pageID, depth int, lower, upper types.Key) types.Key {
+		n, err := bt.readNode(id)
+		if err != nil {
+			t.Fatalf("Failed to read node %d: %v", id, err)
+		}
+		if id != root && len(n.keys) < bt.minKeys(n) {
+			t.Fatalf("Node %d has %d keys, below the minimum of %d", id, len(n.keys), bt.minKeys(n))
+		}
+		for i, key := range n.keys {
+			if i > 0 && key <= n.keys[i-1] {
+				t.Fatalf("Node %d keys out of order: %q", id, n.keys)
+			}
+			if key < lower || (upper != "" && key >= upper) {
+				t.Fatalf("Node %d key %q outside [%q, %q)", id, key, lower, upper)
+			}
+		}
+
+		if n.isLeaf {
+			if leafDepth < 0 {
+				leafDepth = depth
+			} else if depth != leafDepth {
+				t.Fatalf("Leaf %d at depth %d, others at %d", id, depth, leafDepth)
+			}
+			leaves = append(leaves, id)
+			if len(n.keys) == 0 {
+				return ""
+			}
+			return n.keys[0]
+		}
+
+		if len(n.children) != len(n.keys)+1 {
+			t.Fatalf("Node %d has %d keys and %d children", id, len(n.keys), len(n.children))
+		}
+		var smallest types.Key
+		for i, child := range n.children {
+			childLower, childUpper := lower, upper
+			if i > 0 {
+				childLower = n.keys[i-1]
+			}
+			if i < len(n.keys) {
+				childUpper = n.keys[i]
+			}
+			childSmallest := walk(child, depth+1, childLower, childUpper)
+			if i == 0 {
+				smallest = childSmallest
+			} else if childSmallest != n.keys[i-1] {
+				t.Fatalf("Node %d separator %q, but the smallest key to its right is %q", id, n.keys[i-1], childSmallest)
+			}
+		}
+		return smallest
+	}
+	walk(root, 0, "", "")
+
+	var chained []types.Key
+	id := leaves[0]
+	for i := 0; id != 0; i++ {
+		if i >= len(leaves) || leaves[i] != id {
+			t.Fatalf("Leaf chain reaches page %d out of order", id)
+		}
+		n, err := bt.readNode(id)
+		if err != nil {
+			t.Fatalf("Failed to read leaf %d: %v", id, err)
+		}
+		chained = append(chained, n.keys...)
+		id = n.next
+	}
+	if len(chained) != len(want) {
+		t.Fatalf("Expected %d keys along the leaf chain, got %d", len(want), len(chained))
+	}
+	for i, key := range chained {
+		if !want[key] || (i > 0 && key <= chained[i-1]) {
+			t.Fatalf("Unexpected key %q at position %d of the leaf chain", key, i)
+		}
 	}
 }
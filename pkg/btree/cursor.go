@@ -0,0 +1,237 @@
+package btree
+
+import (
+	"halo-db/pkg/types"
+	"sort"
+	"time"
+)
+
+// Cursor walks the entries of a tree in key order, in either direction,
+// skipping expired ones. It moves forward along the leaf links and looks up
+// the previous leaf from the root when moving back. It reads the tree as it
+// goes, so it must not be used after the tree has been written to.
+type Cursor interface {
+	// Seek moves to the first entry at or after key.
+	Seek(key types.Key)
+	// SeekLast moves to the last entry.
+	SeekLast()
+	Next()
+	Prev()
+	Valid() bool
+	Key() types.Key
+	Value() types.Value
+	ExpiresAt() int64
+	Err() error
+}
+
+// cursor only stops at keys in [lower, upper); an empty upper is unbounded.
+// Entries that expire while it is open stay visible, as the time is taken
+// once when it is created.
+type cursor struct {
+	tree  *bPlusTree
+	lower types.Key
+	upper types.Key
+	now   int64
+	leaf  *node
+	pos   int
+	err   error
+}
+
+// Seek returns a cursor at the first entry at or after key.
+func (t *bPlusTree) Seek(key types.Key) Cursor {
+	return t.SeekRange(key, "")
+}
+
+// SeekRange returns a cursor over [start, end), at its first entry. An
+// empty end means the range is unbounded above.
+func (t *bPlusTree) SeekRange(start, end types.Key) Cursor {
+	c := t.newCursor(start, end)
+	c.Seek(start)
+	return c
+}
+
+func (t *bPlusTree) newCursor(lower, upper types.Key) *cursor {
+	return &cursor{tree: t, lower: lower, upper: upper, now: time.Now().UnixNano()}
+}
+
+func (t *bPlusTree) Min() (types.Key, types.Value, error) {
+	return entryAt(t.Seek(""))
+}
+
+func (t *bPlusTree) Max() (types.Key, types.Value, error) {
+	c := t.newCursor("", "")
+	c.SeekLast()
+	return entryAt(c)
+}
+
+// Floor returns the entry with the largest key at or before key.
+func (t *bPlusTree) Floor(key types.Key) (types.Key, types.Value, error) {
+	c := t.newCursor("", "")
+	c.seekLastWhere(func(k types.Key) bool { return k <= key })
+	return entryAt(c)
+}
+
+// Ceiling returns the entry with the smallest key at or after key.
+func (t *bPlusTree) Ceiling(key types.Key) (types.Key, types.Value, error) {
+	return entryAt(t.Seek(key))
+}
+
+func entryAt(c Cursor) (types.Key, types.Value, error) {
+	if !c.Valid() {
+		if err := c.Err(); err != nil {
+			return "", nil, err
+		}
+		return "", nil, ErrKeyNotFound
+	}
+	return c.Key(), c.Value(), nil
+}
+
+func (c *cursor) Seek(key types.Key) {
+	c.err = nil
+	c.leaf = nil
+	if key < c.lower {
+		key = c.lower
+	}
+	if c.tree.pager.root() == 0 {
+		return
+	}
+
+	leaf, _, err := c.tree.findLeaf(key)
+	if err != nil {
+		c.err = err
+		return
+	}
+	c.leaf = leaf
+	c.pos = sort.Search(len(leaf.keys), func(i int) bool { return leaf.keys[i] >= key })
+	c.forward()
+}
+
+func (c *cursor) SeekLast() {
+	if c.upper == "" {
+		c.seekLastWhere(func(types.Key) bool { return true })
+		return
+	}
+	c.seekLastWhere(func(k types.Key) bool { return k < c.upper })
+}
+
+// seekLastWhere moves to the last entry whose key satisfies before, which
+// must hold for every key up to some point and for none after it.
+func (c *cursor) seekLastWhere(before func(types.Key) bool) {
+	c.err = nil
+	c.leaf = nil
+	if root := c.tree.pager.root(); root != 0 {
+		c.leaf, c.pos, c.err = c.tree.lastLeafWhere(root, before)
+	}
+	c.backward()
+}
+
+func (c *cursor) Next() {
+	if !c.Valid() {
+		return
+	}
+	c.pos++
+	c.forward()
+}
+
+func (c *cursor) Prev() {
+	if !c.Valid() {
+		return
+	}
+	c.pos--
+	c.backward()
+}
+
+func (c *cursor) Valid() bool {
+	return c.err == nil && c.leaf != nil
+}
+
+func (c *cursor) Key() types.Key {
+	return c.leaf.keys[c.pos]
+}
+
+func (c *cursor) Value() types.Value {
+	return c.leaf.values[c.pos]
+}
+
+func (c *cursor) ExpiresAt() int64 {
+	return c.leaf.expiries[c.pos]
+}
+
+func (c *cursor) Err() error {
+	return c.err
+}
+
+// forward settles on the first live entry from pos onwards, following the
+// leaf links past the end of each leaf.
+func (c *cursor) forward() {
+	for c.leaf != nil {
+		if c.pos >= len(c.leaf.keys) {
+			if c.leaf.next == 0 {
+				c.leaf = nil
+				return
+			}
+			c.leaf, c.err = c.tree.readNode(c.leaf.next)
+			if c.err != nil {
+				c.leaf = nil
+			}
+			c.pos = 0
+			continue
+		}
+		if c.upper != "" && c.leaf.keys[c.pos] >= c.upper {
+			c.leaf = nil
+			return
+		}
+		if !types.Expired(c.leaf.expiries[c.pos], c.now) {
+			return
+		}
+		c.pos++
+	}
+}
+
+// backward settles on the last live entry from pos back. Leaves only link
+// forward, so the one before is found by looking up, from the root, the
+// last key before the current leaf's first.
+func (c *cursor) backward() {
+	for c.leaf != nil {
+		if c.pos < 0 {
+			first := c.leaf.keys[0]
+			c.leaf, c.pos, c.err = c.tree.lastLeafWhere(c.tree.pager.root(), func(k types.Key) bool { return k < first })
+			continue
+		}
+		if c.leaf.keys[c.pos] < c.lower {
+			c.leaf = nil
+			return
+		}
+		if !types.Expired(c.leaf.expiries[c.pos], c.now) {
+			return
+		}
+		c.pos--
+	}
+}
+
+// lastLeafWhere returns the leaf under id holding the last key that
+// satisfies before, and its position, or a nil leaf if there is none. It
+// descends into the last child that can hold such a key, and backs up to
+// the child before it if that one holds none.
+func (t *bPlusTree) lastLeafWhere(id pageID, before func(types.Key) bool) (*node, int, error) {
+	n, err := t.readNode(id)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	last := sort.Search(len(n.keys), func(i int) bool { return !before(n.keys[i]) })
+	if n.isLeaf {
+		if last == 0 {
+			return nil, 0, nil
+		}
+		return n, last - 1, nil
+	}
+
+	for i := last; i >= 0; i-- {
+		leaf, pos, err := t.lastLeafWhere(n.children[i], before)
+		if err != nil || leaf != nil {
+			return leaf, pos, err
+		}
+	}
+	return nil, 0, nil
+}
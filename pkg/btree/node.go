@@ -1,32 +1,33 @@
 package btree
 
 import (
-	"halo-db/pkg/constants"
+	"encoding/binary"
+	"fmt"
 	"halo-db/pkg/types"
 )
 
 type node struct {
+	id       pageID
 	isLeaf   bool
 	keys     []types.Key
 	values   []types.Value
-	children []*node
-	next     *node
-	parent   *node
+	expiries []int64
+	children []pageID
+	next     pageID
+	overflow []pageID
 }
 
-func (n *node) IsFull() bool {
-	return len(n.keys) >= constants.MaxKeys
+func (n *node) IsFull(maxKeys int) bool {
+	return len(n.keys) >= maxKeys
 }
 
-func (n *node) InsertIntoNode(leftIndex int, key types.Key, right *node) error {
+func (n *node) InsertIntoNode(leftIndex int, key types.Key, right pageID) {
 	n.shiftKeysAndChildren(leftIndex)
 	n.keys[leftIndex] = key
 	n.children[leftIndex+1] = right
-	right.parent = n
-	return nil
 }
 
-func (n *node) InsertKeyValue(key types.Key, value types.Value) {
+func (n *node) InsertKeyValue(key types.Key, value types.Value, expiresAt int64) {
 	if !n.isLeaf {
 		return
 	}
@@ -35,23 +36,24 @@ func (n *node) InsertKeyValue(key types.Key, value types.Value) {
 
 	if insertPosition < len(n.keys) && n.keys[insertPosition] == key {
 		n.values[insertPosition] = value
+		n.expiries[insertPosition] = expiresAt
 		return
 	}
 
-	n.insertAtPosition(insertPosition, key, value)
+	n.insertAtPosition(insertPosition, key, value, expiresAt)
 }
 
-func (n *node) GetValue(key types.Key) (types.Value, bool) {
+func (n *node) GetValue(key types.Key) (types.Value, int64, bool) {
 	if !n.isLeaf {
-		return nil, false
+		return nil, 0, false
 	}
 
 	for i, existingKey := range n.keys {
 		if existingKey == key {
-			return n.values[i], true
+			return n.values[i], n.expiries[i], true
 		}
 	}
-	return nil, false
+	return nil, 0, false
 }
 
 func (n *node) DeleteKey(key types.Key) bool {
@@ -68,6 +70,65 @@ func (n *node) DeleteKey(key types.Key) bool {
 	return false
 }
 
+// BorrowFromLeft moves the last entry of left, n's left sibling, to the
+// front of n. separator is the parent key between them; the one to replace
+// it with is returned. Internal nodes rotate the separator through the
+// parent rather than copying a key up.
+func (n *node) BorrowFromLeft(left *node, separator types.Key) types.Key {
+	last := len(left.keys) - 1
+	if n.isLeaf {
+		n.insertAtPosition(0, left.keys[last], left.values[last], left.expiries[last])
+		left.removeAtPosition(last)
+		return n.keys[0]
+	}
+
+	newSeparator := left.keys[last]
+	n.keys = append([]types.Key{separator}, n.keys...)
+	n.children = append([]pageID{left.children[last+1]}, n.children...)
+	left.keys = left.keys[:last]
+	left.children = left.children[:last+1]
+	return newSeparator
+}
+
+// BorrowFromRight moves the first entry of right, n's right sibling, to the
+// end of n, like BorrowFromLeft.
+func (n *node) BorrowFromRight(right *node, separator types.Key) types.Key {
+	if n.isLeaf {
+		n.insertAtPosition(len(n.keys), right.keys[0], right.values[0], right.expiries[0])
+		right.removeAtPosition(0)
+		return right.keys[0]
+	}
+
+	newSeparator := right.keys[0]
+	n.keys = append(n.keys, separator)
+	n.children = append(n.children, right.children[0])
+	right.keys = append([]types.Key{}, right.keys[1:]...)
+	right.children = append([]pageID{}, right.children[1:]...)
+	return newSeparator
+}
+
+// MergeWith appends right, n's right sibling, to n. separator is the parent
+// key between them, which internal nodes pull down.
+func (n *node) MergeWith(right *node, separator types.Key) {
+	if n.isLeaf {
+		n.keys = append(n.keys, right.keys...)
+		n.values = append(n.values, right.values...)
+		n.expiries = append(n.expiries, right.expiries...)
+		n.next = right.next
+		return
+	}
+
+	n.keys = append(append(n.keys, separator), right.keys...)
+	n.children = append(n.children, right.children...)
+}
+
+// RemoveSeparator drops keys[index] and the child to its right, once that
+// child has been merged into its left sibling.
+func (n *node) RemoveSeparator(index int) {
+	n.keys = append(n.keys[:index], n.keys[index+1:]...)
+	n.children = append(n.children[:index+1], n.children[index+2:]...)
+}
+
 func (n *node) FindChildIndex(key types.Key) int {
 	childIndex := 0
 	for childIndex < len(n.keys) && key >= n.keys[childIndex] {
@@ -76,21 +137,21 @@ func (n *node) FindChildIndex(key types.Key) int {
 	return childIndex
 }
 
-func (n *node) SplitWithKey(key types.Key, value types.Value) (*node, types.Key) {
+func (n *node) SplitWithKey(key types.Key, value types.Value, expiresAt int64, newID pageID) (*node, types.Key) {
 	if !n.isLeaf {
 		return nil, ""
 	}
 
-	tempKeys, tempValues := n.prepareTempArrays(key, value)
+	tempKeys, tempValues, tempExpiries := n.prepareTempArrays(key, value, expiresAt)
 	splitPoint := n.calculateSplitPoint(len(tempKeys))
 
-	n.updateWithLeftHalf(tempKeys, tempValues, splitPoint)
-	newLeaf := n.createNewLeaf(tempKeys, tempValues, splitPoint)
+	n.updateWithLeftHalf(tempKeys, tempValues, tempExpiries, splitPoint)
+	newLeaf := n.createNewLeaf(tempKeys, tempValues, tempExpiries, splitPoint, newID)
 
 	return newLeaf, newLeaf.keys[0]
 }
 
-func (n *node) SplitInternalWithKey(leftIndex int, key types.Key, right *node) (*node, types.Key) {
+func (n *node) SplitInternalWithKey(leftIndex int, key types.Key, right pageID, newID pageID) (*node, types.Key) {
 	if n.isLeaf {
 		return nil, ""
 	}
@@ -100,14 +161,14 @@ func (n *node) SplitInternalWithKey(leftIndex int, key types.Key, right *node) (
 	promotedKey := tempKeys[splitPoint-1]
 
 	n.updateInternalWithLeftHalf(tempKeys, tempChildren, splitPoint)
-	newNode := n.createNewInternalNode(tempKeys, tempChildren, splitPoint)
+	newNode := n.createNewInternalNode(tempKeys, tempChildren, splitPoint, newID)
 
 	return newNode, promotedKey
 }
 
-func (n *node) GetLeftIndex(parent, left *node) int {
+func (n *node) GetLeftIndex(left pageID) int {
 	leftIndex := 0
-	for leftIndex <= len(parent.keys) && parent.children[leftIndex] != left {
+	for leftIndex < len(n.children) && n.children[leftIndex] != left {
 		leftIndex++
 	}
 	return leftIndex
@@ -121,26 +182,31 @@ func (n *node) findInsertPosition(key types.Key) int {
 	return insertPosition
 }
 
-func (n *node) insertAtPosition(position int, key types.Key, value types.Value) {
+func (n *node) insertAtPosition(position int, key types.Key, value types.Value, expiresAt int64) {
 	n.keys = append(n.keys, "")
 	n.values = append(n.values, nil)
+	n.expiries = append(n.expiries, 0)
 
 	copy(n.keys[position+1:], n.keys[position:])
 	copy(n.values[position+1:], n.values[position:])
+	copy(n.expiries[position+1:], n.expiries[position:])
 
 	n.keys[position] = key
 	n.values[position] = value
+	n.expiries[position] = expiresAt
 }
 
 func (n *node) removeAtPosition(position int) {
 	n.keys = append(n.keys[:position], n.keys[position+1:]...)
 	n.values = append(n.values[:position], n.values[position+1:]...)
+	n.expiries = append(n.expiries[:position], n.expiries[position+1:]...)
 }
 
-func (n *node) prepareTempArrays(key types.Key, value types.Value) ([]types.Key, []types.Value) {
+func (n *node) prepareTempArrays(key types.Key, value types.Value, expiresAt int64) ([]types.Key, []types.Value, []int64) {
 	keyCount := len(n.keys)
 	tempKeys := make([]types.Key, keyCount+1)
 	tempValues := make([]types.Value, keyCount+1)
+	tempExpiries := make([]int64, keyCount+1)
 
 	keyInserted := false
 	tempIndex := 0
@@ -149,46 +215,50 @@ func (n *node) prepareTempArrays(key types.Key, value types.Value) ([]types.Key,
 		if !keyInserted && key < n.keys[i] {
 			tempKeys[tempIndex] = key
 			tempValues[tempIndex] = value
+			tempExpiries[tempIndex] = expiresAt
 			tempIndex++
 			keyInserted = true
 		}
 		tempKeys[tempIndex] = n.keys[i]
 		tempValues[tempIndex] = n.values[i]
+		tempExpiries[tempIndex] = n.expiries[i]
 		tempIndex++
 	}
 
 	if !keyInserted {
 		tempKeys[tempIndex] = key
 		tempValues[tempIndex] = value
+		tempExpiries[tempIndex] = expiresAt
 	}
 
-	return tempKeys, tempValues
+	return tempKeys, tempValues, tempExpiries
 }
 
 func (n *node) calculateSplitPoint(totalKeys int) int {
 	return totalKeys / 2
 }
 
-func (n *node) updateWithLeftHalf(tempKeys []types.Key, tempValues []types.Value, splitPoint int) {
+func (n *node) updateWithLeftHalf(tempKeys []types.Key, tempValues []types.Value, tempExpiries []int64, splitPoint int) {
 	n.keys = append([]types.Key{}, tempKeys[:splitPoint]...)
 	n.values = append([]types.Value{}, tempValues[:splitPoint]...)
+	n.expiries = append([]int64{}, tempExpiries[:splitPoint]...)
 }
 
-func (n *node) createNewLeaf(tempKeys []types.Key, tempValues []types.Value, splitPoint int) *node {
-	newLeaf := &node{isLeaf: true}
+func (n *node) createNewLeaf(tempKeys []types.Key, tempValues []types.Value, tempExpiries []int64, splitPoint int, newID pageID) *node {
+	newLeaf := &node{id: newID, isLeaf: true}
 	newLeaf.keys = append([]types.Key{}, tempKeys[splitPoint:]...)
 	newLeaf.values = append([]types.Value{}, tempValues[splitPoint:]...)
+	newLeaf.expiries = append([]int64{}, tempExpiries[splitPoint:]...)
 	newLeaf.next = n.next
-	newLeaf.parent = n.parent
-	n.next = newLeaf
+	n.next = newLeaf.id
 
 	return newLeaf
 }
 
-func (n *node) prepareInternalTempArrays(leftIndex int, key types.Key, right *node) ([]types.Key, []*node) {
+func (n *node) prepareInternalTempArrays(leftIndex int, key types.Key, right pageID) ([]types.Key, []pageID) {
 	keyCount := len(n.keys)
 	tempKeys := make([]types.Key, keyCount+1)
-	tempChildren := make([]*node, keyCount+2)
+	tempChildren := make([]pageID, keyCount+2)
 
 	n.copyChildrenToTemp(tempChildren, leftIndex, right)
 	n.copyKeysToTemp(tempKeys, leftIndex, key)
@@ -196,7 +266,7 @@ func (n *node) prepareInternalTempArrays(leftIndex int, key types.Key, right *no
 	return tempKeys, tempChildren
 }
 
-func (n *node) copyChildrenToTemp(tempChildren []*node, leftIndex int, right *node) {
+func (n *node) copyChildrenToTemp(tempChildren []pageID, leftIndex int, right pageID) {
 	for i, j := 0, 0; i < len(n.children)+1; i++ {
 		if i == leftIndex+1 {
 			tempChildren[j] = right
@@ -222,36 +292,172 @@ func (n *node) copyKeysToTemp(tempKeys []types.Key, leftIndex int, key types.Key
 	}
 }
 
-func (n *node) updateInternalWithLeftHalf(tempKeys []types.Key, tempChildren []*node, splitPoint int) {
+func (n *node) updateInternalWithLeftHalf(tempKeys []types.Key, tempChildren []pageID, splitPoint int) {
 	n.keys = append([]types.Key{}, tempKeys[:splitPoint-1]...)
-	n.children = append([]*node{}, tempChildren[:splitPoint]...)
+	n.children = append([]pageID{}, tempChildren[:splitPoint]...)
 }
 
-func (n *node) createNewInternalNode(tempKeys []types.Key, tempChildren []*node, splitPoint int) *node {
-	newNode := &node{isLeaf: false}
+func (n *node) createNewInternalNode(tempKeys []types.Key, tempChildren []pageID, splitPoint int, newID pageID) *node {
+	newNode := &node{id: newID, isLeaf: false}
 	newNode.keys = append([]types.Key{}, tempKeys[splitPoint:]...)
-	newNode.children = append([]*node{}, tempChildren[splitPoint:]...)
-	newNode.parent = n.parent
-
-	n.updateChildrenParent(newNode)
+	newNode.children = append([]pageID{}, tempChildren[splitPoint:]...)
 
 	return newNode
 }
 
-func (n *node) updateChildrenParent(newNode *node) {
-	for _, child := range newNode.children {
-		if child != nil {
-			child.parent = newNode
-		}
-	}
-}
-
 func (n *node) shiftKeysAndChildren(leftIndex int) {
 	n.keys = append(n.keys, "")
-	n.children = append(n.children, nil)
+	n.children = append(n.children, 0)
 
 	for i := len(n.keys) - 1; i > leftIndex; i-- {
 		n.keys[i] = n.keys[i-1]
 		n.children[i+1] = n.children[i]
 	}
 }
+
+const (
+	nodeTypeInternal       = 0
+	nodeTypeLeaf           = 1
+	nodeTypeLeafWithExpiry = 2
+)
+
+// encode writes leaves that hold expiring entries as nodeTypeLeafWithExpiry,
+// which adds a varint expiry after each value. Leaves without any keep the
+// original layout.
+func (n *node) encode() []byte {
+	withExpiry := false
+	for _, expiresAt := range n.expiries {
+		if expiresAt != 0 {
+			withExpiry = true
+			break
+		}
+	}
+
+	buf := make([]byte, 0, 64)
+	switch {
+	case !n.isLeaf:
+		buf = append(buf, nodeTypeInternal)
+	case withExpiry:
+		buf = append(buf, nodeTypeLeafWithExpiry)
+	default:
+		buf = append(buf, nodeTypeLeaf)
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(n.keys)))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(n.next))
+
+	for i, key := range n.keys {
+		buf = binary.AppendUvarint(buf, uint64(len(key)))
+		buf = append(buf, key...)
+		if n.isLeaf {
+			buf = binary.AppendUvarint(buf, uint64(len(n.values[i])))
+			buf = append(buf, n.values[i]...)
+			if withExpiry {
+				buf = binary.AppendUvarint(buf, uint64(n.expiries[i]))
+			}
+		}
+	}
+
+	if !n.isLeaf {
+		for _, child := range n.children {
+			buf = binary.BigEndian.AppendUint32(buf, uint32(child))
+		}
+	}
+
+	return buf
+}
+
+func decodeNode(id pageID, data []byte) (*node, error) {
+	r := &nodeReader{data: data}
+
+	nodeType := r.byte()
+	withExpiry := nodeType == nodeTypeLeafWithExpiry
+	n := &node{id: id, isLeaf: nodeType == nodeTypeLeaf || withExpiry}
+	count := int(r.uvarint())
+	n.next = pageID(r.uint32())
+
+	n.keys = make([]types.Key, 0, count)
+	if n.isLeaf {
+		n.values = make([]types.Value, 0, count)
+		n.expiries = make([]int64, 0, count)
+	}
+	for i := 0; i < count && r.err == nil; i++ {
+		n.keys = append(n.keys, types.Key(r.bytes()))
+		if n.isLeaf {
+			n.values = append(n.values, types.Value(r.bytes()))
+			expiresAt := int64(0)
+			if withExpiry {
+				expiresAt = int64(r.uvarint())
+			}
+			n.expiries = append(n.expiries, expiresAt)
+		}
+	}
+
+	if !n.isLeaf {
+		n.children = make([]pageID, 0, count+1)
+		for i := 0; i <= count && r.err == nil; i++ {
+			n.children = append(n.children, pageID(r.uint32()))
+		}
+	}
+
+	if r.err != nil {
+		return nil, fmt.Errorf("%w: node %d: %v", ErrCorruptPage, id, r.err)
+	}
+	return n, nil
+}
+
+type nodeReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *nodeReader) byte() byte {
+	if r.err != nil || r.pos >= len(r.data) {
+		r.fail()
+		return 0
+	}
+	b := r.data[r.pos]
+	r.pos++
+	return b
+}
+
+func (r *nodeReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data[r.pos:])
+	if n <= 0 {
+		r.fail()
+		return 0
+	}
+	r.pos += n
+	return v
+}
+
+func (r *nodeReader) uint32() uint32 {
+	if r.err != nil || r.pos+4 > len(r.data) {
+		r.fail()
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.data[r.pos:])
+	r.pos += 4
+	return v
+}
+
+func (r *nodeReader) bytes() []byte {
+	length := r.uvarint()
+	if r.err != nil || uint64(len(r.data)-r.pos) < length {
+		r.fail()
+		return nil
+	}
+	b := make([]byte, length)
+	copy(b, r.data[r.pos:])
+	r.pos += int(length)
+	return b
+}
+
+func (r *nodeReader) fail() {
+	if r.err == nil {
+		r.err = fmt.Errorf("truncated node at offset %d", r.pos)
+	}
+}
@@ -0,0 +1,526 @@
+package btree
+
+import (
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	dberrors "halo-db/pkg/errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+)
+
+type pageID uint32
+
+const (
+	metaPageID pageID = 0
+
+	pageTypeMeta     byte = 1
+	pageTypeNode     byte = 2
+	pageTypeOverflow byte = 3
+	pageTypeFree     byte = 4
+
+	pageHeaderSize = 7
+	metaSize       = 33
+	formatVersion  = 1
+)
+
+var (
+	metaMagic    = []byte("HALOTREE")
+	journalMagic = []byte("HALOJRNL")
+)
+
+var ErrCorruptPage = fmt.Errorf("%w: corrupt page", dberrors.ErrCorrupted)
+
+type meta struct {
+	root     pageID
+	numPages uint32
+	freeHead pageID
+}
+
+type pager struct {
+	path      string
+	file      *os.File
+	pageSize  int
+	meta      meta
+	committed meta
+	dirty     map[pageID][]byte
+	memPages  map[pageID][]byte
+	cache     *pageCache
+	closed    bool
+	mu        sync.Mutex
+}
+
+func newMemPager(pageSize int) *pager {
+	p := &pager{
+		pageSize: pageSize,
+		dirty:    make(map[pageID][]byte),
+		memPages: make(map[pageID][]byte),
+	}
+	p.meta = meta{numPages: 1}
+	p.committed = p.meta
+	return p
+}
+
+func openPager(path string, pageSize int, cacheSize int) (*pager, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open tree file: %w", err)
+	}
+
+	p := &pager{
+		path:     path,
+		file:     file,
+		pageSize: pageSize,
+		dirty:    make(map[pageID][]byte),
+		cache:    newPageCache(cacheSize),
+	}
+
+	if err := p.recoverJournal(); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("failed to stat tree file: %w", err)
+	}
+
+	if info.Size() == 0 {
+		p.meta = meta{numPages: 1}
+		if err := p.writeMetaDirect(); err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+	} else if err := p.readMeta(); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	p.committed = p.meta
+	return p, nil
+}
+
+func (p *pager) read(id pageID) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.readLocked(id)
+}
+
+func (p *pager) readLocked(id pageID) ([]byte, error) {
+	if p.closed {
+		return nil, dberrors.ErrClosed
+	}
+	if page, ok := p.dirty[id]; ok {
+		return page, nil
+	}
+	if uint32(id) >= p.meta.numPages {
+		return nil, fmt.Errorf("%w: page %d out of range", ErrCorruptPage, id)
+	}
+
+	if p.file == nil {
+		page, ok := p.memPages[id]
+		if !ok {
+			return nil, fmt.Errorf("%w: page %d missing", ErrCorruptPage, id)
+		}
+		return page, nil
+	}
+
+	if page, ok := p.cache.get(id); ok {
+		return page, nil
+	}
+
+	page, err := p.readFromDisk(id)
+	if err != nil {
+		return nil, err
+	}
+	p.cache.put(id, page)
+	return page, nil
+}
+
+func (p *pager) readFromDisk(id pageID) ([]byte, error) {
+	page := make([]byte, p.pageSize)
+	if _, err := p.file.ReadAt(page, int64(id)*int64(p.pageSize)); err != nil {
+		return nil, fmt.Errorf("failed to read page %d: %w", id, err)
+	}
+	return page, nil
+}
+
+func (p *pager) write(id pageID, page []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dirty[id] = page
+}
+
+func (p *pager) allocate() (pageID, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return 0, dberrors.ErrClosed
+	}
+
+	if p.meta.freeHead != 0 {
+		id := p.meta.freeHead
+		page, err := p.readLocked(id)
+		if err != nil {
+			return 0, err
+		}
+		if page[0] != pageTypeFree {
+			return 0, fmt.Errorf("%w: free list entry %d has type %d", ErrCorruptPage, id, page[0])
+		}
+		p.meta.freeHead = pageID(binary.BigEndian.Uint32(page[1:5]))
+		return id, nil
+	}
+
+	id := pageID(p.meta.numPages)
+	p.meta.numPages++
+	return id, nil
+}
+
+func (p *pager) free(id pageID) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	page := p.newPage(pageTypeFree, p.meta.freeHead, nil)
+	p.dirty[id] = page
+	p.meta.freeHead = id
+}
+
+func (p *pager) root() pageID {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.meta.root
+}
+
+func (p *pager) setRoot(id pageID) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.meta.root = id
+}
+
+func (p *pager) newPage(pageType byte, next pageID, payload []byte) []byte {
+	page := make([]byte, p.pageSize)
+	page[0] = pageType
+	binary.BigEndian.PutUint32(page[1:5], uint32(next))
+	binary.BigEndian.PutUint16(page[5:7], uint16(len(payload)))
+	copy(page[pageHeaderSize:], payload)
+	return page
+}
+
+func parsePage(id pageID, page []byte) (byte, pageID, []byte, error) {
+	length := int(binary.BigEndian.Uint16(page[5:7]))
+	if pageHeaderSize+length > len(page) {
+		return 0, 0, nil, fmt.Errorf("%w: page %d payload overruns page", ErrCorruptPage, id)
+	}
+	next := pageID(binary.BigEndian.Uint32(page[1:5]))
+	return page[0], next, page[pageHeaderSize : pageHeaderSize+length], nil
+}
+
+func (p *pager) payloadSize() int {
+	return p.pageSize - pageHeaderSize
+}
+
+func (p *pager) commit() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return dberrors.ErrClosed
+	}
+
+	if len(p.dirty) == 0 && p.meta == p.committed {
+		return nil
+	}
+
+	p.dirty[metaPageID] = p.encodeMeta()
+
+	if p.file == nil {
+		for id, page := range p.dirty {
+			p.memPages[id] = page
+		}
+		p.dirty = make(map[pageID][]byte)
+		p.committed = p.meta
+		return nil
+	}
+
+	if err := p.writeJournal(); err != nil {
+		return err
+	}
+
+	for id, page := range p.dirty {
+		if _, err := p.file.WriteAt(page, int64(id)*int64(p.pageSize)); err != nil {
+			return fmt.Errorf("failed to write page %d: %w", id, err)
+		}
+	}
+	if err := p.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync tree file: %w", err)
+	}
+	if err := os.Remove(p.journalPath()); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove tree journal: %w", err)
+	}
+
+	for id, page := range p.dirty {
+		p.cache.put(id, page)
+	}
+	p.dirty = make(map[pageID][]byte)
+	p.committed = p.meta
+	return nil
+}
+
+func (p *pager) reset() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return dberrors.ErrClosed
+	}
+
+	p.dirty = make(map[pageID][]byte)
+	p.meta = meta{numPages: 1}
+
+	if p.file == nil {
+		p.memPages = make(map[pageID][]byte)
+		p.committed = p.meta
+		return nil
+	}
+
+	p.cache.clear()
+	if err := p.writeMetaDirect(); err != nil {
+		return err
+	}
+	if err := p.file.Truncate(int64(p.pageSize)); err != nil {
+		return fmt.Errorf("failed to truncate tree file: %w", err)
+	}
+	p.committed = p.meta
+	return nil
+}
+
+func (p *pager) stats() (numPages uint32, dirtyPages int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.meta.numPages, len(p.dirty)
+}
+
+func (p *pager) close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return dberrors.ErrClosed
+	}
+	p.closed = true
+	p.dirty = make(map[pageID][]byte)
+	if p.file == nil {
+		return nil
+	}
+	err := p.file.Close()
+	p.file = nil
+	return err
+}
+
+func (p *pager) encodeMeta() []byte {
+	page := make([]byte, p.pageSize)
+	page[0] = pageTypeMeta
+	copy(page[1:9], metaMagic)
+	binary.BigEndian.PutUint32(page[9:13], formatVersion)
+	binary.BigEndian.PutUint32(page[13:17], uint32(p.pageSize))
+	binary.BigEndian.PutUint32(page[17:21], uint32(p.meta.root))
+	binary.BigEndian.PutUint32(page[21:25], p.meta.numPages)
+	binary.BigEndian.PutUint32(page[25:29], uint32(p.meta.freeHead))
+	binary.BigEndian.PutUint32(page[29:33], crc32.ChecksumIEEE(page[:29]))
+	return page
+}
+
+func (p *pager) writeMetaDirect() error {
+	if _, err := p.file.WriteAt(p.encodeMeta(), 0); err != nil {
+		return fmt.Errorf("failed to write tree meta page: %w", err)
+	}
+	if err := p.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync tree meta page: %w", err)
+	}
+	return nil
+}
+
+func (p *pager) readMeta() error {
+	header := make([]byte, metaSize)
+	if _, err := p.file.ReadAt(header, 0); err != nil {
+		return fmt.Errorf("failed to read tree meta page: %w", err)
+	}
+
+	if header[0] != pageTypeMeta || string(header[1:9]) != string(metaMagic) {
+		return fmt.Errorf("%w: bad tree file magic", ErrCorruptPage)
+	}
+	if crc32.ChecksumIEEE(header[:29]) != binary.BigEndian.Uint32(header[29:33]) {
+		return fmt.Errorf("%w: tree meta checksum mismatch", ErrCorruptPage)
+	}
+	if version := binary.BigEndian.Uint32(header[9:13]); version != formatVersion {
+		return fmt.Errorf("unsupported tree format version %d", version)
+	}
+	if size := int(binary.BigEndian.Uint32(header[13:17])); size != p.pageSize {
+		return fmt.Errorf("tree file page size %d does not match configured %d", size, p.pageSize)
+	}
+
+	p.meta = meta{
+		root:     pageID(binary.BigEndian.Uint32(header[17:21])),
+		numPages: binary.BigEndian.Uint32(header[21:25]),
+		freeHead: pageID(binary.BigEndian.Uint32(header[25:29])),
+	}
+	return nil
+}
+
+func (p *pager) journalPath() string {
+	return p.path + "-journal"
+}
+
+// writeJournal saves the committed contents of every page about to be
+// overwritten so that an interrupted commit can be rolled back on open.
+func (p *pager) writeJournal() error {
+	journal, err := os.OpenFile(p.journalPath(), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create tree journal: %w", err)
+	}
+	defer func() { _ = journal.Close() }()
+
+	checksum := crc32.NewIEEE()
+	out := io.MultiWriter(journal, checksum)
+
+	header := make([]byte, 16)
+	copy(header[:8], journalMagic)
+	binary.BigEndian.PutUint32(header[8:12], uint32(p.pageSize))
+	binary.BigEndian.PutUint32(header[12:16], p.committed.numPages)
+	if _, err := out.Write(header); err != nil {
+		return fmt.Errorf("failed to write tree journal: %w", err)
+	}
+
+	count := uint32(0)
+	idBytes := make([]byte, 4)
+	for id := range p.dirty {
+		if uint32(id) >= p.committed.numPages {
+			continue
+		}
+		original, err := p.readFromDisk(id)
+		if err != nil {
+			return err
+		}
+		binary.BigEndian.PutUint32(idBytes, uint32(id))
+		if _, err := out.Write(idBytes); err != nil {
+			return fmt.Errorf("failed to write tree journal: %w", err)
+		}
+		if _, err := out.Write(original); err != nil {
+			return fmt.Errorf("failed to write tree journal: %w", err)
+		}
+		count++
+	}
+
+	trailer := make([]byte, 8)
+	binary.BigEndian.PutUint32(trailer[:4], count)
+	binary.BigEndian.PutUint32(trailer[4:], checksum.Sum32())
+	if _, err := journal.Write(trailer); err != nil {
+		return fmt.Errorf("failed to write tree journal: %w", err)
+	}
+
+	return journal.Sync()
+}
+
+func (p *pager) recoverJournal() error {
+	data, err := os.ReadFile(p.journalPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read tree journal: %w", err)
+	}
+
+	if !p.journalComplete(data) {
+		return os.Remove(p.journalPath())
+	}
+
+	numPages := binary.BigEndian.Uint32(data[12:16])
+	entrySize := 4 + p.pageSize
+	body := data[16 : len(data)-8]
+	for offset := 0; offset+entrySize <= len(body); offset += entrySize {
+		id := binary.BigEndian.Uint32(body[offset : offset+4])
+		page := body[offset+4 : offset+entrySize]
+		if _, err := p.file.WriteAt(page, int64(id)*int64(p.pageSize)); err != nil {
+			return fmt.Errorf("failed to restore page %d from journal: %w", id, err)
+		}
+	}
+
+	if err := p.file.Truncate(int64(numPages) * int64(p.pageSize)); err != nil {
+		return fmt.Errorf("failed to truncate tree file during recovery: %w", err)
+	}
+	if err := p.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync tree file during recovery: %w", err)
+	}
+	return os.Remove(p.journalPath())
+}
+
+func (p *pager) journalComplete(data []byte) bool {
+	if len(data) < 24 || string(data[:8]) != string(journalMagic) {
+		return false
+	}
+	if int(binary.BigEndian.Uint32(data[8:12])) != p.pageSize {
+		return false
+	}
+
+	body := data[:len(data)-8]
+	count := binary.BigEndian.Uint32(data[len(data)-8 : len(data)-4])
+	if uint64(len(body)-16) != uint64(count)*uint64(4+p.pageSize) {
+		return false
+	}
+	return crc32.ChecksumIEEE(body) == binary.BigEndian.Uint32(data[len(data)-4:])
+}
+
+type pageCache struct {
+	capacity int
+	items    map[pageID]*list.Element
+	order    *list.List
+}
+
+type cachedPage struct {
+	id   pageID
+	page []byte
+}
+
+func newPageCache(capacity int) *pageCache {
+	if capacity <= 0 {
+		capacity = 1
+	}
+	return &pageCache{
+		capacity: capacity,
+		items:    make(map[pageID]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func (c *pageCache) get(id pageID) ([]byte, bool) {
+	elem, ok := c.items[id]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*cachedPage).page, true
+}
+
+func (c *pageCache) put(id pageID, page []byte) {
+	if elem, ok := c.items[id]; ok {
+		elem.Value.(*cachedPage).page = page
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.items[id] = c.order.PushFront(&cachedPage{id: id, page: page})
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*cachedPage).id)
+	}
+}
+
+func (c *pageCache) clear() {
+	c.items = make(map[pageID]*list.Element)
+	c.order.Init()
+}
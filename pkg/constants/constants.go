@@ -1,11 +1,91 @@
 package constants
 
+import "time"
+
 const DataDir = "data"
 
 const NumPartitions = 4
 
 const MemtableSize = 1000
 
+const MemtableBytes = 4 << 20
+
+const MemoryLimit = 64 << 20
+
+const MaxImmutableMemtables = 2
+
+const MemtableType = "skiplist"
+
 const WALFileName = "wal.log"
 
+const TreeFileName = "tree.db"
+
 const MaxKeys = 4
+
+const PageSize = 4096
+
+const PageCacheSize = 1024
+
+const WALSegmentPrefix = "wal-"
+
+const WALSegmentSize = 64 << 20
+
+const ScanBatchSize = 128
+
+const BatchLogFileName = "batches.log"
+
+const BatchLogResetSize = 1 << 20
+
+const WALSyncMode = "group"
+
+const WALSyncInterval = 100 * time.Millisecond
+
+const TxnLockTimeout = time.Second
+
+const TTLReapInterval = time.Second
+
+const TTLReapBatchSize = 1024
+
+const HTTPMaxBodySize = 8 << 20
+
+const MaxKeySize = 64 << 10
+
+const MaxValueSize = 32 << 20
+
+const FlushInterval = 5 * time.Second
+
+const BloomExpectedKeys = 1000
+
+const BloomFalsePositiveRate = 0.01
+
+const ManifestFileName = "MANIFEST"
+
+const Router = "modulo"
+
+const HashFunction = "md5"
+
+const VirtualNodes = 128
+
+const RangeSplitKeys = 1 << 16
+
+const SplitCheckInterval = 10 * time.Second
+
+const Engine = "btree"
+
+const SSTableBlockSize = 4 << 10
+
+const TableManifestFileName = "TABLES"
+
+const LSMLevels = 7
+
+const CompactionStyle = "leveled"
+
+const CompactionTrigger = 4
+
+const LevelSizeBase = 10 << 20
+
+const LevelSizeMultiplier = 10
+
+const TargetFileSize = 2 << 20
+
+const CompactionWorkers = 1
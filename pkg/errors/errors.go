@@ -0,0 +1,15 @@
+// Package errors defines the errors HaloDB reports across all of its layers.
+// Lower layers wrap them with context, so callers should compare with the
+// standard library's errors.Is rather than ==.
+package errors
+
+import "errors"
+
+var (
+	ErrNotFound  = errors.New("key not found")
+	ErrClosed    = errors.New("database closed")
+	ErrCorrupted = errors.New("data corrupted")
+	ErrReadOnly  = errors.New("database is read-only")
+	ErrTooLarge  = errors.New("key or value too large")
+	ErrConflict  = errors.New("transaction conflict")
+)
@@ -0,0 +1,300 @@
+package httpapi
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"halo-db/pkg/constants"
+	"halo-db/pkg/partition"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startServer(t *testing.T) (*httptest.Server, partition.PartitionManager) {
+	t.Helper()
+
+	pm, err := partition.NewPartitionManager(4, t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create partition manager: %v", err)
+	}
+
+	ts := httptest.NewServer(NewServer(pm).Handler())
+	t.Cleanup(func() {
+		ts.Close()
+		_ = pm.Close()
+	})
+	return ts, pm
+}
+
+func do(t *testing.T, method, url, body string) (int, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to build request: %v", err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to send %s %s: %v", method, url, err)
+	}
+	defer res.Body.Close()
+
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	return res.StatusCode, string(data)
+}
+
+func TestKV(t *testing.T) {
+	ts, _ := startServer(t)
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		status int
+		want   string
+	}{
+		{"GET", "/kv/user:1", "", http.StatusNotFound, ""},
+		{"PUT", "/kv/user:1", `{"value":"alice"}`, http.StatusNoContent, ""},
+		{"GET", "/kv/user:1", "", http.StatusOK, `{"key":"user:1","value":"alice"}`},
+		{"PUT", "/kv/a/b", `{"value":"nested"}`, http.StatusNoContent, ""},
+		{"GET", "/kv/a/b", "", http.StatusOK, `{"key":"a/b","value":"nested"}`},
+		{"PUT", "/kv/user:1", `{"value":`, http.StatusBadRequest, ""},
+		{"PUT", "/kv/user:1", `{}`, http.StatusBadRequest, ""},
+		{"PUT", "/kv/user:1", `{"value":"x","ttl":"soon"}`, http.StatusBadRequest, ""},
+		{"PUT", "/kv/", `{"value":"x"}`, http.StatusBadRequest, ""},
+		{"DELETE", "/kv/user:1", "", http.StatusNoContent, ""},
+		{"GET", "/kv/user:1", "", http.StatusNotFound, ""},
+		{"POST", "/kv/user:1", "", http.StatusMethodNotAllowed, ""},
+	}
+	for i, tc := range tests {
+		status, body := do(t, tc.method, ts.URL+tc.path, tc.body)
+		if status != tc.status {
+			t.Errorf("Request %d (%s %s): expected status %d, got %d: %s", i, tc.method, tc.path, tc.status, status, body)
+		}
+		if tc.want != "" && strings.TrimSpace(body) != tc.want {
+			t.Errorf("Request %d (%s %s): expected body %s, got %s", i, tc.method, tc.path, tc.want, body)
+		}
+	}
+
+	if status, _ := do(t, "PUT", ts.URL+"/kv/temp", `{"value":"v","ttl":"50ms"}`); status != http.StatusNoContent {
+		t.Fatalf("Failed to put with ttl: status %d", status)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if status, _ := do(t, "GET", ts.URL+"/kv/temp", ""); status != http.StatusNotFound {
+		t.Errorf("Expected expired key to return 404, got %d", status)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	ts, pm := startServer(t)
+
+	if err := pm.Put("gone", []byte("v")); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+
+	body := `{"ops":[{"op":"put","key":"a","value":"1"},{"op":"put","key":"b","value":"2"},{"op":"delete","key":"gone"}]}`
+	if status, res := do(t, "POST", ts.URL+"/batch", body); status != http.StatusNoContent {
+		t.Fatalf("Expected batch to succeed, got %d: %s", status, res)
+	}
+	for key, want := range map[string]string{"a": "1", "b": "2"} {
+		value, err := pm.Get(key)
+		if err != nil || string(value) != want {
+			t.Errorf("Expected %s=%s after batch, got %q (%v)", key, want, value, err)
+		}
+	}
+	if _, err := pm.Get("gone"); err == nil {
+		t.Error("Expected deleted key to be gone after batch")
+	}
+
+	body = `{"ops":[{"op":"put","key":"c","value":"3"},{"op":"frob","key":"d"}]}`
+	if status, _ := do(t, "POST", ts.URL+"/batch", body); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown op, got %d", status)
+	}
+	if _, err := pm.Get("c"); err == nil {
+		t.Error("Expected a rejected batch to write nothing")
+	}
+}
+
+func TestBinaryValues(t *testing.T) {
+	ts, pm := startServer(t)
+
+	binary := []byte{0xff, 0x00, 0xfe, 'a', 0x80}
+	encoded := base64.StdEncoding.EncodeToString(binary)
+
+	if status, res := do(t, "PUT", ts.URL+"/kv/bin", `{"value":"`+encoded+`","encoding":"base64"}`); status != http.StatusNoContent {
+		t.Fatalf("Failed to put binary value: %d %s", status, res)
+	}
+	if value, err := pm.Get("bin"); err != nil || !bytes.Equal(value, binary) {
+		t.Fatalf("Expected the binary value to be stored as sent, got %v (%v)", value, err)
+	}
+
+	// Entries whose value is not valid UTF-8 come back base64-encoded, key
+	// and all, whether or not the client asked. Asking also means sending
+	// the key encoded.
+	want := `{"key":"Ymlu","value":"` + encoded + `","encoding":"base64"}`
+	for _, path := range []string{"/kv/bin", "/kv/Ymlu?encoding=base64"} {
+		if status, body := do(t, "GET", ts.URL+path, ""); status != http.StatusOK || strings.TrimSpace(body) != want {
+			t.Errorf("GET %s: expected %s, got %d %s", path, want, status, body)
+		}
+	}
+
+	body := `{"encoding":"base64","ops":[{"op":"put","key":"YjE=","value":"` + encoded + `"},{"op":"put","key":"YjI=","value":"dGV4dA=="}]}`
+	if status, res := do(t, "POST", ts.URL+"/batch", body); status != http.StatusNoContent {
+		t.Fatalf("Expected batch to succeed, got %d: %s", status, res)
+	}
+	if value, err := pm.Get("b1"); err != nil || !bytes.Equal(value, binary) {
+		t.Errorf("Expected the batch to store the binary value, got %v (%v)", value, err)
+	}
+
+	wantEntries := []kvResponse{
+		{Key: "YjE=", Value: encoded, Encoding: "base64"},
+		{Key: "b2", Value: "text"},
+		{Key: "Ymlu", Value: encoded, Encoding: "base64"},
+	}
+	if entries := scanEntries(t, ts.URL+"/scan?prefix=b"); !reflect.DeepEqual(entries, wantEntries) {
+		t.Errorf("Expected scan entries %+v, got %+v", wantEntries, entries)
+	}
+
+	// A key that is not valid UTF-8, as RESP clients can write, comes back
+	// encoded and can be sent back that way.
+	if err := pm.Put("k\xff", []byte("v")); err != nil {
+		t.Fatalf("Failed to put binary key: %v", err)
+	}
+	key := base64.StdEncoding.EncodeToString([]byte("k\xff"))
+	wantEntries = []kvResponse{{Key: key, Value: "dg==", Encoding: "base64"}}
+	if entries := scanEntries(t, ts.URL+"/scan?prefix=k"); !reflect.DeepEqual(entries, wantEntries) {
+		t.Errorf("Expected scan entries %+v, got %+v", wantEntries, entries)
+	}
+	if entries := scanEntries(t, ts.URL+"/scan?encoding=base64&prefix="+url.QueryEscape(key)); !reflect.DeepEqual(entries, wantEntries) {
+		t.Errorf("Expected encoded prefix to find %+v, got %+v", wantEntries, entries)
+	}
+	if status, body := do(t, "GET", ts.URL+"/kv/"+key+"?encoding=base64", ""); status != http.StatusOK {
+		t.Errorf("Expected the encoded key to be found, got %d %s", status, body)
+	}
+	if status, body := do(t, "DELETE", ts.URL+"/kv/"+key+"?encoding=base64", ""); status != http.StatusNoContent {
+		t.Errorf("Expected the encoded key to be deleted, got %d %s", status, body)
+	}
+	if _, err := pm.Get("k\xff"); err == nil {
+		t.Error("Expected the binary key to be deleted")
+	}
+
+	for _, body := range []string{`{"value":"!!","encoding":"base64"}`, `{"value":"x","encoding":"hex"}`} {
+		if status, _ := do(t, "PUT", ts.URL+"/kv/bad", body); status != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s, got %d", body, status)
+		}
+	}
+	for _, path := range []string{"/kv/bin?encoding=hex", "/kv/bin?encoding=base64", "/scan?encoding=base64&start=!!"} {
+		if status, _ := do(t, "GET", ts.URL+path, ""); status != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s, got %d", path, status)
+		}
+	}
+}
+
+func scanEntries(t *testing.T, target string) []kvResponse {
+	t.Helper()
+
+	status, res := do(t, "GET", target, "")
+	if status != http.StatusOK {
+		t.Fatalf("Expected scan to succeed, got %d: %s", status, res)
+	}
+	var entries []kvResponse
+	for _, line := range strings.Split(strings.TrimSpace(res), "\n") {
+		var entry kvResponse
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Invalid scan line %q: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestBodyLimit(t *testing.T) {
+	ts, _ := startServer(t)
+
+	big := fmt.Sprintf(`{"value":"%s"}`, strings.Repeat("x", constants.HTTPMaxBodySize))
+	if status, _ := do(t, "PUT", ts.URL+"/kv/big", big); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for an oversized body, got %d", status)
+	}
+
+	// Without a Content-Length the limit is enforced while decoding.
+	req, _ := http.NewRequest("PUT", ts.URL+"/kv/big", io.MultiReader(strings.NewReader(big)))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for an oversized chunked body, got %d", res.StatusCode)
+	}
+}
+
+func TestScan(t *testing.T) {
+	ts, pm := startServer(t)
+
+	for i := 0; i < 300; i++ {
+		if err := pm.Put(fmt.Sprintf("key:%03d", i), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	if err := pm.Put("other", []byte("v")); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+
+	scan := func(query string) ([]kvResponse, []string) {
+		t.Helper()
+
+		res, err := http.Get(ts.URL + "/scan?" + query)
+		if err != nil {
+			t.Fatalf("Failed to scan: %v", err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("Expected 200 from scan, got %d", res.StatusCode)
+		}
+
+		var entries []kvResponse
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			var entry kvResponse
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				t.Fatalf("Failed to decode scan line %q: %v", scanner.Text(), err)
+			}
+			entries = append(entries, entry)
+		}
+		return entries, res.TransferEncoding
+	}
+
+	// The result is larger than one flush, so it has to be sent in chunks.
+	entries, encoding := scan("prefix=key:")
+	if len(encoding) == 0 || encoding[0] != "chunked" {
+		t.Errorf("Expected a chunked response, got %v", encoding)
+	}
+	if len(entries) != 300 {
+		t.Fatalf("Expected 300 entries for prefix scan, got %d", len(entries))
+	}
+	for i, entry := range entries {
+		if entry.Key != fmt.Sprintf("key:%03d", i) || entry.Value != fmt.Sprint(i) {
+			t.Fatalf("Unexpected entry at %d: %+v", i, entry)
+		}
+	}
+
+	entries, _ = scan("start=key:100&end=key:200&limit=10")
+	if len(entries) != 10 || entries[0].Key != "key:100" || entries[9].Key != "key:109" {
+		t.Errorf("Unexpected limited range scan: %+v", entries)
+	}
+
+	if status, _ := do(t, "GET", ts.URL+"/scan?limit=-1", ""); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a negative limit, got %d", status)
+	}
+}
@@ -0,0 +1,405 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"halo-db/pkg/batch"
+	"halo-db/pkg/constants"
+	dberrors "halo-db/pkg/errors"
+	"halo-db/pkg/iterator"
+	"halo-db/pkg/partition"
+	"halo-db/pkg/types"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+var ErrServerClosed = http.ErrServerClosed
+
+// scanFlushEvery is how many scan results are written before the response
+// is flushed to the client as a chunk.
+const scanFlushEvery = 128
+
+type Server interface {
+	ListenAndServe(addr string) error
+	Serve(listener net.Listener) error
+	Handler() http.Handler
+	Shutdown(ctx context.Context) error
+}
+
+type server struct {
+	pm      partition.PartitionManager
+	handler http.Handler
+	http    *http.Server
+}
+
+// encodingBase64 marks keys and values sent base64-encoded. JSON strings
+// only carry UTF-8, so entries are sent that way when the client asks for it
+// with encoding=base64, and always when their key or value is not valid
+// UTF-8. The encoding query parameter also applies to the keys in the URL,
+// and an "encoding" field to the keys and values in a request body.
+const encodingBase64 = "base64"
+
+type kvResponse struct {
+	Key      string `json:"key"`
+	Value    string `json:"value"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type putRequest struct {
+	Value    *string `json:"value"`
+	Encoding string  `json:"encoding,omitempty"`
+	TTL      string  `json:"ttl,omitempty"`
+}
+
+type batchOp struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+type batchRequest struct {
+	Ops      []batchOp `json:"ops"`
+	Encoding string    `json:"encoding,omitempty"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func NewServer(pm partition.PartitionManager) Server {
+	s := &server{pm: pm}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /kv/{key...}", s.handleGet)
+	mux.HandleFunc("PUT /kv/{key...}", s.handlePut)
+	mux.HandleFunc("DELETE /kv/{key...}", s.handleDelete)
+	mux.HandleFunc("POST /batch", s.handleBatch)
+	mux.HandleFunc("GET /scan", s.handleScan)
+	mux.HandleFunc("GET /stats", s.handleStats)
+
+	s.handler = limitBody(mux)
+	s.http = &http.Server{
+		Handler:           s.handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return s
+}
+
+func (s *server) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	return s.Serve(listener)
+}
+
+func (s *server) Serve(listener net.Listener) error {
+	return s.http.Serve(listener)
+}
+
+func (s *server) Handler() http.Handler {
+	return s.handler
+}
+
+func (s *server) Shutdown(ctx context.Context) error {
+	return s.http.Shutdown(ctx)
+}
+
+func limitBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > constants.HTTPMaxBodySize {
+			writeError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("request body exceeds %d bytes", constants.HTTPMaxBodySize))
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, constants.HTTPMaxBodySize)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *server) handleGet(w http.ResponseWriter, r *http.Request) {
+	encoding, err := responseEncoding(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	key, err := decodeKey(r.PathValue("key"), encoding)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	value, err := s.pm.Get(key)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newKVResponse(key, value, encoding))
+}
+
+func (s *server) handlePut(w http.ResponseWriter, r *http.Request) {
+	key, err := pathKey(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if key == "" {
+		writeError(w, http.StatusBadRequest, errors.New("key must not be empty"))
+		return
+	}
+
+	var req putRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	if req.Value == nil {
+		writeError(w, http.StatusBadRequest, errors.New("missing value"))
+		return
+	}
+	value, err := decodeValue(*req.Value, req.Encoding)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if req.TTL != "" {
+		ttl, parseErr := time.ParseDuration(req.TTL)
+		if parseErr != nil || ttl <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid ttl %q", req.TTL))
+			return
+		}
+		err = s.pm.PutWithTTL(key, value, ttl)
+	} else {
+		err = s.pm.Put(key, value)
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *server) handleDelete(w http.ResponseWriter, r *http.Request) {
+	key, err := pathKey(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := s.pm.Delete(key); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleBatch applies every operation atomically through a WriteBatch.
+func (s *server) handleBatch(w http.ResponseWriter, r *http.Request) {
+	var req batchRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+
+	b := batch.NewWriteBatch()
+	for i, op := range req.Ops {
+		key, err := decodeKey(op.Key, req.Encoding)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("op %d: %w", i, err))
+			return
+		}
+		if key == "" {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("op %d: key must not be empty", i))
+			return
+		}
+		switch op.Op {
+		case "put":
+			value, err := decodeValue(op.Value, req.Encoding)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("op %d: %w", i, err))
+				return
+			}
+			b.Put(key, value)
+		case "delete":
+			b.Delete(key)
+		default:
+			writeError(w, http.StatusBadRequest, fmt.Errorf("op %d: unknown op %q", i, op.Op))
+			return
+		}
+	}
+
+	if err := s.pm.Write(b); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleScan streams the range as newline-delimited JSON objects. The
+// response is chunked, so large ranges are never buffered in memory; an
+// error after the first chunk is reported as a final {"error": ...} line.
+func (s *server) handleScan(w http.ResponseWriter, r *http.Request) {
+	encoding, err := responseEncoding(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	query := r.URL.Query()
+	var bounds [3]types.Key
+	for i, name := range []string{"start", "end", "prefix"} {
+		if bounds[i], err = decodeKey(query.Get(name), encoding); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("%s: %w", name, err))
+			return
+		}
+	}
+	start, end := bounds[0], bounds[1]
+	if prefix := bounds[2]; prefix != "" {
+		start, end = prefix, iterator.PrefixEnd(prefix)
+	}
+
+	limit := -1
+	if raw := query.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q", raw))
+			return
+		}
+		limit = n
+	}
+
+	it := s.pm.Scan(start, end)
+	defer func() { _ = it.Close() }()
+
+	if err := it.Err(); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+
+	written := 0
+	for ; it.Valid() && written != limit; it.Next() {
+		if err := encoder.Encode(newKVResponse(it.Key(), it.Value(), encoding)); err != nil {
+			return
+		}
+		written++
+		if flusher != nil && written%scanFlushEvery == 0 {
+			flusher.Flush()
+		}
+		if r.Context().Err() != nil {
+			return
+		}
+	}
+	if err := it.Err(); err != nil {
+		_ = encoder.Encode(errorResponse{Error: err.Error()})
+	}
+}
+
+func (s *server) handleStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.pm.GetStats())
+}
+
+// responseEncoding returns the encoding the client asked for with the
+// encoding query parameter, for the keys in the URL and the response.
+func responseEncoding(r *http.Request) (string, error) {
+	switch encoding := r.URL.Query().Get("encoding"); encoding {
+	case "", encodingBase64:
+		return encoding, nil
+	default:
+		return "", fmt.Errorf("unknown encoding %q", encoding)
+	}
+}
+
+// pathKey returns the key in a /kv URL, decoded as the encoding query
+// parameter says.
+func pathKey(r *http.Request) (types.Key, error) {
+	encoding, err := responseEncoding(r)
+	if err != nil {
+		return "", err
+	}
+	return decodeKey(r.PathValue("key"), encoding)
+}
+
+func newKVResponse(key types.Key, value types.Value, encoding string) kvResponse {
+	if encoding != encodingBase64 && utf8.ValidString(key) && utf8.Valid(value) {
+		return kvResponse{Key: key, Value: string(value)}
+	}
+	return kvResponse{
+		Key:      base64.StdEncoding.EncodeToString([]byte(key)),
+		Value:    base64.StdEncoding.EncodeToString(value),
+		Encoding: encodingBase64,
+	}
+}
+
+func decodeKey(key, encoding string) (types.Key, error) {
+	decoded, err := decode("key", key, encoding)
+	return types.Key(decoded), err
+}
+
+func decodeValue(value, encoding string) (types.Value, error) {
+	return decode("value", value, encoding)
+}
+
+func decode(what, s, encoding string) ([]byte, error) {
+	switch encoding {
+	case "":
+		return []byte(s), nil
+	case encodingBase64:
+		decoded, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64 %s: %w", what, err)
+		}
+		return decoded, nil
+	}
+	return nil, fmt.Errorf("unknown encoding %q", encoding)
+}
+
+func decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			writeError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("request body exceeds %d bytes", maxBytesErr.Limit))
+		} else {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid JSON body: %w", err))
+		}
+		return false
+	}
+	return true
+}
+
+func writeStoreError(w http.ResponseWriter, err error) {
+	writeError(w, statusFor(err), err)
+}
+
+func statusFor(err error) int {
+	switch {
+	case errors.Is(err, dberrors.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, dberrors.ErrTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, dberrors.ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, dberrors.ErrClosed), errors.Is(err, dberrors.ErrReadOnly):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
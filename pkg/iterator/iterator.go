@@ -0,0 +1,135 @@
+package iterator
+
+import (
+	"halo-db/pkg/types"
+)
+
+type Iterator interface {
+	Seek(key types.Key)
+	Next()
+	Valid() bool
+	Key() types.Key
+	Value() types.Value
+	Err() error
+	Close() error
+}
+
+// ScanFunc visits entries in [start, end) in key order until fn returns
+// false. An empty end means the range is unbounded above.
+type ScanFunc func(start, end types.Key, fn func(types.Key, types.Value) bool) error
+
+func InRange(key, end types.Key) bool {
+	return end == "" || key < end
+}
+
+// PrefixEnd returns the smallest key greater than every key starting with
+// prefix, or an empty key when no such bound exists.
+func PrefixEnd(prefix types.Key) types.Key {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return types.Key(end[:i+1])
+		}
+	}
+	return ""
+}
+
+type pagedIterator struct {
+	start     types.Key
+	end       types.Key
+	batchSize int
+	scan      ScanFunc
+	entries   []types.Entry
+	pos       int
+	exhausted bool
+	err       error
+}
+
+// NewPagedIterator walks a range by pulling batches from scan, resuming after
+// the last returned key each time. The source is free to change between
+// batches, so callers only need to hold their locks inside scan.
+func NewPagedIterator(start, end types.Key, batchSize int, scan ScanFunc) Iterator {
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+	it := &pagedIterator{
+		start:     start,
+		end:       end,
+		batchSize: batchSize,
+		scan:      scan,
+	}
+	it.fill(start, true)
+	return it
+}
+
+func (it *pagedIterator) Seek(key types.Key) {
+	if key < it.start {
+		key = it.start
+	}
+	it.fill(key, true)
+}
+
+func (it *pagedIterator) Next() {
+	if !it.Valid() {
+		return
+	}
+	it.pos++
+	if it.pos >= len(it.entries) && !it.exhausted {
+		it.fill(it.entries[len(it.entries)-1].Key, false)
+	}
+}
+
+func (it *pagedIterator) Valid() bool {
+	return it.err == nil && it.pos < len(it.entries)
+}
+
+func (it *pagedIterator) Key() types.Key {
+	return it.entries[it.pos].Key
+}
+
+func (it *pagedIterator) Value() types.Value {
+	return it.entries[it.pos].Value
+}
+
+func (it *pagedIterator) Err() error {
+	return it.err
+}
+
+func (it *pagedIterator) Close() error {
+	it.entries = nil
+	it.pos = 0
+	return nil
+}
+
+func (it *pagedIterator) fill(from types.Key, inclusive bool) {
+	entries := make([]types.Entry, 0, it.batchSize)
+	err := it.scan(from, it.end, func(key types.Key, value types.Value) bool {
+		if !inclusive && key == from {
+			return true
+		}
+		entries = append(entries, types.Entry{Key: key, Value: value})
+		return len(entries) < it.batchSize
+	})
+
+	it.entries = entries
+	it.pos = 0
+	it.exhausted = len(entries) < it.batchSize
+	it.err = err
+}
+
+type emptyIterator struct {
+	err error
+}
+
+func NewEmptyIterator(err error) Iterator {
+	return &emptyIterator{err: err}
+}
+
+func (it *emptyIterator) Seek(types.Key)     {}
+func (it *emptyIterator) Next()              {}
+func (it *emptyIterator) Valid() bool        { return false }
+func (it *emptyIterator) Key() types.Key     { return "" }
+func (it *emptyIterator) Value() types.Value { return nil }
+func (it *emptyIterator) Err() error         { return it.err }
+func (it *emptyIterator) Close() error       { return nil }
@@ -0,0 +1,120 @@
+package iterator
+
+import (
+	"halo-db/pkg/types"
+	"sort"
+	"testing"
+)
+
+func sliceScan(entries []types.Entry) ScanFunc {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return func(start, end types.Key, fn func(types.Key, types.Value) bool) error {
+		for _, entry := range entries {
+			if entry.Key < start || !InRange(entry.Key, end) {
+				continue
+			}
+			if !fn(entry.Key, entry.Value) {
+				return nil
+			}
+		}
+		return nil
+	}
+}
+
+func collect(t *testing.T, it Iterator) ([]types.Key, []string) {
+	t.Helper()
+	var keys []types.Key
+	var values []string
+	for ; it.Valid(); it.Next() {
+		keys = append(keys, it.Key())
+		values = append(values, string(it.Value()))
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("Iterator error: %v", err)
+	}
+	return keys, values
+}
+
+func TestPrefixEnd(t *testing.T) {
+	cases := map[types.Key]types.Key{
+		"abc":        "abd",
+		"ab\xff":     "ac",
+		"\xff\xff":   "",
+		"":           "",
+		"user:":      "user;",
+		"a\xffb\xff": "a\xffc",
+	}
+	for prefix, expected := range cases {
+		if got := PrefixEnd(prefix); got != expected {
+			t.Errorf("PrefixEnd(%q): expected %q, got %q", prefix, expected, got)
+		}
+	}
+}
+
+func TestPagedIteratorBatches(t *testing.T) {
+	scan := sliceScan([]types.Entry{
+		{Key: "a", Value: []byte("1")},
+		{Key: "b", Value: []byte("2")},
+		{Key: "c", Value: []byte("3")},
+		{Key: "d", Value: []byte("4")},
+		{Key: "e", Value: []byte("5")},
+	})
+
+	keys, _ := collect(t, NewPagedIterator("b", "e", 2, scan))
+	if len(keys) != 3 || keys[0] != "b" || keys[2] != "d" {
+		t.Errorf("Expected [b c d], got %v", keys)
+	}
+
+	it := NewPagedIterator("", "", 2, scan)
+	it.Seek("d")
+	keys, _ = collect(t, it)
+	if len(keys) != 2 || keys[0] != "d" || keys[1] != "e" {
+		t.Errorf("Expected [d e] after seek, got %v", keys)
+	}
+}
+
+func TestMergeIteratorPriority(t *testing.T) {
+	newer := NewPagedIterator("", "", 2, sliceScan([]types.Entry{
+		{Key: "b", Value: []byte("new-b")},
+		{Key: "d", Value: nil},
+	}))
+	older := NewPagedIterator("", "", 2, sliceScan([]types.Entry{
+		{Key: "a", Value: []byte("old-a")},
+		{Key: "b", Value: []byte("old-b")},
+		{Key: "c", Value: []byte("old-c")},
+		{Key: "d", Value: []byte("old-d")},
+	}))
+
+	keys, values := collect(t, NewMergeIterator(newer, older))
+
+	expectedKeys := []types.Key{"a", "b", "c"}
+	expectedValues := []string{"old-a", "new-b", "old-c"}
+	if len(keys) != len(expectedKeys) {
+		t.Fatalf("Expected keys %v, got %v", expectedKeys, keys)
+	}
+	for i := range expectedKeys {
+		if keys[i] != expectedKeys[i] || values[i] != expectedValues[i] {
+			t.Errorf("Entry %d: expected %s=%s, got %s=%s", i, expectedKeys[i], expectedValues[i], keys[i], values[i])
+		}
+	}
+}
+
+func TestMergeIteratorSeek(t *testing.T) {
+	left := NewPagedIterator("", "", 1, sliceScan([]types.Entry{
+		{Key: "a", Value: []byte("1")},
+		{Key: "c", Value: []byte("3")},
+		{Key: "e", Value: []byte("5")},
+	}))
+	right := NewPagedIterator("", "", 1, sliceScan([]types.Entry{
+		{Key: "b", Value: []byte("2")},
+		{Key: "d", Value: []byte("4")},
+	}))
+
+	it := NewMergeIterator(left, right)
+	it.Seek("c")
+	keys, _ := collect(t, it)
+	if len(keys) != 3 || keys[0] != "c" || keys[1] != "d" || keys[2] != "e" {
+		t.Errorf("Expected [c d e] after seek, got %v", keys)
+	}
+	_ = it.Close()
+}
@@ -0,0 +1,136 @@
+package iterator
+
+import (
+	"container/heap"
+	"halo-db/pkg/types"
+)
+
+type mergeIterator struct {
+	iters []Iterator
+	heap  mergeHeap
+	key   types.Key
+	value types.Value
+	valid bool
+}
+
+// NewMergeIterator merges sorted iterators into one. When several iterators
+// hold the same key, the one passed first wins and the others are skipped.
+// Entries with a nil value are tombstones and are never surfaced.
+func NewMergeIterator(iters ...Iterator) Iterator {
+	it := &mergeIterator{iters: iters}
+	it.rebuild()
+	return it
+}
+
+func (it *mergeIterator) Seek(key types.Key) {
+	for _, child := range it.iters {
+		child.Seek(key)
+	}
+	it.rebuild()
+}
+
+func (it *mergeIterator) Next() {
+	if !it.valid {
+		return
+	}
+	it.advance()
+}
+
+func (it *mergeIterator) Valid() bool {
+	return it.valid && it.Err() == nil
+}
+
+func (it *mergeIterator) Key() types.Key {
+	return it.key
+}
+
+func (it *mergeIterator) Value() types.Value {
+	return it.value
+}
+
+func (it *mergeIterator) Err() error {
+	for _, child := range it.iters {
+		if err := child.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (it *mergeIterator) Close() error {
+	var firstErr error
+	for _, child := range it.iters {
+		if err := child.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	it.valid = false
+	return firstErr
+}
+
+func (it *mergeIterator) rebuild() {
+	it.heap = it.heap[:0]
+	for i, child := range it.iters {
+		if child.Valid() {
+			it.heap = append(it.heap, mergeItem{key: child.Key(), index: i})
+		}
+	}
+	heap.Init(&it.heap)
+	it.advance()
+}
+
+func (it *mergeIterator) advance() {
+	for it.heap.Len() > 0 {
+		top := heap.Pop(&it.heap).(mergeItem)
+		winner := it.iters[top.index]
+		it.key = top.key
+		it.value = winner.Value()
+
+		for it.heap.Len() > 0 && it.heap[0].key == top.key {
+			shadowed := heap.Pop(&it.heap).(mergeItem)
+			it.push(shadowed.index)
+		}
+		it.push(top.index)
+
+		if it.value != nil {
+			it.valid = true
+			return
+		}
+	}
+	it.valid = false
+}
+
+func (it *mergeIterator) push(index int) {
+	child := it.iters[index]
+	child.Next()
+	if child.Valid() {
+		heap.Push(&it.heap, mergeItem{key: child.Key(), index: index})
+	}
+}
+
+type mergeItem struct {
+	key   types.Key
+	index int
+}
+
+type mergeHeap []mergeItem
+
+func (h mergeHeap) Len() int { return len(h) }
+
+func (h mergeHeap) Less(i, j int) bool {
+	if h[i].key != h[j].key {
+		return h[i].key < h[j].key
+	}
+	return h[i].index < h[j].index
+}
+
+func (h mergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(mergeItem)) }
+
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
@@ -0,0 +1,477 @@
+package lsm
+
+import (
+	"errors"
+	"fmt"
+	dberrors "halo-db/pkg/errors"
+	"halo-db/pkg/sstable"
+	"halo-db/pkg/types"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// throttleChunk is how many bytes a compaction writes between waits on the
+// rate limiter.
+const throttleChunk = 64 << 10
+
+type compactionStats struct {
+	flushedBytes   int64
+	compactedBytes int64
+	compactions    int
+	err            error
+}
+
+// writeAmplification is the bytes written to tables by flushes and
+// compactions for every byte flushed, since the tree was opened.
+func (s compactionStats) writeAmplification() float64 {
+	if s.flushedBytes == 0 {
+		return 0
+	}
+	return float64(s.flushedBytes+s.compactedBytes) / float64(s.flushedBytes)
+}
+
+// compaction merges inputs, given newest first, into outputLevel. If bottom
+// is set no table outside the inputs holds any of their keys, so tombstones
+// and expired entries can be dropped rather than carried down.
+type compaction struct {
+	level       int
+	outputLevel int
+	inputs      []openTable
+	bottom      bool
+	split       bool
+}
+
+func (t *tree) signal() {
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (t *tree) compactLoop() {
+	defer t.workers.Done()
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-t.wake:
+		}
+		for t.compactOnce() {
+		}
+	}
+}
+
+// compactOnce runs one compaction if one is due, reporting whether it
+// finished. The inputs are marked busy while it runs, so other workers pick
+// compactions that do not touch them.
+func (t *tree) compactOnce() bool {
+	t.compactMu.RLock()
+	defer t.compactMu.RUnlock()
+
+	t.mu.Lock()
+	var c *compaction
+	if !t.closed {
+		c = t.pickCompaction()
+	}
+	if c == nil {
+		t.mu.Unlock()
+		return false
+	}
+	for _, ot := range c.inputs {
+		t.busy[ot.name] = true
+	}
+	t.mu.Unlock()
+
+	err := t.runCompaction(c)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, ot := range c.inputs {
+		delete(t.busy, ot.name)
+	}
+	if !errors.Is(err, dberrors.ErrClosed) {
+		t.stats.err = err
+	}
+	return err == nil
+}
+
+// pickCompaction returns the most pressing compaction whose tables are not
+// already being compacted, or nil if none is due. mu must be held.
+func (t *tree) pickCompaction() *compaction {
+	if t.opts.CompactionStyle == "tiered" {
+		return t.pickTiered()
+	}
+
+	type due struct {
+		level int
+		score float64
+	}
+	var levels []due
+	if n := len(t.levels[0]); n >= t.opts.CompactionTrigger {
+		levels = append(levels, due{0, float64(n) / float64(t.opts.CompactionTrigger)})
+	}
+	for level := 1; level < len(t.levels)-1; level++ {
+		if score := float64(t.levelSize(level)) / t.levelTarget(level); score > 1 {
+			levels = append(levels, due{level, score})
+		}
+	}
+	sort.SliceStable(levels, func(i, j int) bool { return levels[i].score > levels[j].score })
+
+	for _, d := range levels {
+		if c := t.pickLeveled(d.level); c != nil {
+			return c
+		}
+	}
+	return nil
+}
+
+func (t *tree) levelSize(level int) int64 {
+	var size int64
+	for _, ot := range t.levels[level] {
+		size += ot.table.Size()
+	}
+	return size
+}
+
+// levelTarget is the size above which level, from 1 down, is compacted into
+// the next.
+func (t *tree) levelTarget(level int) float64 {
+	return float64(t.opts.LevelSizeBase) * math.Pow(float64(t.opts.LevelSizeMultiplier), float64(level-1))
+}
+
+// pickLeveled compacts level into the next one. All of level 0 goes at once,
+// as its tables overlap; from lower levels one table is taken, cycling
+// through the key space, together with the tables it overlaps below.
+func (t *tree) pickLeveled(level int) *compaction {
+	var candidates [][]openTable
+	if level == 0 {
+		candidates = [][]openTable{slices.Clone(t.levels[0])}
+	} else {
+		tables := t.levels[level]
+		start := sort.Search(len(tables), func(i int) bool { return tables[i].table.Smallest() > t.pointers[level] })
+		for i := range tables {
+			candidates = append(candidates, []openTable{tables[(start+i)%len(tables)]})
+		}
+	}
+
+	for _, inputs := range candidates {
+		lo, hi := keyRange(inputs)
+		overlapping := t.overlapping(level+1, lo, hi)
+		inputs = append(inputs, overlapping...)
+		if slices.ContainsFunc(inputs, func(ot openTable) bool { return t.busy[ot.name] }) {
+			continue
+		}
+
+		lo, hi = keyRange(inputs)
+		bottom := true
+		for below := level + 2; below < len(t.levels); below++ {
+			if len(t.overlapping(below, lo, hi)) > 0 {
+				bottom = false
+			}
+		}
+		if level > 0 {
+			t.pointers[level] = inputs[0].table.Largest()
+		}
+		return &compaction{level: level, outputLevel: level + 1, inputs: inputs, bottom: bottom, split: true}
+	}
+	return nil
+}
+
+// overlapping returns the tables of level, from 1 down, that hold keys in
+// [lo, hi].
+func (t *tree) overlapping(level int, lo, hi types.Key) []openTable {
+	var tables []openTable
+	for _, ot := range t.levels[level] {
+		if ot.table.Largest() >= lo && ot.table.Smallest() <= hi {
+			tables = append(tables, ot)
+		}
+	}
+	return tables
+}
+
+func keyRange(tables []openTable) (lo, hi types.Key) {
+	for i, ot := range tables {
+		if i == 0 || ot.table.Smallest() < lo {
+			lo = ot.table.Smallest()
+		}
+		if i == 0 || ot.table.Largest() > hi {
+			hi = ot.table.Largest()
+		}
+	}
+	return lo, hi
+}
+
+// tier is a run of level 0 tables, adjacent in age, of similar size.
+type tier struct {
+	start, end int
+	bytes      int64
+}
+
+// tiers splits level 0 into runs of tables within a factor of two of the
+// run's average size. Tables being compacted break runs.
+func (t *tree) tiers() []tier {
+	tables := t.levels[0]
+	var tiers []tier
+	for i := 0; i < len(tables); {
+		if t.busy[tables[i].name] {
+			i++
+			continue
+		}
+		run := tier{start: i, end: i + 1, bytes: tables[i].table.Size()}
+		for ; run.end < len(tables) && !t.busy[tables[run.end].name]; run.end++ {
+			avg := run.bytes / int64(run.end-run.start)
+			size := tables[run.end].table.Size()
+			if size > 2*avg || 2*size < avg {
+				break
+			}
+			run.bytes += size
+		}
+		tiers = append(tiers, run)
+		i = run.end
+	}
+	return tiers
+}
+
+// pickTiered merges the smallest run of at least CompactionTrigger similar
+// tables into one table, which takes the run's place in level 0.
+func (t *tree) pickTiered() *compaction {
+	var best *tier
+	for _, run := range t.tiers() {
+		if run.end-run.start >= t.opts.CompactionTrigger && (best == nil || run.bytes < best.bytes) {
+			best = &run
+		}
+	}
+	if best == nil {
+		return nil
+	}
+
+	inputs := slices.Clone(t.levels[0][best.start:best.end])
+	lo, hi := keyRange(inputs)
+	bottom := best.end == len(t.levels[0])
+	for level := 1; level < len(t.levels); level++ {
+		if len(t.overlapping(level, lo, hi)) > 0 {
+			bottom = false
+		}
+	}
+	return &compaction{inputs: inputs, bottom: bottom}
+}
+
+// pendingBytes estimates how many bytes of tables are due to be compacted.
+// mu must be held.
+func (t *tree) pendingBytes() int64 {
+	var pending int64
+	if t.opts.CompactionStyle == "tiered" {
+		for _, run := range t.tiers() {
+			if run.end-run.start >= t.opts.CompactionTrigger {
+				pending += run.bytes
+			}
+		}
+		return pending
+	}
+
+	if len(t.levels[0]) >= t.opts.CompactionTrigger {
+		pending += t.levelSize(0)
+	}
+	for level := 1; level < len(t.levels)-1; level++ {
+		if excess := float64(t.levelSize(level)) - t.levelTarget(level); excess > 0 {
+			pending += int64(excess)
+		}
+	}
+	return pending
+}
+
+// runCompaction writes the merged inputs to new tables and installs them.
+// The new tables are synced before the manifest lists them, so a crash at
+// any point leaves either the inputs or the outputs live and the other set
+// as stray files that the next open removes.
+func (t *tree) runCompaction(c *compaction) error {
+	its := make([]sstable.Iterator, len(c.inputs))
+	expectedKeys, inputBytes := 0, int64(0)
+	for i, ot := range c.inputs {
+		its[i] = ot.table.NewIterator()
+		expectedKeys += ot.table.NumEntries()
+		inputBytes += ot.table.Size()
+	}
+	if c.split && inputBytes > t.opts.TargetFileSize {
+		expectedKeys = int(int64(expectedKeys)*t.opts.TargetFileSize/inputBytes) + 1
+	}
+
+	var outputs []openTable
+	var w sstable.Writer
+	var name string
+	fail := func(err error) error {
+		if w != nil {
+			w.Abort()
+		}
+		for _, ot := range outputs {
+			_ = ot.table.Close()
+			_ = os.Remove(filepath.Join(t.dir, ot.name))
+		}
+		return fmt.Errorf("failed to compact level %d: %w", c.level, err)
+	}
+	finish := func() error {
+		err := w.Finish()
+		w = nil
+		if err != nil {
+			return err
+		}
+		table, err := sstable.Open(filepath.Join(t.dir, name))
+		if err != nil {
+			_ = os.Remove(filepath.Join(t.dir, name))
+			return err
+		}
+		outputs = append(outputs, openTable{name: name, table: table})
+		return nil
+	}
+
+	now := time.Now().UnixNano()
+	var unthrottled int64
+	it := newMergingIterator(its)
+	for it.Seek(""); it.Valid(); it.Next() {
+		select {
+		case <-t.stop:
+			return fail(dberrors.ErrClosed)
+		default:
+		}
+
+		entry := it.Entry()
+		if entry.Kind != types.KindTombstone && types.Expired(entry.ExpiresAt, now) {
+			entry = sstable.Entry{Key: entry.Key, Kind: types.KindTombstone}
+		}
+		if entry.Kind == types.KindTombstone && c.bottom {
+			continue
+		}
+
+		if w == nil {
+			t.mu.Lock()
+			name = t.newTableName()
+			t.mu.Unlock()
+			var err error
+			if w, err = sstable.NewWriter(filepath.Join(t.dir, name), expectedKeys, t.opts); err != nil {
+				return fail(err)
+			}
+		}
+		size := w.Size()
+		if err := w.Add(entry); err != nil {
+			return fail(err)
+		}
+		if unthrottled += w.Size() - size; unthrottled >= throttleChunk {
+			if !t.limiter.wait(unthrottled, t.stop) {
+				return fail(dberrors.ErrClosed)
+			}
+			unthrottled = 0
+		}
+		if c.split && w.Size() >= t.opts.TargetFileSize {
+			if err := finish(); err != nil {
+				return fail(err)
+			}
+		}
+	}
+	if err := it.Err(); err != nil {
+		return fail(err)
+	}
+	if w != nil {
+		if err := finish(); err != nil {
+			return fail(err)
+		}
+	}
+
+	if err := t.install(c, outputs); err != nil {
+		return fail(err)
+	}
+	return nil
+}
+
+// install replaces the inputs of c with outputs. Writing the manifest is the
+// switch; the inputs are removed after it.
+func (t *tree) install(c *compaction, outputs []openTable) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	removed := make(map[string]bool, len(c.inputs))
+	for _, ot := range c.inputs {
+		removed[ot.name] = true
+	}
+	levels := make([][]openTable, len(t.levels))
+	for level, tables := range t.levels {
+		for _, ot := range tables {
+			if !removed[ot.name] {
+				levels[level] = append(levels[level], ot)
+			}
+		}
+	}
+
+	if c.outputLevel == 0 {
+		// Flushes only add newer tables in front of the run, so the run is
+		// still contiguous and its output goes where its newest table was.
+		pos := slices.IndexFunc(t.levels[0], func(ot openTable) bool { return ot.name == c.inputs[0].name })
+		levels[0] = slices.Insert(levels[0], pos, outputs...)
+	} else {
+		levels[c.outputLevel] = append(levels[c.outputLevel], outputs...)
+		sort.Slice(levels[c.outputLevel], func(i, j int) bool {
+			return levels[c.outputLevel][i].table.Smallest() < levels[c.outputLevel][j].table.Smallest()
+		})
+	}
+
+	if err := t.writeManifest(levels); err != nil {
+		return err
+	}
+	t.levels = levels
+
+	for _, ot := range c.inputs {
+		_ = ot.table.Close()
+		_ = os.Remove(filepath.Join(t.dir, ot.name))
+	}
+	for _, ot := range outputs {
+		t.stats.compactedBytes += ot.table.Size()
+	}
+	t.stats.compactions++
+	t.signal()
+	return nil
+}
+
+// rateLimiter spreads compaction writes out to at most rate bytes a second,
+// shared by all workers. A rate of 0 means no limit.
+type rateLimiter struct {
+	rate int64
+	mu   sync.Mutex
+	next time.Time
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	return &rateLimiter{rate: rate}
+}
+
+// wait blocks until n more bytes fit within the rate, reporting false if
+// stop is closed first.
+func (l *rateLimiter) wait(n int64, stop <-chan struct{}) bool {
+	if l.rate <= 0 || n <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(n * int64(time.Second) / l.rate))
+	delay := time.Until(l.next)
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return true
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-stop:
+		return false
+	}
+}
@@ -0,0 +1,457 @@
+package lsm
+
+import (
+	"encoding/json"
+	"fmt"
+	"halo-db/pkg/constants"
+	dberrors "halo-db/pkg/errors"
+	"halo-db/pkg/iterator"
+	"halo-db/pkg/options"
+	"halo-db/pkg/sstable"
+	"halo-db/pkg/types"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tree stores flushed memtables as immutable SSTable files. Every flush adds
+// a table to level 0; a key's newest version is the one in the most recent
+// table that holds it, and a tombstone there hides any older ones.
+// Compaction merges tables in the background to drop the versions and
+// tombstones nothing can see any more.
+type Tree interface {
+	Flush(entries []sstable.Entry) error
+	FindWithExpiry(key types.Key) (types.Value, int64, error)
+	List() []types.Key
+	Scan(start, end types.Key, fn func(types.Key, types.Value) bool) error
+	Expired(now int64) []types.Key
+	Clear() error
+	Close() error
+	Stats() map[string]interface{}
+}
+
+// tableManifest lists the live tables: level 0 newest first, and every level
+// below it in key order. A table file is only read once the manifest lists
+// it, so a crash while one is written leaves a stray file that the next open
+// removes.
+type tableManifest struct {
+	NextFile uint64     `json:"next_file"`
+	Tables   []string   `json:"tables"`
+	Levels   [][]string `json:"levels,omitempty"`
+}
+
+type openTable struct {
+	name  string
+	table sstable.Table
+}
+
+// tree keeps its tables in levels. Level 0 holds flushed tables, whose keys
+// may overlap, newest first. Each level below holds tables with disjoint key
+// ranges in key order, and everything in a level is newer than everything in
+// the levels below it.
+type tree struct {
+	dir      string
+	opts     options.Options
+	levels   [][]openTable
+	nextFile uint64
+	busy     map[string]bool
+	pointers []types.Key
+	stats    compactionStats
+	mu       sync.RWMutex
+
+	// compactMu is held shared by running compactions and flushes and
+	// exclusively by Clear and Close, which must not pull tables from under
+	// them.
+	compactMu sync.RWMutex
+	limiter   *rateLimiter
+	wake      chan struct{}
+	stop      chan struct{}
+	workers   sync.WaitGroup
+	closed    bool
+}
+
+// Open opens the tables in dir, which is created if it does not exist, and
+// starts the compaction workers.
+func Open(dir string, opts options.Options) (Tree, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create table directory: %w", err)
+	}
+
+	m, err := readManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &tree{
+		dir:      dir,
+		opts:     opts,
+		levels:   make([][]openTable, max(constants.LSMLevels, len(m.Levels)+1)),
+		nextFile: m.NextFile,
+		busy:     make(map[string]bool),
+		limiter:  newRateLimiter(opts.CompactionRateLimit),
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+	}
+	t.pointers = make([]types.Key, len(t.levels))
+	for level, names := range append([][]string{m.Tables}, m.Levels...) {
+		for _, name := range names {
+			table, err := sstable.Open(filepath.Join(dir, name))
+			if err != nil {
+				_ = t.closeTables()
+				return nil, err
+			}
+			t.levels[level] = append(t.levels[level], openTable{name: name, table: table})
+		}
+	}
+
+	if err := removeStaleTables(dir, m); err != nil {
+		_ = t.closeTables()
+		return nil, err
+	}
+	if m.Tables == nil {
+		// Write the manifest even with no tables, so the directory is
+		// recognisably an LSM store from the start.
+		if err := t.writeManifest(t.levels); err != nil {
+			_ = t.closeTables()
+			return nil, err
+		}
+	}
+
+	for i := 0; i < opts.CompactionWorkers; i++ {
+		t.workers.Add(1)
+		go t.compactLoop()
+	}
+	t.signal()
+	return t, nil
+}
+
+func readManifest(dir string) (*tableManifest, error) {
+	var m tableManifest
+	data, err := os.ReadFile(filepath.Join(dir, constants.TableManifestFileName))
+	if os.IsNotExist(err) {
+		return &m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read table manifest: %w", err)
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("%w: bad table manifest: %v", dberrors.ErrCorrupted, err)
+	}
+	return &m, nil
+}
+
+// writeManifest replaces the table manifest atomically, so a crash leaves
+// either the old or the new one in place.
+func (t *tree) writeManifest(levels [][]openTable) error {
+	names := func(tables []openTable) []string {
+		list := make([]string, len(tables))
+		for i, ot := range tables {
+			list[i] = ot.name
+		}
+		return list
+	}
+	m := tableManifest{NextFile: t.nextFile, Tables: names(levels[0])}
+	for level := len(levels) - 1; level > 0; level-- {
+		if len(levels[level]) > 0 || m.Levels != nil {
+			m.Levels = append([][]string{names(levels[level])}, m.Levels...)
+		}
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode table manifest: %w", err)
+	}
+
+	path := filepath.Join(t.dir, constants.TableManifestFileName)
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create table manifest: %w", err)
+	}
+	if _, err := file.Write(data); err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to write table manifest: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to sync table manifest: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close table manifest: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to replace table manifest: %w", err)
+	}
+	return syncDir(t.dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory: %w", err)
+	}
+	defer func() { _ = d.Close() }()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory: %w", err)
+	}
+	return nil
+}
+
+func removeStaleTables(dir string, m *tableManifest) error {
+	live := slices.Concat(append([][]string{m.Tables}, m.Levels...)...)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read table directory: %w", err)
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".sst") || slices.Contains(live, entry.Name()) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+			return fmt.Errorf("failed to remove stale table: %w", err)
+		}
+	}
+	return nil
+}
+
+// newTableName reserves the file name of a new table. mu must be held.
+func (t *tree) newTableName() string {
+	name := fmt.Sprintf("%06d.sst", t.nextFile)
+	t.nextFile++
+	return name
+}
+
+// Flush writes entries, sorted by key, to a new level 0 table. The table is
+// written without holding mu, so reads carry on meanwhile; callers must not
+// run flushes concurrently, as the order they finish in is the order their
+// tables shadow each other.
+func (t *tree) Flush(entries []sstable.Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	t.compactMu.RLock()
+	defer t.compactMu.RUnlock()
+
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return dberrors.ErrClosed
+	}
+	name := t.newTableName()
+	t.mu.Unlock()
+
+	path := filepath.Join(t.dir, name)
+	if err := sstable.Write(path, entries, t.opts); err != nil {
+		return err
+	}
+	table, err := sstable.Open(path)
+	if err != nil {
+		_ = os.Remove(path)
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	levels := slices.Clone(t.levels)
+	levels[0] = append([]openTable{{name: name, table: table}}, levels[0]...)
+	if err := t.writeManifest(levels); err != nil {
+		_ = table.Close()
+		_ = os.Remove(path)
+		return err
+	}
+	t.levels = levels
+	t.stats.flushedBytes += table.Size()
+	t.signal()
+	return nil
+}
+
+// candidates returns the tables of level that may hold key, newest first.
+func (t *tree) candidates(level int, key types.Key) []openTable {
+	tables := t.levels[level]
+	if level == 0 {
+		return tables
+	}
+	i := sort.Search(len(tables), func(i int) bool { return tables[i].table.Largest() >= key })
+	if i == len(tables) || tables[i].table.Smallest() > key {
+		return nil
+	}
+	return tables[i : i+1]
+}
+
+func (t *tree) FindWithExpiry(key types.Key) (types.Value, int64, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	for level := range t.levels {
+		for _, ot := range t.candidates(level, key) {
+			entry, found, err := ot.table.Get(key)
+			if err != nil {
+				return nil, 0, err
+			}
+			if !found {
+				continue
+			}
+			if entry.Kind == types.KindTombstone || types.Expired(entry.ExpiresAt, time.Now().UnixNano()) {
+				return nil, 0, dberrors.ErrNotFound
+			}
+			return entry.Value, entry.ExpiresAt, nil
+		}
+	}
+	return nil, 0, dberrors.ErrNotFound
+}
+
+func (t *tree) List() []types.Key {
+	keys := []types.Key{}
+	_ = t.Scan("", "", func(key types.Key, _ types.Value) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys
+}
+
+func (t *tree) Scan(start, end types.Key, fn func(types.Key, types.Value) bool) error {
+	now := time.Now().UnixNano()
+	return t.merge(start, end, func(entry sstable.Entry) bool {
+		if entry.Kind == types.KindTombstone || types.Expired(entry.ExpiresAt, now) {
+			return true
+		}
+		return fn(entry.Key, entry.Value)
+	})
+}
+
+func (t *tree) Expired(now int64) []types.Key {
+	var keys []types.Key
+	_ = t.merge("", "", func(entry sstable.Entry) bool {
+		if entry.Kind != types.KindTombstone && types.Expired(entry.ExpiresAt, now) {
+			keys = append(keys, entry.Key)
+		}
+		return true
+	})
+	return keys
+}
+
+// merge visits the newest version of every key in [start, end), tombstones
+// included, in key order until fn returns false.
+func (t *tree) merge(start, end types.Key, fn func(sstable.Entry) bool) error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var its []sstable.Iterator
+	for _, ot := range t.levels[0] {
+		its = append(its, ot.table.NewIterator())
+	}
+	for _, tables := range t.levels[1:] {
+		if len(tables) > 0 {
+			its = append(its, newLevelIterator(tables))
+		}
+	}
+
+	it := newMergingIterator(its)
+	for it.Seek(start); it.Valid(); it.Next() {
+		if !iterator.InRange(it.Entry().Key, end) || !fn(it.Entry()) {
+			return nil
+		}
+	}
+	return it.Err()
+}
+
+// Clear drops every table. The emptied manifest is written first, so a crash
+// part way leaves only stray files behind.
+func (t *tree) Clear() error {
+	t.compactMu.Lock()
+	defer t.compactMu.Unlock()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	empty := make([][]openTable, len(t.levels))
+	if err := t.writeManifest(empty); err != nil {
+		return err
+	}
+	levels := t.levels
+	t.levels = empty
+	for _, tables := range levels {
+		for _, ot := range tables {
+			_ = ot.table.Close()
+			if err := os.Remove(filepath.Join(t.dir, ot.name)); err != nil {
+				return fmt.Errorf("failed to remove table: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// Close stops the compaction workers, abandoning any compaction in progress,
+// and closes the tables.
+func (t *tree) Close() error {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return dberrors.ErrClosed
+	}
+	t.closed = true
+	t.mu.Unlock()
+
+	close(t.stop)
+	t.workers.Wait()
+
+	t.compactMu.Lock()
+	defer t.compactMu.Unlock()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.closeTables()
+}
+
+func (t *tree) closeTables() error {
+	var firstErr error
+	for level, tables := range t.levels {
+		for _, ot := range tables {
+			if err := ot.table.Close(); err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("failed to close table: %w", err)
+			}
+		}
+		t.levels[level] = nil
+	}
+	return firstErr
+}
+
+func (t *tree) Stats() map[string]interface{} {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	tables, entries, size := 0, 0, int64(0)
+	levelTables := make([]int, len(t.levels))
+	levelBytes := make([]int64, len(t.levels))
+	for level, list := range t.levels {
+		for _, ot := range list {
+			entries += ot.table.NumEntries()
+			levelBytes[level] += ot.table.Size()
+		}
+		levelTables[level] = len(list)
+		tables += len(list)
+		size += levelBytes[level]
+	}
+
+	stats := map[string]interface{}{
+		"tables":                   tables,
+		"entries":                  entries,
+		"bytes":                    size,
+		"level_tables":             levelTables,
+		"level_bytes":              levelBytes,
+		"compaction_style":         t.opts.CompactionStyle,
+		"compactions":              t.stats.compactions,
+		"flushed_bytes":            t.stats.flushedBytes,
+		"compaction_bytes_written": t.stats.compactedBytes,
+		"write_amplification":      t.stats.writeAmplification(),
+		"pending_compaction_bytes": t.pendingBytes(),
+	}
+	if t.stats.err != nil {
+		stats["compaction_error"] = t.stats.err.Error()
+	}
+	return stats
+}
@@ -0,0 +1,362 @@
+package lsm
+
+import (
+	"errors"
+	"fmt"
+	"halo-db/pkg/constants"
+	dberrors "halo-db/pkg/errors"
+	"halo-db/pkg/options"
+	"halo-db/pkg/sstable"
+	"halo-db/pkg/types"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"testing"
+	"time"
+)
+
+func put(key string, value string) sstable.Entry {
+	return sstable.Entry{Key: types.Key(key), Kind: types.KindValue, Value: types.Value(value)}
+}
+
+func del(key string) sstable.Entry {
+	return sstable.Entry{Key: types.Key(key), Kind: types.KindTombstone}
+}
+
+func TestTreeShadowing(t *testing.T) {
+	tree, err := Open(t.TempDir(), options.Default())
+	if err != nil {
+		t.Fatalf("Failed to open tree: %v", err)
+	}
+	defer func() { _ = tree.Close() }()
+
+	past := time.Now().Add(-time.Second).UnixNano()
+	flushes := [][]sstable.Entry{
+		{put("a", "1"), put("b", "1"), put("c", "1"), put("d", "1")},
+		{put("a", "2"), del("b"), {Key: "d", Kind: types.KindValue, Value: types.Value("2"), ExpiresAt: past}},
+		{put("b", "3"), put("e", "3")},
+	}
+	for _, entries := range flushes {
+		if err := tree.Flush(entries); err != nil {
+			t.Fatalf("Failed to flush: %v", err)
+		}
+	}
+
+	want := map[types.Key]string{"a": "2", "b": "3", "c": "1", "e": "3"}
+	for key, value := range want {
+		got, _, err := tree.FindWithExpiry(key)
+		if err != nil || string(got) != value {
+			t.Errorf("Expected %s=%s, got %s (err %v)", key, value, got, err)
+		}
+	}
+	if _, _, err := tree.FindWithExpiry("d"); !errors.Is(err, dberrors.ErrNotFound) {
+		t.Errorf("Expected the expired version of d to hide the older one, got %v", err)
+	}
+
+	var scanned []string
+	err = tree.Scan("b", "e", func(key types.Key, value types.Value) bool {
+		scanned = append(scanned, fmt.Sprintf("%s=%s", key, value))
+		return true
+	})
+	if err != nil || !slices.Equal(scanned, []string{"b=3", "c=1"}) {
+		t.Errorf("Unexpected scan of [b, e): %v (err %v)", scanned, err)
+	}
+	if keys := tree.List(); !slices.Equal(keys, []types.Key{"a", "b", "c", "e"}) {
+		t.Errorf("Unexpected keys %v", keys)
+	}
+	if expired := tree.Expired(time.Now().UnixNano()); !slices.Equal(expired, []types.Key{"d"}) {
+		t.Errorf("Expected d to be reported expired, got %v", expired)
+	}
+	if stats := tree.Stats(); stats["tables"] != 3 {
+		t.Errorf("Expected 3 tables, got %v", stats["tables"])
+	}
+}
+
+func TestTreeReopen(t *testing.T) {
+	dir := t.TempDir()
+	tree, err := Open(dir, options.Default())
+	if err != nil {
+		t.Fatalf("Failed to open tree: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := tree.Flush([]sstable.Entry{put(fmt.Sprintf("key%d", i), "value")}); err != nil {
+			t.Fatalf("Failed to flush: %v", err)
+		}
+	}
+	_ = tree.Close()
+
+	// A table written by a flush that crashed before the manifest recorded it.
+	stray := filepath.Join(dir, "000099.sst")
+	if err := sstable.Write(stray, []sstable.Entry{put("stray", "value")}, options.Default()); err != nil {
+		t.Fatalf("Failed to write table: %v", err)
+	}
+
+	tree, err = Open(dir, options.Default())
+	if err != nil {
+		t.Fatalf("Failed to reopen tree: %v", err)
+	}
+	if keys := tree.List(); len(keys) != 5 {
+		t.Errorf("Expected 5 keys after reopening, got %v", keys)
+	}
+	if _, err := os.Stat(stray); !os.IsNotExist(err) {
+		t.Errorf("Expected the stray table to be removed, got %v", err)
+	}
+
+	if err := tree.Flush([]sstable.Entry{put("key5", "value")}); err != nil {
+		t.Fatalf("Failed to flush after reopening: %v", err)
+	}
+	if err := tree.Clear(); err != nil {
+		t.Fatalf("Failed to clear: %v", err)
+	}
+	if keys := tree.List(); len(keys) != 0 {
+		t.Errorf("Expected no keys after clearing, got %v", keys)
+	}
+	_ = tree.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.sst"))
+	if len(files) != 0 {
+		t.Errorf("Expected clearing to remove every table, found %v", files)
+	}
+	if _, err := os.Stat(filepath.Join(dir, constants.TableManifestFileName)); err != nil {
+		t.Errorf("Expected the manifest to remain: %v", err)
+	}
+}
+
+// waitForCompactions runs compactions alongside the background workers until
+// none is due or running.
+func waitForCompactions(t *testing.T, tr Tree) {
+	t.Helper()
+
+	lt := tr.(*tree)
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		lt.compactOnce()
+		lt.mu.RLock()
+		idle := lt.pendingBytes() == 0 && len(lt.busy) == 0
+		lt.mu.RUnlock()
+		if idle {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Compactions did not finish")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func checkLevels(t *testing.T, tr Tree) {
+	t.Helper()
+
+	lt := tr.(*tree)
+	lt.mu.RLock()
+	defer lt.mu.RUnlock()
+	for level, tables := range lt.levels[1:] {
+		for i := 1; i < len(tables); i++ {
+			if tables[i].table.Smallest() <= tables[i-1].table.Largest() {
+				t.Errorf("Level %d tables %s and %s overlap", level+1, tables[i-1].name, tables[i].name)
+			}
+		}
+	}
+}
+
+func TestLeveledCompaction(t *testing.T) {
+	dir := t.TempDir()
+	opts := options.Default()
+	opts.CompactionTrigger = 2
+	opts.LevelSizeBase = 8 << 10
+	opts.LevelSizeMultiplier = 2
+	opts.TargetFileSize = 4 << 10
+	opts.CompactionWorkers = 2
+
+	tree, err := Open(dir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open tree: %v", err)
+	}
+
+	want := make(map[types.Key]string)
+	for round := 0; round < 40; round++ {
+		var entries []sstable.Entry
+		for i := 0; i < 100; i++ {
+			key := types.Key(fmt.Sprintf("key%04d", (round*37+i*11)%1000))
+			if (round+i)%5 == 0 {
+				entries = append(entries, del(string(key)))
+				delete(want, key)
+			} else {
+				value := fmt.Sprintf("value-%d-%d", round, i)
+				entries = append(entries, put(string(key), value))
+				want[key] = value
+			}
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+		if err := tree.Flush(entries); err != nil {
+			t.Fatalf("Failed to flush: %v", err)
+		}
+	}
+	waitForCompactions(t, tree)
+	checkLevels(t, tree)
+
+	check := func(tree Tree) {
+		t.Helper()
+		for i := 0; i < 1000; i++ {
+			key := types.Key(fmt.Sprintf("key%04d", i))
+			value, _, err := tree.FindWithExpiry(key)
+			if expected, live := want[key]; live {
+				if err != nil || string(value) != expected {
+					t.Fatalf("Expected %s=%s, got %s (err %v)", key, expected, value, err)
+				}
+			} else if !errors.Is(err, dberrors.ErrNotFound) {
+				t.Fatalf("Expected %s to be deleted, got %s (err %v)", key, value, err)
+			}
+		}
+		if keys := tree.List(); len(keys) != len(want) || !sort.StringsAreSorted(keys) {
+			t.Fatalf("Expected %d sorted keys, got %d", len(want), len(keys))
+		}
+	}
+	check(tree)
+
+	stats := tree.Stats()
+	if stats["compactions"].(int) == 0 {
+		t.Fatal("Expected compactions to run")
+	}
+	if wa := stats["write_amplification"].(float64); wa <= 1 {
+		t.Errorf("Expected write amplification above 1, got %v", wa)
+	}
+	if tables := stats["level_tables"].([]int); tables[0] >= opts.CompactionTrigger {
+		t.Errorf("Expected level 0 to be compacted, got %v", tables)
+	}
+	_ = tree.Close()
+
+	tree, err = Open(dir, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen tree: %v", err)
+	}
+	defer func() { _ = tree.Close() }()
+	checkLevels(t, tree)
+	check(tree)
+}
+
+func TestCompactionDropsTombstones(t *testing.T) {
+	opts := options.Default()
+	opts.CompactionTrigger = 2
+
+	tree, err := Open(t.TempDir(), opts)
+	if err != nil {
+		t.Fatalf("Failed to open tree: %v", err)
+	}
+	defer func() { _ = tree.Close() }()
+
+	past := time.Now().Add(-time.Second).UnixNano()
+	if err := tree.Flush([]sstable.Entry{put("a", "1"), put("b", "1"), put("c", "1")}); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	if err := tree.Flush([]sstable.Entry{put("a", "2"), del("b"), {Key: "c", Kind: types.KindValue, Value: types.Value("2"), ExpiresAt: past}}); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	waitForCompactions(t, tree)
+
+	stats := tree.Stats()
+	if stats["tables"] != 1 || stats["entries"] != 1 {
+		t.Errorf("Expected a single table holding only a, got %v tables with %v entries", stats["tables"], stats["entries"])
+	}
+	if value, _, err := tree.FindWithExpiry("a"); err != nil || string(value) != "2" {
+		t.Errorf("Expected a=2, got %s (err %v)", value, err)
+	}
+}
+
+func TestTieredCompaction(t *testing.T) {
+	opts := options.Default()
+	opts.CompactionStyle = "tiered"
+	opts.CompactionTrigger = 3
+
+	tree, err := Open(t.TempDir(), opts)
+	if err != nil {
+		t.Fatalf("Failed to open tree: %v", err)
+	}
+	defer func() { _ = tree.Close() }()
+
+	flush := func(fn func(key string) sstable.Entry) {
+		var entries []sstable.Entry
+		for i := 0; i < 50; i++ {
+			entries = append(entries, fn(fmt.Sprintf("key%02d", i)))
+		}
+		if err := tree.Flush(entries); err != nil {
+			t.Fatalf("Failed to flush: %v", err)
+		}
+	}
+	flush(func(key string) sstable.Entry { return put(key, "1") })
+	flush(func(key string) sstable.Entry { return put(key, "2") })
+	flush(func(key string) sstable.Entry {
+		if key < "key25" {
+			return del(key)
+		}
+		return put(key, "3")
+	})
+	waitForCompactions(t, tree)
+
+	stats := tree.Stats()
+	if stats["tables"] != 1 || stats["entries"] != 25 {
+		t.Errorf("Expected the three tables merged into one of 25 entries, got %v tables with %v entries", stats["tables"], stats["entries"])
+	}
+	if keys := tree.List(); len(keys) != 25 || keys[0] != "key25" {
+		t.Errorf("Unexpected keys after compaction: %v", keys)
+	}
+
+	// A run that does not reach the oldest table keeps its tombstones.
+	for i := 0; i < 3; i++ {
+		flush(func(key string) sstable.Entry { return del(key) })
+	}
+	waitForCompactions(t, tree)
+	if keys := tree.List(); len(keys) != 0 {
+		t.Errorf("Expected every key deleted, got %v", keys)
+	}
+}
+
+func TestCompactionThrottle(t *testing.T) {
+	limiter := newRateLimiter(10000)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		limiter.wait(1000, nil)
+	}
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Errorf("Expected 3000 bytes at 10000 bytes/s to take 300ms, took %v", elapsed)
+	}
+
+	// Closing the tree abandons a throttled compaction and keeps its inputs.
+	dir := t.TempDir()
+	opts := options.Default()
+	opts.CompactionTrigger = 2
+	opts.CompactionRateLimit = 1
+	tree, err := Open(dir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open tree: %v", err)
+	}
+	value := string(make([]byte, 100))
+	for round := 0; round < 2; round++ {
+		var entries []sstable.Entry
+		for i := 0; i < 1000; i++ {
+			entries = append(entries, put(fmt.Sprintf("key%04d", i), value))
+		}
+		if err := tree.Flush(entries); err != nil {
+			t.Fatalf("Failed to flush: %v", err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	start = time.Now()
+	if err := tree.Close(); err != nil {
+		t.Fatalf("Failed to close tree: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Close waited %v for a throttled compaction", elapsed)
+	}
+
+	tree, err = Open(dir, options.Default())
+	if err != nil {
+		t.Fatalf("Failed to reopen tree: %v", err)
+	}
+	defer func() { _ = tree.Close() }()
+	if keys := tree.List(); len(keys) != 1000 {
+		t.Errorf("Expected 1000 keys after an abandoned compaction, got %d", len(keys))
+	}
+}
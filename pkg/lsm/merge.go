@@ -0,0 +1,127 @@
+package lsm
+
+import (
+	"halo-db/pkg/sstable"
+	"halo-db/pkg/types"
+	"sort"
+)
+
+// mergingIterator merges iterators given newest first into one stream in key
+// order that holds only the newest version of each key. Tombstones and
+// expired entries are passed through; what to do with them is up to the
+// caller.
+type mergingIterator struct {
+	its []sstable.Iterator
+	cur int
+	err error
+}
+
+func newMergingIterator(its []sstable.Iterator) *mergingIterator {
+	return &mergingIterator{its: its, cur: -1}
+}
+
+func (m *mergingIterator) Seek(key types.Key) {
+	m.err = nil
+	for _, it := range m.its {
+		it.Seek(key)
+	}
+	m.find()
+}
+
+func (m *mergingIterator) Next() {
+	if !m.Valid() {
+		return
+	}
+	key := m.Entry().Key
+	for _, it := range m.its[m.cur:] {
+		if it.Valid() && it.Entry().Key == key {
+			it.Next()
+		}
+	}
+	m.find()
+}
+
+func (m *mergingIterator) Valid() bool {
+	return m.err == nil && m.cur >= 0
+}
+
+func (m *mergingIterator) Entry() sstable.Entry {
+	return m.its[m.cur].Entry()
+}
+
+func (m *mergingIterator) Err() error {
+	return m.err
+}
+
+// find points cur at the iterator with the smallest key. Iterators are
+// newest first, so on equal keys the first one wins.
+func (m *mergingIterator) find() {
+	m.cur = -1
+	for i, it := range m.its {
+		if !it.Valid() {
+			if err := it.Err(); err != nil {
+				m.err = err
+				m.cur = -1
+				return
+			}
+			continue
+		}
+		if m.cur < 0 || it.Entry().Key < m.its[m.cur].Entry().Key {
+			m.cur = i
+		}
+	}
+}
+
+// levelIterator walks the tables of one level below level 0 as a single
+// run. Their key ranges do not overlap, so it only ever has one of them
+// open.
+type levelIterator struct {
+	tables []openTable
+	pos    int
+	it     sstable.Iterator
+}
+
+func newLevelIterator(tables []openTable) *levelIterator {
+	return &levelIterator{tables: tables, pos: len(tables)}
+}
+
+func (l *levelIterator) Seek(key types.Key) {
+	l.pos = sort.Search(len(l.tables), func(i int) bool { return l.tables[i].table.Largest() >= key })
+	l.it = nil
+	if l.pos < len(l.tables) {
+		l.it = l.tables[l.pos].table.NewIterator()
+		l.it.Seek(key)
+	}
+	l.skipExhausted()
+}
+
+func (l *levelIterator) Next() {
+	if !l.Valid() {
+		return
+	}
+	l.it.Next()
+	l.skipExhausted()
+}
+
+func (l *levelIterator) Valid() bool {
+	return l.it != nil && l.it.Valid()
+}
+
+func (l *levelIterator) Entry() sstable.Entry {
+	return l.it.Entry()
+}
+
+func (l *levelIterator) Err() error {
+	if l.it == nil {
+		return nil
+	}
+	return l.it.Err()
+}
+
+func (l *levelIterator) skipExhausted() {
+	for l.it != nil && !l.it.Valid() && l.it.Err() == nil && l.pos+1 < len(l.tables) {
+		l.pos++
+		l.it = l.tables[l.pos].table.NewIterator()
+		l.it.Seek("")
+	}
+}
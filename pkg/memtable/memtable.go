@@ -3,99 +3,277 @@ package memtable
 import (
 	"halo-db/pkg/constants"
 	"halo-db/pkg/types"
+	"math"
 	"sort"
 	"sync"
+	"time"
 )
 
+// Entry is one version of a key. Tombstones have no value but, like values,
+// carry the sequence number they were written at.
 type Entry struct {
-	Key   types.Key
-	Value types.Value
+	Key       types.Key
+	Kind      types.Kind
+	Value     types.Value
+	ExpiresAt int64
+	Seq       uint64
 }
 
 type Memtable interface {
 	Put(key types.Key, value types.Value)
-	Get(key types.Key) (types.Value, bool)
+	PutWithExpiry(key types.Key, value types.Value, expiresAt int64)
+	Get(key types.Key) (Entry, bool)
+	GetAt(key types.Key, seq uint64) (Entry, bool)
 	Delete(key types.Key)
 	GetAllEntries() []Entry
+	Scan(start, end types.Key, fn func(types.Key, types.Value) bool)
+	ScanAt(start, end types.Key, seq uint64, fn func(types.Key, types.Value) bool)
+	Seq() uint64
+	Retain(seq uint64)
 	GetSize() int
+	GetBytes() int64
 	IsFull() bool
 	Clear()
 }
 
+// keyOverhead and versionOverhead approximate what a memtable spends on
+// each key and each version beyond the bytes of the key and value.
+const (
+	keyOverhead     = 64
+	versionOverhead = 48
+)
+
+type version struct {
+	seq       uint64
+	kind      types.Kind
+	value     types.Value
+	expiresAt int64
+}
+
+// record holds the versions of one key, oldest first. Older versions are
+// only kept while a reader at a retained sequence number may still see them.
+type record struct {
+	key      types.Key
+	versions []version
+}
+
 type memtable struct {
-	entries []Entry
-	size    int
-	mu      sync.RWMutex
+	records  []record
+	size     int
+	maxBytes int64
+	bytes    int64
+	seq      uint64
+	retain   uint64
+	mu       sync.RWMutex
 }
 
 func NewMemtable(size int) Memtable {
+	return NewMemtableWithSeq(size, constants.MemtableBytes, 0)
+}
+
+// NewMemtableWithSeq numbers writes from seq onwards, so a store that swaps
+// in a fresh memtable keeps one sequence across them. The memtable is full
+// once it holds size keys or maxBytes bytes, whichever comes first.
+func NewMemtableWithSeq(size int, maxBytes int64, seq uint64) Memtable {
+	size, maxBytes = limits(size, maxBytes)
+	return &memtable{
+		records:  make([]record, 0),
+		size:     size,
+		maxBytes: maxBytes,
+		seq:      seq,
+		retain:   math.MaxUint64,
+	}
+}
+
+func limits(size int, maxBytes int64) (int, int64) {
 	if size <= 0 {
 		size = constants.MemtableSize
 	}
-	return &memtable{
-		entries: make([]Entry, 0),
-		size:    size,
+	if maxBytes <= 0 {
+		maxBytes = constants.MemtableBytes
 	}
+	return size, maxBytes
 }
 
 func (m *memtable) Put(key types.Key, value types.Value) {
+	m.PutWithExpiry(key, value, 0)
+}
+
+// PutWithExpiry stores value, which may be nil or empty; either way it reads
+// back as an empty value, never as a deletion.
+func (m *memtable) PutWithExpiry(key types.Key, value types.Value, expiresAt int64) {
+	if value == nil {
+		value = types.Value{}
+	}
+	m.add(key, version{kind: types.KindValue, value: value, expiresAt: expiresAt})
+}
+
+func (m *memtable) add(key types.Key, v version) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	pos := sort.Search(len(m.entries), func(i int) bool {
-		return m.entries[i].Key >= key
-	})
+	m.seq++
+	v.seq = m.seq
+	m.bytes += versionSize(v)
 
-	if pos < len(m.entries) && m.entries[pos].Key == key {
-		m.entries[pos].Value = value
+	pos := m.search(key)
+	if pos < len(m.records) && m.records[pos].key == key {
+		r := &m.records[pos]
+		var freed int64
+		r.versions, freed = prune(append(r.versions, v), m.retain)
+		m.bytes -= freed
 		return
 	}
 
-	m.entries = append(m.entries, Entry{})
-	copy(m.entries[pos+1:], m.entries[pos:])
-	m.entries[pos] = Entry{Key: key, Value: value}
+	m.bytes += int64(len(key)) + keyOverhead
+	m.records = append(m.records, record{})
+	copy(m.records[pos+1:], m.records[pos:])
+	m.records[pos] = record{key: key, versions: []version{v}}
+}
+
+func (m *memtable) Get(key types.Key) (Entry, bool) {
+	return m.GetAt(key, math.MaxUint64)
 }
 
-func (m *memtable) Get(key types.Key) (types.Value, bool) {
+// GetAt returns the version key had once every write up to seq was applied.
+// A value that has expired since reads as a tombstone.
+func (m *memtable) GetAt(key types.Key, seq uint64) (Entry, bool) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
-	pos := sort.Search(len(m.entries), func(i int) bool {
-		return m.entries[i].Key >= key
-	})
-
-	if pos < len(m.entries) && m.entries[pos].Key == key {
-		return m.entries[pos].Value, true
+	pos := m.search(key)
+	if pos < len(m.records) && m.records[pos].key == key {
+		return m.records[pos].at(seq, time.Now().UnixNano())
 	}
 
-	return nil, false
+	return Entry{}, false
 }
 
 func (m *memtable) Delete(key types.Key) {
-	m.Put(key, nil)
+	m.add(key, version{kind: types.KindTombstone})
 }
 
+// GetAllEntries returns the latest version of every key, in key order.
+// Expired values are returned as they are, for the caller to check.
 func (m *memtable) GetAllEntries() []Entry {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
-	result := make([]Entry, len(m.entries))
-	copy(result, m.entries)
+	result := make([]Entry, len(m.records))
+	for i, r := range m.records {
+		result[i] = r.versions[len(r.versions)-1].entry(r.key)
+	}
 	return result
 }
 
+func (m *memtable) Scan(start, end types.Key, fn func(types.Key, types.Value) bool) {
+	m.ScanAt(start, end, math.MaxUint64, fn)
+}
+
+// ScanAt passes tombstones, and values that have expired, to fn as nil
+// values; live values are never nil, even when empty.
+func (m *memtable) ScanAt(start, end types.Key, seq uint64, fn func(types.Key, types.Value) bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	now := time.Now().UnixNano()
+	for pos := m.search(start); pos < len(m.records); pos++ {
+		r := m.records[pos]
+		if end != "" && r.key >= end {
+			return
+		}
+		entry, found := r.at(seq, now)
+		if !found {
+			continue
+		}
+		if !fn(r.key, entry.Value) {
+			return
+		}
+	}
+}
+
+func (m *memtable) Seq() uint64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.seq
+}
+
+// Retain keeps the versions visible at seq, and everything newer, from
+// being pruned. math.MaxUint64 keeps only the latest version of each key.
+func (m *memtable) Retain(seq uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.retain = seq
+}
+
 func (m *memtable) GetSize() int {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
-	return len(m.entries)
+	return len(m.records)
+}
+
+func (m *memtable) GetBytes() int64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.bytes
 }
 
 func (m *memtable) IsFull() bool {
-	return m.GetSize() >= m.size
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.records) >= m.size || m.bytes >= m.maxBytes
 }
 
 func (m *memtable) Clear() {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	m.entries = make([]Entry, 0)
+	m.records = make([]record, 0)
+	m.bytes = 0
+}
+
+func (m *memtable) search(key types.Key) int {
+	return sort.Search(len(m.records), func(i int) bool {
+		return m.records[i].key >= key
+	})
+}
+
+func (r record) at(seq uint64, now int64) (Entry, bool) {
+	for i := len(r.versions) - 1; i >= 0; i-- {
+		v := r.versions[i]
+		if v.seq > seq {
+			continue
+		}
+		if v.kind == types.KindValue && types.Expired(v.expiresAt, now) {
+			return Entry{Key: r.key, Kind: types.KindTombstone, Seq: v.seq}, true
+		}
+		return v.entry(r.key), true
+	}
+	return Entry{}, false
+}
+
+func (v version) entry(key types.Key) Entry {
+	return Entry{Key: key, Kind: v.kind, Value: v.value, ExpiresAt: v.expiresAt, Seq: v.seq}
+}
+
+// prune drops the versions no reader at a retained sequence number can see,
+// and returns what they took up.
+func prune(versions []version, retain uint64) ([]version, int64) {
+	keep := 0
+	for i, v := range versions {
+		if v.seq <= retain {
+			keep = i
+		}
+	}
+	if keep == 0 {
+		return versions, 0
+	}
+	var freed int64
+	for _, v := range versions[:keep] {
+		freed += versionSize(v)
+	}
+	return append(versions[:0:0], versions[keep:]...), freed
+}
+
+func versionSize(v version) int64 {
+	return int64(len(v.value)) + versionOverhead
 }
@@ -1,8 +1,14 @@
 package memtable
 
 import (
+	"fmt"
 	"halo-db/pkg/types"
+	"math"
+	"math/rand/v2"
+	"reflect"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestMemtablePutAndGet(t *testing.T) {
@@ -11,12 +17,12 @@ func TestMemtablePutAndGet(t *testing.T) {
 	mt.Put("key1", types.Value("value1"))
 	mt.Put("key2", types.Value("value2"))
 
-	if value, found := mt.Get("key1"); !found || string(value) != "value1" {
-		t.Errorf("Expected value1, got %v", value)
+	if entry, found := mt.Get("key1"); !found || string(entry.Value) != "value1" {
+		t.Errorf("Expected value1, got %v", entry.Value)
 	}
 
-	if value, found := mt.Get("key2"); !found || string(value) != "value2" {
-		t.Errorf("Expected value2, got %v", value)
+	if entry, found := mt.Get("key2"); !found || string(entry.Value) != "value2" {
+		t.Errorf("Expected value2, got %v", entry.Value)
 	}
 
 	if _, found := mt.Get("key3"); found {
@@ -30,8 +36,8 @@ func TestMemtableOverwrite(t *testing.T) {
 	mt.Put("key1", types.Value("value1"))
 	mt.Put("key1", types.Value("value1_updated"))
 
-	if value, found := mt.Get("key1"); !found || string(value) != "value1_updated" {
-		t.Errorf("Expected value1_updated, got %v", value)
+	if entry, found := mt.Get("key1"); !found || string(entry.Value) != "value1_updated" {
+		t.Errorf("Expected value1_updated, got %v", entry.Value)
 	}
 }
 
@@ -41,8 +47,8 @@ func TestMemtableDelete(t *testing.T) {
 	mt.Put("key1", types.Value("value1"))
 	mt.Delete("key1")
 
-	if value, found := mt.Get("key1"); found && value != nil {
-		t.Errorf("Expected deleted key to return nil, got %v", value)
+	if entry, found := mt.Get("key1"); !found || entry.Kind != types.KindTombstone || entry.Value != nil {
+		t.Errorf("Expected deleted key to return a tombstone, got %+v", entry)
 	}
 }
 
@@ -98,3 +104,328 @@ func TestMemtableIsFull(t *testing.T) {
 		t.Error("Expected full with 2 entries")
 	}
 }
+
+func TestMemtableByteLimit(t *testing.T) {
+	for name, mt := range map[string]Memtable{
+		"slice":    NewMemtableWithSeq(100, 4096, 0),
+		"skiplist": NewSkiplistMemtable(100, 4096, 0),
+	} {
+		t.Run(name, func(t *testing.T) {
+			for i := 0; i < 3; i++ {
+				mt.Put(types.Key(fmt.Sprintf("key%d", i)), make(types.Value, 1000))
+				if mt.IsFull() {
+					t.Fatalf("Expected not full with %d entries of 1000 bytes", i+1)
+				}
+			}
+			mt.Put("key3", make(types.Value, 1000))
+			if !mt.IsFull() {
+				t.Errorf("Expected full at %d bytes", mt.GetBytes())
+			}
+		})
+	}
+}
+
+func TestMemtableScan(t *testing.T) {
+	mt := NewMemtable(100)
+
+	mt.Put("c", types.Value("3"))
+	mt.Put("a", types.Value("1"))
+	mt.Put("b", types.Value("2"))
+	mt.Delete("d")
+
+	var keys []types.Key
+	mt.Scan("b", "", func(key types.Key, value types.Value) bool {
+		keys = append(keys, key)
+		return true
+	})
+
+	if len(keys) != 3 || keys[0] != "b" || keys[1] != "c" || keys[2] != "d" {
+		t.Errorf("Expected [b c d] including tombstone, got %v", keys)
+	}
+}
+
+func TestMemtableVersions(t *testing.T) {
+	mt := NewMemtable(100)
+
+	mt.Put("key1", types.Value("v1"))
+	seq := mt.Seq()
+	mt.Retain(seq)
+
+	mt.Put("key1", types.Value("v2"))
+	mt.Delete("key1")
+	mt.Put("key2", types.Value("new"))
+
+	if entry, found := mt.GetAt("key1", seq); !found || string(entry.Value) != "v1" {
+		t.Errorf("Expected v1 at seq %d, got %v", seq, entry.Value)
+	}
+	if _, found := mt.GetAt("key2", seq); found {
+		t.Error("Expected key2 to be invisible at the retained seq")
+	}
+	if entry, found := mt.Get("key1"); !found || entry.Kind != types.KindTombstone {
+		t.Errorf("Expected key1 to be deleted, got %+v", entry)
+	}
+
+	var keys []types.Key
+	mt.ScanAt("", "", seq, func(key types.Key, value types.Value) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if len(keys) != 1 || keys[0] != "key1" {
+		t.Errorf("Expected only key1 at seq %d, got %v", seq, keys)
+	}
+
+	mt.Retain(mt.Seq())
+	mt.Put("key1", types.Value("v3"))
+	if _, found := mt.GetAt("key1", seq); found {
+		t.Error("Expected old versions to be pruned once no longer retained")
+	}
+}
+
+func TestMemtableWithSeq(t *testing.T) {
+	mt := NewMemtableWithSeq(100, 0, 41)
+	mt.Put("key1", types.Value("value"))
+
+	if seq := mt.Seq(); seq != 42 {
+		t.Errorf("Expected seq 42, got %d", seq)
+	}
+	if _, found := mt.GetAt("key1", 41); found {
+		t.Error("Expected key1 to be invisible before its seq")
+	}
+	if entry, found := mt.GetAt("key1", 42); !found || string(entry.Value) != "value" || entry.Seq != 42 {
+		t.Errorf("Expected key1 at seq 42, got %+v", entry)
+	}
+}
+
+func TestMemtableExpiry(t *testing.T) {
+	mt := NewMemtable(100)
+
+	mt.PutWithExpiry("expired", types.Value("value"), time.Now().Add(-time.Second).UnixNano())
+	mt.PutWithExpiry("live", types.Value("value"), time.Now().Add(time.Hour).UnixNano())
+
+	if entry, found := mt.Get("expired"); !found || entry.Kind != types.KindTombstone {
+		t.Errorf("Expected expired key to read as deleted, got %+v, %v", entry, found)
+	}
+	if entry, found := mt.Get("live"); !found || string(entry.Value) != "value" {
+		t.Errorf("Expected live value, got %v", entry.Value)
+	}
+}
+
+func TestMemtableEmptyValues(t *testing.T) {
+	mt := NewMemtable(100)
+
+	mt.Put("empty", types.Value{})
+	mt.Put("nil", nil)
+	mt.Put("deleted", types.Value("value"))
+	mt.Delete("deleted")
+
+	for _, key := range []types.Key{"empty", "nil"} {
+		entry, found := mt.Get(key)
+		if !found || entry.Kind != types.KindValue || entry.Value == nil || len(entry.Value) != 0 {
+			t.Errorf("Expected an empty value for %s, got %+v", key, entry)
+		}
+	}
+	if entry, found := mt.Get("deleted"); !found || entry.Kind != types.KindTombstone || entry.Seq != 4 {
+		t.Errorf("Expected a tombstone at seq 4, got %+v", entry)
+	}
+
+	scanned := make(map[types.Key]types.Value)
+	mt.Scan("", "", func(key types.Key, value types.Value) bool {
+		scanned[key] = value
+		return true
+	})
+	if scanned["empty"] == nil || scanned["nil"] == nil || scanned["deleted"] != nil {
+		t.Errorf("Expected only the tombstone to scan as nil, got %v", scanned)
+	}
+
+	for _, entry := range mt.GetAllEntries() {
+		want := types.KindValue
+		if entry.Key == "deleted" {
+			want = types.KindTombstone
+		}
+		if entry.Kind != want {
+			t.Errorf("Expected kind %d for %s, got %d", want, entry.Key, entry.Kind)
+		}
+	}
+}
+
+func TestSkiplistMatchesSlice(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	slice := NewMemtable(1 << 20)
+	skiplist := NewSkiplistMemtable(1<<20, 0, 0)
+	both := []Memtable{slice, skiplist}
+	past := time.Now().Add(-time.Second).UnixNano()
+
+	var retained []uint64
+	for i := 0; i < 5000; i++ {
+		key := types.Key(fmt.Sprintf("key%03d", rng.IntN(300)))
+		value := types.Value(fmt.Sprintf("value%d", i))
+		op := rng.IntN(10)
+		for _, mt := range both {
+			switch {
+			case op < 6:
+				mt.Put(key, value)
+			case op < 8:
+				mt.Delete(key)
+			case op < 9:
+				mt.PutWithExpiry(key, value, past)
+			default:
+				mt.Put(key, nil)
+			}
+		}
+		if i%1000 == 0 {
+			retained = append(retained, slice.Seq())
+			for _, mt := range both {
+				mt.Retain(retained[0])
+			}
+		}
+	}
+
+	if slice.Seq() != skiplist.Seq() || slice.GetSize() != skiplist.GetSize() {
+		t.Fatalf("Expected seq %d and size %d, got %d and %d", slice.Seq(), slice.GetSize(), skiplist.Seq(), skiplist.GetSize())
+	}
+	if want, got := slice.GetAllEntries(), skiplist.GetAllEntries(); !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected the same entries from both memtables")
+	}
+	for _, seq := range append(retained, math.MaxUint64) {
+		for i := 0; i < 310; i++ {
+			key := types.Key(fmt.Sprintf("key%03d", i))
+			want, wantFound := slice.GetAt(key, seq)
+			got, gotFound := skiplist.GetAt(key, seq)
+			if wantFound != gotFound || !reflect.DeepEqual(want, got) {
+				t.Fatalf("Expected %+v (%v) for %s at seq %d, got %+v (%v)", want, wantFound, key, seq, got, gotFound)
+			}
+		}
+		if want, got := scanAll(slice, "key100", "key200", seq), scanAll(skiplist, "key100", "key200", seq); !reflect.DeepEqual(want, got) {
+			t.Errorf("Expected the same scan at seq %d", seq)
+		}
+	}
+}
+
+func scanAll(mt Memtable, start, end types.Key, seq uint64) []types.Entry {
+	var entries []types.Entry
+	mt.ScanAt(start, end, seq, func(key types.Key, value types.Value) bool {
+		entries = append(entries, types.Entry{Key: key, Value: value})
+		return true
+	})
+	return entries
+}
+
+func TestSkiplistConcurrentReads(t *testing.T) {
+	mt := NewSkiplistMemtable(1<<20, 0, 0)
+	for i := 0; i < 1000; i += 2 {
+		mt.Put(types.Key(fmt.Sprintf("key%04d", i)), types.Value("value"))
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				prev := types.Key("")
+				count := 0
+				mt.Scan("", "", func(key types.Key, value types.Value) bool {
+					if key <= prev && count > 0 {
+						t.Errorf("Scan went from %s to %s", prev, key)
+					}
+					prev = key
+					count++
+					return true
+				})
+				if count < 500 {
+					t.Errorf("Expected at least the 500 initial keys, scanned %d", count)
+				}
+				if entry, found := mt.Get("key0500"); !found || string(entry.Value) != "value" {
+					t.Errorf("Expected key0500 to stay readable, got %+v", entry)
+				}
+			}
+		}()
+	}
+
+	for i := 1; i < 1000; i += 2 {
+		mt.Put(types.Key(fmt.Sprintf("key%04d", i)), types.Value("value"))
+		mt.Put(types.Key(fmt.Sprintf("key%04d", i-1)), types.Value("value"))
+	}
+	close(done)
+	wg.Wait()
+
+	if mt.GetSize() != 1000 {
+		t.Errorf("Expected 1000 keys, got %d", mt.GetSize())
+	}
+}
+
+func TestMemtableBytes(t *testing.T) {
+	for name, newMemtable := range implementations {
+		t.Run(name, func(t *testing.T) {
+			mt := newMemtable(100)
+			if mt.GetBytes() != 0 {
+				t.Fatalf("Expected an empty memtable to take no bytes, got %d", mt.GetBytes())
+			}
+
+			mt.Put("key", make(types.Value, 1000))
+			first := mt.GetBytes()
+			if first < 1003 {
+				t.Errorf("Expected at least the key and value bytes, got %d", first)
+			}
+			mt.Retain(mt.Seq())
+			mt.Put("key", make(types.Value, 1000))
+			if mt.GetBytes() < first+1000 {
+				t.Errorf("Expected a second version to add its value, got %d after %d", mt.GetBytes(), first)
+			}
+
+			mt.Clear()
+			if mt.GetBytes() != 0 {
+				t.Errorf("Expected Clear to reset bytes, got %d", mt.GetBytes())
+			}
+		})
+	}
+}
+
+var implementations = map[string]func(size int) Memtable{
+	"slice":    NewMemtable,
+	"skiplist": func(size int) Memtable { return NewSkiplistMemtable(size, 0, 0) },
+}
+
+func BenchmarkMemtablePut(b *testing.B) {
+	for name, newMemtable := range implementations {
+		b.Run(name, func(b *testing.B) {
+			keys := make([]types.Key, 10000)
+			rng := rand.New(rand.NewPCG(1, 2))
+			for i := range keys {
+				keys[i] = types.Key(fmt.Sprintf("key%08d", rng.IntN(1<<30)))
+			}
+			value := types.Value("value")
+			var mt Memtable
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if i%len(keys) == 0 {
+					mt = newMemtable(len(keys))
+				}
+				mt.Put(keys[i%len(keys)], value)
+			}
+		})
+	}
+}
+
+func BenchmarkMemtableGet(b *testing.B) {
+	for name, newMemtable := range implementations {
+		b.Run(name, func(b *testing.B) {
+			mt := newMemtable(10000)
+			for i := 0; i < 10000; i++ {
+				mt.Put(types.Key(fmt.Sprintf("key%05d", i)), types.Value("value"))
+			}
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				mt.Get(types.Key(fmt.Sprintf("key%05d", i%10000)))
+			}
+		})
+	}
+}
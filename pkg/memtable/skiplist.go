@@ -0,0 +1,259 @@
+package memtable
+
+import (
+	"halo-db/pkg/types"
+	"math"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	maxHeight = 12
+	// Each level holds about a quarter of the nodes of the one below.
+	heightBranching = 4
+	arenaChunkSize  = 64 << 10
+	nodeSlabSize    = 256
+)
+
+// skiplist is a memtable whose readers never lock. Writers are serialised
+// by mu, and publish each node only once it is fully built, linking it in
+// from the bottom level up with atomic stores; a reader that races a write
+// sees the list either with or without the new node. A key's versions are
+// replaced as a whole, never changed in place, for the same reason.
+type skiplist struct {
+	head     atomic.Pointer[node]
+	height   atomic.Int32
+	arena    *arena
+	slab     []node
+	rng      *rand.Rand
+	size     int
+	maxBytes int64
+	count    atomic.Int64
+	bytes    atomic.Int64
+	seq      atomic.Uint64
+	retain   uint64
+	mu       sync.Mutex
+}
+
+type node struct {
+	key      types.Key
+	versions atomic.Pointer[[]version]
+	next     [maxHeight]atomic.Pointer[node]
+}
+
+// NewSkiplistMemtable is NewMemtableWithSeq backed by a skiplist, which
+// inserts in O(log n) and lets reads run alongside a write.
+func NewSkiplistMemtable(size int, maxBytes int64, seq uint64) Memtable {
+	size, maxBytes = limits(size, maxBytes)
+	s := &skiplist{
+		size:     size,
+		maxBytes: maxBytes,
+		retain:   math.MaxUint64,
+		rng:      rand.New(rand.NewPCG(seq, uint64(time.Now().UnixNano()))),
+	}
+	s.seq.Store(seq)
+	s.reset()
+	return s
+}
+
+func (s *skiplist) reset() {
+	s.head.Store(&node{})
+	s.height.Store(1)
+	s.arena = &arena{}
+	s.slab = nil
+	s.count.Store(0)
+	s.bytes.Store(0)
+}
+
+func (s *skiplist) Put(key types.Key, value types.Value) {
+	s.PutWithExpiry(key, value, 0)
+}
+
+func (s *skiplist) PutWithExpiry(key types.Key, value types.Value, expiresAt int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.add(key, version{kind: types.KindValue, value: s.arena.copy(value), expiresAt: expiresAt})
+}
+
+func (s *skiplist) Delete(key types.Key) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.add(key, version{kind: types.KindTombstone})
+}
+
+// add must be called with mu held.
+func (s *skiplist) add(key types.Key, v version) {
+	v.seq = s.seq.Load() + 1
+	s.bytes.Add(versionSize(v))
+
+	var prev [maxHeight]*node
+	n := s.findGreaterOrEqual(key, &prev)
+	if n != nil && n.key == key {
+		versions := *n.versions.Load()
+		// The full slice expression makes append copy, leaving the slice
+		// readers may hold untouched. Pruned values stay in the arena, so
+		// they still count towards bytes.
+		versions, _ = prune(append(versions[:len(versions):len(versions)], v), s.retain)
+		n.versions.Store(&versions)
+		s.seq.Store(v.seq)
+		return
+	}
+
+	height := s.randomHeight()
+	if current := int(s.height.Load()); height > current {
+		for level := current; level < height; level++ {
+			prev[level] = s.head.Load()
+		}
+		s.height.Store(int32(height))
+	}
+
+	n = s.newNode(key)
+	versions := []version{v}
+	n.versions.Store(&versions)
+	for level := 0; level < height; level++ {
+		n.next[level].Store(prev[level].next[level].Load())
+	}
+	for level := 0; level < height; level++ {
+		prev[level].next[level].Store(n)
+	}
+
+	s.count.Add(1)
+	s.bytes.Add(int64(len(key)) + keyOverhead)
+	s.seq.Store(v.seq)
+}
+
+// newNode hands out nodes from a slab, so a memtable allocates its nodes a
+// few hundred at a time. It must be called with mu held.
+func (s *skiplist) newNode(key types.Key) *node {
+	if len(s.slab) == 0 {
+		s.slab = make([]node, nodeSlabSize)
+	}
+	n := &s.slab[0]
+	s.slab = s.slab[1:]
+	n.key = key
+	return n
+}
+
+func (s *skiplist) randomHeight() int {
+	height := 1
+	for height < maxHeight && s.rng.IntN(heightBranching) == 0 {
+		height++
+	}
+	return height
+}
+
+// findGreaterOrEqual returns the first node at or after key, or nil. If
+// prev is set, it is filled with the last node before key on every level.
+func (s *skiplist) findGreaterOrEqual(key types.Key, prev *[maxHeight]*node) *node {
+	x := s.head.Load()
+	for level := int(s.height.Load()) - 1; level >= 0; level-- {
+		for {
+			next := x.next[level].Load()
+			if next == nil || next.key >= key {
+				break
+			}
+			x = next
+		}
+		if prev != nil {
+			prev[level] = x
+		}
+	}
+	return x.next[0].Load()
+}
+
+func (s *skiplist) Get(key types.Key) (Entry, bool) {
+	return s.GetAt(key, math.MaxUint64)
+}
+
+func (s *skiplist) GetAt(key types.Key, seq uint64) (Entry, bool) {
+	n := s.findGreaterOrEqual(key, nil)
+	if n == nil || n.key != key {
+		return Entry{}, false
+	}
+	return n.record().at(seq, time.Now().UnixNano())
+}
+
+func (s *skiplist) GetAllEntries() []Entry {
+	result := make([]Entry, 0, s.count.Load())
+	for n := s.head.Load().next[0].Load(); n != nil; n = n.next[0].Load() {
+		versions := *n.versions.Load()
+		result = append(result, versions[len(versions)-1].entry(n.key))
+	}
+	return result
+}
+
+func (s *skiplist) Scan(start, end types.Key, fn func(types.Key, types.Value) bool) {
+	s.ScanAt(start, end, math.MaxUint64, fn)
+}
+
+func (s *skiplist) ScanAt(start, end types.Key, seq uint64, fn func(types.Key, types.Value) bool) {
+	now := time.Now().UnixNano()
+	for n := s.findGreaterOrEqual(start, nil); n != nil; n = n.next[0].Load() {
+		if end != "" && n.key >= end {
+			return
+		}
+		entry, found := n.record().at(seq, now)
+		if !found {
+			continue
+		}
+		if !fn(n.key, entry.Value) {
+			return
+		}
+	}
+}
+
+func (s *skiplist) Seq() uint64 {
+	return s.seq.Load()
+}
+
+func (s *skiplist) Retain(seq uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.retain = seq
+}
+
+func (s *skiplist) GetSize() int {
+	return int(s.count.Load())
+}
+
+func (s *skiplist) GetBytes() int64 {
+	return s.bytes.Load()
+}
+
+func (s *skiplist) IsFull() bool {
+	return s.GetSize() >= s.size || s.GetBytes() >= s.maxBytes
+}
+
+// Clear starts over with an empty list and a fresh arena; readers still on
+// the old list keep it, and the values they hold, alive until they finish.
+func (s *skiplist) Clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reset()
+}
+
+func (n *node) record() record {
+	return record{key: n.key, versions: *n.versions.Load()}
+}
+
+// arena copies values into large chunks, so a memtable makes one allocation
+// per chunk rather than one per value. Chunks are never reused: a value
+// stays valid for as long as anyone holds it.
+type arena struct {
+	chunk []byte
+}
+
+func (a *arena) copy(value types.Value) types.Value {
+	n := len(value)
+	if n > arenaChunkSize/4 {
+		return append(make(types.Value, 0, n), value...)
+	}
+	if cap(a.chunk)-len(a.chunk) < n || a.chunk == nil {
+		a.chunk = make([]byte, 0, arenaChunkSize)
+	}
+	start := len(a.chunk)
+	a.chunk = append(a.chunk, value...)
+	return a.chunk[start:len(a.chunk):len(a.chunk)]
+}
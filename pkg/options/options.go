@@ -0,0 +1,210 @@
+package options
+
+import (
+	"fmt"
+	"halo-db/pkg/constants"
+	"slices"
+	"time"
+)
+
+// Options configures a database. The zero value is not usable; start from
+// Default and override what you need.
+type Options struct {
+	NumPartitions          int           `json:"num_partitions"`
+	Router                 string        `json:"router"`
+	HashFunction           string        `json:"hash_function"`
+	VirtualNodes           int           `json:"virtual_nodes"`
+	PartitionWeights       []int         `json:"partition_weights,omitempty"`
+	RangeSplitKeys         int           `json:"range_split_keys"`
+	SplitCheckInterval     time.Duration `json:"split_check_interval"`
+	Engine                 string        `json:"engine"`
+	CompactionStyle        string        `json:"compaction_style"`
+	CompactionTrigger      int           `json:"compaction_trigger"`
+	LevelSizeBase          int64         `json:"level_size_base"`
+	LevelSizeMultiplier    int           `json:"level_size_multiplier"`
+	TargetFileSize         int64         `json:"target_file_size"`
+	CompactionWorkers      int           `json:"compaction_workers"`
+	CompactionRateLimit    int64         `json:"compaction_rate_limit"`
+	MemtableType           string        `json:"memtable_type"`
+	MemtableSize           int           `json:"memtable_size"`
+	MemtableBytes          int64         `json:"memtable_bytes"`
+	MemoryLimit            int64         `json:"memory_limit"`
+	MaxImmutableMemtables  int           `json:"max_immutable_memtables"`
+	TreeOrder              int           `json:"tree_order"`
+	PageSize               int           `json:"page_size"`
+	PageCacheSize          int           `json:"page_cache_size"`
+	BloomExpectedKeys      int           `json:"bloom_expected_keys"`
+	BloomFalsePositiveRate float64       `json:"bloom_false_positive_rate"`
+	SyncMode               string        `json:"sync_mode"`
+	SyncInterval           time.Duration `json:"sync_interval"`
+	WALSegmentSize         int64         `json:"wal_segment_size"`
+	FlushInterval          time.Duration `json:"flush_interval"`
+	TTLReapInterval        time.Duration `json:"ttl_reap_interval"`
+	TxnLockTimeout         time.Duration `json:"txn_lock_timeout"`
+}
+
+func Default() Options {
+	return Options{
+		NumPartitions:          constants.NumPartitions,
+		Router:                 constants.Router,
+		HashFunction:           constants.HashFunction,
+		VirtualNodes:           constants.VirtualNodes,
+		RangeSplitKeys:         constants.RangeSplitKeys,
+		SplitCheckInterval:     constants.SplitCheckInterval,
+		Engine:                 constants.Engine,
+		CompactionStyle:        constants.CompactionStyle,
+		CompactionTrigger:      constants.CompactionTrigger,
+		LevelSizeBase:          constants.LevelSizeBase,
+		LevelSizeMultiplier:    constants.LevelSizeMultiplier,
+		TargetFileSize:         constants.TargetFileSize,
+		CompactionWorkers:      constants.CompactionWorkers,
+		MemtableType:           constants.MemtableType,
+		MemtableSize:           constants.MemtableSize,
+		MemtableBytes:          constants.MemtableBytes,
+		MemoryLimit:            constants.MemoryLimit,
+		MaxImmutableMemtables:  constants.MaxImmutableMemtables,
+		TreeOrder:              constants.MaxKeys,
+		PageSize:               constants.PageSize,
+		PageCacheSize:          constants.PageCacheSize,
+		BloomExpectedKeys:      constants.BloomExpectedKeys,
+		BloomFalsePositiveRate: constants.BloomFalsePositiveRate,
+		SyncMode:               constants.WALSyncMode,
+		SyncInterval:           constants.WALSyncInterval,
+		WALSegmentSize:         constants.WALSegmentSize,
+		FlushInterval:          constants.FlushInterval,
+		TTLReapInterval:        constants.TTLReapInterval,
+		TxnLockTimeout:         constants.TxnLockTimeout,
+	}
+}
+
+func (o Options) Validate() error {
+	switch {
+	case o.NumPartitions <= 0:
+		return fmt.Errorf("invalid options: NumPartitions must be positive, got %d", o.NumPartitions)
+	case o.MemtableSize <= 0:
+		return fmt.Errorf("invalid options: MemtableSize must be positive, got %d", o.MemtableSize)
+	case o.MemtableBytes <= 0:
+		return fmt.Errorf("invalid options: MemtableBytes must be positive, got %d", o.MemtableBytes)
+	case o.MemoryLimit < 0:
+		return fmt.Errorf("invalid options: MemoryLimit must not be negative, got %d", o.MemoryLimit)
+	case o.MaxImmutableMemtables <= 0:
+		return fmt.Errorf("invalid options: MaxImmutableMemtables must be positive, got %d", o.MaxImmutableMemtables)
+	case o.TreeOrder < 3:
+		return fmt.Errorf("invalid options: TreeOrder must be at least 3, got %d", o.TreeOrder)
+	case o.PageSize < 512 || o.PageSize > 1<<16:
+		return fmt.Errorf("invalid options: PageSize must be between 512 and 65536, got %d", o.PageSize)
+	case o.PageCacheSize < 0:
+		return fmt.Errorf("invalid options: PageCacheSize must not be negative, got %d", o.PageCacheSize)
+	case o.BloomExpectedKeys <= 0:
+		return fmt.Errorf("invalid options: BloomExpectedKeys must be positive, got %d", o.BloomExpectedKeys)
+	case o.BloomFalsePositiveRate <= 0 || o.BloomFalsePositiveRate >= 1:
+		return fmt.Errorf("invalid options: BloomFalsePositiveRate must be in (0, 1), got %v", o.BloomFalsePositiveRate)
+	case o.SyncMode == "interval" && o.SyncInterval <= 0:
+		return fmt.Errorf("invalid options: SyncInterval must be positive in interval mode, got %v", o.SyncInterval)
+	case o.WALSegmentSize <= 0:
+		return fmt.Errorf("invalid options: WALSegmentSize must be positive, got %d", o.WALSegmentSize)
+	case o.FlushInterval <= 0:
+		return fmt.Errorf("invalid options: FlushInterval must be positive, got %v", o.FlushInterval)
+	case o.TTLReapInterval <= 0:
+		return fmt.Errorf("invalid options: TTLReapInterval must be positive, got %v", o.TTLReapInterval)
+	case o.TxnLockTimeout <= 0:
+		return fmt.Errorf("invalid options: TxnLockTimeout must be positive, got %v", o.TxnLockTimeout)
+	case o.RangeSplitKeys < 2:
+		return fmt.Errorf("invalid options: RangeSplitKeys must be at least 2, got %d", o.RangeSplitKeys)
+	case o.SplitCheckInterval <= 0:
+		return fmt.Errorf("invalid options: SplitCheckInterval must be positive, got %v", o.SplitCheckInterval)
+	case o.CompactionTrigger < 2:
+		return fmt.Errorf("invalid options: CompactionTrigger must be at least 2, got %d", o.CompactionTrigger)
+	case o.LevelSizeBase <= 0:
+		return fmt.Errorf("invalid options: LevelSizeBase must be positive, got %d", o.LevelSizeBase)
+	case o.LevelSizeMultiplier < 2:
+		return fmt.Errorf("invalid options: LevelSizeMultiplier must be at least 2, got %d", o.LevelSizeMultiplier)
+	case o.TargetFileSize <= 0:
+		return fmt.Errorf("invalid options: TargetFileSize must be positive, got %d", o.TargetFileSize)
+	case o.CompactionWorkers <= 0:
+		return fmt.Errorf("invalid options: CompactionWorkers must be positive, got %d", o.CompactionWorkers)
+	case o.CompactionRateLimit < 0:
+		return fmt.Errorf("invalid options: CompactionRateLimit must not be negative, got %d", o.CompactionRateLimit)
+	}
+
+	switch o.SyncMode {
+	case "always", "group", "interval", "none":
+	default:
+		return fmt.Errorf("invalid options: unknown sync mode %q", o.SyncMode)
+	}
+
+	switch o.Engine {
+	case "btree", "lsm":
+	default:
+		return fmt.Errorf("invalid options: unknown storage engine %q", o.Engine)
+	}
+
+	switch o.MemtableType {
+	case "skiplist", "slice":
+	default:
+		return fmt.Errorf("invalid options: unknown memtable type %q", o.MemtableType)
+	}
+
+	switch o.CompactionStyle {
+	case "leveled", "tiered":
+	default:
+		return fmt.Errorf("invalid options: unknown compaction style %q", o.CompactionStyle)
+	}
+
+	switch o.HashFunction {
+	case "md5", "fnv1a":
+	default:
+		return fmt.Errorf("invalid options: unknown hash function %q", o.HashFunction)
+	}
+
+	switch o.Router {
+	case "modulo", "range":
+		if o.PartitionWeights != nil {
+			return fmt.Errorf("invalid options: PartitionWeights needs the consistent router")
+		}
+	case "consistent":
+		if o.VirtualNodes <= 0 {
+			return fmt.Errorf("invalid options: VirtualNodes must be positive, got %d", o.VirtualNodes)
+		}
+		if o.PartitionWeights != nil && len(o.PartitionWeights) != o.NumPartitions {
+			return fmt.Errorf("invalid options: %d PartitionWeights for %d partitions", len(o.PartitionWeights), o.NumPartitions)
+		}
+		for _, weight := range o.PartitionWeights {
+			if weight <= 0 {
+				return fmt.Errorf("invalid options: PartitionWeights must be positive, got %d", weight)
+			}
+		}
+	default:
+		return fmt.Errorf("invalid options: unknown router %q", o.Router)
+	}
+	return nil
+}
+
+// CheckCompatible reports whether a database created with stored can be
+// opened with o. Only settings that decide where data lives or how it is laid
+// out on disk have to match; everything else may change between opens. Range
+// partitioned databases split on their own, so their partition count is not
+// compared.
+func (o Options) CheckCompatible(stored Options) error {
+	if o.Router != "range" && o.NumPartitions != stored.NumPartitions {
+		return fmt.Errorf("database has %d partitions, options ask for %d", stored.NumPartitions, o.NumPartitions)
+	}
+	if o.Engine != stored.Engine {
+		return fmt.Errorf("database stores data with the %s engine, options ask for %s", stored.Engine, o.Engine)
+	}
+	if o.PageSize != stored.PageSize {
+		return fmt.Errorf("database uses %d-byte pages, options ask for %d", stored.PageSize, o.PageSize)
+	}
+	if o.Router != stored.Router || o.HashFunction != stored.HashFunction {
+		return fmt.Errorf("database routes with %s/%s, options ask for %s/%s", stored.Router, stored.HashFunction, o.Router, o.HashFunction)
+	}
+	if o.Router == "consistent" {
+		if o.VirtualNodes != stored.VirtualNodes {
+			return fmt.Errorf("database uses %d virtual nodes, options ask for %d", stored.VirtualNodes, o.VirtualNodes)
+		}
+		if !slices.Equal(o.PartitionWeights, stored.PartitionWeights) {
+			return fmt.Errorf("database uses partition weights %v, options ask for %v", stored.PartitionWeights, o.PartitionWeights)
+		}
+	}
+	return nil
+}
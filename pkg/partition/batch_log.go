@@ -0,0 +1,110 @@
+package partition
+
+import (
+	"encoding/binary"
+	"fmt"
+	"halo-db/pkg/constants"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const batchLogRecordSize = 12
+
+var batchLogTable = crc32.MakeTable(crc32.Castagnoli)
+
+// batchLog is the coordinator log for batches that span partitions. A batch
+// ID is appended once every partition has prepared its part, and that record
+// is the commit decision used to resolve prepared batches after a crash.
+type batchLog struct {
+	path string
+	file *os.File
+	size int64
+	mu   sync.Mutex
+}
+
+func openBatchLog(dataDir string) (*batchLog, error) {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	path := filepath.Join(dataDir, constants.BatchLogFileName)
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open batch log: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("failed to stat batch log: %w", err)
+	}
+
+	return &batchLog{path: path, file: file, size: info.Size()}, nil
+}
+
+func (l *batchLog) committed() (map[uint64]bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	data, err := os.ReadFile(l.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read batch log: %w", err)
+	}
+
+	result := make(map[uint64]bool)
+	for len(data) >= batchLogRecordSize {
+		record := data[:batchLogRecordSize]
+		data = data[batchLogRecordSize:]
+		if crc32.Checksum(record[:8], batchLogTable) != binary.BigEndian.Uint32(record[8:]) {
+			break
+		}
+		result[binary.BigEndian.Uint64(record[:8])] = true
+	}
+	return result, nil
+}
+
+func (l *batchLog) logCommit(batchID uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	record := make([]byte, batchLogRecordSize)
+	binary.BigEndian.PutUint64(record[:8], batchID)
+	binary.BigEndian.PutUint32(record[8:], crc32.Checksum(record[:8], batchLogTable))
+
+	if _, err := l.file.Write(record); err != nil {
+		return fmt.Errorf("failed to write batch commit: %w", err)
+	}
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync batch log: %w", err)
+	}
+	l.size += batchLogRecordSize
+	return nil
+}
+
+func (l *batchLog) reset() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.file.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate batch log: %w", err)
+	}
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync batch log: %w", err)
+	}
+	l.size = 0
+	return nil
+}
+
+func (l *batchLog) getSize() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.size
+}
+
+func (l *batchLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
@@ -0,0 +1,395 @@
+package partition
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"halo-db/pkg/constants"
+	dberrors "halo-db/pkg/errors"
+	"halo-db/pkg/options"
+	"halo-db/pkg/types"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+)
+
+// Manifest format versions, each named for what it added. Older manifests
+// are upgraded to the current version on open: a version 1 manifest gets
+// its partitioning from its options, one from before version 4 the modulo
+// router over MD5 and one from before version 6 the btree engine. Missing
+// generations and key ranges read as generation 0 and hash partitioning, as
+// they were.
+const (
+	// manifestVersionLegacy is a data directory from before there was a
+	// manifest.
+	manifestVersionLegacy       = 0
+	manifestVersionOptions      = 1
+	manifestVersionPartitioning = 2
+	manifestVersionGenerations  = 3
+	manifestVersionRouters      = 4
+	manifestVersionRanges       = 5
+	manifestVersionEngines      = 6
+	manifestVersion             = manifestVersionEngines
+)
+
+// Names of the partitioning hashes: the first four bytes of the key's MD5
+// digest read big endian, and 64-bit FNV-1a mixed by the murmur3 finalizer.
+const (
+	hashMD5   = "md5-be32"
+	hashFNV1a = "fnv1a-64-fmix"
+)
+
+var ErrIncompatible = errors.New("data directory is incompatible with the options")
+
+var (
+	partitionDirPattern  = regexp.MustCompile(`^partition_(\d+)$`)
+	generationDirPattern = regexp.MustCompile(`^gen_(\d+)$`)
+)
+
+// manifest records how a data directory was created, so that a later open
+// that would route keys differently is refused instead of silently missing
+// them. Files lists the files that live as long as the database itself; WAL
+// segments come and go with checkpoints and are not tracked.
+//
+// Every resharding writes its partitions into a new generation directory;
+// generation 0 keeps its partitions directly in the data directory. A range
+// partitioned database lists its partitions in key order in Ranges; their
+// IDs, which name their directories, stay fixed as partitions split.
+type manifest struct {
+	FormatVersion int             `json:"format_version"`
+	NumPartitions int             `json:"num_partitions"`
+	HashFunction  string          `json:"hash_function"`
+	Generation    int             `json:"generation"`
+	Options       options.Options `json:"options"`
+	Files         []string        `json:"files"`
+	Resharding    *reshardState   `json:"resharding,omitempty"`
+	Ranges        []keyRange      `json:"ranges,omitempty"`
+}
+
+// keyRange is a partition that owns the keys from Start up to the Start of
+// the next range.
+type keyRange struct {
+	ID    int    `json:"id"`
+	Start []byte `json:"start"`
+}
+
+// reshardState is the progress of a resharding. Every key below NextKey has
+// been copied into the target generation.
+type reshardState struct {
+	NumPartitions int    `json:"num_partitions"`
+	Generation    int    `json:"generation"`
+	NextKey       []byte `json:"next_key"`
+}
+
+func manifestPath(dataDir string) string {
+	return filepath.Join(dataDir, constants.ManifestFileName)
+}
+
+func generationDirName(generation int) string {
+	if generation == 0 {
+		return ""
+	}
+	return fmt.Sprintf("gen_%d", generation)
+}
+
+func partitionDirName(generation, id int) string {
+	return filepath.Join(generationDirName(generation), fmt.Sprintf("partition_%d", id))
+}
+
+func partitionDir(dataDir string, generation, id int) string {
+	return filepath.Join(dataDir, partitionDirName(generation, id))
+}
+
+// loadManifest reads the manifest in dataDir, upgrading older formats, and
+// checks that opts can open the directory. A directory without a manifest
+// or any partitions is new and gets a fresh manifest.
+func loadManifest(dataDir string, opts options.Options) (*manifest, error) {
+	m, err := readManifest(dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	if m == nil {
+		if m, err = legacyManifest(dataDir, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	if m.FormatVersion > manifestVersion {
+		return nil, fmt.Errorf("%w: manifest format version %d is newer than the supported version %d", ErrIncompatible, m.FormatVersion, manifestVersion)
+	}
+	if m.FormatVersion == manifestVersionOptions {
+		m.NumPartitions = m.Options.NumPartitions
+		m.HashFunction = hashMD5
+	}
+	if m.FormatVersion < manifestVersionRouters {
+		m.Options.Router = "modulo"
+		m.Options.HashFunction = "md5"
+	}
+	if m.FormatVersion < manifestVersionEngines {
+		m.Options.Engine = "btree"
+	}
+	if m.Resharding != nil && m.Resharding.Generation <= m.Generation {
+		return nil, fmt.Errorf("%w: resharding target generation %d is not after generation %d", dberrors.ErrCorrupted, m.Resharding.Generation, m.Generation)
+	}
+
+	if m.HashFunction != hashMD5 && m.HashFunction != hashFNV1a {
+		return nil, fmt.Errorf("%w: unknown hash function %q", ErrIncompatible, m.HashFunction)
+	}
+	if m.FormatVersion == manifestVersionLegacy && opts.Router != "modulo" {
+		return nil, fmt.Errorf("%w: database routes with the modulo router, options ask for %s", ErrIncompatible, opts.Router)
+	}
+	if m.FormatVersion == manifestVersionLegacy && opts.Engine != "btree" {
+		return nil, fmt.Errorf("%w: database stores data with the btree engine, options ask for %s", ErrIncompatible, opts.Engine)
+	}
+	if id := routingHashes[opts.HashFunction].id; m.HashFunction != id {
+		return nil, fmt.Errorf("%w: database hashes keys with %s, options ask for %s", ErrIncompatible, m.HashFunction, id)
+	}
+	if m.Ranges != nil {
+		if len(m.Ranges) != m.NumPartitions || len(m.Ranges[0].Start) != 0 {
+			return nil, fmt.Errorf("%w: manifest has %d key ranges for %d partitions", dberrors.ErrCorrupted, len(m.Ranges), m.NumPartitions)
+		}
+		for i := 1; i < len(m.Ranges); i++ {
+			if string(m.Ranges[i].Start) <= string(m.Ranges[i-1].Start) {
+				return nil, fmt.Errorf("%w: manifest key ranges are out of order", dberrors.ErrCorrupted)
+			}
+		}
+		opts.NumPartitions = m.NumPartitions
+	} else if m.NumPartitions != opts.NumPartitions {
+		return nil, fmt.Errorf("%w: database has %d partitions, options ask for %d", ErrIncompatible, m.NumPartitions, opts.NumPartitions)
+	}
+	if m.FormatVersion != manifestVersionLegacy {
+		if err := opts.CheckCompatible(m.Options); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrIncompatible, err)
+		}
+	}
+
+	for _, name := range m.Files {
+		if _, err := os.Stat(filepath.Join(dataDir, name)); err != nil {
+			return nil, fmt.Errorf("%w: manifest lists %s, which cannot be opened: %v", dberrors.ErrCorrupted, name, err)
+		}
+	}
+
+	m.FormatVersion = manifestVersion
+	m.Options = opts
+	return m, nil
+}
+
+// legacyManifest describes a data directory that has no manifest. Its
+// partition count is taken from the partition directories it contains.
+func legacyManifest(dataDir string, opts options.Options) (*manifest, error) {
+	entries, err := os.ReadDir(dataDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read data directory: %w", err)
+	}
+
+	ids := make(map[int]bool)
+	for _, entry := range entries {
+		var id int
+		if !entry.IsDir() {
+			continue
+		}
+		if generationDirPattern.MatchString(entry.Name()) {
+			return nil, fmt.Errorf("%w: data directory has partition generations but no manifest", dberrors.ErrCorrupted)
+		}
+		if match := partitionDirPattern.FindStringSubmatch(entry.Name()); match != nil {
+			_, _ = fmt.Sscan(match[1], &id)
+			ids[id] = true
+		}
+	}
+
+	if len(ids) == 0 {
+		m := &manifest{
+			FormatVersion: manifestVersion,
+			NumPartitions: opts.NumPartitions,
+			HashFunction:  routingHashes[opts.HashFunction].id,
+			Options:       opts,
+		}
+		if opts.Router == "range" {
+			m.NumPartitions = 1
+			m.Options.NumPartitions = 1
+			m.Ranges = []keyRange{{ID: 0}}
+		}
+		return m, nil
+	}
+
+	for id := 0; id < len(ids); id++ {
+		if !ids[id] {
+			return nil, fmt.Errorf("%w: partition directories are not numbered 0 to %d", dberrors.ErrCorrupted, len(ids)-1)
+		}
+	}
+	return &manifest{
+		FormatVersion: manifestVersionLegacy,
+		NumPartitions: len(ids),
+		HashFunction:  hashMD5,
+	}, nil
+}
+
+// readManifest returns nil if the data directory has no manifest yet.
+func readManifest(dataDir string) (*manifest, error) {
+	data, err := os.ReadFile(manifestPath(dataDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("%w: bad manifest: %v", dberrors.ErrCorrupted, err)
+	}
+	if m.FormatVersion == manifestVersionLegacy {
+		m.FormatVersion = manifestVersionOptions
+	}
+	return &m, nil
+}
+
+// writeManifest replaces the manifest atomically, so a crash leaves either
+// the old or the new one in place.
+func writeManifest(dataDir string, m *manifest) error {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+
+	path := manifestPath(dataDir)
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create manifest: %w", err)
+	}
+	if _, err := file.Write(data); err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to sync manifest: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close manifest: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to replace manifest: %w", err)
+	}
+	return syncDir(dataDir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory: %w", err)
+	}
+	defer func() { _ = d.Close() }()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory: %w", err)
+	}
+	return nil
+}
+
+// partitionIDs returns the IDs of the current partitions in routing order.
+func (m *manifest) partitionIDs() []int {
+	ids := make([]int, 0, m.NumPartitions)
+	if m.Ranges != nil {
+		for _, r := range m.Ranges {
+			ids = append(ids, r.ID)
+		}
+		return ids
+	}
+	for id := 0; id < m.NumPartitions; id++ {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// splitPoints returns the start keys of every range but the first.
+func (m *manifest) splitPoints() []types.Key {
+	points := make([]types.Key, 0, len(m.Ranges))
+	for _, r := range m.Ranges[1:] {
+		points = append(points, types.Key(r.Start))
+	}
+	return points
+}
+
+// livePartitions maps each generation in use to the IDs of its partitions.
+func (m *manifest) livePartitions() map[int][]int {
+	live := map[int][]int{m.Generation: m.partitionIDs()}
+	if m.Resharding != nil {
+		ids := make([]int, m.Resharding.NumPartitions)
+		for id := range ids {
+			ids[id] = id
+		}
+		live[m.Resharding.Generation] = ids
+	}
+	return live
+}
+
+// liveFiles lists the files, relative to the data directory, that exist for
+// as long as the partitions the manifest describes do.
+func (m *manifest) liveFiles() []string {
+	storage := constants.TreeFileName
+	if m.Options.Engine == "lsm" {
+		storage = constants.TableManifestFileName
+	}
+
+	files := []string{constants.BatchLogFileName}
+	for generation, ids := range m.livePartitions() {
+		for _, id := range ids {
+			dir := partitionDirName(generation, id)
+			files = append(files, filepath.Join(dir, constants.WALFileName), filepath.Join(dir, storage))
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+// removeStalePartitions deletes partition directories the manifest does not
+// list. They are left behind when a crash interrupts the cleanup after a
+// resharding, or a range split before it was recorded.
+func removeStalePartitions(dataDir string, m *manifest) error {
+	live := m.livePartitions()
+
+	removeStale := func(dir string, generation int) error {
+		entries, err := os.ReadDir(dir)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to read data directory: %w", err)
+		}
+		for _, entry := range entries {
+			var stale bool
+			if match := generationDirPattern.FindStringSubmatch(entry.Name()); match != nil && generation == 0 {
+				var gen int
+				_, _ = fmt.Sscan(match[1], &gen)
+				stale = live[gen] == nil
+			} else if match := partitionDirPattern.FindStringSubmatch(entry.Name()); match != nil {
+				var id int
+				_, _ = fmt.Sscan(match[1], &id)
+				stale = !slices.Contains(live[generation], id)
+			}
+			if stale && entry.IsDir() {
+				if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+					return fmt.Errorf("failed to remove stale partition directory: %w", err)
+				}
+			}
+		}
+		return nil
+	}
+
+	if err := removeStale(dataDir, 0); err != nil {
+		return err
+	}
+	for generation := range live {
+		if generation != 0 {
+			if err := removeStale(filepath.Join(dataDir, generationDirName(generation)), generation); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -1,31 +1,54 @@
 package partition
 
 import (
-	"fmt"
+	"halo-db/pkg/batch"
+	"halo-db/pkg/iterator"
+	"halo-db/pkg/options"
 	"halo-db/pkg/store"
 	"halo-db/pkg/types"
-	"sync"
+	"time"
 )
 
 type Partition interface {
 	Put(key types.Key, value types.Value) error
+	PutWithTTL(key types.Key, value types.Value, ttl time.Duration) error
+	PutWithExpiry(key types.Key, value types.Value, expiresAt int64) error
 	Get(key types.Key) (types.Value, error)
+	GetWithExpiry(key types.Key) (types.Value, int64, error)
 	Delete(key types.Key) error
+	Write(b *batch.WriteBatch) error
+	Prepare(batchID uint64, b *batch.WriteBatch) error
+	CommitPrepared(batchID uint64) error
+	AbortPrepared(batchID uint64) error
+	PreparedBatches() []uint64
 	List() []types.Key
+	Scan(start, end types.Key) iterator.Iterator
+	ScanPrefix(prefix types.Key) iterator.Iterator
+	Snapshot() store.Snapshot
+	Sync() error
 	Clear() error
 	Close() error
+	GetStats() map[string]interface{}
 	GetID() int
 }
 
+// partition passes calls straight through to its store, which does its own
+// locking.
 type partition struct {
 	ID    int
 	store store.Store
-	mu    sync.RWMutex
 }
 
 func NewPartition(id int, dataDir string) (Partition, error) {
-	partitionDataDir := fmt.Sprintf("%s/partition_%d", dataDir, id)
-	st, err := store.NewStore(partitionDataDir)
+	return NewPartitionWithOptions(id, dataDir, options.Default())
+}
+
+func NewPartitionWithOptions(id int, dataDir string, opts options.Options) (Partition, error) {
+	return openPartition(id, partitionDir(dataDir, 0, id), opts, store.NewMemoryBudget(opts.MemoryLimit))
+}
+
+func openPartition(id int, dir string, opts options.Options, memory store.MemoryBudget) (Partition, error) {
+	st, err := store.NewStoreWithMemory(dir, opts, memory)
 	if err != nil {
 		return nil, err
 	}
@@ -37,32 +60,70 @@ func NewPartition(id int, dataDir string) (Partition, error) {
 }
 
 func (p *partition) Put(key types.Key, value types.Value) error {
-	p.mu.Lock()
-	defer p.mu.Unlock()
 	return p.store.Put(key, value)
 }
 
+func (p *partition) PutWithTTL(key types.Key, value types.Value, ttl time.Duration) error {
+	return p.store.PutWithTTL(key, value, ttl)
+}
+
+func (p *partition) PutWithExpiry(key types.Key, value types.Value, expiresAt int64) error {
+	return p.store.PutWithExpiry(key, value, expiresAt)
+}
+
 func (p *partition) Get(key types.Key) (types.Value, error) {
-	p.mu.RLock()
-	defer p.mu.RUnlock()
 	return p.store.Get(key)
 }
 
+func (p *partition) GetWithExpiry(key types.Key) (types.Value, int64, error) {
+	return p.store.GetWithExpiry(key)
+}
+
 func (p *partition) Delete(key types.Key) error {
-	p.mu.Lock()
-	defer p.mu.Unlock()
 	return p.store.Delete(key)
 }
 
+func (p *partition) Write(b *batch.WriteBatch) error {
+	return p.store.Write(b)
+}
+
+func (p *partition) Prepare(batchID uint64, b *batch.WriteBatch) error {
+	return p.store.Prepare(batchID, b)
+}
+
+func (p *partition) CommitPrepared(batchID uint64) error {
+	return p.store.CommitPrepared(batchID)
+}
+
+func (p *partition) AbortPrepared(batchID uint64) error {
+	return p.store.AbortPrepared(batchID)
+}
+
+func (p *partition) PreparedBatches() []uint64 {
+	return p.store.PreparedBatches()
+}
+
 func (p *partition) List() []types.Key {
-	p.mu.RLock()
-	defer p.mu.RUnlock()
 	return p.store.List()
 }
 
+func (p *partition) Scan(start, end types.Key) iterator.Iterator {
+	return p.store.Scan(start, end)
+}
+
+func (p *partition) ScanPrefix(prefix types.Key) iterator.Iterator {
+	return p.store.ScanPrefix(prefix)
+}
+
+func (p *partition) Snapshot() store.Snapshot {
+	return p.store.Snapshot()
+}
+
+func (p *partition) Sync() error {
+	return p.store.Sync()
+}
+
 func (p *partition) Clear() error {
-	p.mu.Lock()
-	defer p.mu.Unlock()
 	return p.store.Clear()
 }
 
@@ -70,6 +131,10 @@ func (p *partition) Close() error {
 	return p.store.Close()
 }
 
+func (p *partition) GetStats() map[string]interface{} {
+	return p.store.GetStats()
+}
+
 func (p *partition) GetID() int {
 	return p.ID
 }
@@ -29,6 +29,10 @@ func TestCrashRecovery(t *testing.T) {
 	t.Run("PartialWALCorruption", func(t *testing.T) {
 		testPartialWALCorruption(t, dataDir)
 	})
+
+	t.Run("RecoveryFromTreeFile", func(t *testing.T) {
+		testRecoveryFromTreeFile(t, dataDir)
+	})
 }
 
 func testCrashDuringWALWrite(t *testing.T, baseDataDir string) {
@@ -275,6 +279,61 @@ func testPartialWALCorruption(t *testing.T, baseDataDir string) {
 	}
 }
 
+func testRecoveryFromTreeFile(t *testing.T, baseDataDir string) {
+	dataDir := filepath.Join(baseDataDir, "tree_recovery")
+	_ = os.RemoveAll(dataDir)
+
+	pm, err := NewPartitionManager(1, dataDir)
+	if err != nil {
+		t.Fatalf("Failed to create partition manager: %v", err)
+	}
+
+	numKeys := 1000
+	for i := 0; i < numKeys; i++ {
+		key := types.Key(fmt.Sprintf("tree_key_%d", i))
+		if err := pm.Put(key, types.Value(fmt.Sprintf("tree_value_%d", i))); err != nil {
+			t.Fatalf("Failed to put key %s: %v", key, err)
+		}
+	}
+
+	_ = pm.Close()
+
+	segments, err := filepath.Glob(filepath.Join(dataDir, "partition_0", "wal-*.log"))
+	if err != nil {
+		t.Fatalf("Failed to list WAL segments: %v", err)
+	}
+	if len(segments) != 0 {
+		t.Errorf("Expected checkpointed WAL segments to be removed, found %v", segments)
+	}
+	walInfo, err := os.Stat(filepath.Join(dataDir, "partition_0", "wal.log"))
+	if err != nil {
+		t.Fatalf("Failed to stat WAL: %v", err)
+	}
+	if walInfo.Size() > 1024 {
+		t.Errorf("Expected only a checkpoint record in the WAL after flush, got size %d", walInfo.Size())
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, "partition_0", "tree.db")); err != nil {
+		t.Fatalf("Expected tree file to exist: %v", err)
+	}
+
+	pm2, err := NewPartitionManager(1, dataDir)
+	if err != nil {
+		t.Fatalf("Failed to create new partition manager: %v", err)
+	}
+	defer func() { _ = pm2.Close() }()
+
+	for i := 0; i < numKeys; i++ {
+		key := types.Key(fmt.Sprintf("tree_key_%d", i))
+		value, err := pm2.Get(key)
+		if err != nil {
+			t.Fatalf("Failed to recover key %s from tree file: %v", key, err)
+		}
+		if string(value) != fmt.Sprintf("tree_value_%d", i) {
+			t.Errorf("Recovered value mismatch for key %s: got %s", key, value)
+		}
+	}
+}
+
 func TestConcurrentCrashRecovery(t *testing.T) {
 	dataDir := "test_data_concurrent_crash"
 	_ = os.RemoveAll(dataDir)
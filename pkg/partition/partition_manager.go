@@ -1,70 +1,481 @@
 package partition
 
 import (
-	"crypto/md5"
-	"encoding/binary"
+	"fmt"
+	"halo-db/pkg/batch"
+	"halo-db/pkg/constants"
+	dberrors "halo-db/pkg/errors"
+	"halo-db/pkg/iterator"
+	"halo-db/pkg/options"
+	"halo-db/pkg/store"
 	"halo-db/pkg/types"
+	"slices"
+	"sort"
 	"sync"
+	"time"
 )
 
 type PartitionManager interface {
 	Put(key types.Key, value types.Value) error
+	PutWithTTL(key types.Key, value types.Value, ttl time.Duration) error
 	Get(key types.Key) (types.Value, error)
 	Delete(key types.Key) error
+	Write(b *batch.WriteBatch) error
 	List() []types.Key
+	Scan(start, end types.Key) iterator.Iterator
+	ScanPrefix(prefix types.Key) iterator.Iterator
+	Snapshot() store.Snapshot
+	Begin() Txn
+	BeginPessimistic() Txn
 	Clear() error
 	Close() error
 	GetStats() map[string]interface{}
 	GetPartition(key types.Key) Partition
+	Reshard(numPartitions int) error
 }
 
 type partitionManager struct {
-	partitions []Partition
-	numParts   int
+	partitions  []Partition
+	router      Router
+	opts        options.Options
+	memory      store.MemoryBudget
+	dataDir     string
+	manifest    *manifest
+	migration   *migration
+	splitting   *split
+	splitStop   chan struct{}
+	splitDone   chan struct{}
+	dirty       map[int]struct{}
+	dirtyMu     sync.Mutex
+	batchLog    *batchLog
+	batchMu     sync.Mutex
+	lastBatchID uint64
+	// unresolved holds the partitions that failed to apply each committed
+	// batch. The batch log keeps its decisions until they are retried.
+	unresolved map[uint64][]Partition
+	txns       *txnTracker
+	locks      *lockTable
+	closed     bool
 	mu         sync.RWMutex
 }
 
 func NewPartitionManager(numPartitions int, dataDir string) (PartitionManager, error) {
+	opts := options.Default()
+	opts.NumPartitions = numPartitions
+	return NewPartitionManagerWithOptions(dataDir, opts)
+}
+
+func NewPartitionManagerWithOptions(dataDir string, opts options.Options) (PartitionManager, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	m, err := loadManifest(dataDir, opts)
+	if err != nil {
+		return nil, err
+	}
+	opts = m.Options
+
+	bLog, err := openBatchLog(dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := removeStalePartitions(dataDir, m); err != nil {
+		return nil, err
+	}
+
 	pm := &partitionManager{
-		partitions: make([]Partition, numPartitions),
-		numParts:   numPartitions,
+		opts:       opts,
+		memory:     store.NewMemoryBudget(opts.MemoryLimit),
+		dataDir:    dataDir,
+		manifest:   m,
+		batchLog:   bLog,
+		txns:       newTxnTracker(),
+		locks:      newLockTable(opts.TxnLockTimeout),
+		dirty:      make(map[int]struct{}),
+		unresolved: make(map[uint64][]Partition),
 	}
 
-	for i := 0; i < numPartitions; i++ {
-		pt, err := NewPartition(i, dataDir)
+	if m.Ranges != nil {
+		pm.router = NewRangeRouter(m.splitPoints())
+	} else if pm.router, err = NewRouter(opts); err != nil {
+		return nil, err
+	}
+	pm.partitions, err = openPartitions(dataDir, m.Generation, m.partitionIDs(), opts, pm.memory)
+	if err != nil {
+		return nil, err
+	}
+	if m.Resharding != nil {
+		router, err := NewRouter(reshardOptions(opts, m.Resharding.NumPartitions))
 		if err != nil {
 			return nil, err
 		}
-		pm.partitions[i] = pt
+		targets, err := openPartitions(dataDir, m.Resharding.Generation, m.livePartitions()[m.Resharding.Generation], opts, pm.memory)
+		if err != nil {
+			return nil, err
+		}
+		pm.migration = &migration{
+			partitions: targets,
+			router:     router,
+			generation: m.Resharding.Generation,
+			next:       types.Key(m.Resharding.NextKey),
+		}
 	}
 
+	if err := pm.recoverBatches(); err != nil {
+		return nil, err
+	}
+	if err := pm.trimRanges(); err != nil {
+		return nil, err
+	}
+
+	m.Files = m.liveFiles()
+	if err := writeManifest(dataDir, m); err != nil {
+		return nil, err
+	}
+
+	if pm.migration != nil {
+		pm.startMigration()
+	}
+	if m.Ranges != nil {
+		pm.startSplitter()
+	}
 	return pm, nil
 }
 
+func openPartitions(dataDir string, generation int, ids []int, opts options.Options, memory store.MemoryBudget) ([]Partition, error) {
+	partitions := make([]Partition, len(ids))
+	for i, id := range ids {
+		pt, err := openPartition(id, partitionDir(dataDir, generation, id), opts, memory)
+		if err != nil {
+			for _, opened := range partitions[:i] {
+				_ = opened.Close()
+			}
+			return nil, err
+		}
+		partitions[i] = pt
+	}
+	return partitions, nil
+}
+
 func (pm *partitionManager) GetPartition(key types.Key) Partition {
-	hash := hashKey(key)
-	partitionID := hash % uint32(pm.numParts)
-	return pm.partitions[partitionID]
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	return pm.partitionFor(key)
+}
+
+// partitionFor is GetPartition for callers that already hold mu.
+func (pm *partitionManager) partitionFor(key types.Key) Partition {
+	return pm.partitions[pm.router.Route(key)]
 }
 
 func (pm *partitionManager) Put(key types.Key, value types.Value) error {
-	pt := pm.GetPartition(key)
-	return pt.Put(key, value)
+	return pm.writeKey(key, func(pt Partition) error {
+		return pt.Put(key, value)
+	})
+}
+
+func (pm *partitionManager) PutWithTTL(key types.Key, value types.Value, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("TTL must be positive, got %v", ttl)
+	}
+	expiresAt := time.Now().Add(ttl).UnixNano()
+	return pm.writeKey(key, func(pt Partition) error {
+		return pt.PutWithExpiry(key, value, expiresAt)
+	})
 }
 
 func (pm *partitionManager) Get(key types.Key) (types.Value, error) {
-	pt := pm.GetPartition(key)
-	return pt.Get(key)
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	return pm.partitionFor(key).Get(key)
 }
 
 func (pm *partitionManager) Delete(key types.Key) error {
-	pt := pm.GetPartition(key)
-	return pt.Delete(key)
+	return pm.writeKey(key, func(pt Partition) error {
+		return pt.Delete(key)
+	})
+}
+
+// writeKey applies a single-key write. While a resharding or split is
+// running the write also goes to the partition the key will live in
+// afterwards, so keys the copier has already passed stay current.
+func (pm *partitionManager) writeKey(key types.Key, write func(Partition) error) error {
+	pm.txns.mu.RLock()
+	defer pm.txns.mu.RUnlock()
+
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	if pm.migration != nil {
+		if err := write(pm.migration.partitionFor(key)); err != nil {
+			return err
+		}
+	}
+	if sp := pm.splitting; sp != nil && sp.covers(key) {
+		sp.mu.RLock()
+		defer sp.mu.RUnlock()
+		if err := write(sp.upper); err != nil {
+			return err
+		}
+	}
+	pt := pm.partitionFor(key)
+	if err := write(pt); err != nil {
+		return err
+	}
+	pm.markWritten(pt)
+	pm.txns.recordWrites(key)
+	return nil
+}
+
+// Write applies every operation in b atomically. A batch that touches one
+// partition is a single WAL group there; otherwise each partition prepares
+// its part, the decision is logged in the batch log and only then are the
+// parts committed, so after a crash either all partitions apply the batch or
+// none do.
+func (pm *partitionManager) Write(b *batch.WriteBatch) error {
+	pm.txns.mu.RLock()
+	defer pm.txns.mu.RUnlock()
+
+	if err := pm.writeBatch(b); err != nil {
+		return err
+	}
+	pm.txns.recordWrites(batchKeys(b)...)
+	return nil
+}
+
+func (pm *partitionManager) writeBatch(b *batch.WriteBatch) error {
+	if b.Len() == 0 {
+		return nil
+	}
+
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	// While a resharding or split is running the batch also goes to the
+	// partitions its keys will live in afterwards, under the same commit
+	// decision, so a crash cannot leave it applied on one side only.
+	var parts []batchPart
+	if pm.migration != nil {
+		parts = splitBatch(pm.migration.partitions, pm.migration.router, b)
+	}
+	if sp := pm.splitting; sp != nil {
+		if sub := sp.moving(b); sub != nil {
+			sp.mu.RLock()
+			defer sp.mu.RUnlock()
+			parts = append(parts, batchPart{pt: sp.upper, ops: sub})
+		}
+	}
+	parts = append(parts, splitBatch(pm.partitions, pm.router, b)...)
+
+	var err error
+	if len(parts) == 1 {
+		err = parts[0].pt.Write(parts[0].ops)
+	} else {
+		err = pm.writeAcrossPartitions(parts)
+	}
+	if err != nil {
+		return err
+	}
+	for _, op := range b.Ops() {
+		pm.markWritten(pm.partitionFor(op.Key))
+	}
+	return nil
+}
+
+// batchPart is the share of a batch that goes to one partition.
+type batchPart struct {
+	pt  Partition
+	ops *batch.WriteBatch
+}
+
+// splitBatch groups the operations of b by the partition router sends them
+// to, in partition order.
+func splitBatch(partitions []Partition, router Router, b *batch.WriteBatch) []batchPart {
+	groups := make(map[int]*batch.WriteBatch)
+	for _, op := range b.Ops() {
+		id := router.Route(op.Key)
+		sub, exists := groups[id]
+		if !exists {
+			sub = batch.NewWriteBatch()
+			groups[id] = sub
+		}
+		if op.Type == batch.OpDelete {
+			sub.Delete(op.Key)
+		} else {
+			sub.Put(op.Key, op.Value)
+		}
+	}
+
+	ids := make([]int, 0, len(groups))
+	for id := range groups {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	parts := make([]batchPart, len(ids))
+	for i, id := range ids {
+		parts[i] = batchPart{pt: partitions[id], ops: groups[id]}
+	}
+	return parts
+}
+
+func (pm *partitionManager) writeAcrossPartitions(parts []batchPart) error {
+	pm.batchMu.Lock()
+	defer pm.batchMu.Unlock()
+
+	// A batch that still fails was reported when it was written; this one
+	// goes ahead regardless.
+	_ = pm.retryUnresolved()
+
+	batchID := pm.nextBatchID()
+	prepared := make([]Partition, 0, len(parts))
+
+	abort := func() {
+		for _, pt := range prepared {
+			_ = pt.AbortPrepared(batchID)
+		}
+	}
+
+	for _, part := range parts {
+		if err := part.pt.Prepare(batchID, part.ops); err != nil {
+			abort()
+			return fmt.Errorf("failed to prepare batch on partition %d: %w", part.pt.GetID(), err)
+		}
+		prepared = append(prepared, part.pt)
+	}
+
+	if err := pm.batchLog.logCommit(batchID); err != nil {
+		abort()
+		return err
+	}
+
+	if err := pm.commitPrepared(batchID, prepared); err != nil {
+		return err
+	}
+
+	if len(pm.unresolved) == 0 && pm.batchLog.getSize() >= constants.BatchLogResetSize {
+		return pm.resetBatchLog()
+	}
+	return nil
+}
+
+// commitPrepared applies a committed batch on each of partitions. Those that
+// fail are kept in unresolved, to be retried by retryUnresolved.
+func (pm *partitionManager) commitPrepared(batchID uint64, partitions []Partition) error {
+	var failed []Partition
+	var firstErr error
+	for _, pt := range partitions {
+		if err := pt.CommitPrepared(batchID); err != nil {
+			failed = append(failed, pt)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("batch committed but partition %d failed to apply it: %w", pt.GetID(), err)
+			}
+		}
+	}
+	if len(failed) > 0 {
+		pm.unresolved[batchID] = failed
+	} else {
+		delete(pm.unresolved, batchID)
+	}
+	return firstErr
+}
+
+// retryUnresolved applies again the committed batches that partitions failed
+// to apply. It must be called with batchMu held.
+func (pm *partitionManager) retryUnresolved() error {
+	var firstErr error
+	for batchID, partitions := range pm.unresolved {
+		if err := pm.commitPrepared(batchID, partitions); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// resetBatchLog empties the batch log once the commit records it stands
+// for are durable in the partitions. Unless they fsync every write, those
+// records may still be in the page cache, and a partition that lost one
+// would abort its part of the batch on recovery with no decision left to
+// tell it otherwise.
+func (pm *partitionManager) resetBatchLog() error {
+	for _, pt := range pm.allPartitions() {
+		if err := pt.Sync(); err != nil {
+			return fmt.Errorf("failed to sync partition %d before resetting the batch log: %w", pt.GetID(), err)
+		}
+	}
+	return pm.batchLog.reset()
+}
+
+func (pm *partitionManager) nextBatchID() uint64 {
+	id := uint64(time.Now().UnixNano())
+	if id <= pm.lastBatchID {
+		id = pm.lastBatchID + 1
+	}
+	pm.lastBatchID = id
+	return id
+}
+
+func (pm *partitionManager) recoverBatches() error {
+	committed, err := pm.batchLog.committed()
+	if err != nil {
+		return err
+	}
+
+	for _, pt := range pm.allPartitions() {
+		for _, batchID := range pt.PreparedBatches() {
+			if batchID > pm.lastBatchID {
+				pm.lastBatchID = batchID
+			}
+			if committed[batchID] {
+				err = pt.CommitPrepared(batchID)
+			} else {
+				err = pt.AbortPrepared(batchID)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to resolve batch %d on partition %d: %w", batchID, pt.GetID(), err)
+			}
+		}
+	}
+
+	return pm.resetBatchLog()
+}
+
+// allPartitions returns the partitions in use, including the targets of a
+// resharding or split in progress.
+func (pm *partitionManager) allPartitions() []Partition {
+	if pm.migration == nil && pm.splitting == nil {
+		return pm.partitions
+	}
+	all := slices.Clone(pm.partitions)
+	if pm.migration != nil {
+		all = append(all, pm.migration.partitions...)
+	}
+	if pm.splitting != nil {
+		all = append(all, pm.splitting.upper)
+	}
+	return all
 }
 
 func (pm *partitionManager) List() []types.Key {
 	pm.mu.RLock()
 	defer pm.mu.RUnlock()
+	return pm.listLocked()
+}
+
+// listLocked returns every key. Range partitions are listed through a scan,
+// which returns the keys in order.
+func (pm *partitionManager) listLocked() []types.Key {
+	if _, ordered := pm.router.(*rangeRouter); ordered {
+		it := pm.scanLocked("", "")
+		defer func() { _ = it.Close() }()
+
+		keys := make([]types.Key, 0)
+		for ; it.Valid(); it.Next() {
+			keys = append(keys, it.Key())
+		}
+		return keys
+	}
 
 	allKeys := make(map[types.Key]bool)
 
@@ -82,26 +493,84 @@ func (pm *partitionManager) List() []types.Key {
 	return result
 }
 
+func (pm *partitionManager) Scan(start, end types.Key) iterator.Iterator {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	return pm.scanLocked(start, end)
+}
+
+// scanLocked merges scans of every partition. Range partitions are only
+// scanned if they overlap [start, end), and only over the part they own, so
+// keys left behind by an unfinished split never show up.
+func (pm *partitionManager) scanLocked(start, end types.Key) iterator.Iterator {
+	ranges, ordered := pm.router.(*rangeRouter)
+
+	iters := make([]iterator.Iterator, 0, len(pm.partitions))
+	for pos, pt := range pm.partitions {
+		if !ordered {
+			iters = append(iters, pt.Scan(start, end))
+		} else if from, to, overlaps := ranges.clip(pos, start, end); overlaps {
+			iters = append(iters, pt.Scan(from, to))
+		}
+	}
+	return iterator.NewMergeIterator(iters...)
+}
+
+func (pm *partitionManager) ScanPrefix(prefix types.Key) iterator.Iterator {
+	return pm.Scan(prefix, iterator.PrefixEnd(prefix))
+}
+
 func (pm *partitionManager) Clear() error {
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
 
-	for _, pt := range pm.partitions {
+	if pm.closed {
+		return dberrors.ErrClosed
+	}
+
+	for _, pt := range pm.allPartitions() {
 		if err := pt.Clear(); err != nil {
 			return err
 		}
 	}
 
-	return nil
+	// Cleared partitions hold nothing prepared to retry.
+	pm.batchMu.Lock()
+	defer pm.batchMu.Unlock()
+	pm.unresolved = make(map[uint64][]Partition)
+	return pm.batchLog.reset()
 }
 
+// Close stops a running resharding, which resumes from its last recorded
+// position the next time the data directory is opened.
 func (pm *partitionManager) Close() error {
-	for _, pt := range pm.partitions {
+	pm.mu.Lock()
+	if pm.closed {
+		pm.mu.Unlock()
+		return dberrors.ErrClosed
+	}
+	pm.closed = true
+	m := pm.migration
+	pm.mu.Unlock()
+
+	if m != nil {
+		close(m.stop)
+		<-m.done
+	}
+	if pm.splitStop != nil {
+		close(pm.splitStop)
+		<-pm.splitDone
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	for _, pt := range pm.allPartitions() {
 		if err := pt.Close(); err != nil {
 			return err
 		}
 	}
-	return nil
+	return pm.batchLog.close()
 }
 
 func (pm *partitionManager) GetStats() map[string]interface{} {
@@ -109,20 +578,50 @@ func (pm *partitionManager) GetStats() map[string]interface{} {
 	defer pm.mu.RUnlock()
 
 	totalKeys := 0
-
-	for _, pt := range pm.partitions {
-		totalKeys += len(pt.List())
+	if _, ordered := pm.router.(*rangeRouter); ordered {
+		totalKeys = len(pm.listLocked())
+	} else {
+		for _, pt := range pm.partitions {
+			totalKeys += len(pt.List())
+		}
 	}
 
-	return map[string]interface{}{
+	stats := map[string]interface{}{
 		"total_keys":     totalKeys,
-		"num_partitions": pm.numParts,
+		"num_partitions": len(pm.partitions),
 		"bloom_filter":   "enabled",
 		"partitioning":   "enabled",
+		"router":         pm.opts.Router,
+		"engine":         pm.opts.Engine,
 	}
-}
-
-func hashKey(key types.Key) uint32 {
-	hash := md5.Sum([]byte(key))
-	return binary.BigEndian.Uint32(hash[:4])
+	var immutables int
+	var stalls uint64
+	var pending, flushed, compacted int64
+	for _, pt := range pm.partitions {
+		ptStats := pt.GetStats()
+		immutables += ptStats["immutable_memtables"].(int)
+		stalls += ptStats["write_stalls"].(uint64)
+		if tables, ok := ptStats["lsm"].(map[string]interface{}); ok {
+			pending += tables["pending_compaction_bytes"].(int64)
+			flushed += tables["flushed_bytes"].(int64)
+			compacted += tables["compaction_bytes_written"].(int64)
+		}
+	}
+	stats["immutable_memtables"] = immutables
+	stats["write_stalls"] = stalls
+	stats["memory_used"] = pm.memory.Used()
+	stats["memory_limit"] = pm.memory.Limit()
+	stats["memory_stalls"] = pm.memory.Stalls()
+	if pm.opts.Engine == "lsm" {
+		stats["pending_compaction_bytes"] = pending
+		stats["write_amplification"] = 0.0
+		if flushed > 0 {
+			stats["write_amplification"] = float64(flushed+compacted) / float64(flushed)
+		}
+	}
+	if pm.migration != nil {
+		stats["resharding_to"] = len(pm.migration.partitions)
+		stats["resharding_next_key"] = pm.migration.next
+	}
+	return stats
 }
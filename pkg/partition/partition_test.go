@@ -1,11 +1,25 @@
 package partition
 
 import (
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"halo-db/pkg/batch"
+	"halo-db/pkg/constants"
+	dberrors "halo-db/pkg/errors"
+	"halo-db/pkg/iterator"
+	"halo-db/pkg/options"
+	"halo-db/pkg/store"
 	"halo-db/pkg/types"
 	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestPartitionManager(t *testing.T) {
@@ -244,3 +258,1878 @@ func TestPartitionConcurrency(t *testing.T) {
 		t.Fatalf("Expected %d keys after concurrent operations, got %d", expectedKeys, len(allKeys))
 	}
 }
+
+func TestPartitionScan(t *testing.T) {
+	dataDir := "test_data_scan"
+	_ = os.RemoveAll(dataDir)
+
+	pm, err := NewPartitionManager(4, dataDir)
+	if err != nil {
+		t.Fatalf("Failed to create partition manager: %v", err)
+	}
+	defer func() { _ = pm.Close() }()
+
+	for i := 0; i < 3000; i++ {
+		key := types.Key(fmt.Sprintf("user:%04d", i))
+		if err := pm.Put(key, types.Value(fmt.Sprintf("value_%d", i))); err != nil {
+			t.Fatalf("Failed to put %s: %v", key, err)
+		}
+	}
+	if err := pm.Put("order:1", types.Value("order")); err != nil {
+		t.Fatalf("Failed to put order: %v", err)
+	}
+	for i := 0; i < 3000; i += 2 {
+		key := types.Key(fmt.Sprintf("user:%04d", i))
+		if err := pm.Delete(key); err != nil {
+			t.Fatalf("Failed to delete %s: %v", key, err)
+		}
+	}
+
+	it := pm.Scan("user:0100", "user:0200")
+	var keys []types.Key
+	for ; it.Valid(); it.Next() {
+		keys = append(keys, it.Key())
+		expected := fmt.Sprintf("value_%s", strings.TrimLeft(strings.TrimPrefix(it.Key(), "user:"), "0"))
+		if string(it.Value()) != expected {
+			t.Errorf("Value mismatch for %s: expected %s, got %s", it.Key(), expected, it.Value())
+		}
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("Scan error: %v", err)
+	}
+	_ = it.Close()
+
+	if len(keys) != 50 {
+		t.Fatalf("Expected 50 keys in range, got %d", len(keys))
+	}
+	for i, key := range keys {
+		expected := types.Key(fmt.Sprintf("user:%04d", 101+2*i))
+		if key != expected {
+			t.Fatalf("Expected %s at position %d, got %s", expected, i, key)
+		}
+	}
+
+	it = pm.ScanPrefix("user:")
+	count := 0
+	var last types.Key
+	for ; it.Valid(); it.Next() {
+		if count > 0 && it.Key() <= last {
+			t.Fatalf("Prefix scan out of order: %s after %s", it.Key(), last)
+		}
+		last = it.Key()
+		count++
+	}
+	_ = it.Close()
+	if count != 1500 {
+		t.Errorf("Expected 1500 keys with prefix, got %d", count)
+	}
+
+	it = pm.ScanPrefix("order:")
+	if !it.Valid() || it.Key() != "order:1" {
+		t.Errorf("Expected order:1 from prefix scan")
+	}
+	_ = it.Close()
+}
+
+func TestPartitionWriteBatch(t *testing.T) {
+	dataDir := "test_data_batch"
+	_ = os.RemoveAll(dataDir)
+
+	pm, err := NewPartitionManager(4, dataDir)
+	if err != nil {
+		t.Fatalf("Failed to create partition manager: %v", err)
+	}
+
+	if err := pm.Put("stale", types.Value("old")); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+
+	b := batch.NewWriteBatch()
+	for i := 0; i < 20; i++ {
+		b.Put(types.Key(fmt.Sprintf("batch_%d", i)), types.Value(fmt.Sprintf("value_%d", i)))
+	}
+	b.Delete("stale")
+	if err := pm.Write(b); err != nil {
+		t.Fatalf("Failed to write batch: %v", err)
+	}
+
+	partitions := make(map[int]bool)
+	for _, op := range b.Ops() {
+		partitions[pm.GetPartition(op.Key).GetID()] = true
+	}
+	if len(partitions) < 2 {
+		t.Fatalf("Expected batch to span several partitions, got %d", len(partitions))
+	}
+
+	// Leave two batches in doubt: only the one recorded in the batch log
+	// may survive a restart.
+	for _, tc := range []struct {
+		id     uint64
+		prefix string
+	}{{1, "decided"}, {2, "undecided"}} {
+		subs := make(map[Partition]*batch.WriteBatch)
+		for i := 0; i < 8; i++ {
+			key := types.Key(fmt.Sprintf("%s_%d", tc.prefix, i))
+			pt := pm.GetPartition(key)
+			if subs[pt] == nil {
+				subs[pt] = batch.NewWriteBatch()
+			}
+			subs[pt].Put(key, types.Value("value"))
+		}
+		for pt, sub := range subs {
+			if err := pt.Prepare(tc.id, sub); err != nil {
+				t.Fatalf("Failed to prepare batch %d on partition %d: %v", tc.id, pt.GetID(), err)
+			}
+		}
+	}
+	if err := pm.(*partitionManager).batchLog.logCommit(1); err != nil {
+		t.Fatalf("Failed to log commit: %v", err)
+	}
+	_ = pm.Close()
+
+	pm, err = NewPartitionManager(4, dataDir)
+	if err != nil {
+		t.Fatalf("Failed to reopen partition manager: %v", err)
+	}
+	defer func() { _ = pm.Close() }()
+
+	for i := 0; i < 20; i++ {
+		key := types.Key(fmt.Sprintf("batch_%d", i))
+		if value, err := pm.Get(key); err != nil || string(value) != fmt.Sprintf("value_%d", i) {
+			t.Errorf("Expected %s to survive restart, got %q (%v)", key, value, err)
+		}
+	}
+	if _, err := pm.Get("stale"); err == nil {
+		t.Error("Expected stale key to be deleted by the batch")
+	}
+	for i := 0; i < 8; i++ {
+		if _, err := pm.Get(types.Key(fmt.Sprintf("decided_%d", i))); err != nil {
+			t.Errorf("Expected decided_%d to be committed on recovery: %v", i, err)
+		}
+		if _, err := pm.Get(types.Key(fmt.Sprintf("undecided_%d", i))); err == nil {
+			t.Errorf("Expected undecided_%d to be aborted on recovery", i)
+		}
+	}
+	for _, pt := range pm.(*partitionManager).partitions {
+		if len(pt.PreparedBatches()) != 0 {
+			t.Errorf("Partition %d still has in-doubt batches", pt.GetID())
+		}
+	}
+}
+
+func TestPartitionSnapshot(t *testing.T) {
+	dataDir := "test_data_snapshot"
+	_ = os.RemoveAll(dataDir)
+
+	pm, err := NewPartitionManager(4, dataDir)
+	if err != nil {
+		t.Fatalf("Failed to create partition manager: %v", err)
+	}
+	defer func() { _ = pm.Close() }()
+
+	for i := 0; i < 100; i++ {
+		key := types.Key(fmt.Sprintf("key_%03d", i))
+		if err := pm.Put(key, types.Value("old")); err != nil {
+			t.Fatalf("Failed to put %s: %v", key, err)
+		}
+	}
+
+	snap := pm.Snapshot()
+
+	for i := 0; i < 100; i++ {
+		key := types.Key(fmt.Sprintf("key_%03d", i))
+		if i%2 == 0 {
+			err = pm.Delete(key)
+		} else {
+			err = pm.Put(key, types.Value("new"))
+		}
+		if err != nil {
+			t.Fatalf("Failed to update %s: %v", key, err)
+		}
+	}
+	// Enough writes to flush every memtable into the tree.
+	for i := 0; i < 5000; i++ {
+		if err := pm.Put(types.Key(fmt.Sprintf("extra_%04d", i)), types.Value("extra")); err != nil {
+			t.Fatalf("Failed to put extra key: %v", err)
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		key := types.Key(fmt.Sprintf("key_%03d", i))
+		if value, err := snap.Get(key); err != nil || string(value) != "old" {
+			t.Fatalf("Expected snapshot to see old value for %s, got %q (%v)", key, value, err)
+		}
+	}
+	if _, err := snap.Get("extra_0001"); err == nil {
+		t.Error("Expected keys written after the snapshot to be invisible")
+	}
+	if keys := snap.List(); len(keys) != 100 {
+		t.Errorf("Expected 100 keys in snapshot, got %d", len(keys))
+	}
+
+	it := snap.ScanPrefix("key_")
+	count := 0
+	for ; it.Valid(); it.Next() {
+		if string(it.Value()) != "old" {
+			t.Errorf("Expected old value for %s in snapshot scan, got %s", it.Key(), it.Value())
+		}
+		count++
+	}
+	_ = it.Close()
+	if count != 100 {
+		t.Errorf("Expected 100 keys in snapshot scan, got %d", count)
+	}
+
+	if value, err := pm.Get("key_001"); err != nil || string(value) != "new" {
+		t.Errorf("Expected live read to see new value, got %q (%v)", value, err)
+	}
+
+	snap.Release()
+	if _, err := snap.Get("key_001"); !errors.Is(err, store.ErrSnapshotReleased) {
+		t.Errorf("Expected ErrSnapshotReleased after release, got %v", err)
+	}
+}
+
+func TestPartitionSnapshotConcurrentWrites(t *testing.T) {
+	dataDir := "test_data_snapshot_concurrent"
+	_ = os.RemoveAll(dataDir)
+	defer func() { _ = os.RemoveAll(dataDir) }()
+
+	opts := options.Default()
+	opts.NumPartitions = 4
+	opts.SyncMode = "none"
+	pm, err := NewPartitionManagerWithOptions(dataDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to create partition manager: %v", err)
+	}
+	defer func() { _ = pm.Close() }()
+
+	// The writers must be able to run while a snapshot is being taken.
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+
+	// Each round writes its number to every one of a writer's keys in
+	// order, so at any point in time no key holds a later round than a key
+	// before it.
+	const writers = 4
+	const numKeys = 16
+	key := func(w, i int) types.Key { return types.Key(fmt.Sprintf("key_%d_%02d", w, i)) }
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for round := 0; ; round++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				for i := 0; i < numKeys; i++ {
+					if err := pm.Put(key(w, i), types.Value(fmt.Sprintf("%08d", round))); err != nil {
+						t.Errorf("Failed to put: %v", err)
+						return
+					}
+				}
+			}
+		}(w)
+	}
+	defer func() {
+		close(done)
+		wg.Wait()
+	}()
+
+	for n := 0; n < 1000; n++ {
+		snap := pm.Snapshot()
+		for w := 0; w < writers; w++ {
+			prev := ""
+			for i := 0; i < numKeys; i++ {
+				value, err := snap.Get(key(w, i))
+				if err != nil && !errors.Is(err, dberrors.ErrNotFound) {
+					t.Fatalf("Failed to read snapshot: %v", err)
+				}
+				if i > 0 && string(value) > prev {
+					t.Fatalf("Snapshot is not a point in time: %s holds round %q after round %q", key(w, i), value, prev)
+				}
+				prev = string(value)
+			}
+		}
+		snap.Release()
+	}
+}
+
+func TestTransactions(t *testing.T) {
+	dataDir := "test_data_txn"
+	_ = os.RemoveAll(dataDir)
+
+	pm, err := NewPartitionManager(4, dataDir)
+	if err != nil {
+		t.Fatalf("Failed to create partition manager: %v", err)
+	}
+	defer func() { _ = pm.Close() }()
+
+	if err := pm.Put("counter", types.Value("0")); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+
+	t.Run("CommitAndRollback", func(t *testing.T) {
+		txn := pm.Begin()
+		if err := txn.Put("txn_a", types.Value("1")); err != nil {
+			t.Fatalf("Failed to put in txn: %v", err)
+		}
+		if err := txn.Delete("counter"); err != nil {
+			t.Fatalf("Failed to delete in txn: %v", err)
+		}
+		if value, err := txn.Get("txn_a"); err != nil || string(value) != "1" {
+			t.Errorf("Expected txn to read its own write, got %q (%v)", value, err)
+		}
+		if _, err := txn.Get("counter"); err == nil {
+			t.Error("Expected txn to see its own delete")
+		}
+		if _, err := pm.Get("txn_a"); err == nil {
+			t.Error("Expected buffered write to be invisible before commit")
+		}
+
+		it := txn.Scan("", "")
+		var keys []types.Key
+		for ; it.Valid(); it.Next() {
+			keys = append(keys, it.Key())
+		}
+		_ = it.Close()
+		if len(keys) != 1 || keys[0] != "txn_a" {
+			t.Errorf("Expected scan to return only txn_a, got %v", keys)
+		}
+
+		if err := txn.Rollback(); err != nil {
+			t.Fatalf("Failed to roll back: %v", err)
+		}
+		if _, err := pm.Get("txn_a"); err == nil {
+			t.Error("Expected rolled back write to be discarded")
+		}
+		if err := txn.Commit(); !errors.Is(err, ErrTxnDone) {
+			t.Errorf("Expected ErrTxnDone, got %v", err)
+		}
+
+		txn = pm.Begin()
+		_ = txn.Put("txn_a", types.Value("1"))
+		if err := txn.Commit(); err != nil {
+			t.Fatalf("Failed to commit: %v", err)
+		}
+		if value, err := pm.Get("txn_a"); err != nil || string(value) != "1" {
+			t.Errorf("Expected committed value, got %q (%v)", value, err)
+		}
+	})
+
+	t.Run("OptimisticConflict", func(t *testing.T) {
+		first := pm.Begin()
+		second := pm.Begin()
+
+		if _, err := first.Get("counter"); err != nil {
+			t.Fatalf("Failed to read: %v", err)
+		}
+		if _, err := second.Get("counter"); err != nil {
+			t.Fatalf("Failed to read: %v", err)
+		}
+		_ = first.Put("counter", types.Value("1"))
+		_ = second.Put("counter", types.Value("2"))
+
+		if err := first.Commit(); err != nil {
+			t.Fatalf("Expected first commit to succeed: %v", err)
+		}
+		if err := second.Commit(); !errors.Is(err, ErrTxnConflict) {
+			t.Fatalf("Expected ErrTxnConflict, got %v", err)
+		}
+
+		reader := pm.Begin()
+		_, _ = reader.Get("counter")
+		if err := pm.Put("counter", types.Value("3")); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+		if value, _ := reader.Get("counter"); string(value) != "1" {
+			t.Errorf("Expected snapshot read of 1, got %s", value)
+		}
+		_ = reader.Put("other", types.Value("x"))
+		if err := reader.Commit(); !errors.Is(err, ErrTxnConflict) {
+			t.Fatalf("Expected read-write conflict, got %v", err)
+		}
+	})
+
+	t.Run("PessimisticCounter", func(t *testing.T) {
+		if err := pm.Put("counter", types.Value("0")); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				txn := pm.BeginPessimistic()
+				value, err := txn.Get("counter")
+				if err != nil {
+					t.Errorf("Failed to read counter: %v", err)
+					_ = txn.Rollback()
+					return
+				}
+				var n int
+				_, _ = fmt.Sscanf(string(value), "%d", &n)
+				_ = txn.Put("counter", types.Value(fmt.Sprintf("%d", n+1)))
+				if err := txn.Commit(); err != nil {
+					t.Errorf("Failed to commit: %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if value, err := pm.Get("counter"); err != nil || string(value) != "10" {
+			t.Errorf("Expected counter to be 10, got %q (%v)", value, err)
+		}
+	})
+}
+
+func TestPartitionTTL(t *testing.T) {
+	dataDir := "test_data_ttl"
+	_ = os.RemoveAll(dataDir)
+
+	pm, err := NewPartitionManager(2, dataDir)
+	if err != nil {
+		t.Fatalf("Failed to create partition manager: %v", err)
+	}
+
+	if err := pm.PutWithTTL("short", types.Value("value"), 200*time.Millisecond); err != nil {
+		t.Fatalf("Failed to put with TTL: %v", err)
+	}
+	if err := pm.PutWithTTL("long", types.Value("value"), time.Hour); err != nil {
+		t.Fatalf("Failed to put with TTL: %v", err)
+	}
+	if err := pm.Put("forever", types.Value("value")); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	if err := pm.PutWithTTL("bad", types.Value("value"), 0); err == nil {
+		t.Error("Expected a non-positive TTL to be rejected")
+	}
+
+	if _, err := pm.Get("short"); err != nil {
+		t.Fatalf("Expected short-lived key before expiry: %v", err)
+	}
+
+	_ = pm.Close()
+	pm, err = NewPartitionManager(2, dataDir)
+	if err != nil {
+		t.Fatalf("Failed to reopen partition manager: %v", err)
+	}
+	defer func() { _ = pm.Close() }()
+
+	time.Sleep(300 * time.Millisecond)
+
+	if _, err := pm.Get("short"); err == nil {
+		t.Error("Expected short-lived key to expire")
+	}
+	for _, key := range []types.Key{"long", "forever"} {
+		if _, err := pm.Get(key); err != nil {
+			t.Errorf("Expected %s to survive: %v", key, err)
+		}
+	}
+	if keys := pm.List(); len(keys) != 2 {
+		t.Errorf("Expected 2 live keys, got %v", keys)
+	}
+
+	it := pm.Scan("", "")
+	count := 0
+	for ; it.Valid(); it.Next() {
+		count++
+	}
+	_ = it.Close()
+	if count != 2 {
+		t.Errorf("Expected scan to return 2 live keys, got %d", count)
+	}
+}
+
+func TestPartitionErrors(t *testing.T) {
+	dataDir := "test_data_errors"
+	_ = os.RemoveAll(dataDir)
+	defer func() { _ = os.RemoveAll(dataDir) }()
+
+	pm, err := NewPartitionManager(2, dataDir)
+	if err != nil {
+		t.Fatalf("Failed to create partition manager: %v", err)
+	}
+
+	if _, err := pm.Get("missing"); !errors.Is(err, dberrors.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for a missing key, got %v", err)
+	}
+
+	// Deleted in the memtable, and missing from the tree after a flush.
+	for i := 0; i < 3000; i++ {
+		if err := pm.Put(fmt.Sprintf("key%d", i), types.Value("value")); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	if err := pm.Delete("key1"); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	for _, key := range []types.Key{"key1", "key9999"} {
+		if _, err := pm.Get(key); !errors.Is(err, dberrors.ErrNotFound) {
+			t.Errorf("Expected ErrNotFound for %s, got %v", key, err)
+		}
+	}
+
+	sn := pm.Snapshot()
+	if _, err := sn.Get("key1"); !errors.Is(err, dberrors.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound from snapshot, got %v", err)
+	}
+	sn.Release()
+
+	big := types.Value(strings.Repeat("x", constants.MaxValueSize+1))
+	if err := pm.Put("big", big); !errors.Is(err, dberrors.ErrTooLarge) {
+		t.Errorf("Expected ErrTooLarge for an oversized value, got %v", err)
+	}
+	b := batch.NewWriteBatch()
+	b.Put("small", types.Value("v"))
+	b.Put(types.Key(strings.Repeat("k", constants.MaxKeySize+1)), types.Value("v"))
+	if err := pm.Write(b); !errors.Is(err, dberrors.ErrTooLarge) {
+		t.Errorf("Expected ErrTooLarge for an oversized key in a batch, got %v", err)
+	}
+	if _, err := pm.Get("small"); !errors.Is(err, dberrors.ErrNotFound) {
+		t.Errorf("Expected a rejected batch to write nothing, got %v", err)
+	}
+
+	txn1, txn2 := pm.Begin(), pm.Begin()
+	_, _ = txn1.Get("key2")
+	_ = txn1.Put("key2", types.Value("one"))
+	_ = txn2.Put("key2", types.Value("two"))
+	if err := txn2.Commit(); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+	if err := txn1.Commit(); !errors.Is(err, dberrors.ErrConflict) {
+		t.Errorf("Expected ErrConflict, got %v", err)
+	}
+
+	if err := pm.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+
+	if _, err := pm.Get("key2"); !errors.Is(err, dberrors.ErrClosed) {
+		t.Errorf("Expected ErrClosed from Get, got %v", err)
+	}
+	if err := pm.Put("key2", types.Value("v")); !errors.Is(err, dberrors.ErrClosed) {
+		t.Errorf("Expected ErrClosed from Put, got %v", err)
+	}
+	if err := pm.Delete("key2"); !errors.Is(err, dberrors.ErrClosed) {
+		t.Errorf("Expected ErrClosed from Delete, got %v", err)
+	}
+	if err := pm.Write(b); !errors.Is(err, dberrors.ErrClosed) {
+		t.Errorf("Expected ErrClosed from Write, got %v", err)
+	}
+	it := pm.Scan("", "")
+	if it.Valid() || !errors.Is(it.Err(), dberrors.ErrClosed) {
+		t.Errorf("Expected ErrClosed from Scan, got %v", it.Err())
+	}
+	_ = it.Close()
+	if _, err := pm.Snapshot().Get("key2"); !errors.Is(err, dberrors.ErrClosed) {
+		t.Errorf("Expected ErrClosed from a snapshot, got %v", err)
+	}
+	if err := pm.Clear(); !errors.Is(err, dberrors.ErrClosed) {
+		t.Errorf("Expected ErrClosed from Clear, got %v", err)
+	}
+	if err := pm.Close(); !errors.Is(err, dberrors.ErrClosed) {
+		t.Errorf("Expected ErrClosed from a second Close, got %v", err)
+	}
+}
+
+func TestPartitionOptions(t *testing.T) {
+	dataDir := "test_data_options"
+	_ = os.RemoveAll(dataDir)
+	defer func() { _ = os.RemoveAll(dataDir) }()
+
+	opts := options.Default()
+	opts.NumPartitions = 3
+	opts.MemtableSize = 50
+	opts.TreeOrder = 16
+	opts.SyncMode = "none"
+
+	pm, err := NewPartitionManagerWithOptions(dataDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to create partition manager: %v", err)
+	}
+	for i := 0; i < 500; i++ {
+		if err := pm.Put(fmt.Sprintf("key%03d", i), types.Value(fmt.Sprintf("value%d", i))); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	if got := pm.GetStats()["num_partitions"]; got != 3 {
+		t.Errorf("Expected 3 partitions, got %v", got)
+	}
+	_ = pm.Close()
+
+	mismatched := opts
+	mismatched.NumPartitions = 4
+	if _, err := NewPartitionManagerWithOptions(dataDir, mismatched); !errors.Is(err, ErrIncompatible) {
+		t.Fatalf("Expected ErrIncompatible for a different partition count, got %v", err)
+	}
+	mismatched = opts
+	mismatched.PageSize = 8192
+	if _, err := NewPartitionManagerWithOptions(dataDir, mismatched); !errors.Is(err, ErrIncompatible) {
+		t.Fatalf("Expected ErrIncompatible for a different page size, got %v", err)
+	}
+
+	invalid := opts
+	invalid.BloomFalsePositiveRate = 1.5
+	if _, err := NewPartitionManagerWithOptions(dataDir, invalid); err == nil {
+		t.Fatal("Expected invalid options to be rejected")
+	}
+
+	// Memtable size and type, tree order and sync mode may change between
+	// opens.
+	reopened := opts
+	reopened.MemtableSize = 1000
+	reopened.MemtableType = "slice"
+	reopened.TreeOrder = 4
+	reopened.SyncMode = "always"
+	pm, err = NewPartitionManagerWithOptions(dataDir, reopened)
+	if err != nil {
+		t.Fatalf("Failed to reopen with compatible options: %v", err)
+	}
+	defer func() { _ = pm.Close() }()
+
+	for i := 0; i < 500; i++ {
+		value, err := pm.Get(fmt.Sprintf("key%03d", i))
+		if err != nil || string(value) != fmt.Sprintf("value%d", i) {
+			t.Fatalf("Expected value%d for key%03d after reopen, got %q (%v)", i, i, value, err)
+		}
+	}
+
+	m, err := readManifest(dataDir)
+	if err != nil || m == nil {
+		t.Fatalf("Failed to read manifest: %v", err)
+	}
+	if !reflect.DeepEqual(m.Options, reopened) {
+		t.Errorf("Expected the manifest to record the latest options, got %+v", m.Options)
+	}
+}
+
+func TestStorageEngines(t *testing.T) {
+	for _, engine := range []string{"btree", "lsm"} {
+		t.Run(engine, func(t *testing.T) {
+			dataDir := "test_data_engine_" + engine
+			_ = os.RemoveAll(dataDir)
+			defer func() { _ = os.RemoveAll(dataDir) }()
+
+			opts := options.Default()
+			opts.Engine = engine
+			opts.NumPartitions = 2
+			opts.MemtableSize = 20
+			opts.SyncMode = "none"
+			opts.CompactionTrigger = 2
+
+			pm, err := NewPartitionManagerWithOptions(dataDir, opts)
+			if err != nil {
+				t.Fatalf("Failed to create partition manager: %v", err)
+			}
+			for round := 0; round < 3; round++ {
+				for i := 0; i < 200; i++ {
+					value := types.Value(fmt.Sprintf("value%d-%d", i, round))
+					if err := pm.Put(fmt.Sprintf("key%03d", i), value); err != nil {
+						t.Fatalf("Failed to put: %v", err)
+					}
+				}
+			}
+			for i := 0; i < 200; i += 3 {
+				if err := pm.Delete(fmt.Sprintf("key%03d", i)); err != nil {
+					t.Fatalf("Failed to delete: %v", err)
+				}
+			}
+			if err := pm.PutWithTTL("short", types.Value("value"), 50*time.Millisecond); err != nil {
+				t.Fatalf("Failed to put with TTL: %v", err)
+			}
+			if err := pm.PutWithTTL("long", types.Value("value"), time.Hour); err != nil {
+				t.Fatalf("Failed to put with TTL: %v", err)
+			}
+			_ = pm.Close()
+
+			if engine == "lsm" {
+				tables, _ := filepath.Glob(filepath.Join(partitionDir(dataDir, 0, 0), "*.sst"))
+				if len(tables) == 0 {
+					t.Fatal("Expected the lsm engine to write SSTables")
+				}
+			}
+
+			mismatched := opts
+			mismatched.Engine = map[string]string{"btree": "lsm", "lsm": "btree"}[engine]
+			if _, err := NewPartitionManagerWithOptions(dataDir, mismatched); !errors.Is(err, ErrIncompatible) {
+				t.Fatalf("Expected ErrIncompatible for a different engine, got %v", err)
+			}
+
+			pm, err = NewPartitionManagerWithOptions(dataDir, opts)
+			if err != nil {
+				t.Fatalf("Failed to reopen partition manager: %v", err)
+			}
+			defer func() { _ = pm.Close() }()
+
+			time.Sleep(60 * time.Millisecond)
+			for i := 0; i < 200; i++ {
+				value, err := pm.Get(fmt.Sprintf("key%03d", i))
+				if i%3 == 0 {
+					if !errors.Is(err, dberrors.ErrNotFound) {
+						t.Fatalf("Expected key%03d to be deleted, got %q (%v)", i, value, err)
+					}
+				} else if err != nil || string(value) != fmt.Sprintf("value%d-2", i) {
+					t.Fatalf("Expected the last value of key%03d, got %q (%v)", i, value, err)
+				}
+			}
+			if _, err := pm.Get("short"); !errors.Is(err, dberrors.ErrNotFound) {
+				t.Errorf("Expected short to have expired, got %v", err)
+			}
+			if value, err := pm.Get("long"); err != nil || string(value) != "value" {
+				t.Errorf("Expected long to survive, got %q (%v)", value, err)
+			}
+
+			it := pm.Scan("key100", "key110")
+			var keys []types.Key
+			for ; it.Valid(); it.Next() {
+				keys = append(keys, it.Key())
+			}
+			_ = it.Close()
+			want := []types.Key{"key100", "key101", "key103", "key104", "key106", "key107", "key109"}
+			if !reflect.DeepEqual(keys, want) {
+				t.Errorf("Expected scan %v, got %v", want, keys)
+			}
+
+			stats := pm.GetStats()
+			if stats["engine"] != engine {
+				t.Errorf("Expected the %s engine in stats, got %v", engine, stats["engine"])
+			}
+			if _, reported := stats["pending_compaction_bytes"]; reported != (engine == "lsm") {
+				t.Errorf("Expected compaction stats only for the lsm engine, got %v", stats)
+			}
+		})
+	}
+}
+
+func TestImmutableMemtables(t *testing.T) {
+	for _, engine := range []string{"btree", "lsm"} {
+		t.Run(engine, func(t *testing.T) {
+			dataDir := "test_data_immutable_" + engine
+			_ = os.RemoveAll(dataDir)
+			defer func() { _ = os.RemoveAll(dataDir) }()
+
+			opts := options.Default()
+			opts.Engine = engine
+			opts.NumPartitions = 1
+			opts.MemtableSize = 10
+			opts.MaxImmutableMemtables = 1
+			opts.SyncMode = "none"
+
+			pm, err := NewPartitionManagerWithOptions(dataDir, opts)
+			if err != nil {
+				t.Fatalf("Failed to create partition manager: %v", err)
+			}
+			for i := 0; i < 50; i++ {
+				if err := pm.Put(fmt.Sprintf("key%02d", i), types.Value("old")); err != nil {
+					t.Fatalf("Failed to put: %v", err)
+				}
+			}
+			snap := pm.Snapshot()
+
+			// Writers fill memtables far faster than they are flushed, so
+			// they keep running into a full queue and stalling.
+			var wg sync.WaitGroup
+			for w := 0; w < 4; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					for i := 0; i < 250; i++ {
+						if err := pm.Put(fmt.Sprintf("writer%d-%03d", w, i), types.Value("value")); err != nil {
+							t.Errorf("Failed to put: %v", err)
+							return
+						}
+						if i%5 == 0 {
+							if err := pm.Put(fmt.Sprintf("key%02d", i/5), types.Value("new")); err != nil {
+								t.Errorf("Failed to put: %v", err)
+								return
+							}
+						}
+					}
+				}(w)
+			}
+			wg.Wait()
+
+			for w := 0; w < 4; w++ {
+				for i := 0; i < 250; i++ {
+					if value, err := pm.Get(fmt.Sprintf("writer%d-%03d", w, i)); err != nil || string(value) != "value" {
+						t.Fatalf("Expected writer%d-%03d to be readable, got %q (%v)", w, i, value, err)
+					}
+				}
+			}
+			for i := 0; i < 50; i++ {
+				key := fmt.Sprintf("key%02d", i)
+				if value, err := pm.Get(key); err != nil || string(value) != "new" {
+					t.Errorf("Expected the new value of %s, got %q (%v)", key, value, err)
+				}
+				if value, err := snap.Get(key); err != nil || string(value) != "old" {
+					t.Errorf("Expected the snapshot to see the old value of %s, got %q (%v)", key, value, err)
+				}
+			}
+			if keys := snap.List(); len(keys) != 50 {
+				t.Errorf("Expected 50 keys in the snapshot, got %d", len(keys))
+			}
+			snap.Release()
+
+			stats := pm.GetStats()
+			if _, reported := stats["write_stalls"]; !reported {
+				t.Errorf("Expected write stalls in stats, got %v", stats)
+			}
+			if queued := stats["immutable_memtables"].(int); queued > opts.MaxImmutableMemtables {
+				t.Errorf("Expected at most %d immutable memtables, got %d", opts.MaxImmutableMemtables, queued)
+			}
+			_ = pm.Close()
+
+			pm, err = NewPartitionManagerWithOptions(dataDir, opts)
+			if err != nil {
+				t.Fatalf("Failed to reopen partition manager: %v", err)
+			}
+			defer func() { _ = pm.Close() }()
+			if keys := pm.List(); len(keys) != 1050 {
+				t.Errorf("Expected 1050 keys after reopening, got %d", len(keys))
+			}
+		})
+	}
+}
+
+func TestEmptyValues(t *testing.T) {
+	for _, engine := range []string{"btree", "lsm"} {
+		t.Run(engine, func(t *testing.T) {
+			dataDir := "test_data_empty_" + engine
+			_ = os.RemoveAll(dataDir)
+			defer func() { _ = os.RemoveAll(dataDir) }()
+
+			opts := options.Default()
+			opts.Engine = engine
+			opts.NumPartitions = 2
+			opts.MemtableSize = 4
+			opts.SyncMode = "none"
+
+			pm, err := NewPartitionManagerWithOptions(dataDir, opts)
+			if err != nil {
+				t.Fatalf("Failed to create partition manager: %v", err)
+			}
+			if err := pm.Put("empty", types.Value{}); err != nil {
+				t.Fatalf("Failed to put: %v", err)
+			}
+			if err := pm.Put("nil", nil); err != nil {
+				t.Fatalf("Failed to put: %v", err)
+			}
+			b := batch.NewWriteBatch()
+			b.Put("batch", nil)
+			if err := pm.Write(b); err != nil {
+				t.Fatalf("Failed to write batch: %v", err)
+			}
+			txn := pm.Begin()
+			if err := txn.Put("txn", nil); err != nil {
+				t.Fatalf("Failed to put in transaction: %v", err)
+			}
+			if err := txn.Commit(); err != nil {
+				t.Fatalf("Failed to commit: %v", err)
+			}
+
+			keys := []types.Key{"batch", "empty", "nil", "txn"}
+			check := func(stage string) {
+				t.Helper()
+				for _, key := range keys {
+					if value, err := pm.Get(key); err != nil || value == nil || len(value) != 0 {
+						t.Errorf("Expected an empty value for %s %s, got %q (%v)", key, stage, value, err)
+					}
+				}
+				it := pm.Scan("", "")
+				var got []types.Key
+				for ; it.Valid(); it.Next() {
+					got = append(got, it.Key())
+				}
+				_ = it.Close()
+				if !reflect.DeepEqual(got, keys) {
+					t.Errorf("Expected scan %v %s, got %v", keys, stage, got)
+				}
+			}
+			check("before flushing")
+
+			// Fill the memtables so the empty values are flushed.
+			for i := 0; i < 20; i++ {
+				if err := pm.Put(fmt.Sprintf("z%02d", i), types.Value("value")); err != nil {
+					t.Fatalf("Failed to put: %v", err)
+				}
+				if err := pm.Delete(fmt.Sprintf("z%02d", i)); err != nil {
+					t.Fatalf("Failed to delete: %v", err)
+				}
+			}
+			_ = pm.Close()
+
+			pm, err = NewPartitionManagerWithOptions(dataDir, opts)
+			if err != nil {
+				t.Fatalf("Failed to reopen partition manager: %v", err)
+			}
+			defer func() { _ = pm.Close() }()
+			check("after reopening")
+		})
+	}
+}
+
+func TestMemoryLimit(t *testing.T) {
+	dataDir := "test_data_memory"
+	_ = os.RemoveAll(dataDir)
+	defer func() { _ = os.RemoveAll(dataDir) }()
+
+	opts := options.Default()
+	opts.NumPartitions = 4
+	opts.MemtableSize = 1 << 20
+	opts.MemtableBytes = 64 << 10
+	opts.MemoryLimit = 128 << 10
+	opts.SyncMode = "none"
+
+	pm, err := NewPartitionManagerWithOptions(dataDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to create partition manager: %v", err)
+	}
+	defer func() { _ = pm.Close() }()
+
+	// Each partition's memtables could hold 192 KiB on their own, so only
+	// the shared limit keeps the four of them under 128 KiB. Writers may
+	// overshoot it by the one write each has in flight.
+	const writers = 8
+	const valueSize = 2 << 10
+	ceiling := opts.MemoryLimit + writers*(valueSize+1024)
+
+	done := make(chan struct{})
+	peak := make(chan int64)
+	go func() {
+		var max int64
+		for {
+			select {
+			case <-done:
+				peak <- max
+				return
+			default:
+			}
+			if used := pm.GetStats()["memory_used"].(int64); used > max {
+				max = used
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				if err := pm.Put(fmt.Sprintf("writer%d-%03d", w, i), make(types.Value, valueSize)); err != nil {
+					t.Errorf("Failed to put: %v", err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(done)
+
+	if max := <-peak; max > ceiling {
+		t.Errorf("Expected memtables to stay under %d bytes, peaked at %d", ceiling, max)
+	}
+	stats := pm.GetStats()
+	if stats["memory_limit"] != opts.MemoryLimit {
+		t.Errorf("Expected a memory limit of %d, got %v", opts.MemoryLimit, stats["memory_limit"])
+	}
+	if stats["memory_stalls"].(uint64) == 0 {
+		t.Errorf("Expected writers to wait for memory, got %v", stats)
+	}
+	for w := 0; w < writers; w++ {
+		for i := 0; i < 200; i++ {
+			key := fmt.Sprintf("writer%d-%03d", w, i)
+			if value, err := pm.Get(key); err != nil || len(value) != valueSize {
+				t.Fatalf("Expected %s to be readable, got %d bytes (%v)", key, len(value), err)
+			}
+		}
+	}
+}
+
+func TestManifest(t *testing.T) {
+	dataDir := "test_data_manifest"
+	_ = os.RemoveAll(dataDir)
+	defer func() { _ = os.RemoveAll(dataDir) }()
+
+	open := func(numPartitions int) (PartitionManager, error) {
+		return NewPartitionManager(numPartitions, dataDir)
+	}
+
+	pm, err := open(4)
+	if err != nil {
+		t.Fatalf("Failed to create partition manager: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := pm.Put(fmt.Sprintf("key%d", i), types.Value("value")); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	_ = pm.Close()
+
+	m, err := readManifest(dataDir)
+	if err != nil || m == nil {
+		t.Fatalf("Failed to read manifest: %v", err)
+	}
+	if m.FormatVersion != manifestVersion || m.NumPartitions != 4 || m.HashFunction != hashMD5 {
+		t.Errorf("Unexpected manifest header: %+v", m)
+	}
+	if len(m.Files) != 9 {
+		t.Errorf("Expected 9 live files, got %v", m.Files)
+	}
+
+	if _, err := open(8); !errors.Is(err, ErrIncompatible) {
+		t.Fatalf("Expected ErrIncompatible when opening 4 partitions as 8, got %v", err)
+	}
+
+	// A directory from before manifests existed is upgraded, with the
+	// partition count taken from its partition directories.
+	if err := os.Remove(manifestPath(dataDir)); err != nil {
+		t.Fatalf("Failed to remove manifest: %v", err)
+	}
+	if _, err := open(2); !errors.Is(err, ErrIncompatible) {
+		t.Fatalf("Expected ErrIncompatible for a legacy directory with 4 partitions, got %v", err)
+	}
+	pm, err = open(4)
+	if err != nil {
+		t.Fatalf("Failed to upgrade legacy directory: %v", err)
+	}
+	if _, err := pm.Get("key42"); err != nil {
+		t.Errorf("Expected key42 after upgrade: %v", err)
+	}
+	_ = pm.Close()
+	if m, err := readManifest(dataDir); err != nil || m == nil || m.FormatVersion != manifestVersion {
+		t.Fatalf("Expected an upgraded manifest, got %+v (%v)", m, err)
+	}
+
+	// So is a manifest that only recorded the options.
+	opts := options.Default()
+	data := fmt.Sprintf(`{"options":{"num_partitions":4,"page_size":%d}}`, opts.PageSize)
+	if err := os.WriteFile(manifestPath(dataDir), []byte(data), 0644); err != nil {
+		t.Fatalf("Failed to write manifest: %v", err)
+	}
+	pm, err = open(4)
+	if err != nil {
+		t.Fatalf("Failed to upgrade options-only manifest: %v", err)
+	}
+	_ = pm.Close()
+
+	m, _ = readManifest(dataDir)
+	m.FormatVersion = manifestVersion + 1
+	if err := writeManifest(dataDir, m); err != nil {
+		t.Fatalf("Failed to write manifest: %v", err)
+	}
+	if _, err := open(4); !errors.Is(err, ErrIncompatible) {
+		t.Fatalf("Expected ErrIncompatible for a newer format version, got %v", err)
+	}
+
+	m.FormatVersion = manifestVersion
+	if err := writeManifest(dataDir, m); err != nil {
+		t.Fatalf("Failed to write manifest: %v", err)
+	}
+	if err := os.Remove(filepath.Join(partitionDir(dataDir, 0, 2), "tree.db")); err != nil {
+		t.Fatalf("Failed to remove tree file: %v", err)
+	}
+	if _, err := open(4); !errors.Is(err, dberrors.ErrCorrupted) {
+		t.Fatalf("Expected ErrCorrupted for a missing live file, got %v", err)
+	}
+
+	if err := os.WriteFile(manifestPath(dataDir), []byte("{not json"), 0644); err != nil {
+		t.Fatalf("Failed to write manifest: %v", err)
+	}
+	if _, err := open(4); !errors.Is(err, dberrors.ErrCorrupted) {
+		t.Fatalf("Expected ErrCorrupted for an unreadable manifest, got %v", err)
+	}
+}
+
+func TestReshard(t *testing.T) {
+	dataDir := "test_data_reshard"
+	_ = os.RemoveAll(dataDir)
+	defer func() { _ = os.RemoveAll(dataDir) }()
+
+	pm, err := NewPartitionManager(4, dataDir)
+	if err != nil {
+		t.Fatalf("Failed to create partition manager: %v", err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		if err := pm.Put(fmt.Sprintf("key%04d", i), types.Value(fmt.Sprintf("value%d", i))); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	if err := pm.PutWithTTL("ttl", types.Value("value"), time.Hour); err != nil {
+		t.Fatalf("Failed to put with TTL: %v", err)
+	}
+	expiresAt := func(pm PartitionManager) int64 {
+		_, at, err := pm.GetPartition("ttl").GetWithExpiry("ttl")
+		if err != nil {
+			t.Fatalf("Failed to read TTL key: %v", err)
+		}
+		return at
+	}
+	deadline := expiresAt(pm)
+
+	// Writers keep going while keys are copied; their writes must survive
+	// whichever side of the copier they land on.
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				key := types.Key(fmt.Sprintf("key%04d", (i*4+w)%1000))
+				if err := pm.Put(key, types.Value("updated")); err != nil {
+					t.Errorf("Failed to put during resharding: %v", err)
+					return
+				}
+				if err := pm.Delete(types.Key(fmt.Sprintf("new%d-%d", w, i-1))); err != nil {
+					t.Errorf("Failed to delete during resharding: %v", err)
+					return
+				}
+				if err := pm.Put(types.Key(fmt.Sprintf("new%d-%d", w, i)), types.Value("new")); err != nil {
+					t.Errorf("Failed to put during resharding: %v", err)
+					return
+				}
+			}
+		}(w)
+	}
+
+	if err := pm.Reshard(7); err != nil {
+		t.Fatalf("Failed to reshard: %v", err)
+	}
+	close(stop)
+	wg.Wait()
+
+	check := func(pm PartitionManager) {
+		t.Helper()
+		if stats := pm.GetStats(); stats["num_partitions"] != 7 {
+			t.Errorf("Expected 7 partitions, got %v", stats["num_partitions"])
+		}
+		for i := 0; i < 1000; i++ {
+			key := types.Key(fmt.Sprintf("key%04d", i))
+			value, err := pm.Get(key)
+			if err != nil || (string(value) != "updated" && string(value) != fmt.Sprintf("value%d", i)) {
+				t.Fatalf("Unexpected value for %s: %q, %v", key, value, err)
+			}
+		}
+		for w := 0; w < 4; w++ {
+			if keys := pm.ScanPrefix(types.Key(fmt.Sprintf("new%d-", w))); keys.Valid() {
+				keys.Next()
+				if keys.Valid() {
+					t.Errorf("Expected at most one live key for writer %d, got a second: %s", w, keys.Key())
+				}
+				_ = keys.Close()
+			}
+		}
+		if at := expiresAt(pm); at != deadline {
+			t.Errorf("Expected TTL deadline %d to be kept, got %d", deadline, at)
+		}
+	}
+	check(pm)
+	_ = pm.Close()
+
+	if _, err := NewPartitionManager(4, dataDir); !errors.Is(err, ErrIncompatible) {
+		t.Fatalf("Expected ErrIncompatible when opening with the old partition count, got %v", err)
+	}
+	pm, err = NewPartitionManager(7, dataDir)
+	if err != nil {
+		t.Fatalf("Failed to reopen after resharding: %v", err)
+	}
+	defer func() { _ = pm.Close() }()
+	check(pm)
+
+	if _, err := os.Stat(partitionDir(dataDir, 0, 0)); !os.IsNotExist(err) {
+		t.Errorf("Expected the old partitions to be removed, got %v", err)
+	}
+	if err := pm.Reshard(7); err != nil {
+		t.Errorf("Expected resharding to the current count to be a no-op, got %v", err)
+	}
+}
+
+func TestReshardResume(t *testing.T) {
+	dataDir := "test_data_reshard_resume"
+	_ = os.RemoveAll(dataDir)
+	defer func() { _ = os.RemoveAll(dataDir) }()
+
+	pm, err := NewPartitionManager(4, dataDir)
+	if err != nil {
+		t.Fatalf("Failed to create partition manager: %v", err)
+	}
+	for i := 0; i < 1000; i++ {
+		if err := pm.Put(fmt.Sprintf("key%04d", i), types.Value("value")); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+
+	// Start a resharding by hand and copy two chunks, so that the process
+	// can stop partway through as if it had crashed.
+	p := pm.(*partitionManager)
+	p.mu.Lock()
+	targets, err := openPartitions(dataDir, 1, []int{0, 1, 2}, p.opts, p.memory)
+	if err != nil {
+		t.Fatalf("Failed to open target partitions: %v", err)
+	}
+	p.manifest.Resharding = &reshardState{NumPartitions: 3, Generation: 1}
+	p.manifest.Files = p.manifest.liveFiles()
+	if err := writeManifest(dataDir, p.manifest); err != nil {
+		t.Fatalf("Failed to write manifest: %v", err)
+	}
+	router, err := NewRouter(reshardOptions(p.opts, 3))
+	if err != nil {
+		t.Fatalf("Failed to create router: %v", err)
+	}
+	m := &migration{partitions: targets, router: router, generation: 1, stop: make(chan struct{}), done: make(chan struct{})}
+	close(m.done)
+	p.migration = m
+	p.mu.Unlock()
+
+	for i := 0; i < 2; i++ {
+		if finished, err := p.copyChunk(m); err != nil || finished {
+			t.Fatalf("Failed to copy chunk: finished %v, %v", finished, err)
+		}
+	}
+	if err := pm.Put("key0000", types.Value("copied-then-updated")); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	if err := pm.Put("key0999", types.Value("not-yet-copied")); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	if err := pm.Reshard(5); !errors.Is(err, ErrReshardInProgress) {
+		t.Errorf("Expected ErrReshardInProgress, got %v", err)
+	}
+	_ = pm.Close()
+
+	stored, err := readManifest(dataDir)
+	if err != nil || stored.Resharding == nil || len(stored.Resharding.NextKey) == 0 {
+		t.Fatalf("Expected resharding progress in the manifest, got %+v, %v", stored, err)
+	}
+
+	pm, err = NewPartitionManager(4, dataDir)
+	if err != nil {
+		t.Fatalf("Failed to reopen during resharding: %v", err)
+	}
+	if err := pm.Reshard(3); err != nil {
+		t.Fatalf("Failed to finish resharding: %v", err)
+	}
+	_ = pm.Close()
+
+	pm, err = NewPartitionManager(3, dataDir)
+	if err != nil {
+		t.Fatalf("Failed to reopen after resharding: %v", err)
+	}
+	defer func() { _ = pm.Close() }()
+
+	if keys := pm.List(); len(keys) != 1000 {
+		t.Errorf("Expected 1000 keys, got %d", len(keys))
+	}
+	for key, want := range map[types.Key]string{"key0000": "copied-then-updated", "key0500": "value", "key0999": "not-yet-copied"} {
+		if value, err := pm.Get(key); err != nil || string(value) != want {
+			t.Errorf("Expected %s=%s, got %q, %v", key, want, value, err)
+		}
+	}
+}
+
+func TestReshardBatchAtomic(t *testing.T) {
+	dataDir := "test_data_reshard_batch"
+	_ = os.RemoveAll(dataDir)
+	defer func() { _ = os.RemoveAll(dataDir) }()
+
+	pm, err := NewPartitionManager(4, dataDir)
+	if err != nil {
+		t.Fatalf("Failed to create partition manager: %v", err)
+	}
+	defer func() { _ = pm.Close() }()
+
+	// Start a resharding by hand with the copier stopped, so batches keep
+	// going to both sets of partitions.
+	p := pm.(*partitionManager)
+	p.mu.Lock()
+	targets, err := openPartitions(dataDir, 1, []int{0, 1, 2}, p.opts, p.memory)
+	if err != nil {
+		t.Fatalf("Failed to open target partitions: %v", err)
+	}
+	router, err := NewRouter(reshardOptions(p.opts, 3))
+	if err != nil {
+		t.Fatalf("Failed to create router: %v", err)
+	}
+	m := &migration{partitions: targets, router: router, generation: 1, stop: make(chan struct{}), done: make(chan struct{})}
+	close(m.done)
+	p.migration = m
+	p.mu.Unlock()
+
+	b := batch.NewWriteBatch()
+	for i := 0; i < 20; i++ {
+		b.Put(types.Key(fmt.Sprintf("key%02d", i)), types.Value("value"))
+	}
+
+	// An old partition that cannot prepare must keep the batch off the
+	// targets as well.
+	if err := p.partitions[0].Close(); err != nil {
+		t.Fatalf("Failed to close partition: %v", err)
+	}
+	if err := pm.Write(b); err == nil {
+		t.Fatal("Expected the batch to fail on the closed partition")
+	}
+	for i := 0; i < 20; i++ {
+		key := types.Key(fmt.Sprintf("key%02d", i))
+		if value, err := m.partitionFor(key).Get(key); !errors.Is(err, dberrors.ErrNotFound) {
+			t.Errorf("Expected %s to be kept off the targets, got %q (%v)", key, value, err)
+		}
+	}
+
+	reopened, err := openPartition(0, partitionDir(dataDir, 0, 0), p.opts, p.memory)
+	if err != nil {
+		t.Fatalf("Failed to reopen partition: %v", err)
+	}
+	p.partitions[0] = reopened
+	if err := pm.Write(b); err != nil {
+		t.Fatalf("Failed to write batch: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		key := types.Key(fmt.Sprintf("key%02d", i))
+		if value, err := m.partitionFor(key).Get(key); err != nil || string(value) != "value" {
+			t.Errorf("Expected %s on the targets, got %q (%v)", key, value, err)
+		}
+		if value, err := pm.Get(key); err != nil || string(value) != "value" {
+			t.Errorf("Expected %s on the old partitions, got %q (%v)", key, value, err)
+		}
+	}
+}
+
+func TestBatchLogReset(t *testing.T) {
+	dataDir := "test_data_batch_log_reset"
+	_ = os.RemoveAll(dataDir)
+	defer func() { _ = os.RemoveAll(dataDir) }()
+
+	opts := options.Default()
+	opts.NumPartitions = 4
+	opts.SyncMode = "none"
+	pm, err := NewPartitionManagerWithOptions(dataDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to create partition manager: %v", err)
+	}
+	defer func() { _ = pm.Close() }()
+
+	b := batch.NewWriteBatch()
+	for i := 0; i < 20; i++ {
+		b.Put(types.Key(fmt.Sprintf("key%02d", i)), types.Value("value"))
+	}
+	if err := pm.Write(b); err != nil {
+		t.Fatalf("Failed to write batch: %v", err)
+	}
+
+	p := pm.(*partitionManager)
+	syncs := func(pt Partition) uint64 {
+		return pt.GetStats()["wal"].(map[string]interface{})["syncs"].(uint64)
+	}
+	for _, pt := range p.partitions {
+		if n := syncs(pt); n != 0 {
+			t.Fatalf("Expected partition %d not to sync on its own, got %d syncs", pt.GetID(), n)
+		}
+	}
+
+	// The commit records are only in the page cache, so they must be
+	// synced before the decisions are dropped.
+	p.mu.RLock()
+	err = p.resetBatchLog()
+	p.mu.RUnlock()
+	if err != nil {
+		t.Fatalf("Failed to reset batch log: %v", err)
+	}
+	for _, pt := range p.partitions {
+		if n := syncs(pt); n == 0 {
+			t.Errorf("Expected partition %d to sync before the batch log reset", pt.GetID())
+		}
+	}
+	if size := p.batchLog.getSize(); size != 0 {
+		t.Errorf("Expected an empty batch log, got %d bytes", size)
+	}
+}
+
+// failingCommit fails to apply prepared batches a number of times, as a
+// partition short of memory or disk would.
+type failingCommit struct {
+	Partition
+	failures int
+}
+
+func (f *failingCommit) CommitPrepared(batchID uint64) error {
+	if f.failures > 0 {
+		f.failures--
+		return errors.New("disk full")
+	}
+	return f.Partition.CommitPrepared(batchID)
+}
+
+func TestUnresolvedBatchRetry(t *testing.T) {
+	dataDir := "test_data_unresolved_batch"
+	_ = os.RemoveAll(dataDir)
+	defer func() { _ = os.RemoveAll(dataDir) }()
+
+	pm, err := NewPartitionManager(4, dataDir)
+	if err != nil {
+		t.Fatalf("Failed to create partition manager: %v", err)
+	}
+	defer func() { _ = pm.Close() }()
+
+	p := pm.(*partitionManager)
+	failing := &failingCommit{Partition: p.partitions[0], failures: 2}
+	p.partitions[0] = failing
+
+	batchOf := func(value string) *batch.WriteBatch {
+		b := batch.NewWriteBatch()
+		for i := 0; i < 20; i++ {
+			b.Put(types.Key(fmt.Sprintf("key%02d", i)), types.Value(value))
+		}
+		return b
+	}
+	var failed types.Key
+	for i := 0; i < 20; i++ {
+		if key := types.Key(fmt.Sprintf("key%02d", i)); p.router.Route(key) == 0 {
+			failed = key
+		}
+	}
+
+	if err := pm.Write(batchOf("first")); err == nil {
+		t.Fatal("Expected the batch to fail on the failing partition")
+	}
+	if len(p.unresolved) != 1 {
+		t.Fatalf("Expected 1 unresolved batch, got %d", len(p.unresolved))
+	}
+
+	// The retry fails again, and the second batch goes ahead of it.
+	if err := pm.Write(batchOf("second")); err != nil {
+		t.Fatalf("Failed to write batch: %v", err)
+	}
+	if len(p.unresolved) != 1 {
+		t.Fatalf("Expected the first batch to stay unresolved, got %d", len(p.unresolved))
+	}
+	if value, err := pm.Get(failed); err != nil || string(value) != "second" {
+		t.Errorf("Expected %s=second, got %q (%v)", failed, value, err)
+	}
+
+	if err := pm.Write(batchOf("third")); err != nil {
+		t.Fatalf("Failed to write batch: %v", err)
+	}
+	if len(p.unresolved) != 0 {
+		t.Errorf("Expected the retried batch to be resolved, got %d", len(p.unresolved))
+	}
+	if value, err := pm.Get(failed); err != nil || string(value) != "third" {
+		t.Errorf("Expected %s=third, got %q (%v)", failed, value, err)
+	}
+}
+
+func TestRouters(t *testing.T) {
+	keys := make([]types.Key, 10000)
+	for i := range keys {
+		keys[i] = types.Key(fmt.Sprintf("key%05d", i))
+	}
+	counts := func(r Router) []int {
+		c := make([]int, r.NumPartitions())
+		for _, key := range keys {
+			c[r.Route(key)]++
+		}
+		return c
+	}
+
+	// The modulo router over MD5 must keep routing exactly as databases
+	// created before routers existed did.
+	modulo := NewModuloRouter(4, MD5Hash)
+	for _, key := range keys[:100] {
+		hash := md5.Sum([]byte(key))
+		if want := int(binary.BigEndian.Uint32(hash[:4]) % 4); modulo.Route(key) != want {
+			t.Fatalf("Expected %s in partition %d, got %d", key, want, modulo.Route(key))
+		}
+	}
+
+	for _, hash := range []HashFunc{MD5Hash, FNV1aHash} {
+		ring := NewConsistentRouter([]int{1, 1, 1, 1, 1, 1, 1, 1}, 128, hash)
+		for id, count := range counts(ring) {
+			if count < len(keys)/8/2 || count > len(keys)/8*2 {
+				t.Errorf("Partition %d of 8 got %d of %d keys", id, count, len(keys))
+			}
+		}
+
+		grown := NewConsistentRouter([]int{1, 1, 1, 1, 1, 1, 1, 1, 1}, 128, hash)
+		moved := 0
+		for _, key := range keys {
+			if from, to := ring.Route(key), grown.Route(key); from != to {
+				moved++
+				if to != 8 {
+					t.Fatalf("Key %s moved from %d to %d instead of to the new partition", key, from, to)
+				}
+			}
+		}
+		if moved == 0 || moved > len(keys)/9*2 {
+			t.Errorf("Expected about 1/9 of the keys to move, %d of %d did", moved, len(keys))
+		}
+
+		weighted := counts(NewConsistentRouter([]int{1, 3}, 128, hash))
+		if weighted[1] < 2*weighted[0] {
+			t.Errorf("Expected the partition with weight 3 to get about 3x the keys, got %v", weighted)
+		}
+	}
+}
+
+func TestConsistentRouting(t *testing.T) {
+	dataDir := "test_data_consistent"
+	_ = os.RemoveAll(dataDir)
+	defer func() { _ = os.RemoveAll(dataDir) }()
+
+	opts := options.Default()
+	opts.Router = "consistent"
+	opts.HashFunction = "fnv1a"
+	opts.PartitionWeights = []int{1, 2, 1, 1}
+
+	bad := opts
+	bad.PartitionWeights = []int{1, 2}
+	if _, err := NewPartitionManagerWithOptions(dataDir, bad); err == nil {
+		t.Fatal("Expected weights for the wrong number of partitions to be rejected")
+	}
+
+	pm, err := NewPartitionManagerWithOptions(dataDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to create partition manager: %v", err)
+	}
+	for i := 0; i < 500; i++ {
+		if err := pm.Put(fmt.Sprintf("key%03d", i), types.Value("value")); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	_ = pm.Close()
+
+	for _, change := range []func(*options.Options){
+		func(o *options.Options) { o.Router = "modulo"; o.PartitionWeights = nil },
+		func(o *options.Options) { o.HashFunction = "md5" },
+		func(o *options.Options) { o.VirtualNodes = 64 },
+		func(o *options.Options) { o.PartitionWeights = nil },
+	} {
+		other := opts
+		change(&other)
+		if _, err := NewPartitionManagerWithOptions(dataDir, other); !errors.Is(err, ErrIncompatible) {
+			t.Errorf("Expected ErrIncompatible for changed routing, got %v", err)
+		}
+	}
+
+	pm, err = NewPartitionManagerWithOptions(dataDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen partition manager: %v", err)
+	}
+	if err := pm.Reshard(5); err != nil {
+		t.Fatalf("Failed to reshard: %v", err)
+	}
+	_ = pm.Close()
+
+	opts.NumPartitions = 5
+	opts.PartitionWeights = nil
+	pm, err = NewPartitionManagerWithOptions(dataDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen after resharding: %v", err)
+	}
+	defer func() { _ = pm.Close() }()
+	for i := 0; i < 500; i++ {
+		if _, err := pm.Get(fmt.Sprintf("key%03d", i)); err != nil {
+			t.Fatalf("Failed to get key%03d: %v", i, err)
+		}
+	}
+}
+
+func TestRangePartitioning(t *testing.T) {
+	dataDir := "test_data_range"
+	_ = os.RemoveAll(dataDir)
+	defer func() { _ = os.RemoveAll(dataDir) }()
+
+	opts := options.Default()
+	opts.Router = "range"
+	opts.RangeSplitKeys = 100
+	opts.SplitCheckInterval = time.Hour
+
+	pm, err := NewPartitionManagerWithOptions(dataDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to create partition manager: %v", err)
+	}
+	if stats := pm.GetStats(); stats["num_partitions"] != 1 {
+		t.Fatalf("Expected a new range partitioned database to start with 1 partition, got %v", stats["num_partitions"])
+	}
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%04d", (i*7919)%1000)
+		if err := pm.Put(key, types.Value(key)); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	if err := pm.PutWithTTL("key0500", types.Value("key0500"), time.Hour); err != nil {
+		t.Fatalf("Failed to put with TTL: %v", err)
+	}
+	_, deadline, _ := pm.GetPartition("key0500").GetWithExpiry("key0500")
+
+	p := pm.(*partitionManager)
+	for {
+		before := len(p.partitions)
+		if err := p.checkSplits(); err != nil {
+			t.Fatalf("Failed to split: %v", err)
+		}
+		if len(p.partitions) == before {
+			break
+		}
+	}
+	if len(p.partitions) < 10 {
+		t.Errorf("Expected at least 10 partitions after splitting, got %d", len(p.partitions))
+	}
+	for pos := range p.partitions {
+		if count, _ := p.countKeys(pos, 1000); count > 100 {
+			t.Errorf("Partition at %d still has %d keys", pos, count)
+		}
+	}
+
+	check := func(pm PartitionManager) {
+		t.Helper()
+		keys := pm.List()
+		if len(keys) != 1000 {
+			t.Fatalf("Expected 1000 keys, got %d", len(keys))
+		}
+		for i, key := range keys {
+			if want := types.Key(fmt.Sprintf("key%04d", i)); key != want {
+				t.Fatalf("Expected List to be ordered, got %s at %d", key, i)
+			}
+			if value, err := pm.Get(key); err != nil || string(value) != string(key) {
+				t.Fatalf("Unexpected value for %s: %q, %v", key, value, err)
+			}
+		}
+		if _, at, err := pm.GetPartition("key0500").GetWithExpiry("key0500"); err != nil || at != deadline {
+			t.Errorf("Expected TTL deadline %d to be kept, got %d, %v", deadline, at, err)
+		}
+
+		it := pm.ScanPrefix("key05")
+		count := 0
+		for ; it.Valid(); it.Next() {
+			count++
+		}
+		_ = it.Close()
+		if count != 100 {
+			t.Errorf("Expected 100 keys with prefix key05, got %d", count)
+		}
+	}
+	check(pm)
+
+	// A prefix scan only reaches the partitions whose range overlaps it.
+	ranges := p.router.(*rangeRouter)
+	touched := 0
+	for pos := range p.partitions {
+		if _, _, overlaps := ranges.clip(pos, "key05", iterator.PrefixEnd("key05")); overlaps {
+			touched++
+		}
+	}
+	if touched > 3 {
+		t.Errorf("Expected a 100-key prefix scan to touch at most 3 partitions, got %d", touched)
+	}
+
+	if err := pm.Reshard(2); err == nil {
+		t.Error("Expected resharding a range partitioned database to fail")
+	}
+
+	// Keys a partition holds outside its range, as an interrupted split
+	// leaves them, are neither read nor listed, and are trimmed on open.
+	first := p.partitions[0]
+	if err := first.Put("zzz", types.Value("stray")); err != nil {
+		t.Fatalf("Failed to put stray key: %v", err)
+	}
+	if _, err := pm.Get("zzz"); !errors.Is(err, dberrors.ErrNotFound) {
+		t.Errorf("Expected stray key to be invisible, got %v", err)
+	}
+	numPartitions := len(p.partitions)
+	_ = pm.Close()
+
+	if err := os.MkdirAll(partitionDir(dataDir, 0, 99), 0755); err != nil {
+		t.Fatalf("Failed to create stale partition directory: %v", err)
+	}
+
+	if _, err := NewPartitionManager(4, dataDir); !errors.Is(err, ErrIncompatible) {
+		t.Fatalf("Expected ErrIncompatible when opening with the modulo router, got %v", err)
+	}
+	pm, err = NewPartitionManagerWithOptions(dataDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen partition manager: %v", err)
+	}
+	defer func() { _ = pm.Close() }()
+
+	if stats := pm.GetStats(); stats["num_partitions"] != numPartitions {
+		t.Errorf("Expected %d partitions after reopen, got %v", numPartitions, stats["num_partitions"])
+	}
+	check(pm)
+	for _, key := range pm.(*partitionManager).partitions[0].List() {
+		if key == "zzz" {
+			t.Error("Expected the stray key to be trimmed on open")
+		}
+	}
+	if _, err := os.Stat(partitionDir(dataDir, 0, 99)); !os.IsNotExist(err) {
+		t.Errorf("Expected the stale partition directory to be removed, got %v", err)
+	}
+}
+
+func TestSplitDuringWrites(t *testing.T) {
+	dataDir := "test_data_split_writes"
+	_ = os.RemoveAll(dataDir)
+	defer func() { _ = os.RemoveAll(dataDir) }()
+
+	opts := options.Default()
+	opts.Router = "range"
+	opts.RangeSplitKeys = 100
+	opts.SplitCheckInterval = time.Hour
+
+	pm, err := NewPartitionManagerWithOptions(dataDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to create partition manager: %v", err)
+	}
+	defer func() { _ = pm.Close() }()
+
+	for i := 0; i < 1000; i++ {
+		if err := pm.Put(fmt.Sprintf("key%04d", i), types.Value("old")); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+
+	// Stop the split after its first chunk and write to keys on both sides
+	// of the copier.
+	p := pm.(*partitionManager)
+	sp, err := p.beginSplit(0)
+	if err != nil || sp == nil {
+		t.Fatalf("Failed to begin split: %v", err)
+	}
+	if sp.mid != "key0500" {
+		t.Fatalf("Expected the split to start at key0500, got %s", sp.mid)
+	}
+	next, done, err := p.copySplitChunk(sp, sp.mid)
+	if err != nil || done {
+		t.Fatalf("Failed to copy the first chunk: done %v, %v", done, err)
+	}
+
+	writes := map[string]string{
+		"key0510": "new",
+		"key0900": "new",
+		"key1500": "added",
+	}
+	for key, value := range writes {
+		if err := pm.Put(key, types.Value(value)); err != nil {
+			t.Fatalf("Failed to put during split: %v", err)
+		}
+	}
+	if err := pm.Delete("key0520"); err != nil {
+		t.Fatalf("Failed to delete during split: %v", err)
+	}
+	b := batch.NewWriteBatch()
+	b.Put("key0530", types.Value("batch"))
+	b.Put("key0700", types.Value("batch"))
+	b.Delete("key0100")
+	if err := pm.Write(b); err != nil {
+		t.Fatalf("Failed to write batch during split: %v", err)
+	}
+	writes["key0530"] = "batch"
+	writes["key0700"] = "batch"
+
+	if err := p.completeSplit(sp, next); err != nil {
+		t.Fatalf("Failed to complete split: %v", err)
+	}
+	if len(p.partitions) != 2 {
+		t.Fatalf("Expected 2 partitions after the split, got %d", len(p.partitions))
+	}
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%04d", i)
+		want, written := writes[key]
+		if !written {
+			want = "old"
+		}
+		value, err := pm.Get(key)
+		if key == "key0100" || key == "key0520" {
+			if !errors.Is(err, dberrors.ErrNotFound) {
+				t.Errorf("Expected %s to stay deleted, got %q (%v)", key, value, err)
+			}
+			continue
+		}
+		if err != nil || string(value) != want {
+			t.Errorf("Expected %s=%s after the split, got %q (%v)", key, want, value, err)
+		}
+	}
+	if value, err := pm.Get("key1500"); err != nil || string(value) != "added" {
+		t.Errorf("Expected key1500 to be added, got %q (%v)", value, err)
+	}
+	if count, _ := p.countKeys(0, 1000); count != 499 {
+		t.Errorf("Expected 499 keys below the split, got %d", count)
+	}
+	if count, _ := p.countKeys(1, 1000); count != 500 {
+		t.Errorf("Expected 500 keys above the split, got %d", count)
+	}
+}
+
+func TestSnapshotDuringSplitCleanup(t *testing.T) {
+	dataDir := "test_data_split_snapshot"
+	_ = os.RemoveAll(dataDir)
+	defer func() { _ = os.RemoveAll(dataDir) }()
+
+	opts := options.Default()
+	opts.Router = "range"
+	opts.SplitCheckInterval = time.Hour
+
+	pm, err := NewPartitionManagerWithOptions(dataDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to create partition manager: %v", err)
+	}
+	defer func() { _ = pm.Close() }()
+
+	for i := 0; i < 10; i++ {
+		if err := pm.Put(types.Key(fmt.Sprintf("k%d", i)), types.Value("v1")); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+
+	// Switch the split over without deleting the moved keys from the old
+	// partition, then change two of them in the new one.
+	p := pm.(*partitionManager)
+	sp, err := p.beginSplit(0)
+	if err != nil || sp == nil {
+		t.Fatalf("Failed to begin split: %v", err)
+	}
+	for next, done := sp.mid, false; !done; {
+		if next, done, err = p.copySplitChunk(sp, next); err != nil {
+			t.Fatalf("Failed to copy: %v", err)
+		}
+	}
+	if err := p.finishSplit(sp); err != nil {
+		t.Fatalf("Failed to finish split: %v", err)
+	}
+	if err := pm.Put("k8", types.Value("v2")); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	if err := pm.Delete("k9"); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+
+	snap := pm.Snapshot()
+	defer snap.Release()
+
+	it := snap.Scan("", "")
+	var scanned []string
+	for ; it.Valid(); it.Next() {
+		scanned = append(scanned, fmt.Sprintf("%s=%s", it.Key(), it.Value()))
+	}
+	_ = it.Close()
+	want := []string{"k0=v1", "k1=v1", "k2=v1", "k3=v1", "k4=v1", "k5=v1", "k6=v1", "k7=v1", "k8=v2"}
+	if !reflect.DeepEqual(scanned, want) {
+		t.Errorf("Expected the snapshot to scan %v, got %v", want, scanned)
+	}
+	if keys := snap.List(); len(keys) != 9 {
+		t.Errorf("Expected the snapshot to list 9 keys, got %v", keys)
+	}
+}
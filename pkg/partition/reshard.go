@@ -0,0 +1,271 @@
+package partition
+
+import (
+	"errors"
+	"fmt"
+	"halo-db/pkg/batch"
+	"halo-db/pkg/constants"
+	dberrors "halo-db/pkg/errors"
+	"halo-db/pkg/options"
+	"halo-db/pkg/types"
+	"os"
+	"path/filepath"
+)
+
+var ErrReshardInProgress = errors.New("resharding already in progress")
+
+// migration is a resharding in progress. Reads are served from the current
+// partitions; writes go to both sets while the copier walks the keyspace in
+// order and copies every key below next into the target partitions.
+type migration struct {
+	partitions []Partition
+	router     Router
+	generation int
+	next       types.Key
+	err        error
+	stop       chan struct{}
+	done       chan struct{}
+}
+
+// Reshard moves the database to numPartitions partitions and returns once
+// the new routing is in effect. Reads and writes are served throughout; only
+// the copying of each chunk of keys briefly holds them up. Progress is
+// recorded in the manifest, so if the process stops the resharding resumes
+// when the data directory is opened again, and Reshard on the reopened
+// manager waits for it.
+//
+// Snapshots, transactions and iterators that are still open when routing
+// switches fail with ErrClosed, as the partitions they read are removed.
+func (pm *partitionManager) Reshard(numPartitions int) error {
+	if numPartitions <= 0 {
+		return fmt.Errorf("number of partitions must be positive, got %d", numPartitions)
+	}
+
+	pm.mu.Lock()
+	if pm.closed {
+		pm.mu.Unlock()
+		return dberrors.ErrClosed
+	}
+	if _, ordered := pm.router.(*rangeRouter); ordered {
+		pm.mu.Unlock()
+		return fmt.Errorf("range partitioned databases split on their own and cannot be resharded")
+	}
+	m := pm.migration
+	if m != nil && len(m.partitions) != numPartitions {
+		pm.mu.Unlock()
+		return fmt.Errorf("%w: moving to %d partitions", ErrReshardInProgress, len(m.partitions))
+	}
+	if m != nil {
+		select {
+		case <-m.done:
+			// The copier stopped on an error; try again from where it was.
+			pm.startMigration()
+		default:
+		}
+	} else {
+		if numPartitions == len(pm.partitions) {
+			pm.mu.Unlock()
+			return nil
+		}
+		var err error
+		if m, err = pm.beginMigration(numPartitions); err != nil {
+			pm.mu.Unlock()
+			return err
+		}
+	}
+	pm.mu.Unlock()
+
+	<-m.done
+	return m.err
+}
+
+// beginMigration creates the target partitions and records the resharding
+// in the manifest before any key is copied. mu must be held.
+func (pm *partitionManager) beginMigration(numPartitions int) (*migration, error) {
+	generation := pm.manifest.Generation + 1
+	genDir := filepath.Join(pm.dataDir, generationDirName(generation))
+	if err := os.RemoveAll(genDir); err != nil {
+		return nil, fmt.Errorf("failed to remove leftover partition directory: %w", err)
+	}
+
+	router, err := NewRouter(reshardOptions(pm.opts, numPartitions))
+	if err != nil {
+		return nil, err
+	}
+	pm.manifest.Resharding = &reshardState{NumPartitions: numPartitions, Generation: generation}
+	targets, err := openPartitions(pm.dataDir, generation, pm.manifest.livePartitions()[generation], pm.opts, pm.memory)
+	if err != nil {
+		pm.manifest.Resharding = nil
+		return nil, err
+	}
+
+	pm.manifest.Files = pm.manifest.liveFiles()
+	if err := writeManifest(pm.dataDir, pm.manifest); err != nil {
+		pm.manifest.Resharding = nil
+		pm.manifest.Files = pm.manifest.liveFiles()
+		for _, pt := range targets {
+			_ = pt.Close()
+		}
+		return nil, err
+	}
+
+	pm.migration = &migration{partitions: targets, router: router, generation: generation}
+	pm.startMigration()
+	return pm.migration, nil
+}
+
+// reshardOptions are the options of the database once it has been resharded
+// to numPartitions. Partition weights are per partition, so they are dropped
+// and the new partitions are weighted equally.
+func reshardOptions(opts options.Options, numPartitions int) options.Options {
+	opts.NumPartitions = numPartitions
+	opts.PartitionWeights = nil
+	return opts
+}
+
+func (m *migration) partitionFor(key types.Key) Partition {
+	return m.partitions[m.router.Route(key)]
+}
+
+func (pm *partitionManager) startMigration() {
+	m := pm.migration
+	m.stop = make(chan struct{})
+	m.done = make(chan struct{})
+
+	go func() {
+		defer close(m.done)
+		for {
+			select {
+			case <-m.stop:
+				m.err = dberrors.ErrClosed
+				return
+			default:
+			}
+
+			finished, err := pm.copyChunk(m)
+			if err != nil {
+				m.err = fmt.Errorf("failed to reshard: %w", err)
+				return
+			}
+			if finished {
+				return
+			}
+		}
+	}()
+}
+
+// copyChunk copies the next ScanBatchSize keys into the target partitions
+// and records how far it got, switching routing once the keyspace is
+// exhausted. The target partitions are synced before progress is recorded,
+// whatever the sync mode, so a recorded position never runs ahead of the
+// copied data.
+func (pm *partitionManager) copyChunk(m *migration) (bool, error) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	it := pm.scanLocked(m.next, "")
+	defer func() { _ = it.Close() }()
+
+	c := newEntryCopier()
+	var last types.Key
+	copied := 0
+	for ; it.Valid() && copied < constants.ScanBatchSize; it.Next() {
+		last = it.Key()
+		copied++
+		if err := c.copy(pm.partitionFor(last), m.partitionFor(last), last); err != nil {
+			return false, err
+		}
+	}
+	if err := it.Err(); err != nil {
+		return false, err
+	}
+	exhausted := !it.Valid()
+
+	if err := c.flush(); err != nil {
+		return false, err
+	}
+	for _, pt := range m.partitions {
+		if err := pt.Sync(); err != nil {
+			return false, err
+		}
+	}
+
+	if exhausted {
+		return true, pm.switchPartitions(m)
+	}
+
+	m.next = last + "\x00"
+	pm.manifest.Resharding.NextKey = []byte(m.next)
+	return false, writeManifest(pm.dataDir, pm.manifest)
+}
+
+// switchPartitions makes the target partitions current. Writing the manifest
+// is the switch: once it is on disk a restart opens the new generation, and
+// the old one is removed as stale if the cleanup here does not finish. mu
+// must be held.
+func (pm *partitionManager) switchPartitions(m *migration) error {
+	next := *pm.manifest
+	next.Generation = m.generation
+	next.NumPartitions = len(m.partitions)
+	next.Options = reshardOptions(next.Options, len(m.partitions))
+	next.Resharding = nil
+	next.Files = next.liveFiles()
+	if err := writeManifest(pm.dataDir, &next); err != nil {
+		return err
+	}
+
+	old := pm.partitions
+	pm.manifest = &next
+	pm.partitions = m.partitions
+	pm.router = m.router
+	pm.opts = reshardOptions(pm.opts, len(m.partitions))
+	pm.migration = nil
+
+	for _, pt := range old {
+		_ = pt.Close()
+	}
+	return removeStalePartitions(pm.dataDir, pm.manifest)
+}
+
+// entryCopier copies entries between partitions with their expiry. Entries
+// without one are batched per destination until flush.
+type entryCopier struct {
+	groups map[Partition]*batch.WriteBatch
+}
+
+func newEntryCopier() *entryCopier {
+	return &entryCopier{groups: make(map[Partition]*batch.WriteBatch)}
+}
+
+// copy reads key from src and writes it to dst. A key that has expired or
+// been deleted since it was found is simply not copied.
+func (c *entryCopier) copy(src, dst Partition, key types.Key) error {
+	value, expiresAt, err := src.GetWithExpiry(key)
+	if errors.Is(err, dberrors.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if expiresAt != 0 {
+		return dst.PutWithExpiry(key, value, expiresAt)
+	}
+	sub, exists := c.groups[dst]
+	if !exists {
+		sub = batch.NewWriteBatch()
+		c.groups[dst] = sub
+	}
+	sub.Put(key, value)
+	return nil
+}
+
+func (c *entryCopier) flush() error {
+	for dst, sub := range c.groups {
+		if err := dst.Write(sub); err != nil {
+			return err
+		}
+		delete(c.groups, dst)
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package partition
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"halo-db/pkg/options"
+	"halo-db/pkg/types"
+	"hash/fnv"
+	"sort"
+)
+
+// Router decides which partition owns a key.
+type Router interface {
+	Route(key types.Key) int
+	NumPartitions() int
+}
+
+type HashFunc func(key types.Key) uint64
+
+// MD5Hash is the first four bytes of the key's MD5 digest, read big endian.
+// It is what databases created before routers were configurable use.
+func MD5Hash(key types.Key) uint64 {
+	hash := md5.Sum([]byte(key))
+	return uint64(binary.BigEndian.Uint32(hash[:4]))
+}
+
+// FNV1aHash is 64-bit FNV-1a, which is much cheaper than MD5. FNV alone
+// leaves the high bits of short, similar keys close together, which bunches
+// up ring points, so the result goes through the murmur3 finalizer.
+func FNV1aHash(key types.Key) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// routingHashes maps the hash names used in options to the names recorded
+// in the manifest. The manifest names describe the exact bits used, so
+// "md5-be32" stays stable even if the option spelling changes.
+var routingHashes = map[string]struct {
+	id string
+	fn HashFunc
+}{
+	"md5":   {hashMD5, MD5Hash},
+	"fnv1a": {hashFNV1a, FNV1aHash},
+}
+
+type moduloRouter struct {
+	numPartitions int
+	hash          HashFunc
+}
+
+// NewModuloRouter routes a key to its hash modulo the partition count. It
+// spreads keys evenly, but changing the count moves nearly every key.
+func NewModuloRouter(numPartitions int, hash HashFunc) Router {
+	return &moduloRouter{numPartitions: numPartitions, hash: hash}
+}
+
+func (r *moduloRouter) Route(key types.Key) int {
+	return int(r.hash(key) % uint64(r.numPartitions))
+}
+
+func (r *moduloRouter) NumPartitions() int {
+	return r.numPartitions
+}
+
+type ringPoint struct {
+	hash      uint64
+	partition int
+}
+
+type consistentRouter struct {
+	ring          []ringPoint
+	numPartitions int
+	hash          HashFunc
+}
+
+// NewConsistentRouter places virtualNodes points per unit of weight on a
+// hash ring for each partition, and routes a key to the partition owning the
+// first point at or after the key's hash. Adding a partition only moves the
+// keys its points take over, about 1/n of them.
+func NewConsistentRouter(weights []int, virtualNodes int, hash HashFunc) Router {
+	r := &consistentRouter{numPartitions: len(weights), hash: hash}
+	for id, weight := range weights {
+		for v := 0; v < weight*virtualNodes; v++ {
+			point := hash(types.Key(fmt.Sprintf("partition-%d-vnode-%d", id, v)))
+			r.ring = append(r.ring, ringPoint{hash: point, partition: id})
+		}
+	}
+	sort.Slice(r.ring, func(i, j int) bool {
+		if r.ring[i].hash != r.ring[j].hash {
+			return r.ring[i].hash < r.ring[j].hash
+		}
+		return r.ring[i].partition < r.ring[j].partition
+	})
+	return r
+}
+
+func (r *consistentRouter) Route(key types.Key) int {
+	h := r.hash(key)
+	i := sort.Search(len(r.ring), func(i int) bool { return r.ring[i].hash >= h })
+	if i == len(r.ring) {
+		i = 0
+	}
+	return r.ring[i].partition
+}
+
+func (r *consistentRouter) NumPartitions() int {
+	return r.numPartitions
+}
+
+// NewRouter builds the hash router opts describe. Range routers depend on
+// where the database has split and are built with NewRangeRouter.
+func NewRouter(opts options.Options) (Router, error) {
+	hash, exists := routingHashes[opts.HashFunction]
+	if !exists {
+		return nil, fmt.Errorf("unknown hash function %q", opts.HashFunction)
+	}
+
+	switch opts.Router {
+	case "modulo":
+		return NewModuloRouter(opts.NumPartitions, hash.fn), nil
+	case "consistent":
+		weights := opts.PartitionWeights
+		if weights == nil {
+			weights = make([]int, opts.NumPartitions)
+			for i := range weights {
+				weights[i] = 1
+			}
+		}
+		return NewConsistentRouter(weights, opts.VirtualNodes, hash.fn), nil
+	case "range":
+		return nil, fmt.Errorf("range routers depend on the database's split points")
+	}
+	return nil, fmt.Errorf("unknown router %q", opts.Router)
+}
+
+type rangeRouter struct {
+	splitPoints []types.Key
+}
+
+// NewRangeRouter gives each partition a contiguous key interval: partition i
+// owns the keys from splitPoints[i-1] up to but not including
+// splitPoints[i], the first partition everything below splitPoints[0] and
+// the last everything from the final split point on. Split points must be
+// sorted.
+func NewRangeRouter(splitPoints []types.Key) Router {
+	return &rangeRouter{splitPoints: splitPoints}
+}
+
+func (r *rangeRouter) Route(key types.Key) int {
+	return sort.Search(len(r.splitPoints), func(i int) bool { return r.splitPoints[i] > key })
+}
+
+func (r *rangeRouter) NumPartitions() int {
+	return len(r.splitPoints) + 1
+}
+
+// bounds returns the interval partition pos owns. An empty end means the
+// interval is unbounded above.
+func (r *rangeRouter) bounds(pos int) (start, end types.Key) {
+	if pos > 0 {
+		start = r.splitPoints[pos-1]
+	}
+	if pos < len(r.splitPoints) {
+		end = r.splitPoints[pos]
+	}
+	return start, end
+}
+
+// clip narrows [start, end) to the part partition pos owns, reporting false
+// if nothing is left.
+func (r *rangeRouter) clip(pos int, start, end types.Key) (types.Key, types.Key, bool) {
+	lo, hi := r.bounds(pos)
+	if lo > start {
+		start = lo
+	}
+	if hi != "" && (end == "" || hi < end) {
+		end = hi
+	}
+	return start, end, end == "" || start < end
+}
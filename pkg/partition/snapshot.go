@@ -0,0 +1,82 @@
+package partition
+
+import (
+	"halo-db/pkg/iterator"
+	"halo-db/pkg/store"
+	"halo-db/pkg/types"
+)
+
+type managerSnapshot struct {
+	snapshots []store.Snapshot
+	router    Router
+}
+
+// Snapshot freezes every partition at once. Every write, single-key or
+// batch, holds txns.mu for reading, so holding it exclusively keeps any
+// write from landing between the partition snapshots.
+func (pm *partitionManager) Snapshot() store.Snapshot {
+	pm.txns.mu.Lock()
+	defer pm.txns.mu.Unlock()
+	return pm.snapshotLocked()
+}
+
+// snapshotLocked must be called with txns.mu held exclusively.
+func (pm *partitionManager) snapshotLocked() store.Snapshot {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	snapshots := make([]store.Snapshot, len(pm.partitions))
+	for i, pt := range pm.partitions {
+		snapshots[i] = pt.Snapshot()
+	}
+	return &managerSnapshot{snapshots: snapshots, router: pm.router}
+}
+
+func (ms *managerSnapshot) Get(key types.Key) (types.Value, error) {
+	return ms.snapshots[ms.router.Route(key)].Get(key)
+}
+
+// List returns every key. Range partitions are listed through a scan, so
+// keys a split has moved but not yet deleted from the old partition are
+// left out, as in listLocked.
+func (ms *managerSnapshot) List() []types.Key {
+	keys := make([]types.Key, 0)
+	if _, ordered := ms.router.(*rangeRouter); ordered {
+		it := ms.Scan("", "")
+		defer func() { _ = it.Close() }()
+		for ; it.Valid(); it.Next() {
+			keys = append(keys, it.Key())
+		}
+		return keys
+	}
+
+	for _, sn := range ms.snapshots {
+		keys = append(keys, sn.List()...)
+	}
+	return keys
+}
+
+// Scan clips range partitions to the part they own, as scanLocked does.
+func (ms *managerSnapshot) Scan(start, end types.Key) iterator.Iterator {
+	ranges, ordered := ms.router.(*rangeRouter)
+
+	iters := make([]iterator.Iterator, 0, len(ms.snapshots))
+	for pos, sn := range ms.snapshots {
+		if !ordered {
+			iters = append(iters, sn.Scan(start, end))
+		} else if from, to, overlaps := ranges.clip(pos, start, end); overlaps {
+			iters = append(iters, sn.Scan(from, to))
+		}
+	}
+	return iterator.NewMergeIterator(iters...)
+}
+
+func (ms *managerSnapshot) ScanPrefix(prefix types.Key) iterator.Iterator {
+	return ms.Scan(prefix, iterator.PrefixEnd(prefix))
+}
+
+func (ms *managerSnapshot) Release() {
+	for _, sn := range ms.snapshots {
+		sn.Release()
+	}
+}
@@ -0,0 +1,376 @@
+package partition
+
+import (
+	"fmt"
+	"halo-db/pkg/batch"
+	"halo-db/pkg/constants"
+	dberrors "halo-db/pkg/errors"
+	"halo-db/pkg/types"
+	"math"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// markWritten notes that pt has been written to, so the splitter looks at it
+// on its next check. Hash partitions never split and are not tracked.
+func (pm *partitionManager) markWritten(pt Partition) {
+	if _, ordered := pm.router.(*rangeRouter); !ordered {
+		return
+	}
+	pm.dirtyMu.Lock()
+	pm.dirty[pt.GetID()] = struct{}{}
+	pm.dirtyMu.Unlock()
+}
+
+// startSplitter checks the range partitions written since the previous
+// check every SplitCheckInterval and splits those above RangeSplitKeys.
+func (pm *partitionManager) startSplitter() {
+	pm.splitStop = make(chan struct{})
+	pm.splitDone = make(chan struct{})
+
+	go func() {
+		defer close(pm.splitDone)
+		ticker := time.NewTicker(pm.opts.SplitCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-pm.splitStop:
+				return
+			case <-ticker.C:
+				_ = pm.checkSplits()
+			}
+		}
+	}()
+}
+
+func (pm *partitionManager) checkSplits() error {
+	pm.dirtyMu.Lock()
+	dirty := pm.dirty
+	pm.dirty = make(map[int]struct{})
+	pm.dirtyMu.Unlock()
+
+	for id := range dirty {
+		if err := pm.splitIfLarge(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitIfLarge splits the partition with the given ID if it holds more than
+// RangeSplitKeys keys.
+func (pm *partitionManager) splitIfLarge(id int) error {
+	pm.mu.RLock()
+	if pm.closed {
+		pm.mu.RUnlock()
+		return dberrors.ErrClosed
+	}
+	pos := pm.partitionPosition(id)
+	if pos < 0 {
+		pm.mu.RUnlock()
+		return nil
+	}
+	count, err := pm.countKeys(pos, pm.opts.RangeSplitKeys+1)
+	pm.mu.RUnlock()
+	if err != nil || count <= pm.opts.RangeSplitKeys {
+		return err
+	}
+
+	sp, err := pm.beginSplit(id)
+	if err != nil || sp == nil {
+		return err
+	}
+	return pm.completeSplit(sp, sp.mid)
+}
+
+func (pm *partitionManager) partitionPosition(id int) int {
+	for pos, pt := range pm.partitions {
+		if pt.GetID() == id {
+			return pos
+		}
+	}
+	return -1
+}
+
+// countKeys counts the keys range partition pos owns, stopping at limit.
+func (pm *partitionManager) countKeys(pos, limit int) (int, error) {
+	start, end := pm.router.(*rangeRouter).bounds(pos)
+	it := pm.partitions[pos].Scan(start, end)
+	defer func() { _ = it.Close() }()
+
+	count := 0
+	for ; it.Valid() && count < limit; it.Next() {
+		count++
+	}
+	return count, it.Err()
+}
+
+// split is a range partition being split in two. The source's keys from mid
+// up are copied into upper, and until the router switches over, writes to
+// them go to both.
+type split struct {
+	source Partition
+	upper  Partition
+	dir    string
+	mid    types.Key
+	end    types.Key
+	// mu is held by writers to the moving keys while they write both
+	// partitions, and by the copier for each chunk, so a chunk never copies
+	// over a value a write has already put in upper.
+	mu sync.RWMutex
+}
+
+func (sp *split) covers(key types.Key) bool {
+	return key >= sp.mid && (sp.end == "" || key < sp.end)
+}
+
+// moving returns the operations of b on the keys sp is moving, or nil if
+// there are none.
+func (sp *split) moving(b *batch.WriteBatch) *batch.WriteBatch {
+	var sub *batch.WriteBatch
+	for _, op := range b.Ops() {
+		if !sp.covers(op.Key) {
+			continue
+		}
+		if sub == nil {
+			sub = batch.NewWriteBatch()
+		}
+		if op.Type == batch.OpDelete {
+			sub.Delete(op.Key)
+		} else {
+			sub.Put(op.Key, op.Value)
+		}
+	}
+	return sub
+}
+
+// beginSplit picks the middle key of range partition id and opens the
+// partition that will take the keys from there up. Finding the middle scans
+// the partition, so it is done under the shared lock; the exclusive one is
+// only taken to start sending writes to both partitions. It returns nil if
+// the partition is gone or too small to split.
+func (pm *partitionManager) beginSplit(id int) (*split, error) {
+	pm.mu.RLock()
+	if pm.closed {
+		pm.mu.RUnlock()
+		return nil, dberrors.ErrClosed
+	}
+	pos := pm.partitionPosition(id)
+	if pos < 0 {
+		pm.mu.RUnlock()
+		return nil, nil
+	}
+	start, end := pm.router.(*rangeRouter).bounds(pos)
+	source := pm.partitions[pos]
+	count, err := pm.countKeys(pos, math.MaxInt)
+	var mid types.Key
+	if err == nil && count >= 2 {
+		mid, err = keyAt(source, start, end, count/2)
+	}
+	upperID := 0
+	for _, r := range pm.manifest.Ranges {
+		upperID = max(upperID, r.ID+1)
+	}
+	dir := partitionDir(pm.dataDir, pm.manifest.Generation, upperID)
+	opts := pm.opts
+	pm.mu.RUnlock()
+	if err != nil || count < 2 {
+		return nil, err
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, fmt.Errorf("failed to remove leftover partition directory: %w", err)
+	}
+	upper, err := openPartition(upperID, dir, opts, pm.memory)
+	if err != nil {
+		return nil, err
+	}
+	sp := &split{source: source, upper: upper, dir: dir, mid: mid, end: end}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	if pm.closed {
+		_ = upper.Close()
+		_ = os.RemoveAll(dir)
+		return nil, dberrors.ErrClosed
+	}
+	pm.splitting = sp
+	return sp, nil
+}
+
+// completeSplit copies the moving keys from next up into the new partition
+// and switches them over to it. The new partition is synced before the
+// manifest records it, so a crash before that point leaves only a stale
+// directory. The moved keys are then deleted from the old partition; any a
+// crash leaves behind are outside its range, never read, and trimmed on the
+// next open.
+func (pm *partitionManager) completeSplit(sp *split, next types.Key) error {
+	for {
+		var done bool
+		var err error
+		if next, done, err = pm.copySplitChunk(sp, next); err != nil {
+			return pm.abortSplit(sp, err)
+		}
+		if done {
+			break
+		}
+	}
+	if err := sp.upper.Sync(); err != nil {
+		return pm.abortSplit(sp, err)
+	}
+	if err := pm.finishSplit(sp); err != nil {
+		return pm.abortSplit(sp, err)
+	}
+
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	return deleteRange(sp.source, sp.mid, sp.end)
+}
+
+// copySplitChunk copies up to ScanBatchSize keys from next up, and returns
+// where the next chunk starts and whether there are any keys left. Writes to
+// the moving keys wait for the chunk; all others carry on.
+func (pm *partitionManager) copySplitChunk(sp *split, next types.Key) (types.Key, bool, error) {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	if pm.closed {
+		return "", false, dberrors.ErrClosed
+	}
+
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	it := sp.source.Scan(next, sp.end)
+	defer func() { _ = it.Close() }()
+
+	c := newEntryCopier()
+	var last types.Key
+	copied := 0
+	for ; it.Valid() && copied < constants.ScanBatchSize; it.Next() {
+		last = it.Key()
+		copied++
+		if err := c.copy(sp.source, sp.upper, last); err != nil {
+			return "", false, err
+		}
+	}
+	if err := it.Err(); err != nil {
+		return "", false, err
+	}
+	if err := c.flush(); err != nil {
+		return "", false, err
+	}
+	return last + "\x00", !it.Valid(), nil
+}
+
+// finishSplit records the split in the manifest and routes the moved keys
+// to the new partition, the only part of a split that stops reads and
+// writes.
+func (pm *partitionManager) finishSplit(sp *split) error {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	if pm.closed {
+		return dberrors.ErrClosed
+	}
+	pos := pm.partitionPosition(sp.source.GetID())
+	id := sp.upper.GetID()
+
+	next := *pm.manifest
+	next.Ranges = slices.Insert(slices.Clone(next.Ranges), pos+1, keyRange{ID: id, Start: []byte(sp.mid)})
+	next.NumPartitions++
+	next.Options.NumPartitions++
+	next.Files = next.liveFiles()
+	if err := writeManifest(pm.dataDir, &next); err != nil {
+		return err
+	}
+
+	pm.manifest = &next
+	pm.partitions = slices.Insert(pm.partitions, pos+1, sp.upper)
+	pm.router = NewRangeRouter(next.splitPoints())
+	pm.opts.NumPartitions++
+	pm.splitting = nil
+
+	pm.dirtyMu.Lock()
+	pm.dirty[sp.source.GetID()] = struct{}{}
+	pm.dirty[id] = struct{}{}
+	pm.dirtyMu.Unlock()
+	return nil
+}
+
+func (pm *partitionManager) abortSplit(sp *split, err error) error {
+	pm.mu.Lock()
+	pm.splitting = nil
+	pm.mu.Unlock()
+
+	_ = sp.upper.Close()
+	_ = os.RemoveAll(sp.dir)
+	return fmt.Errorf("failed to split partition %d: %w", sp.source.GetID(), err)
+}
+
+// keyAt returns the key n keys into [start, end) of pt.
+func keyAt(pt Partition, start, end types.Key, n int) (types.Key, error) {
+	it := pt.Scan(start, end)
+	defer func() { _ = it.Close() }()
+
+	for i := 0; i < n && it.Valid(); i++ {
+		it.Next()
+	}
+	if !it.Valid() {
+		if err := it.Err(); err != nil {
+			return "", err
+		}
+		return "", fmt.Errorf("partition %d shrank while being split", pt.GetID())
+	}
+	return it.Key(), nil
+}
+
+// deleteRange deletes every key of pt in [start, end).
+func deleteRange(pt Partition, start, end types.Key) error {
+	for {
+		it := pt.Scan(start, end)
+		b := batch.NewWriteBatch()
+		for ; it.Valid() && b.Len() < constants.ScanBatchSize; it.Next() {
+			b.Delete(it.Key())
+		}
+		err := it.Err()
+		_ = it.Close()
+		if err != nil {
+			return err
+		}
+		if b.Len() == 0 {
+			return nil
+		}
+		if err := pt.Write(b); err != nil {
+			return err
+		}
+	}
+}
+
+// trimRanges deletes keys that range partitions hold outside their range,
+// left behind by a split that was interrupted after it was recorded.
+func (pm *partitionManager) trimRanges() error {
+	ranges, ordered := pm.router.(*rangeRouter)
+	if !ordered {
+		return nil
+	}
+
+	for pos, pt := range pm.partitions {
+		start, end := ranges.bounds(pos)
+		if start != "" {
+			if err := deleteRange(pt, "", start); err != nil {
+				return err
+			}
+		}
+		if end != "" {
+			if err := deleteRange(pt, end, ""); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
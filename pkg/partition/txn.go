@@ -0,0 +1,383 @@
+package partition
+
+import (
+	"errors"
+	"fmt"
+	"halo-db/pkg/batch"
+	"halo-db/pkg/constants"
+	dberrors "halo-db/pkg/errors"
+	"halo-db/pkg/iterator"
+	"halo-db/pkg/memtable"
+	"halo-db/pkg/store"
+	"halo-db/pkg/types"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTxnConflict    = dberrors.ErrConflict
+	ErrTxnDone        = errors.New("transaction already committed or rolled back")
+	ErrTxnLockTimeout = fmt.Errorf("%w: timed out waiting for key lock", dberrors.ErrConflict)
+)
+
+type Txn interface {
+	Get(key types.Key) (types.Value, error)
+	Put(key types.Key, value types.Value) error
+	Delete(key types.Key) error
+	Scan(start, end types.Key) iterator.Iterator
+	Commit() error
+	Rollback() error
+}
+
+type txn struct {
+	pm          *partitionManager
+	pessimistic bool
+	startSeq    uint64
+	snapshot    store.Snapshot
+	writes      memtable.Memtable
+	reads       map[types.Key]struct{}
+	done        bool
+	mu          sync.Mutex
+}
+
+// Begin starts an optimistic transaction. Reads come from a snapshot taken
+// here, and Commit fails with ErrTxnConflict if any key the transaction read
+// or wrote was changed by someone else in the meantime. Keys are tracked
+// individually, so a scan does not notice keys inserted into its range.
+func (pm *partitionManager) Begin() Txn {
+	t := &txn{
+		pm:     pm,
+		writes: memtable.NewMemtable(pm.opts.MemtableSize),
+		reads:  make(map[types.Key]struct{}),
+	}
+
+	pm.txns.mu.Lock()
+	defer pm.txns.mu.Unlock()
+
+	t.startSeq = pm.txns.begin(t)
+	t.snapshot = pm.snapshotLocked()
+	return t
+}
+
+// BeginPessimistic starts a transaction that locks every key it reads or
+// writes until it finishes, so Commit never conflicts. Locks are only
+// honoured by other transactions; plain writes go straight through. Scans
+// read the latest data and do not lock the keys they return.
+func (pm *partitionManager) BeginPessimistic() Txn {
+	return &txn{
+		pm:          pm,
+		pessimistic: true,
+		writes:      memtable.NewMemtable(pm.opts.MemtableSize),
+		reads:       make(map[types.Key]struct{}),
+	}
+}
+
+func (t *txn) Get(key types.Key) (types.Value, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.done {
+		return nil, ErrTxnDone
+	}
+
+	if entry, found := t.writes.Get(key); found {
+		if entry.Kind == types.KindTombstone {
+			return nil, dberrors.ErrNotFound
+		}
+		return entry.Value, nil
+	}
+
+	if t.pessimistic {
+		if err := t.pm.locks.acquire(t, key); err != nil {
+			return nil, err
+		}
+		return t.pm.Get(key)
+	}
+
+	t.reads[key] = struct{}{}
+	return t.snapshot.Get(key)
+}
+
+func (t *txn) Put(key types.Key, value types.Value) error {
+	return t.write(key, value, types.KindValue)
+}
+
+func (t *txn) Delete(key types.Key) error {
+	return t.write(key, nil, types.KindTombstone)
+}
+
+func (t *txn) write(key types.Key, value types.Value, kind types.Kind) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.done {
+		return ErrTxnDone
+	}
+	if t.pessimistic {
+		if err := t.pm.locks.acquire(t, key); err != nil {
+			return err
+		}
+	}
+
+	if kind == types.KindTombstone {
+		t.writes.Delete(key)
+	} else {
+		t.writes.Put(key, value)
+	}
+	return nil
+}
+
+// Scan merges the transaction's own writes over the data it reads from.
+func (t *txn) Scan(start, end types.Key) iterator.Iterator {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.done {
+		return iterator.NewEmptyIterator(ErrTxnDone)
+	}
+
+	writes := iterator.NewPagedIterator(start, end, constants.ScanBatchSize, t.scanWrites)
+	if t.pessimistic {
+		return iterator.NewMergeIterator(writes, t.pm.Scan(start, end))
+	}
+	return &trackingIterator{
+		Iterator: iterator.NewMergeIterator(writes, t.snapshot.Scan(start, end)),
+		txn:      t,
+	}
+}
+
+func (t *txn) scanWrites(start, end types.Key, fn func(types.Key, types.Value) bool) error {
+	t.writes.Scan(start, end, fn)
+	return nil
+}
+
+func (t *txn) Commit() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.done {
+		return ErrTxnDone
+	}
+	defer t.finish()
+
+	b := batch.NewWriteBatch()
+	for _, entry := range t.writes.GetAllEntries() {
+		if entry.Kind == types.KindTombstone {
+			b.Delete(entry.Key)
+		} else {
+			b.Put(entry.Key, entry.Value)
+		}
+	}
+
+	if t.pessimistic {
+		return t.pm.Write(b)
+	}
+
+	tracker := t.pm.txns
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	for key := range t.reads {
+		if tracker.changedSince(key, t.startSeq) {
+			return fmt.Errorf("%w: key %s was modified", ErrTxnConflict, key)
+		}
+	}
+	for _, op := range b.Ops() {
+		if tracker.changedSince(op.Key, t.startSeq) {
+			return fmt.Errorf("%w: key %s was modified", ErrTxnConflict, op.Key)
+		}
+	}
+
+	if err := t.pm.writeBatch(b); err != nil {
+		return err
+	}
+	tracker.recordWrites(batchKeys(b)...)
+	return nil
+}
+
+func (t *txn) Rollback() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.done {
+		return ErrTxnDone
+	}
+	t.finish()
+	return nil
+}
+
+func (t *txn) finish() {
+	t.done = true
+	t.writes.Clear()
+
+	if t.pessimistic {
+		t.pm.locks.releaseAll(t)
+		return
+	}
+
+	t.snapshot.Release()
+	t.pm.txns.end(t)
+}
+
+// trackingIterator adds every key a scan lands on to the transaction's read
+// set.
+type trackingIterator struct {
+	iterator.Iterator
+	txn *txn
+}
+
+func (it *trackingIterator) Seek(key types.Key) {
+	it.Iterator.Seek(key)
+	it.track()
+}
+
+func (it *trackingIterator) Next() {
+	it.Iterator.Next()
+	it.track()
+}
+
+func (it *trackingIterator) Valid() bool {
+	valid := it.Iterator.Valid()
+	if valid {
+		it.track()
+	}
+	return valid
+}
+
+func (it *trackingIterator) track() {
+	if !it.Iterator.Valid() {
+		return
+	}
+	it.txn.mu.Lock()
+	if !it.txn.done {
+		it.txn.reads[it.Iterator.Key()] = struct{}{}
+	}
+	it.txn.mu.Unlock()
+}
+
+// txnTracker remembers the sequence number of the last write to each key
+// while optimistic transactions are running. Writers hold mu shared while
+// they apply and record a write; Begin and Commit hold it exclusively, so a
+// write is always recorded before a later transaction can start or validate.
+type txnTracker struct {
+	mu        sync.RWMutex
+	trackMu   sync.Mutex
+	seq       uint64
+	lastWrite map[types.Key]uint64
+	active    map[*txn]struct{}
+}
+
+func newTxnTracker() *txnTracker {
+	return &txnTracker{
+		lastWrite: make(map[types.Key]uint64),
+		active:    make(map[*txn]struct{}),
+	}
+}
+
+func (tt *txnTracker) begin(t *txn) uint64 {
+	tt.trackMu.Lock()
+	defer tt.trackMu.Unlock()
+
+	tt.active[t] = struct{}{}
+	return tt.seq
+}
+
+func (tt *txnTracker) end(t *txn) {
+	tt.trackMu.Lock()
+	defer tt.trackMu.Unlock()
+
+	delete(tt.active, t)
+	if len(tt.active) == 0 {
+		tt.lastWrite = make(map[types.Key]uint64)
+	}
+}
+
+func (tt *txnTracker) recordWrites(keys ...types.Key) {
+	tt.trackMu.Lock()
+	defer tt.trackMu.Unlock()
+
+	if len(tt.active) == 0 {
+		return
+	}
+	tt.seq++
+	for _, key := range keys {
+		tt.lastWrite[key] = tt.seq
+	}
+}
+
+func (tt *txnTracker) changedSince(key types.Key, seq uint64) bool {
+	tt.trackMu.Lock()
+	defer tt.trackMu.Unlock()
+	return tt.lastWrite[key] > seq
+}
+
+type keyLock struct {
+	owner    *txn
+	released chan struct{}
+}
+
+type lockTable struct {
+	locks   map[types.Key]*keyLock
+	held    map[*txn][]types.Key
+	timeout time.Duration
+	mu      sync.Mutex
+}
+
+func newLockTable(timeout time.Duration) *lockTable {
+	return &lockTable{
+		locks:   make(map[types.Key]*keyLock),
+		held:    make(map[*txn][]types.Key),
+		timeout: timeout,
+	}
+}
+
+// acquire takes an exclusive lock on key for t. Waiting is bounded by the
+// lock timeout, which is also how deadlocks between transactions end.
+func (lt *lockTable) acquire(t *txn, key types.Key) error {
+	timer := time.NewTimer(lt.timeout)
+	defer timer.Stop()
+
+	for {
+		lt.mu.Lock()
+		l, exists := lt.locks[key]
+		if !exists {
+			lt.locks[key] = &keyLock{owner: t, released: make(chan struct{})}
+			lt.held[t] = append(lt.held[t], key)
+			lt.mu.Unlock()
+			return nil
+		}
+		if l.owner == t {
+			lt.mu.Unlock()
+			return nil
+		}
+		released := l.released
+		lt.mu.Unlock()
+
+		select {
+		case <-released:
+		case <-timer.C:
+			return fmt.Errorf("%w: %s", ErrTxnLockTimeout, key)
+		}
+	}
+}
+
+func (lt *lockTable) releaseAll(t *txn) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+
+	for _, key := range lt.held[t] {
+		if l, exists := lt.locks[key]; exists && l.owner == t {
+			close(l.released)
+			delete(lt.locks, key)
+		}
+	}
+	delete(lt.held, t)
+}
+
+func batchKeys(b *batch.WriteBatch) []types.Key {
+	keys := make([]types.Key, 0, b.Len())
+	for _, op := range b.Ops() {
+		keys = append(keys, op.Key)
+	}
+	return keys
+}
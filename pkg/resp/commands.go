@@ -0,0 +1,457 @@
+package resp
+
+import (
+	"errors"
+	"fmt"
+	"halo-db/pkg/batch"
+	dberrors "halo-db/pkg/errors"
+	"halo-db/pkg/iterator"
+	"halo-db/pkg/types"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultScanCount = 10
+
+// dispatch runs one command and writes its reply. cursors holds the SCAN
+// cursors of the connection it came in on. It reports whether the client
+// asked to close the connection.
+func (s *server) dispatch(w writer, cursors *cursorTable, args [][]byte) bool {
+	name := strings.ToUpper(string(args[0]))
+	args = args[1:]
+
+	switch name {
+	case "PING":
+		s.ping(w, args)
+	case "ECHO":
+		if len(args) != 1 {
+			wrongArgs(w, name)
+			return false
+		}
+		w.bulk(args[0])
+	case "GET":
+		s.get(w, args)
+	case "SET":
+		s.set(w, args)
+	case "DEL":
+		s.del(w, args)
+	case "EXISTS":
+		s.exists(w, args)
+	case "KEYS":
+		s.keys(w, args)
+	case "SCAN":
+		s.scan(w, cursors, args)
+	case "MGET":
+		s.mget(w, args)
+	case "MSET":
+		s.mset(w, args)
+	case "INFO":
+		s.info(w)
+	case "COMMAND":
+		w.array(0)
+	case "SELECT":
+		if len(args) != 1 {
+			wrongArgs(w, name)
+		} else if string(args[0]) != "0" {
+			w.error("ERR DB index is out of range")
+		} else {
+			w.simple("OK")
+		}
+	case "QUIT":
+		w.simple("OK")
+		return true
+	default:
+		w.error(fmt.Sprintf("ERR unknown command '%s'", strings.ToLower(name)))
+	}
+	return false
+}
+
+func (s *server) ping(w writer, args [][]byte) {
+	switch len(args) {
+	case 0:
+		w.simple("PONG")
+	case 1:
+		w.bulk(args[0])
+	default:
+		wrongArgs(w, "PING")
+	}
+}
+
+func (s *server) get(w writer, args [][]byte) {
+	if len(args) != 1 {
+		wrongArgs(w, "GET")
+		return
+	}
+	value, err := s.pm.Get(types.Key(args[0]))
+	if err != nil {
+		if isNotFound(err) {
+			w.null()
+		} else {
+			w.error("ERR " + err.Error())
+		}
+		return
+	}
+	w.bulk(value)
+}
+
+// set supports the EX and PX options; they map onto PutWithTTL.
+func (s *server) set(w writer, args [][]byte) {
+	if len(args) != 2 && len(args) != 4 {
+		w.error("ERR syntax error")
+		return
+	}
+	key, value := types.Key(args[0]), types.Value(args[1])
+
+	var err error
+	if len(args) == 4 {
+		n, parseErr := strconv.ParseInt(string(args[3]), 10, 64)
+		if parseErr != nil || n <= 0 {
+			w.error("ERR invalid expire time in 'set' command")
+			return
+		}
+
+		var ttl time.Duration
+		switch strings.ToUpper(string(args[2])) {
+		case "EX":
+			ttl = time.Duration(n) * time.Second
+		case "PX":
+			ttl = time.Duration(n) * time.Millisecond
+		default:
+			w.error("ERR syntax error")
+			return
+		}
+		err = s.pm.PutWithTTL(key, value, ttl)
+	} else {
+		err = s.pm.Put(key, value)
+	}
+
+	if err != nil {
+		w.error("ERR " + err.Error())
+		return
+	}
+	w.simple("OK")
+}
+
+func (s *server) del(w writer, args [][]byte) {
+	if len(args) == 0 {
+		wrongArgs(w, "DEL")
+		return
+	}
+
+	deleted := int64(0)
+	for _, arg := range args {
+		key := types.Key(arg)
+		exists, err := s.keyExists(key)
+		if err != nil {
+			w.error("ERR " + err.Error())
+			return
+		}
+		if !exists {
+			continue
+		}
+		if err := s.pm.Delete(key); err != nil {
+			w.error("ERR " + err.Error())
+			return
+		}
+		deleted++
+	}
+	w.integer(deleted)
+}
+
+func (s *server) exists(w writer, args [][]byte) {
+	if len(args) == 0 {
+		wrongArgs(w, "EXISTS")
+		return
+	}
+
+	count := int64(0)
+	for _, arg := range args {
+		exists, err := s.keyExists(types.Key(arg))
+		if err != nil {
+			w.error("ERR " + err.Error())
+			return
+		}
+		if exists {
+			count++
+		}
+	}
+	w.integer(count)
+}
+
+func (s *server) keyExists(key types.Key) (bool, error) {
+	_, err := s.pm.Get(key)
+	if err == nil {
+		return true, nil
+	}
+	if isNotFound(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+func (s *server) keys(w writer, args [][]byte) {
+	if len(args) != 1 {
+		wrongArgs(w, "KEYS")
+		return
+	}
+	pattern := string(args[0])
+
+	it := s.scanPattern("", pattern)
+	defer func() { _ = it.Close() }()
+
+	var keys []types.Key
+	for ; it.Valid(); it.Next() {
+		if match(pattern, it.Key()) {
+			keys = append(keys, it.Key())
+		}
+	}
+	if err := it.Err(); err != nil {
+		w.error("ERR " + err.Error())
+		return
+	}
+
+	w.array(len(keys))
+	for _, key := range keys {
+		w.bulk([]byte(key))
+	}
+}
+
+// scan walks the keyspace in key order. COUNT bounds the number of keys
+// examined per call, as in Redis, so a call can return fewer matches.
+func (s *server) scan(w writer, cursors *cursorTable, args [][]byte) {
+	if len(args) == 0 || len(args)%2 != 1 {
+		w.error("ERR syntax error")
+		return
+	}
+
+	cursor, err := strconv.ParseUint(string(args[0]), 10, 64)
+	if err != nil {
+		w.error("ERR invalid cursor")
+		return
+	}
+
+	pattern := "*"
+	count := defaultScanCount
+	for i := 1; i < len(args); i += 2 {
+		switch strings.ToUpper(string(args[i])) {
+		case "MATCH":
+			pattern = string(args[i+1])
+		case "COUNT":
+			count, err = strconv.Atoi(string(args[i+1]))
+			if err != nil || count <= 0 {
+				w.error("ERR value is not an integer or out of range")
+				return
+			}
+		default:
+			w.error("ERR syntax error")
+			return
+		}
+	}
+
+	var after types.Key
+	if cursor != 0 {
+		var found bool
+		if after, found = cursors.load(cursor); !found {
+			w.error("ERR invalid cursor")
+			return
+		}
+	}
+
+	it := s.scanPattern(after, pattern)
+	defer func() { _ = it.Close() }()
+
+	var keys []types.Key
+	var last types.Key
+	examined := 0
+	for ; it.Valid() && examined < count; it.Next() {
+		if cursor != 0 && it.Key() == after {
+			continue
+		}
+		last = it.Key()
+		examined++
+		if match(pattern, last) {
+			keys = append(keys, last)
+		}
+	}
+	if err := it.Err(); err != nil {
+		w.error("ERR " + err.Error())
+		return
+	}
+
+	next := uint64(0)
+	if it.Valid() {
+		next = cursors.save(last)
+	}
+
+	w.array(2)
+	w.bulk([]byte(strconv.FormatUint(next, 10)))
+	w.array(len(keys))
+	for _, key := range keys {
+		w.bulk([]byte(key))
+	}
+}
+
+// scanPattern narrows the scan to the literal prefix of a glob pattern so
+// that KEYS user:* does not walk the whole keyspace.
+func (s *server) scanPattern(from types.Key, pattern string) iterator.Iterator {
+	prefix := pattern
+	if i := strings.IndexAny(pattern, `*?[\`); i >= 0 {
+		prefix = pattern[:i]
+	}
+
+	start := from
+	if prefix > start {
+		start = prefix
+	}
+	return s.pm.Scan(start, iterator.PrefixEnd(prefix))
+}
+
+func (s *server) mget(w writer, args [][]byte) {
+	if len(args) == 0 {
+		wrongArgs(w, "MGET")
+		return
+	}
+
+	// Every value is read before the reply starts, so a failed read can
+	// still be reported as an error rather than a missing key.
+	values := make([]types.Value, len(args))
+	missing := make([]bool, len(args))
+	for i, arg := range args {
+		value, err := s.pm.Get(types.Key(arg))
+		if err != nil {
+			if !isNotFound(err) {
+				w.error("ERR " + err.Error())
+				return
+			}
+			missing[i] = true
+		}
+		values[i] = value
+	}
+
+	w.array(len(values))
+	for i, value := range values {
+		if missing[i] {
+			w.null()
+			continue
+		}
+		w.bulk(value)
+	}
+}
+
+// mset writes all pairs as one batch, so either every key is set or none.
+func (s *server) mset(w writer, args [][]byte) {
+	if len(args) == 0 || len(args)%2 != 0 {
+		wrongArgs(w, "MSET")
+		return
+	}
+
+	b := batch.NewWriteBatch()
+	for i := 0; i < len(args); i += 2 {
+		b.Put(types.Key(args[i]), types.Value(args[i+1]))
+	}
+	if err := s.pm.Write(b); err != nil {
+		w.error("ERR " + err.Error())
+		return
+	}
+	w.simple("OK")
+}
+
+func (s *server) info(w writer) {
+	stats := s.pm.GetStats()
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	sb.WriteString("# Server\r\n")
+	sb.WriteString("halo_db_mode:standalone\r\n")
+	fmt.Fprintf(&sb, "partitions:%v\r\n", stats["num_partitions"])
+	sb.WriteString("\r\n# Stats\r\n")
+	for _, name := range names {
+		fmt.Fprintf(&sb, "%s:%v\r\n", name, stats[name])
+	}
+	w.bulk([]byte(sb.String()))
+}
+
+func wrongArgs(w writer, name string) {
+	w.error(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+}
+
+// match reports whether key matches a Redis glob pattern: * and ? match
+// any run of bytes and any single byte, [abc] and [a-z] match a set, and a
+// backslash escapes the next byte.
+func match(pattern string, key types.Key) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(key); i++ {
+				if match(pattern, key[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(key) == 0 {
+				return false
+			}
+		case '[':
+			if len(key) == 0 {
+				return false
+			}
+			end := strings.IndexByte(pattern[1:], ']')
+			if end < 0 {
+				return false
+			}
+			if !matchSet(pattern[1:end+1], key[0]) {
+				return false
+			}
+			pattern = pattern[end+1:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(key) == 0 || key[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern = pattern[1:]
+		key = key[1:]
+	}
+	return len(key) == 0
+}
+
+func matchSet(set string, c byte) bool {
+	negate := len(set) > 0 && set[0] == '^'
+	if negate {
+		set = set[1:]
+	}
+
+	matched := false
+	for i := 0; i < len(set); i++ {
+		if i+2 < len(set) && set[i+1] == '-' {
+			if set[i] <= c && c <= set[i+2] {
+				matched = true
+			}
+			i += 2
+		} else if set[i] == c {
+			matched = true
+		}
+	}
+	return matched != negate
+}
+
+func isNotFound(err error) bool {
+	return errors.Is(err, dberrors.ErrNotFound)
+}
@@ -0,0 +1,123 @@
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxBulkSize  = 512 << 20
+	maxArraySize = 1 << 20
+	maxInlineLen = 64 << 10
+)
+
+var ErrProtocol = errors.New("protocol error")
+
+// readCommand reads one request, either a RESP array of bulk strings as sent
+// by client libraries or an inline command line as typed into telnet.
+func readCommand(r *bufio.Reader) ([][]byte, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, nil
+	}
+	if line[0] != '*' {
+		return splitInline(string(line)), nil
+	}
+
+	count, err := strconv.Atoi(string(line[1:]))
+	if err != nil || count > maxArraySize {
+		return nil, fmt.Errorf("%w: invalid multibulk length", ErrProtocol)
+	}
+	if count <= 0 {
+		return nil, nil
+	}
+
+	args := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, fmt.Errorf("%w: expected '$', got '%s'", ErrProtocol, line)
+		}
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil || size < 0 || size > maxBulkSize {
+			return nil, fmt.Errorf("%w: invalid bulk length", ErrProtocol)
+		}
+
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		if buf[size] != '\r' || buf[size+1] != '\n' {
+			return nil, fmt.Errorf("%w: bulk string not terminated by CRLF", ErrProtocol)
+		}
+		args = append(args, buf[:size])
+	}
+	return args, nil
+}
+
+func readLine(r *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, isPrefix, err := r.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, chunk...)
+		if len(line) > maxInlineLen {
+			return nil, fmt.Errorf("%w: line too long", ErrProtocol)
+		}
+		if !isPrefix {
+			return line, nil
+		}
+	}
+}
+
+func splitInline(line string) [][]byte {
+	fields := strings.Fields(line)
+	args := make([][]byte, len(fields))
+	for i, field := range fields {
+		args[i] = []byte(field)
+	}
+	return args
+}
+
+type writer struct {
+	*bufio.Writer
+}
+
+func (w writer) simple(s string) {
+	w.WriteString("+" + s + "\r\n")
+}
+
+func (w writer) error(msg string) {
+	msg = strings.NewReplacer("\r", " ", "\n", " ").Replace(msg)
+	w.WriteString("-" + msg + "\r\n")
+}
+
+func (w writer) integer(n int64) {
+	w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func (w writer) bulk(b []byte) {
+	w.WriteString("$" + strconv.Itoa(len(b)) + "\r\n")
+	w.Write(b)
+	w.WriteString("\r\n")
+}
+
+func (w writer) null() {
+	w.WriteString("$-1\r\n")
+}
+
+func (w writer) array(n int) {
+	w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
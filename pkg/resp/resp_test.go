@@ -0,0 +1,333 @@
+package resp
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"halo-db/pkg/partition"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadCommand(t *testing.T) {
+	input := "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nva\r\nl\r\nPING hello\r\n"
+	r := bufio.NewReader(strings.NewReader(input))
+
+	args, err := readCommand(r)
+	if err != nil {
+		t.Fatalf("Failed to read command: %v", err)
+	}
+	if len(args) != 3 || string(args[0]) != "SET" || string(args[2]) != "va\r\nl" {
+		t.Fatalf("Unexpected multibulk command: %q", args)
+	}
+
+	args, err = readCommand(r)
+	if err != nil {
+		t.Fatalf("Failed to read inline command: %v", err)
+	}
+	if len(args) != 2 || string(args[0]) != "PING" || string(args[1]) != "hello" {
+		t.Fatalf("Unexpected inline command: %q", args)
+	}
+
+	if _, err := readCommand(r); err != io.EOF {
+		t.Fatalf("Expected EOF, got %v", err)
+	}
+
+	r = bufio.NewReader(strings.NewReader("*1\r\n$abc\r\n"))
+	if _, err := readCommand(r); err == nil {
+		t.Fatal("Expected a protocol error for a bad bulk length")
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		key     string
+		want    bool
+	}{
+		{"*", "anything/at:all", true},
+		{"user:*", "user:1", true},
+		{"user:*", "order:1", false},
+		{"h?llo", "hello", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{"*:end", "a:b:end", true},
+	}
+	for _, tc := range tests {
+		if got := match(tc.pattern, tc.key); got != tc.want {
+			t.Errorf("match(%q, %q) = %v, want %v", tc.pattern, tc.key, got, tc.want)
+		}
+	}
+}
+
+func startServer(t *testing.T) (Server, partition.PartitionManager, net.Conn) {
+	t.Helper()
+
+	pm, err := partition.NewPartitionManager(4, t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create partition manager: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	srv := NewServer(pm)
+	go func() { _ = srv.Serve(listener) }()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+
+	t.Cleanup(func() {
+		_ = conn.Close()
+		_ = srv.Shutdown(context.Background())
+		_ = pm.Close()
+	})
+	return srv, pm, conn
+}
+
+func encode(args ...string) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&sb, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return sb.String()
+}
+
+func readReply(t *testing.T, r *bufio.Reader) interface{} {
+	t.Helper()
+
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("Failed to read reply: %v", err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+
+	switch line[0] {
+	case '+':
+		return line[1:]
+	case '-':
+		return fmt.Errorf("%s", line[1:])
+	case ':':
+		n, _ := strconv.ParseInt(line[1:], 10, 64)
+		return n
+	case '$':
+		size, _ := strconv.Atoi(line[1:])
+		if size < 0 {
+			return nil
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			t.Fatalf("Failed to read bulk reply: %v", err)
+		}
+		return string(buf[:size])
+	case '*':
+		count, _ := strconv.Atoi(line[1:])
+		items := make([]interface{}, count)
+		for i := range items {
+			items[i] = readReply(t, r)
+		}
+		return items
+	}
+	t.Fatalf("Unexpected reply line %q", line)
+	return nil
+}
+
+func TestServerCommands(t *testing.T) {
+	_, _, conn := startServer(t)
+	r := bufio.NewReader(conn)
+
+	// Everything is written in one go to exercise pipelining.
+	requests := []string{
+		encode("PING"),
+		encode("SET", "user:1", "alice"),
+		encode("SET", "user:2", "bob"),
+		encode("MSET", "order:1", "x", "order:2", "y"),
+		encode("GET", "user:1"),
+		encode("GET", "missing"),
+		encode("MGET", "user:2", "missing"),
+		encode("EXISTS", "user:1", "user:2", "missing"),
+		encode("KEYS", "user:*"),
+		encode("DEL", "user:1", "missing"),
+		encode("GET", "user:1"),
+		encode("SET", "temp", "v", "PX", "50"),
+		encode("NOSUCH"),
+		"PING inline\r\n",
+	}
+	if _, err := conn.Write([]byte(strings.Join(requests, ""))); err != nil {
+		t.Fatalf("Failed to write pipeline: %v", err)
+	}
+
+	expected := []interface{}{
+		"PONG",
+		"OK",
+		"OK",
+		"OK",
+		"alice",
+		nil,
+		[]interface{}{"bob", nil},
+		int64(2),
+		[]interface{}{"user:1", "user:2"},
+		int64(1),
+		nil,
+		"OK",
+		fmt.Errorf("ERR unknown command 'nosuch'"),
+		"inline",
+	}
+	for i, want := range expected {
+		got := readReply(t, r)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Reply %d: expected %#v, got %#v", i, want, got)
+		}
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	_, _ = conn.Write([]byte(encode("GET", "temp")))
+	if got := readReply(t, r); got != nil {
+		t.Errorf("Expected expired key to read as nil, got %#v", got)
+	}
+
+	_, _ = conn.Write([]byte(encode("INFO")))
+	if info, ok := readReply(t, r).(string); !ok || !strings.Contains(info, "total_keys:") {
+		t.Errorf("Unexpected INFO reply: %q", info)
+	}
+}
+
+func TestServerMGetError(t *testing.T) {
+	_, pm, conn := startServer(t)
+	r := bufio.NewReader(conn)
+
+	if err := pm.Put("user:1", []byte("alice")); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	_ = pm.Close()
+
+	// A failed read must not look like a missing key.
+	_, _ = conn.Write([]byte(encode("MGET", "user:1", "missing")))
+	reply := readReply(t, r)
+	if err, ok := reply.(error); !ok || !strings.HasPrefix(err.Error(), "ERR ") {
+		t.Errorf("Expected an error reply from MGET on a closed database, got %#v", reply)
+	}
+}
+
+func TestServerScan(t *testing.T) {
+	_, pm, conn := startServer(t)
+	r := bufio.NewReader(conn)
+
+	for i := 0; i < 25; i++ {
+		if err := pm.Put(fmt.Sprintf("key:%02d", i), []byte("v")); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	if err := pm.Put("other", []byte("v")); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+
+	var keys []string
+	cursor := "0"
+	for {
+		_, _ = conn.Write([]byte(encode("SCAN", cursor, "MATCH", "key:*", "COUNT", "7")))
+		reply, ok := readReply(t, r).([]interface{})
+		if !ok || len(reply) != 2 {
+			t.Fatalf("Unexpected SCAN reply: %#v", reply)
+		}
+		for _, key := range reply[1].([]interface{}) {
+			keys = append(keys, key.(string))
+		}
+		cursor = reply[0].(string)
+		if cursor == "0" {
+			break
+		}
+	}
+
+	if len(keys) != 25 {
+		t.Fatalf("Expected 25 keys from SCAN, got %d: %v", len(keys), keys)
+	}
+	for i, key := range keys {
+		if key != fmt.Sprintf("key:%02d", i) {
+			t.Fatalf("Expected key:%02d at position %d, got %s", i, i, key)
+		}
+	}
+}
+
+func TestServerScanCursorsPerConnection(t *testing.T) {
+	srv, pm, conn := startServer(t)
+	r := bufio.NewReader(conn)
+
+	for i := 0; i < 10; i++ {
+		if err := pm.Put(fmt.Sprintf("key:%02d", i), []byte("v")); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+
+	_, _ = conn.Write([]byte(encode("SCAN", "0", "COUNT", "5")))
+	reply, ok := readReply(t, r).([]interface{})
+	if !ok || len(reply) != 2 || reply[0] == "0" {
+		t.Fatalf("Unexpected SCAN reply: %#v", reply)
+	}
+	cursor := reply[0].(string)
+
+	// Another client opens more cursors than a connection may keep.
+	other, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer func() { _ = other.Close() }()
+	var pipeline strings.Builder
+	for i := 0; i <= maxCursors; i++ {
+		pipeline.WriteString(encode("SCAN", "0", "COUNT", "1"))
+	}
+	_, _ = other.Write([]byte(pipeline.String()))
+	or := bufio.NewReader(other)
+	for i := 0; i <= maxCursors; i++ {
+		if _, ok := readReply(t, or).([]interface{}); !ok {
+			t.Fatalf("Unexpected SCAN reply on the other connection")
+		}
+	}
+
+	_, _ = conn.Write([]byte(encode("SCAN", cursor, "COUNT", "5")))
+	reply, ok = readReply(t, r).([]interface{})
+	if !ok || len(reply) != 2 {
+		t.Fatalf("Expected the first scan to resume, got %#v", reply)
+	}
+	keys := reply[1].([]interface{})
+	if len(keys) != 5 || keys[0] != "key:05" {
+		t.Errorf("Expected key:05 to key:09, got %v", keys)
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	srv, _, conn := startServer(t)
+	r := bufio.NewReader(conn)
+
+	_, _ = conn.Write([]byte(encode("PING")))
+	if got := readReply(t, r); got != "PONG" {
+		t.Fatalf("Expected PONG, got %#v", got)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("Failed to shut down: %v", err)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := r.ReadByte(); err == nil {
+		t.Fatal("Expected the idle connection to be closed on shutdown")
+	}
+	if _, err := net.Dial("tcp", srv.Addr().String()); err == nil {
+		t.Fatal("Expected new connections to be refused after shutdown")
+	}
+}
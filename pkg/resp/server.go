@@ -0,0 +1,206 @@
+package resp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"halo-db/pkg/partition"
+	"halo-db/pkg/types"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrServerClosed = errors.New("resp: server closed")
+
+type Server interface {
+	ListenAndServe(addr string) error
+	Serve(listener net.Listener) error
+	Addr() net.Addr
+	Shutdown(ctx context.Context) error
+}
+
+type server struct {
+	pm       partition.PartitionManager
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closing  bool
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+}
+
+func NewServer(pm partition.PartitionManager) Server {
+	return &server{
+		pm:    pm,
+		conns: make(map[net.Conn]struct{}),
+	}
+}
+
+func (s *server) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	return s.Serve(listener)
+}
+
+func (s *server) Serve(listener net.Listener) error {
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		_ = listener.Close()
+		return ErrServerClosed
+	}
+	s.listener = listener
+	s.mu.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closing := s.closing
+			s.mu.Unlock()
+			if closing {
+				return ErrServerClosed
+			}
+			return fmt.Errorf("failed to accept connection: %w", err)
+		}
+
+		s.mu.Lock()
+		if s.closing {
+			s.mu.Unlock()
+			_ = conn.Close()
+			return ErrServerClosed
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go s.handle(conn)
+	}
+}
+
+func (s *server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Shutdown stops accepting connections and lets every connection finish the
+// commands it has already read. Idle connections are woken up through their
+// read deadline; if ctx ends first the remaining connections are closed.
+func (s *server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	if s.listener != nil {
+		_ = s.listener.Close()
+	}
+	for conn := range s.conns {
+		_ = conn.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		for conn := range s.conns {
+			_ = conn.Close()
+		}
+		s.mu.Unlock()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// handle serves one connection. Replies are buffered and only flushed once
+// no more pipelined commands are waiting in the read buffer, so a pipeline
+// of N commands costs one write instead of N.
+func (s *server) handle(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		_ = conn.Close()
+		s.wg.Done()
+	}()
+
+	r := bufio.NewReader(conn)
+	w := writer{bufio.NewWriter(conn)}
+	cursors := newCursorTable()
+
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			if errors.Is(err, ErrProtocol) {
+				w.error("ERR " + err.Error())
+				_ = w.Flush()
+			}
+			return
+		}
+
+		if len(args) > 0 {
+			if quit := s.dispatch(w, cursors, args); quit {
+				_ = w.Flush()
+				return
+			}
+		}
+
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+
+		s.mu.Lock()
+		closing := s.closing
+		s.mu.Unlock()
+		if closing && r.Buffered() == 0 {
+			return
+		}
+	}
+}
+
+// cursorTable maps SCAN cursors to the last key returned. Clients expect
+// numeric cursors, while the keyspace is ordered by key, so the key is kept
+// here and the client only sees its number. Each connection has its own
+// table, so scans on other connections never evict its cursors; only a
+// client that keeps more than maxCursors scans open loses its oldest.
+type cursorTable struct {
+	next    uint64
+	cursors map[uint64]types.Key
+	order   []uint64
+}
+
+const maxCursors = 4096
+
+func newCursorTable() *cursorTable {
+	return &cursorTable{cursors: make(map[uint64]types.Key)}
+}
+
+func (ct *cursorTable) save(key types.Key) uint64 {
+	ct.next++
+	ct.cursors[ct.next] = key
+	ct.order = append(ct.order, ct.next)
+	if len(ct.order) > maxCursors {
+		delete(ct.cursors, ct.order[0])
+		ct.order = ct.order[1:]
+	}
+	return ct.next
+}
+
+func (ct *cursorTable) load(cursor uint64) (types.Key, bool) {
+	key, found := ct.cursors[cursor]
+	return key, found
+}
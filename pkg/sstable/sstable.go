@@ -0,0 +1,237 @@
+package sstable
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"halo-db/pkg/bloom"
+	"halo-db/pkg/constants"
+	dberrors "halo-db/pkg/errors"
+	"halo-db/pkg/options"
+	"halo-db/pkg/types"
+	"hash/crc32"
+	"os"
+)
+
+const (
+	footerSize    = 48
+	formatVersion = 1
+)
+
+var tableMagic = []byte{'H', 'A', 'L', 'O', 'S', 'S', 'T', formatVersion}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+var ErrCorrupted = fmt.Errorf("sstable %w", dberrors.ErrCorrupted)
+
+// Entry is one key of a table. A tombstone records that the key was deleted,
+// so that it hides older versions of the key in other tables.
+type Entry struct {
+	Key       types.Key
+	Kind      types.Kind
+	Value     types.Value
+	ExpiresAt int64
+}
+
+// Writer builds a table from entries added in ascending key order. Nothing
+// can be read from the file until Finish has synced it.
+type Writer interface {
+	Add(entry Entry) error
+	Size() int64
+	Finish() error
+	Abort()
+}
+
+// A table file is laid out as
+//
+//	data block... | index block | bloom block | footer
+//
+// Data blocks hold about SSTableBlockSize bytes of entries, each
+// kind(1) | varint-prefixed key | varint-prefixed value | varint expiry. The
+// index block holds the varint-prefixed smallest key of the table, then for
+// every data block its varint-prefixed last key and varint offset and
+// length. The bloom block is the encoded filter of all keys. Every block is
+// followed by its crc32c. The footer is the offset and length of the index
+// and bloom blocks and the entry count, each a big-endian uint64, and the
+// magic number.
+type writer struct {
+	path     string
+	file     *os.File
+	buf      *bufio.Writer
+	offset   int64
+	block    []byte
+	index    []byte
+	bloom    bloom.BloomFilter
+	smallest types.Key
+	last     types.Key
+	count    uint64
+}
+
+// Write builds a table at path holding entries, which must be sorted by key
+// without duplicates.
+func Write(path string, entries []Entry, opts options.Options) error {
+	w, err := NewWriter(path, len(entries), opts)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := w.Add(entry); err != nil {
+			w.Abort()
+			return err
+		}
+	}
+	return w.Finish()
+}
+
+// NewWriter creates a table at path, sizing its bloom filter for
+// expectedKeys at the false positive rate in opts.
+func NewWriter(path string, expectedKeys int, opts options.Options) (Writer, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create table: %w", err)
+	}
+
+	n := uint(max(expectedKeys, 1))
+	size := bloom.EstimateSize(n, opts.BloomFalsePositiveRate)
+	hashFuncs := max(bloom.EstimateHashFunctions(size, n), 1)
+
+	return &writer{
+		path:  path,
+		file:  file,
+		buf:   bufio.NewWriter(file),
+		bloom: bloom.NewBloomFilter(max(size, 1), hashFuncs),
+	}, nil
+}
+
+func (w *writer) Add(entry Entry) error {
+	if w.count > 0 && entry.Key <= w.last {
+		return fmt.Errorf("table keys out of order: %q after %q", entry.Key, w.last)
+	}
+	if w.count == 0 {
+		w.smallest = entry.Key
+	}
+
+	if !entry.Kind.Valid() {
+		return fmt.Errorf("unknown entry kind %d for key %q", entry.Kind, entry.Key)
+	}
+	w.block = append(w.block, byte(entry.Kind))
+	w.block = appendBytes(w.block, []byte(entry.Key))
+	w.block = appendBytes(w.block, entry.Value)
+	w.block = binary.AppendUvarint(w.block, uint64(entry.ExpiresAt))
+
+	w.bloom.Add(entry.Key)
+	w.last = entry.Key
+	w.count++
+
+	if len(w.block) >= constants.SSTableBlockSize {
+		return w.flushBlock()
+	}
+	return nil
+}
+
+// Size is the number of bytes written so far, including the pending block.
+func (w *writer) Size() int64 {
+	return w.offset + int64(len(w.block))
+}
+
+func (w *writer) flushBlock() error {
+	offset, length, err := w.writeBlock(w.block)
+	if err != nil {
+		return err
+	}
+	w.index = appendBytes(w.index, []byte(w.last))
+	w.index = binary.AppendUvarint(w.index, uint64(offset))
+	w.index = binary.AppendUvarint(w.index, uint64(length))
+	w.block = w.block[:0]
+	return nil
+}
+
+func (w *writer) writeBlock(data []byte) (int64, int64, error) {
+	offset := w.offset
+	if _, err := w.buf.Write(data); err != nil {
+		return 0, 0, fmt.Errorf("failed to write table: %w", err)
+	}
+	if _, err := w.buf.Write(binary.BigEndian.AppendUint32(nil, crc32.Checksum(data, castagnoli))); err != nil {
+		return 0, 0, fmt.Errorf("failed to write table: %w", err)
+	}
+	w.offset += int64(len(data)) + 4
+	return offset, int64(len(data)), nil
+}
+
+// Finish writes the index, filter and footer and syncs the file.
+func (w *writer) Finish() error {
+	if err := w.finish(); err != nil {
+		w.Abort()
+		return err
+	}
+	return nil
+}
+
+func (w *writer) finish() error {
+	if len(w.block) > 0 {
+		if err := w.flushBlock(); err != nil {
+			return err
+		}
+	}
+
+	index := appendBytes(nil, []byte(w.smallest))
+	indexOffset, indexLength, err := w.writeBlock(append(index, w.index...))
+	if err != nil {
+		return err
+	}
+	filter, err := w.bloom.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("failed to encode bloom filter: %w", err)
+	}
+	bloomOffset, bloomLength, err := w.writeBlock(filter)
+	if err != nil {
+		return err
+	}
+
+	footer := make([]byte, 0, footerSize)
+	for _, n := range []int64{indexOffset, indexLength, bloomOffset, bloomLength, int64(w.count)} {
+		footer = binary.BigEndian.AppendUint64(footer, uint64(n))
+	}
+	footer = append(footer, tableMagic...)
+	if _, err := w.buf.Write(footer); err != nil {
+		return fmt.Errorf("failed to write table: %w", err)
+	}
+
+	if err := w.buf.Flush(); err != nil {
+		return fmt.Errorf("failed to write table: %w", err)
+	}
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync table: %w", err)
+	}
+	if err := w.file.Close(); err != nil {
+		return fmt.Errorf("failed to close table: %w", err)
+	}
+	return nil
+}
+
+// Abort closes and removes the unfinished table.
+func (w *writer) Abort() {
+	_ = w.file.Close()
+	_ = os.Remove(w.path)
+}
+
+func appendBytes(buf, data []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+func readBytes(data []byte) ([]byte, []byte, error) {
+	length, n := binary.Uvarint(data)
+	if n <= 0 || uint64(len(data)-n) < length {
+		return nil, nil, fmt.Errorf("%w: bad length prefix", ErrCorrupted)
+	}
+	return data[n : n+int(length)], data[n+int(length):], nil
+}
+
+func readUvarint(data []byte) (uint64, []byte, error) {
+	value, n := binary.Uvarint(data)
+	if n <= 0 {
+		return 0, nil, fmt.Errorf("%w: bad varint", ErrCorrupted)
+	}
+	return value, data[n:], nil
+}
@@ -0,0 +1,159 @@
+package sstable
+
+import (
+	"errors"
+	"fmt"
+	dberrors "halo-db/pkg/errors"
+	"halo-db/pkg/options"
+	"halo-db/pkg/types"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestTable(t *testing.T, path string, n int) []Entry {
+	t.Helper()
+
+	entries := make([]Entry, n)
+	for i := range entries {
+		entries[i] = Entry{Key: types.Key(fmt.Sprintf("key%05d", i)), Kind: types.KindValue, Value: types.Value(fmt.Sprintf("value%d", i))}
+		switch i % 10 {
+		case 3:
+			entries[i] = Entry{Key: entries[i].Key, Kind: types.KindTombstone}
+		case 5:
+			entries[i].Kind = types.KindMerge
+		case 7:
+			entries[i].ExpiresAt = int64(1000 + i)
+		}
+	}
+	if err := Write(path, entries, options.Default()); err != nil {
+		t.Fatalf("Failed to write table: %v", err)
+	}
+	return entries
+}
+
+func TestTableRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "000001.sst")
+	entries := writeTestTable(t, path, 2000)
+
+	table, err := Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open table: %v", err)
+	}
+	defer func() { _ = table.Close() }()
+
+	if table.NumEntries() != len(entries) {
+		t.Errorf("Expected %d entries, got %d", len(entries), table.NumEntries())
+	}
+	if table.Smallest() != "key00000" || table.Largest() != "key01999" {
+		t.Errorf("Unexpected key range [%s, %s]", table.Smallest(), table.Largest())
+	}
+
+	for _, want := range entries {
+		got, found, err := table.Get(want.Key)
+		if err != nil || !found {
+			t.Fatalf("Failed to get %s: found=%v err=%v", want.Key, found, err)
+		}
+		if got.Kind != want.Kind || string(got.Value) != string(want.Value) || got.ExpiresAt != want.ExpiresAt {
+			t.Fatalf("Entry %s round-tripped as %+v, want %+v", want.Key, got, want)
+		}
+	}
+	for _, key := range []types.Key{"", "key", "key00000x", "zzz"} {
+		if _, found, err := table.Get(key); found || err != nil {
+			t.Errorf("Expected %q to be absent, found=%v err=%v", key, found, err)
+		}
+	}
+
+	it := table.NewIterator()
+	it.Seek("key01500")
+	count := 0
+	for ; it.Valid(); it.Next() {
+		if it.Entry().Key != entries[1500+count].Key {
+			t.Fatalf("Expected %s at position %d, got %s", entries[1500+count].Key, count, it.Entry().Key)
+		}
+		count++
+	}
+	if it.Err() != nil || count != 500 {
+		t.Errorf("Expected 500 entries from key01500, got %d (err %v)", count, it.Err())
+	}
+
+	it.Seek("key00999x")
+	if !it.Valid() || it.Entry().Key != "key01000" {
+		t.Errorf("Expected seek between keys to land on key01000")
+	}
+}
+
+func TestTableEmptyValue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "000001.sst")
+	if err := Write(path, []Entry{{Key: "empty", Kind: types.KindValue, Value: types.Value{}}}, options.Default()); err != nil {
+		t.Fatalf("Failed to write table: %v", err)
+	}
+	table, err := Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open table: %v", err)
+	}
+	defer func() { _ = table.Close() }()
+
+	entry, found, err := table.Get("empty")
+	if err != nil || !found || entry.Kind != types.KindValue || entry.Value == nil || len(entry.Value) != 0 {
+		t.Errorf("Expected an empty value, got %+v found=%v err=%v", entry, found, err)
+	}
+}
+
+func TestTableKeyOrder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "000001.sst")
+	err := Write(path, []Entry{{Key: "b", Kind: types.KindValue, Value: types.Value("1")}, {Key: "a", Kind: types.KindValue, Value: types.Value("2")}}, options.Default())
+	if err == nil {
+		t.Fatal("Expected an error for keys out of order")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected the unfinished table to be removed, got %v", err)
+	}
+}
+
+func TestTableCorruption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "000001.sst")
+	writeTestTable(t, path, 500)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read table: %v", err)
+	}
+
+	damaged := append([]byte(nil), data...)
+	damaged[10] ^= 0xff
+	if err := os.WriteFile(path, damaged, 0644); err != nil {
+		t.Fatalf("Failed to write table: %v", err)
+	}
+	table, err := Open(path)
+	if err != nil {
+		t.Fatalf("Damage to a data block should not stop the table opening: %v", err)
+	}
+	if _, _, err := table.Get("key00000"); !errors.Is(err, ErrCorrupted) || !errors.Is(err, dberrors.ErrCorrupted) {
+		t.Errorf("Expected ErrCorrupted reading a damaged block, got %v", err)
+	}
+	it := table.NewIterator()
+	it.Seek("")
+	if it.Valid() || !errors.Is(it.Err(), ErrCorrupted) {
+		t.Errorf("Expected the iterator to stop with ErrCorrupted, got %v", it.Err())
+	}
+	_ = table.Close()
+
+	for _, offset := range []int{len(data) - 1, len(data) - footerSize - 10} {
+		damaged := append([]byte(nil), data...)
+		damaged[offset] ^= 0xff
+		if err := os.WriteFile(path, damaged, 0644); err != nil {
+			t.Fatalf("Failed to write table: %v", err)
+		}
+		if _, err := Open(path); !errors.Is(err, ErrCorrupted) {
+			t.Errorf("Expected ErrCorrupted for damage at offset %d, got %v", offset, err)
+		}
+	}
+
+	if err := os.WriteFile(path, data[:len(data)/2], 0644); err != nil {
+		t.Fatalf("Failed to write table: %v", err)
+	}
+	if _, err := Open(path); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("Expected ErrCorrupted for a truncated table, got %v", err)
+	}
+}
@@ -0,0 +1,289 @@
+package sstable
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"halo-db/pkg/bloom"
+	"halo-db/pkg/types"
+	"hash/crc32"
+	"os"
+	"slices"
+	"sort"
+)
+
+// Table is an open, immutable table file. The index and bloom filter are
+// held in memory; data blocks are read from the file as needed, so a table
+// can be read from many goroutines at once.
+type Table interface {
+	Get(key types.Key) (Entry, bool, error)
+	NewIterator() Iterator
+	Smallest() types.Key
+	Largest() types.Key
+	NumEntries() int
+	Size() int64
+	Close() error
+}
+
+// Iterator walks a table in key order. It starts before the first entry;
+// call Seek to position it.
+type Iterator interface {
+	Seek(key types.Key)
+	Next()
+	Valid() bool
+	Entry() Entry
+	Err() error
+}
+
+type blockHandle struct {
+	lastKey types.Key
+	offset  int64
+	length  int64
+}
+
+type table struct {
+	file     *os.File
+	size     int64
+	blocks   []blockHandle
+	bloom    bloom.BloomFilter
+	smallest types.Key
+	count    int
+}
+
+func Open(path string) (Table, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open table: %w", err)
+	}
+	t, err := openTable(file)
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("failed to open table %s: %w", path, err)
+	}
+	return t, nil
+}
+
+func openTable(file *os.File) (*table, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	t := &table{file: file, size: info.Size()}
+	if t.size < footerSize {
+		return nil, fmt.Errorf("%w: file too short", ErrCorrupted)
+	}
+
+	footer := make([]byte, footerSize)
+	if _, err := file.ReadAt(footer, t.size-footerSize); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(footer[40:], tableMagic) {
+		return nil, fmt.Errorf("%w: bad magic number", ErrCorrupted)
+	}
+	field := func(i int) int64 { return int64(binary.BigEndian.Uint64(footer[i*8 : i*8+8])) }
+	t.count = int(field(4))
+
+	index, err := t.readBlock(field(0), field(1))
+	if err != nil {
+		return nil, err
+	}
+	if err := t.decodeIndex(index); err != nil {
+		return nil, err
+	}
+
+	filter, err := t.readBlock(field(2), field(3))
+	if err != nil {
+		return nil, err
+	}
+	if t.bloom, err = bloom.UnmarshalBloomFilter(filter); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorrupted, err)
+	}
+	return t, nil
+}
+
+func (t *table) decodeIndex(index []byte) error {
+	smallest, rest, err := readBytes(index)
+	if err != nil {
+		return err
+	}
+	t.smallest = types.Key(smallest)
+
+	for len(rest) > 0 {
+		var h blockHandle
+		var key []byte
+		var offset, length uint64
+		if key, rest, err = readBytes(rest); err != nil {
+			return err
+		}
+		if offset, rest, err = readUvarint(rest); err != nil {
+			return err
+		}
+		if length, rest, err = readUvarint(rest); err != nil {
+			return err
+		}
+		h.lastKey, h.offset, h.length = types.Key(key), int64(offset), int64(length)
+		if n := len(t.blocks); n > 0 && h.lastKey <= t.blocks[n-1].lastKey {
+			return fmt.Errorf("%w: index keys out of order", ErrCorrupted)
+		}
+		t.blocks = append(t.blocks, h)
+	}
+	return nil
+}
+
+// readBlock reads the block at offset and checks it against its checksum.
+func (t *table) readBlock(offset, length int64) ([]byte, error) {
+	if offset < 0 || length < 0 || offset+length+4 > t.size-footerSize {
+		return nil, fmt.Errorf("%w: block at %d overruns the file", ErrCorrupted, offset)
+	}
+	data := make([]byte, length+4)
+	if _, err := t.file.ReadAt(data, offset); err != nil {
+		return nil, fmt.Errorf("failed to read table: %w", err)
+	}
+	if crc32.Checksum(data[:length], castagnoli) != binary.BigEndian.Uint32(data[length:]) {
+		return nil, fmt.Errorf("%w: checksum mismatch in block at %d", ErrCorrupted, offset)
+	}
+	return data[:length], nil
+}
+
+func (t *table) readEntries(i int) ([]Entry, error) {
+	data, err := t.readBlock(t.blocks[i].offset, t.blocks[i].length)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+	for len(data) > 0 {
+		var entry Entry
+		var key, value []byte
+		var expiresAt uint64
+		kind := types.Kind(data[0])
+		if key, data, err = readBytes(data[1:]); err != nil {
+			return nil, err
+		}
+		if value, data, err = readBytes(data); err != nil {
+			return nil, err
+		}
+		if expiresAt, data, err = readUvarint(data); err != nil {
+			return nil, err
+		}
+		switch kind {
+		case types.KindValue, types.KindMerge:
+			entry.Value = slices.Clone(value)
+			if entry.Value == nil {
+				entry.Value = []byte{}
+			}
+		case types.KindTombstone:
+		default:
+			return nil, fmt.Errorf("%w: unknown entry kind %d", ErrCorrupted, kind)
+		}
+		entry.Kind = kind
+		entry.Key = types.Key(key)
+		entry.ExpiresAt = int64(expiresAt)
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// findBlock returns the first block that may hold key.
+func (t *table) findBlock(key types.Key) int {
+	return sort.Search(len(t.blocks), func(i int) bool { return t.blocks[i].lastKey >= key })
+}
+
+// Get returns the table's entry for key, which may be a tombstone or have
+// expired; the caller decides what either means.
+func (t *table) Get(key types.Key) (Entry, bool, error) {
+	if !t.bloom.Contains(key) {
+		return Entry{}, false, nil
+	}
+	i := t.findBlock(key)
+	if i == len(t.blocks) {
+		return Entry{}, false, nil
+	}
+	entries, err := t.readEntries(i)
+	if err != nil {
+		return Entry{}, false, err
+	}
+	j := sort.Search(len(entries), func(j int) bool { return entries[j].Key >= key })
+	if j == len(entries) || entries[j].Key != key {
+		return Entry{}, false, nil
+	}
+	return entries[j], true, nil
+}
+
+func (t *table) NewIterator() Iterator {
+	return &tableIterator{table: t, block: len(t.blocks)}
+}
+
+func (t *table) Smallest() types.Key {
+	return t.smallest
+}
+
+func (t *table) Largest() types.Key {
+	if len(t.blocks) == 0 {
+		return ""
+	}
+	return t.blocks[len(t.blocks)-1].lastKey
+}
+
+func (t *table) NumEntries() int {
+	return t.count
+}
+
+func (t *table) Size() int64 {
+	return t.size
+}
+
+func (t *table) Close() error {
+	return t.file.Close()
+}
+
+type tableIterator struct {
+	table   *table
+	block   int
+	entries []Entry
+	pos     int
+	err     error
+}
+
+func (it *tableIterator) Seek(key types.Key) {
+	it.err = nil
+	it.load(it.table.findBlock(key))
+	for it.Valid() && it.entries[it.pos].Key < key {
+		it.pos++
+	}
+	it.skipExhausted()
+}
+
+func (it *tableIterator) Next() {
+	if !it.Valid() {
+		return
+	}
+	it.pos++
+	it.skipExhausted()
+}
+
+func (it *tableIterator) Valid() bool {
+	return it.err == nil && it.pos < len(it.entries)
+}
+
+func (it *tableIterator) Entry() Entry {
+	return it.entries[it.pos]
+}
+
+func (it *tableIterator) Err() error {
+	return it.err
+}
+
+func (it *tableIterator) load(block int) {
+	it.block, it.entries, it.pos = block, nil, 0
+	if block < len(it.table.blocks) {
+		it.entries, it.err = it.table.readEntries(block)
+	}
+}
+
+// skipExhausted moves on to the next block once the current one is used up.
+func (it *tableIterator) skipExhausted() {
+	for it.err == nil && it.pos == len(it.entries) && it.block < len(it.table.blocks) {
+		it.load(it.block + 1)
+	}
+}
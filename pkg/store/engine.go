@@ -0,0 +1,142 @@
+package store
+
+import (
+	"fmt"
+	"halo-db/pkg/btree"
+	"halo-db/pkg/constants"
+	"halo-db/pkg/lsm"
+	"halo-db/pkg/memtable"
+	"halo-db/pkg/options"
+	"halo-db/pkg/sstable"
+	"halo-db/pkg/types"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// engine holds what the store flushes out of its memtable. Flush takes the
+// memtable's latest entries, tombstones included, and makes them
+// durable before returning, so the WAL can be checkpointed behind them.
+// Flushes run one at a time, but alongside reads.
+type engine interface {
+	Flush(entries []memtable.Entry) error
+	FindWithExpiry(key types.Key) (types.Value, int64, error)
+	List() []types.Key
+	Scan(start, end types.Key, fn func(types.Key, types.Value) bool) error
+	Expired(now int64) []types.Key
+	Clear() error
+	Close() error
+	Stats() map[string]interface{}
+}
+
+func openEngine(dataDir string, opts options.Options) (engine, error) {
+	switch opts.Engine {
+	case "btree":
+		tree, err := btree.OpenBPlusTreeWithOptions(filepath.Join(dataDir, constants.TreeFileName), opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open B+ tree: %w", err)
+		}
+		return &treeEngine{tree: tree}, nil
+	case "lsm":
+		tree, err := lsm.Open(dataDir, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open SSTables: %w", err)
+		}
+		return lsmEngine{tree}, nil
+	}
+	return nil, fmt.Errorf("unknown storage engine %q", opts.Engine)
+}
+
+// treeEngine updates the B+ tree in place, one key at a time. The tree is
+// not safe for concurrent use, and flushes run alongside reads, so every
+// call goes through mu.
+type treeEngine struct {
+	tree btree.BTree
+	mu   sync.RWMutex
+}
+
+func (e *treeEngine) Flush(entries []memtable.Entry) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := time.Now().UnixNano()
+	for _, entry := range entries {
+		if entry.Kind == types.KindValue && !types.Expired(entry.ExpiresAt, now) {
+			if err := e.tree.InsertWithExpiry(entry.Key, entry.Value, entry.ExpiresAt); err != nil {
+				return fmt.Errorf("failed to insert into B+ tree: %w", err)
+			}
+		} else {
+			_ = e.tree.Delete(entry.Key)
+		}
+	}
+
+	if err := e.tree.Sync(); err != nil {
+		return fmt.Errorf("failed to sync B+ tree: %w", err)
+	}
+	return nil
+}
+
+func (e *treeEngine) FindWithExpiry(key types.Key) (types.Value, int64, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.tree.FindWithExpiry(key)
+}
+
+func (e *treeEngine) List() []types.Key {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.tree.List()
+}
+
+func (e *treeEngine) Scan(start, end types.Key, fn func(types.Key, types.Value) bool) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.tree.Scan(start, end, fn)
+}
+
+func (e *treeEngine) Expired(now int64) []types.Key {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.tree.Expired(now)
+}
+
+func (e *treeEngine) Clear() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.tree.Clear()
+}
+
+func (e *treeEngine) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.tree.Close()
+}
+
+func (e *treeEngine) Stats() map[string]interface{} {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.tree.Stats()
+}
+
+// lsmEngine writes each flush to a new SSTable. Deleted and expired entries
+// become tombstones, which hide the key's versions in older tables.
+type lsmEngine struct {
+	lsm.Tree
+}
+
+func (e lsmEngine) Flush(entries []memtable.Entry) error {
+	now := time.Now().UnixNano()
+	table := make([]sstable.Entry, len(entries))
+	for i, entry := range entries {
+		if entry.Kind == types.KindValue && !types.Expired(entry.ExpiresAt, now) {
+			table[i] = sstable.Entry{Key: entry.Key, Kind: types.KindValue, Value: entry.Value, ExpiresAt: entry.ExpiresAt}
+		} else {
+			table[i] = sstable.Entry{Key: entry.Key, Kind: types.KindTombstone}
+		}
+	}
+
+	if err := e.Tree.Flush(table); err != nil {
+		return fmt.Errorf("failed to write SSTable: %w", err)
+	}
+	return nil
+}
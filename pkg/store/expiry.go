@@ -0,0 +1,89 @@
+package store
+
+import (
+	"container/heap"
+	"halo-db/pkg/types"
+)
+
+// expiryIndex knows the deadline of every key with a TTL, so the reaper can
+// find the expired ones without scanning the store. Overwriting a key leaves
+// its old deadline in the heap; deadlines holds only the latest, and the
+// stale ones are dropped as they come up.
+type expiryIndex struct {
+	deadlines map[types.Key]int64
+	heap      expiryHeap
+}
+
+func newExpiryIndex() *expiryIndex {
+	return &expiryIndex{deadlines: make(map[types.Key]int64)}
+}
+
+// set records that key now expires at expiresAt; 0 means it no longer
+// expires.
+func (x *expiryIndex) set(key types.Key, expiresAt int64) {
+	if expiresAt == 0 {
+		delete(x.deadlines, key)
+		return
+	}
+	if x.deadlines[key] == expiresAt {
+		return
+	}
+	x.deadlines[key] = expiresAt
+	heap.Push(&x.heap, expiryItem{key: key, expiresAt: expiresAt})
+
+	// Keys that keep getting new deadlines would otherwise fill the heap
+	// with stale ones.
+	if len(x.heap) > 2*len(x.deadlines)+1024 {
+		x.rebuild()
+	}
+}
+
+// expired takes up to limit keys that have expired at now out of the index
+// and returns them with their deadlines.
+func (x *expiryIndex) expired(now int64, limit int) []expiryItem {
+	var items []expiryItem
+	for len(items) < limit && len(x.heap) > 0 && types.Expired(x.heap[0].expiresAt, now) {
+		item := heap.Pop(&x.heap).(expiryItem)
+		if x.deadlines[item.key] != item.expiresAt {
+			continue
+		}
+		delete(x.deadlines, item.key)
+		items = append(items, item)
+	}
+	return items
+}
+
+func (x *expiryIndex) clear() {
+	x.deadlines = make(map[types.Key]int64)
+	x.heap = nil
+}
+
+func (x *expiryIndex) rebuild() {
+	x.heap = x.heap[:0]
+	for key, expiresAt := range x.deadlines {
+		x.heap = append(x.heap, expiryItem{key: key, expiresAt: expiresAt})
+	}
+	heap.Init(&x.heap)
+}
+
+type expiryItem struct {
+	key       types.Key
+	expiresAt int64
+}
+
+type expiryHeap []expiryItem
+
+func (h expiryHeap) Len() int { return len(h) }
+
+func (h expiryHeap) Less(i, j int) bool { return h[i].expiresAt < h[j].expiresAt }
+
+func (h expiryHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *expiryHeap) Push(x interface{}) { *h = append(*h, x.(expiryItem)) }
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
@@ -0,0 +1,174 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// MemoryBudget caps the bytes held by the memtables of every store sharing
+// it, queued ones included. Writers to any of the stores wait while the
+// total is over the limit.
+type MemoryBudget interface {
+	Used() int64
+	Limit() int64
+	Stalls() uint64
+	register(s *store)
+	unregister(s *store)
+	add(delta int64)
+	wake()
+	wait() error
+}
+
+type memoryBudget struct {
+	limit  int64
+	used   atomic.Int64
+	stalls uint64
+	stores map[*store]struct{}
+	mu     sync.Mutex
+	// cond wakes writers waiting for memory once some is given back.
+	cond *sync.Cond
+	// wakeups counts the broadcasts on cond, so a writer can tell it missed
+	// one while it had mu released.
+	wakeups uint64
+}
+
+// NewMemoryBudget returns a budget of limit bytes; 0 means no limit.
+func NewMemoryBudget(limit int64) MemoryBudget {
+	b := &memoryBudget{
+		limit:  limit,
+		stores: make(map[*store]struct{}),
+	}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+func (b *memoryBudget) Used() int64 {
+	return b.used.Load()
+}
+
+func (b *memoryBudget) Limit() int64 {
+	return b.limit
+}
+
+func (b *memoryBudget) Stalls() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.stalls
+}
+
+func (b *memoryBudget) register(s *store) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.stores[s] = struct{}{}
+}
+
+func (b *memoryBudget) unregister(s *store) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.stores, s)
+	b.broadcast()
+}
+
+// add records a change in the bytes a store holds. Only a drop can let a
+// waiting writer through, so growth skips the lock.
+func (b *memoryBudget) add(delta int64) {
+	if delta >= 0 {
+		b.used.Add(delta)
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used.Add(delta)
+	b.broadcast()
+}
+
+// wake lets waiting writers look again, for when a flush they may be
+// waiting on has failed.
+func (b *memoryBudget) wake() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.broadcast()
+}
+
+// broadcast must be called with mu held.
+func (b *memoryBudget) broadcast() {
+	b.wakeups++
+	b.cond.Broadcast()
+}
+
+func (b *memoryBudget) over() bool {
+	return b.limit > 0 && b.used.Load() > b.limit
+}
+
+// wait holds a writer back while the budget is exceeded. Only flushes give
+// memory back, so it first hands the memtables of the stores holding the
+// most to their flushers. A writer is let through if no store has anything
+// to flush, rather than stalled for good, and gets the flush error if the
+// flush it waited on failed, as that memory is not coming back.
+//
+// It must be called without any store's mu held, as it takes them.
+func (b *memoryBudget) wait() error {
+	if !b.over() {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stalled := false
+	for b.over() {
+		stores := b.largestFirst()
+		seen := b.wakeups
+		b.mu.Unlock()
+		var flushing *store
+		for _, s := range stores {
+			if s.relieve() {
+				flushing = s
+				break
+			}
+		}
+		b.mu.Lock()
+
+		if flushing == nil || !b.over() {
+			return nil
+		}
+		if !stalled {
+			stalled = true
+			b.stalls++
+		}
+		if b.wakeups == seen {
+			b.cond.Wait()
+		}
+
+		b.mu.Unlock()
+		err := flushing.flushError()
+		b.mu.Lock()
+		if err != nil {
+			return fmt.Errorf("failed to free memory: %w", err)
+		}
+	}
+	return nil
+}
+
+// largestFirst must be called with mu held.
+func (b *memoryBudget) largestFirst() []*store {
+	type held struct {
+		s     *store
+		bytes int64
+	}
+	holders := make([]held, 0, len(b.stores))
+	for s := range b.stores {
+		if bytes := s.memBytes.Load(); bytes > 0 {
+			holders = append(holders, held{s, bytes})
+		}
+	}
+	sort.Slice(holders, func(i, j int) bool { return holders[i].bytes > holders[j].bytes })
+
+	stores := make([]*store, len(holders))
+	for i, h := range holders {
+		stores[i] = h.s
+	}
+	return stores
+}
@@ -0,0 +1,210 @@
+package store
+
+import (
+	"errors"
+	"halo-db/pkg/constants"
+	dberrors "halo-db/pkg/errors"
+	"halo-db/pkg/iterator"
+	"halo-db/pkg/memtable"
+	"halo-db/pkg/types"
+	"math"
+)
+
+var ErrSnapshotReleased = errors.New("snapshot released")
+
+type Snapshot interface {
+	Get(key types.Key) (types.Value, error)
+	List() []types.Key
+	Scan(start, end types.Key) iterator.Iterator
+	ScanPrefix(prefix types.Key) iterator.Iterator
+	Release()
+}
+
+// snapshot reads the memtables at a fixed sequence number, which carries on
+// from one memtable to the next. The storage engine only reads the latest
+// value of each key, so before a flush or clear overwrites a key the store
+// saves what the snapshot saw into preserved, which then shadows the engine
+// for that key.
+type snapshot struct {
+	store     *store
+	seq       uint64
+	preserved memtable.Memtable
+	released  bool
+}
+
+func (s *store) Snapshot() Snapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sn := &snapshot{
+		store:     s,
+		seq:       s.memtable.Seq(),
+		preserved: memtable.NewMemtable(s.opts.MemtableSize),
+	}
+	s.snapshots[sn] = struct{}{}
+	s.updateRetention()
+	return sn
+}
+
+func (sn *snapshot) Get(key types.Key) (types.Value, error) {
+	s := sn.store
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if err := sn.check(); err != nil {
+		return nil, err
+	}
+
+	entry, found := getAt(s.memtables(), key, sn.seq)
+	if !found {
+		entry, found = sn.preserved.Get(key)
+	}
+	if found {
+		if entry.Kind == types.KindTombstone {
+			return nil, dberrors.ErrNotFound
+		}
+		return entry.Value, nil
+	}
+
+	if !s.bloomFilter.Contains(key) {
+		return nil, dberrors.ErrNotFound
+	}
+	value, _, err := s.engine.FindWithExpiry(key)
+	return value, err
+}
+
+func (sn *snapshot) List() []types.Key {
+	it := sn.Scan("", "")
+	defer func() { _ = it.Close() }()
+
+	keys := make([]types.Key, 0)
+	for ; it.Valid(); it.Next() {
+		keys = append(keys, it.Key())
+	}
+	return keys
+}
+
+func (sn *snapshot) Scan(start, end types.Key) iterator.Iterator {
+	sn.store.mu.RLock()
+	mems := sn.store.memtables()
+	sn.store.mu.RUnlock()
+
+	iters := make([]iterator.Iterator, 0, len(mems)+2)
+	for _, mem := range mems {
+		iters = append(iters, iterator.NewPagedIterator(start, end, constants.ScanBatchSize, sn.scanMemtable(mem)))
+	}
+	iters = append(iters,
+		iterator.NewPagedIterator(start, end, constants.ScanBatchSize, sn.scanPreserved),
+		iterator.NewPagedIterator(start, end, constants.ScanBatchSize, sn.scanEngine))
+	return iterator.NewMergeIterator(iters...)
+}
+
+func (sn *snapshot) ScanPrefix(prefix types.Key) iterator.Iterator {
+	return sn.Scan(prefix, iterator.PrefixEnd(prefix))
+}
+
+func (sn *snapshot) Release() {
+	s := sn.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sn.released {
+		return
+	}
+	sn.released = true
+	sn.preserved.Clear()
+	delete(s.snapshots, sn)
+	s.updateRetention()
+	s.account()
+}
+
+func (sn *snapshot) check() error {
+	if sn.released {
+		return ErrSnapshotReleased
+	}
+	if sn.store.closed {
+		return dberrors.ErrClosed
+	}
+	return nil
+}
+
+func (sn *snapshot) scanMemtable(mem memtable.Memtable) iterator.ScanFunc {
+	return func(start, end types.Key, fn func(types.Key, types.Value) bool) error {
+		sn.store.mu.RLock()
+		defer sn.store.mu.RUnlock()
+
+		if err := sn.check(); err != nil {
+			return err
+		}
+		mem.ScanAt(start, end, sn.seq, fn)
+		return nil
+	}
+}
+
+func (sn *snapshot) scanPreserved(start, end types.Key, fn func(types.Key, types.Value) bool) error {
+	sn.store.mu.RLock()
+	defer sn.store.mu.RUnlock()
+
+	if err := sn.check(); err != nil {
+		return err
+	}
+	sn.preserved.Scan(start, end, fn)
+	return nil
+}
+
+func (sn *snapshot) scanEngine(start, end types.Key, fn func(types.Key, types.Value) bool) error {
+	sn.store.mu.RLock()
+	defer sn.store.mu.RUnlock()
+
+	if err := sn.check(); err != nil {
+		return err
+	}
+	return sn.store.engine.Scan(start, end, fn)
+}
+
+// preserveForSnapshots saves what every open snapshot sees for keys before
+// they are overwritten in the storage engine and mems, newest first, are
+// dropped. mems are newer than anything saved by earlier calls, so a version
+// found in them replaces what was saved; otherwise the saved value stands,
+// or failing that the engine's.
+func (s *store) preserveForSnapshots(keys []types.Key, mems ...memtable.Memtable) {
+	for sn := range s.snapshots {
+		for _, key := range keys {
+			entry, found := getAt(mems, key, sn.seq)
+			if !found {
+				if _, saved := sn.preserved.Get(key); saved {
+					continue
+				}
+				entry.Kind = types.KindTombstone
+				if value, expiresAt, err := s.engine.FindWithExpiry(key); err == nil {
+					entry = memtable.Entry{Kind: types.KindValue, Value: value, ExpiresAt: expiresAt}
+				}
+			}
+			if entry.Kind == types.KindTombstone {
+				sn.preserved.Delete(key)
+			} else {
+				sn.preserved.PutWithExpiry(key, entry.Value, entry.ExpiresAt)
+			}
+		}
+	}
+}
+
+func (s *store) updateRetention() {
+	oldest := uint64(math.MaxUint64)
+	for sn := range s.snapshots {
+		if sn.seq < oldest {
+			oldest = sn.seq
+		}
+	}
+	s.memtable.Retain(oldest)
+}
+
+// getAt looks key up in mems, newest first, as of seq.
+func getAt(mems []memtable.Memtable, key types.Key, seq uint64) (memtable.Entry, bool) {
+	for _, mem := range mems {
+		if entry, found := mem.GetAt(key, seq); found {
+			return entry, true
+		}
+	}
+	return memtable.Entry{}, false
+}
@@ -1,139 +1,380 @@
 package store
 
 import (
+	"errors"
 	"fmt"
+	"halo-db/pkg/batch"
 	"halo-db/pkg/bloom"
-	"halo-db/pkg/btree"
+	"halo-db/pkg/constants"
+	dberrors "halo-db/pkg/errors"
+	"halo-db/pkg/iterator"
 	"halo-db/pkg/memtable"
+	"halo-db/pkg/options"
 	"halo-db/pkg/types"
 	"halo-db/pkg/wal"
+	"math"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Store interface {
 	Put(key types.Key, value types.Value) error
+	PutWithTTL(key types.Key, value types.Value, ttl time.Duration) error
+	PutWithExpiry(key types.Key, value types.Value, expiresAt int64) error
 	Get(key types.Key) (types.Value, error)
+	GetWithExpiry(key types.Key) (types.Value, int64, error)
 	Delete(key types.Key) error
+	Write(b *batch.WriteBatch) error
+	Prepare(batchID uint64, b *batch.WriteBatch) error
+	CommitPrepared(batchID uint64) error
+	AbortPrepared(batchID uint64) error
+	PreparedBatches() []uint64
 	List() []types.Key
+	Scan(start, end types.Key) iterator.Iterator
+	ScanPrefix(prefix types.Key) iterator.Iterator
+	Snapshot() Snapshot
+	Sync() error
 	Close() error
 	Clear() error
 	GetStats() map[string]interface{}
 }
 
 type store struct {
-	tree        btree.BTree
-	memtable    memtable.Memtable
+	engine   engine
+	memtable memtable.Memtable
+	// immutables are full memtables waiting for the background flusher,
+	// oldest first. They stay readable until their entries are in the
+	// engine.
+	immutables  []immutable
 	wal         wal.WAL
 	bloomFilter bloom.BloomFilter
 	dataDir     string
-	mu          sync.RWMutex
-	stopChan    chan struct{}
+	opts        options.Options
+	prepared    map[uint64]*batch.WriteBatch
+	snapshots   map[*snapshot]struct{}
+	expiries    *expiryIndex
+	closed      bool
+	flushErr    error
+	syncErr     error
+	stalls      uint64
+	memory      MemoryBudget
+	// memBytes is what the store has accounted to memory for its
+	// memtables and those of its snapshots.
+	memBytes atomic.Int64
+	mu       sync.RWMutex
+	// flushCond wakes writers stalled on a full immutable queue.
+	flushCond *sync.Cond
+	// flushMu is held for the whole of each flush, so Clear and Close never
+	// run while the engine is being written outside mu.
+	flushMu   sync.Mutex
+	flushChan chan struct{}
+	stopChan  chan struct{}
+}
+
+// immutable is a memtable that no longer takes writes, with the last WAL
+// LSN it holds, which the WAL is checkpointed to once it is flushed.
+type immutable struct {
+	mem memtable.Memtable
+	lsn uint64
 }
 
 func NewStore(dataDir string) (Store, error) {
-	tree := btree.NewBPlusTree()
-	mTable := memtable.NewMemtable(1000)
+	return NewStoreWithOptions(dataDir, options.Default())
+}
+
+func NewStoreWithOptions(dataDir string, opts options.Options) (Store, error) {
+	return NewStoreWithMemory(dataDir, opts, NewMemoryBudget(opts.MemoryLimit))
+}
+
+// NewStoreWithMemory opens a store whose memtables count towards memory,
+// which may be shared with other stores.
+func NewStoreWithMemory(dataDir string, opts options.Options, memory MemoryBudget) (Store, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	mTable := newMemtable(opts, 0)
 
-	w, err := wal.NewWAL(dataDir)
+	w, err := wal.NewWALWithOptions(dataDir, opts)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create WAL: %w", err)
 	}
 
-	size := bloom.EstimateSize(1000, 0.01)
-	hashFuncs := bloom.EstimateHashFunctions(size, 1000)
+	e, err := openEngine(dataDir, opts)
+	if err != nil {
+		_ = w.Close()
+		return nil, err
+	}
+
+	expectedKeys := uint(opts.BloomExpectedKeys)
+	size := bloom.EstimateSize(expectedKeys, opts.BloomFalsePositiveRate)
+	hashFuncs := bloom.EstimateHashFunctions(size, expectedKeys)
 	bloomFilter := bloom.NewBloomFilter(size, hashFuncs)
 
 	store := &store{
-		tree:        tree,
+		engine:      e,
 		memtable:    mTable,
 		wal:         w,
 		bloomFilter: bloomFilter,
 		dataDir:     dataDir,
+		opts:        opts,
+		memory:      memory,
+		snapshots:   make(map[*snapshot]struct{}),
+		expiries:    newExpiryIndex(),
+		flushChan:   make(chan struct{}, 1),
 		stopChan:    make(chan struct{}),
 	}
+	store.flushCond = sync.NewCond(&store.mu)
+
+	for _, key := range e.List() {
+		bloomFilter.Add(key)
+	}
+	store.loadExpiries()
 
 	if err := store.replayWAL(); err != nil {
+		_ = w.Close()
+		_ = e.Close()
 		return nil, fmt.Errorf("failed to replay WAL: %w", err)
 	}
+	store.prepared = w.Prepared()
+	memory.register(store)
+	store.account()
 
 	go store.backgroundFlush()
+	go store.backgroundReap()
 
 	return store, nil
 }
 
 func (s *store) Put(key types.Key, value types.Value) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	return s.PutWithExpiry(key, value, 0)
+}
 
-	if err := s.wal.LogInsert(key, value); err != nil {
-		return fmt.Errorf("failed to log insert to WAL: %w", err)
-	}
-
-	s.memtable.Put(key, value)
-	s.bloomFilter.Add(key)
-
-	if s.memtable.IsFull() {
-		if err := s.flushMemtable(); err != nil {
-			return fmt.Errorf("failed to flush memtable: %w", err)
-		}
+func (s *store) PutWithTTL(key types.Key, value types.Value, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("TTL must be positive, got %v", ttl)
 	}
+	return s.PutWithExpiry(key, value, time.Now().Add(ttl).UnixNano())
+}
 
-	return nil
+// PutWithExpiry is PutWithTTL with the expiry given as Unix nanoseconds, for
+// callers that move entries and must keep their original deadline.
+func (s *store) PutWithExpiry(key types.Key, value types.Value, expiresAt int64) error {
+	return s.write("insert", func() (uint64, error) {
+		return s.wal.AppendInsert(key, value, expiresAt)
+	}, func() {
+		s.memtable.PutWithExpiry(key, value, expiresAt)
+		s.bloomFilter.Add(key)
+		s.expiries.set(key, expiresAt)
+	})
 }
 
 func (s *store) Get(key types.Key) (types.Value, error) {
+	value, _, err := s.GetWithExpiry(key)
+	return value, err
+}
+
+// GetWithExpiry is Get that also returns when the value expires, in Unix
+// nanoseconds, or 0 if it does not.
+func (s *store) GetWithExpiry(key types.Key) (types.Value, int64, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	if value, found := s.memtable.Get(key); found {
-		if value == nil {
-			return nil, fmt.Errorf("key not found")
+	if s.closed {
+		return nil, 0, dberrors.ErrClosed
+	}
+
+	for _, mem := range s.memtables() {
+		if entry, found := mem.Get(key); found {
+			if entry.Kind == types.KindTombstone {
+				return nil, 0, dberrors.ErrNotFound
+			}
+			return entry.Value, entry.ExpiresAt, nil
 		}
-		return value, nil
 	}
 
 	if !s.bloomFilter.Contains(key) {
-		return nil, fmt.Errorf("key not found")
+		return nil, 0, dberrors.ErrNotFound
 	}
 
-	return s.tree.Find(key)
+	return s.engine.FindWithExpiry(key)
 }
 
 func (s *store) Delete(key types.Key) error {
+	return s.write("delete", func() (uint64, error) {
+		return s.wal.AppendDelete(key)
+	}, func() {
+		s.memtable.Delete(key)
+		s.expiries.set(key, 0)
+	})
+}
+
+func (s *store) Write(b *batch.WriteBatch) error {
+	if b.Len() == 0 {
+		return nil
+	}
+	return s.write("batch", func() (uint64, error) {
+		return s.wal.AppendBatch(b.Ops())
+	}, func() {
+		s.applyBatch(b)
+	})
+}
+
+// write appends a WAL record with log and applies it with apply, both under
+// mu, then waits for the record to become durable with mu released. Writers
+// only queue on mu for the append, so in group sync mode the ones that
+// arrive during an fsync share the next one. A write can be read a moment
+// before it is durable; a crash in between loses it, as it would had it
+// come a moment later. If the fsync fails the write stays readable but is
+// reported as failed, so the store turns read-only, as after a failed
+// flush, and never flushes it to the engine; a reopen recovers whatever the
+// WAL kept.
+func (s *store) write(what string, log func() (uint64, error), apply func()) error {
+	if err := s.memory.wait(); err != nil {
+		return err
+	}
 	s.mu.Lock()
-	defer s.mu.Unlock()
 
-	if err := s.wal.LogDelete(key); err != nil {
-		return fmt.Errorf("failed to log delete to WAL: %w", err)
+	if err := s.makeRoom(); err != nil {
+		s.mu.Unlock()
+		return err
 	}
 
-	s.memtable.Delete(key)
+	lsn, err := log()
+	if err != nil {
+		s.mu.Unlock()
+		return fmt.Errorf("failed to log %s to WAL: %w", what, err)
+	}
+
+	apply()
+	s.maybeRotate()
+	s.account()
+	s.mu.Unlock()
 
-	if s.memtable.IsFull() {
-		if err := s.flushMemtable(); err != nil {
-			return fmt.Errorf("failed to flush memtable: %w", err)
+	if err := s.wal.WaitDurable(lsn); err != nil {
+		if !errors.Is(err, dberrors.ErrClosed) {
+			s.mu.Lock()
+			if s.syncErr == nil {
+				s.syncErr = err
+			}
+			s.mu.Unlock()
+			// Writers waiting on memory will not see the flusher free it.
+			s.memory.wake()
 		}
+		return fmt.Errorf("failed to sync WAL: %w", err)
+	}
+	return nil
+}
+
+func (s *store) Prepare(batchID uint64, b *batch.WriteBatch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
+
+	if err := s.wal.LogPrepare(batchID, b.Ops()); err != nil {
+		return fmt.Errorf("failed to log prepared batch to WAL: %w", err)
+	}
+
+	s.prepared[batchID] = b
+	return nil
+}
+
+func (s *store) CommitPrepared(batchID uint64) error {
+	if err := s.memory.wait(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.makeRoom(); err != nil {
+		return err
+	}
+
+	b, exists := s.prepared[batchID]
+	if !exists {
+		return fmt.Errorf("batch %d is not prepared", batchID)
 	}
 
+	if err := s.wal.LogCommit(batchID); err != nil {
+		return fmt.Errorf("failed to log batch commit to WAL: %w", err)
+	}
+	delete(s.prepared, batchID)
+
+	s.applyBatch(b)
+	s.maybeRotate()
+	s.account()
 	return nil
 }
 
+func (s *store) AbortPrepared(batchID uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
+
+	if _, exists := s.prepared[batchID]; !exists {
+		return fmt.Errorf("batch %d is not prepared", batchID)
+	}
+
+	if err := s.wal.LogAbort(batchID); err != nil {
+		return fmt.Errorf("failed to log batch abort to WAL: %w", err)
+	}
+	delete(s.prepared, batchID)
+	return nil
+}
+
+func (s *store) PreparedBatches() []uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ids := make([]uint64, 0, len(s.prepared))
+	for id := range s.prepared {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (s *store) applyBatch(b *batch.WriteBatch) {
+	for _, op := range b.Ops() {
+		s.expiries.set(op.Key, 0)
+		if op.Type == batch.OpDelete {
+			s.memtable.Delete(op.Key)
+		} else {
+			s.memtable.Put(op.Key, op.Value)
+			s.bloomFilter.Add(op.Key)
+		}
+	}
+}
+
 func (s *store) List() []types.Key {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
+	if s.closed {
+		return nil
+	}
+
 	keys := make(map[types.Key]bool)
 
-	for _, key := range s.tree.List() {
+	for _, key := range s.engine.List() {
 		keys[key] = true
 	}
 
-	for _, entry := range s.memtable.GetAllEntries() {
-		if entry.Value != nil {
-			keys[entry.Key] = true
-		} else {
-			delete(keys, entry.Key)
+	now := time.Now().UnixNano()
+	mems := s.memtables()
+	for i := len(mems) - 1; i >= 0; i-- {
+		for _, entry := range mems[i].GetAllEntries() {
+			if entry.Kind == types.KindValue && !types.Expired(entry.ExpiresAt, now) {
+				keys[entry.Key] = true
+			} else {
+				delete(keys, entry.Key)
+			}
 		}
 	}
 
@@ -145,80 +386,435 @@ func (s *store) List() []types.Key {
 	return result
 }
 
+// Scan reads the memtables there are when it starts. Those that fill up
+// meanwhile are only swapped out, not changed, so they stay valid to read.
+func (s *store) Scan(start, end types.Key) iterator.Iterator {
+	s.mu.RLock()
+	mems := s.memtables()
+	s.mu.RUnlock()
+
+	iters := make([]iterator.Iterator, 0, len(mems)+1)
+	for _, mem := range mems {
+		iters = append(iters, iterator.NewPagedIterator(start, end, constants.ScanBatchSize, s.scanMemtable(mem)))
+	}
+	iters = append(iters, iterator.NewPagedIterator(start, end, constants.ScanBatchSize, s.scanEngine))
+	return iterator.NewMergeIterator(iters...)
+}
+
+func (s *store) ScanPrefix(prefix types.Key) iterator.Iterator {
+	return s.Scan(prefix, iterator.PrefixEnd(prefix))
+}
+
+func (s *store) scanMemtable(mem memtable.Memtable) iterator.ScanFunc {
+	return func(start, end types.Key, fn func(types.Key, types.Value) bool) error {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+
+		if s.closed {
+			return dberrors.ErrClosed
+		}
+		mem.Scan(start, end, fn)
+		return nil
+	}
+}
+
+func (s *store) scanEngine(start, end types.Key, fn func(types.Key, types.Value) bool) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return dberrors.ErrClosed
+	}
+	return s.engine.Scan(start, end, fn)
+}
+
+// Sync makes every write so far durable, whatever the WAL sync mode.
+func (s *store) Sync() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return dberrors.ErrClosed
+	}
+	return s.wal.Sync()
+}
+
 func (s *store) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return dberrors.ErrClosed
+	}
+	s.closed = true
+	s.flushCond.Broadcast()
+	s.mu.Unlock()
+
 	close(s.stopChan)
-	return s.wal.Close()
+
+	// Full memtables are flushed rather than left for the WAL to replay.
+	// The active one is left, like any memtable that has not filled up.
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	flushErr := s.flushQueued()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The active memtable is left to the WAL, so its bytes stop counting
+	// against the budget.
+	s.memory.unregister(s)
+	s.memory.add(-s.memBytes.Swap(0))
+
+	if err := s.engine.Close(); err != nil {
+		_ = s.wal.Close()
+		return fmt.Errorf("failed to close storage engine: %w", err)
+	}
+	if err := s.wal.Close(); err != nil {
+		return err
+	}
+	if flushErr != nil {
+		return fmt.Errorf("failed to flush memtable: %w", flushErr)
+	}
+	return nil
 }
 
 func (s *store) Clear() error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.closed {
+		return dberrors.ErrClosed
+	}
+
 	if err := s.wal.Clear(); err != nil {
 		return fmt.Errorf("failed to clear WAL: %w", err)
 	}
+	s.prepared = make(map[uint64]*batch.WriteBatch)
+
+	mems := s.memtables()
+	if len(s.snapshots) > 0 {
+		keys := s.engine.List()
+		for _, mem := range mems {
+			for _, entry := range mem.GetAllEntries() {
+				keys = append(keys, entry.Key)
+			}
+		}
+		s.preserveForSnapshots(keys, mems...)
+	}
 
-	s.tree = btree.NewBPlusTree()
-	s.memtable.Clear()
+	if err := s.engine.Clear(); err != nil {
+		return fmt.Errorf("failed to clear storage engine: %w", err)
+	}
+	// Scans may still hold the memtables, so they are emptied rather than
+	// just dropped.
+	for _, mem := range mems {
+		mem.Clear()
+	}
+	s.immutables = nil
 	s.bloomFilter.Clear()
+	s.expiries.clear()
+	s.account()
+	s.flushCond.Broadcast()
 
 	return nil
 }
 
-func (s *store) flushMemtable() error {
-	entries := s.memtable.GetAllEntries()
+// newMemtable numbers its writes from seq onwards. The sorted slice is kept
+// for comparing against the skiplist.
+func newMemtable(opts options.Options, seq uint64) memtable.Memtable {
+	if opts.MemtableType == "slice" {
+		return memtable.NewMemtableWithSeq(opts.MemtableSize, opts.MemtableBytes, seq)
+	}
+	return memtable.NewSkiplistMemtable(opts.MemtableSize, opts.MemtableBytes, seq)
+}
+
+// memtables returns the active memtable and then the immutable ones, newest
+// first, which is the order reads consult them in.
+func (s *store) memtables() []memtable.Memtable {
+	mems := make([]memtable.Memtable, 0, len(s.immutables)+1)
+	mems = append(mems, s.memtable)
+	for i := len(s.immutables) - 1; i >= 0; i-- {
+		mems = append(mems, s.immutables[i].mem)
+	}
+	return mems
+}
+
+// makeRoom makes sure the active memtable can take a write. A full one is
+// swapped for a fresh one, but only while fewer than MaxImmutableMemtables
+// are waiting to be flushed; past that the writer stalls until the flusher
+// catches up, so writes cannot outrun the engine.
+func (s *store) makeRoom() error {
+	stalled := false
+	for {
+		if err := s.checkWritable(); err != nil {
+			return err
+		}
+		if !s.memtable.IsFull() {
+			return nil
+		}
+		if len(s.immutables) < s.opts.MaxImmutableMemtables {
+			s.rotateMemtable()
+			return nil
+		}
+		if !stalled {
+			stalled = true
+			s.stalls++
+		}
+		s.flushCond.Wait()
+	}
+}
+
+// maybeRotate hands a full memtable to the flusher straight after the write
+// that filled it, if there is room in the queue.
+func (s *store) maybeRotate() {
+	if s.memtable.IsFull() && len(s.immutables) < s.opts.MaxImmutableMemtables {
+		s.rotateMemtable()
+	}
+}
+
+func (s *store) rotateMemtable() {
+	s.immutables = append(s.immutables, immutable{mem: s.memtable, lsn: s.wal.LastLSN()})
+	s.memtable = newMemtable(s.opts, s.memtable.Seq())
+	s.updateRetention()
+
+	select {
+	case s.flushChan <- struct{}{}:
+	default:
+	}
+}
+
+// account reports the change in the bytes held by the memtables to the
+// memory budget, counting the versions kept for open snapshots. It must be
+// called with mu held.
+func (s *store) account() {
+	var total int64
+	for _, mem := range s.memtables() {
+		total += mem.GetBytes()
+	}
+	for sn := range s.snapshots {
+		total += sn.preserved.GetBytes()
+	}
+	s.memory.add(total - s.memBytes.Swap(total))
+}
+
+func (s *store) flushError() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.failure()
+}
+
+// failure returns why the store stopped taking writes, if it has. It must
+// be called with mu held.
+func (s *store) failure() error {
+	if s.flushErr != nil {
+		return s.flushErr
+	}
+	return s.syncErr
+}
+
+// relieve hands a non-empty memtable to the flusher before it is full, so
+// the memory budget gets its bytes back. It reports whether the store has a
+// flush coming that will give memory back.
+func (s *store) relieve() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.checkWritable() != nil {
+		return false
+	}
+	if s.memtable.GetSize() > 0 && len(s.immutables) < s.opts.MaxImmutableMemtables {
+		s.rotateMemtable()
+	}
+	return len(s.immutables) > 0
+}
+
+func (s *store) flushImmutables() {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	_ = s.flushQueued()
+}
 
-	for _, entry := range entries {
-		if entry.Value != nil {
-			if err := s.tree.Insert(entry.Key, entry.Value); err != nil {
-				return fmt.Errorf("failed to insert into B+ tree: %w", err)
+// flushQueued moves the queued memtables into the storage engine, oldest
+// first, with flushMu held. Only the engine write runs without mu, so reads
+// and writes carry on meanwhile. If it fails part way the engine may hold
+// an unknown mix of old and new data, so the store stops taking writes; the
+// WAL still has everything and a reopen recovers from it. Once the store is
+// read-only nothing more is flushed.
+func (s *store) flushQueued() error {
+	for {
+		s.mu.Lock()
+		if err := s.failure(); err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		if len(s.immutables) == 0 {
+			s.mu.Unlock()
+			return nil
+		}
+		imm := s.immutables[0]
+		entries := imm.mem.GetAllEntries()
+		if len(s.snapshots) > 0 {
+			keys := make([]types.Key, len(entries))
+			for i, entry := range entries {
+				keys[i] = entry.Key
 			}
-			s.bloomFilter.Add(entry.Key)
+			s.preserveForSnapshots(keys, imm.mem)
+		}
+		s.mu.Unlock()
+
+		err := s.writeImmutable(imm, entries)
+
+		s.mu.Lock()
+		if err != nil {
+			s.flushErr = err
+			// Writers waiting on memory counted on this flush.
+			s.memory.wake()
 		} else {
-			_ = s.tree.Delete(entry.Key)
+			for _, entry := range entries {
+				if entry.Kind == types.KindValue {
+					s.bloomFilter.Add(entry.Key)
+				}
+			}
+			s.immutables = s.immutables[1:]
+		}
+		s.account()
+		s.flushCond.Broadcast()
+		s.mu.Unlock()
+
+		if err != nil {
+			return err
 		}
 	}
+}
 
-	s.memtable.Clear()
+func (s *store) writeImmutable(imm immutable, entries []memtable.Entry) error {
+	if err := s.engine.Flush(entries); err != nil {
+		return err
+	}
+	if err := s.wal.Checkpoint(imm.lsn); err != nil {
+		return fmt.Errorf("failed to checkpoint WAL: %w", err)
+	}
 	return nil
 }
 
 func (s *store) backgroundFlush() {
-	ticker := time.NewTicker(5 * time.Second)
+	ticker := time.NewTicker(s.opts.FlushInterval)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ticker.C:
 			s.mu.Lock()
-			if s.memtable.GetSize() > 0 {
-				err := s.flushMemtable()
-				if err != nil {
-					panic("error flushing memtable")
-				}
+			if s.checkWritable() == nil && s.memtable.GetSize() > 0 && len(s.immutables) < s.opts.MaxImmutableMemtables {
+				s.rotateMemtable()
 			}
 			s.mu.Unlock()
+		case <-s.flushChan:
+			s.flushImmutables()
 		case <-s.stopChan:
 			return
 		}
 	}
 }
 
-func (s *store) replayWAL() error {
-	insertHandler := func(key types.Key, value types.Value) error {
-		if err := s.tree.Insert(key, value); err != nil {
-			return err
+// backgroundReap deletes expired keys so they stop taking up space. Reads
+// already hide them, so this only has to keep up roughly.
+func (s *store) backgroundReap() {
+	ticker := time.NewTicker(s.opts.TTLReapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for {
+				reaped, err := s.reapExpired()
+				if err != nil || reaped < constants.TTLReapBatchSize {
+					break
+				}
+			}
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// reapExpired deletes up to TTLReapBatchSize expired keys and returns how
+// many it deleted. The keys come from the expiry index, so writers only wait
+// for one chunk of deletes, never for a scan.
+func (s *store) reapExpired() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkWritable(); err != nil {
+		return 0, err
+	}
+
+	expired := s.expiries.expired(time.Now().UnixNano(), constants.TTLReapBatchSize)
+	if len(expired) == 0 {
+		return 0, nil
+	}
+	b := batch.NewWriteBatch()
+	for _, item := range expired {
+		b.Delete(item.key)
+	}
+
+	if _, err := s.wal.AppendBatch(b.Ops()); err != nil {
+		for _, item := range expired {
+			s.expiries.set(item.key, item.expiresAt)
 		}
+		return 0, fmt.Errorf("failed to log expired keys to WAL: %w", err)
+	}
+	s.applyBatch(b)
+	s.maybeRotate()
+	s.account()
+	return len(expired), nil
+}
+
+// loadExpiries fills the expiry index from the engine, the one time it is
+// scanned for deadlines; from then on the writes keep the index current.
+// Keys that have already expired are found but no longer readable, so they
+// are given a deadline of now.
+func (s *store) loadExpiries() {
+	now := time.Now().UnixNano()
+	for _, key := range s.engine.Expired(math.MaxInt64) {
+		_, expiresAt, err := s.engine.FindWithExpiry(key)
+		if err != nil {
+			expiresAt = now
+		}
+		s.expiries.set(key, expiresAt)
+	}
+}
+
+func (s *store) checkWritable() error {
+	if s.closed {
+		return dberrors.ErrClosed
+	}
+	if s.flushErr != nil {
+		return fmt.Errorf("%w after failed flush: %v", dberrors.ErrReadOnly, s.flushErr)
+	}
+	if s.syncErr != nil {
+		return fmt.Errorf("%w after failed WAL sync: %v", dberrors.ErrReadOnly, s.syncErr)
+	}
+	return nil
+}
+
+func (s *store) replayWAL() error {
+	insertHandler := func(key types.Key, value types.Value, expiresAt int64) error {
+		s.memtable.PutWithExpiry(key, value, expiresAt)
 		s.bloomFilter.Add(key)
+		s.expiries.set(key, expiresAt)
 		return nil
 	}
 
 	deleteHandler := func(key types.Key) error {
-		_ = s.tree.Delete(key)
+		s.memtable.Delete(key)
+		s.expiries.set(key, 0)
 		return nil
 	}
 
-	return s.wal.Replay(insertHandler, deleteHandler)
+	return s.wal.ReplayWithExpiry(insertHandler, deleteHandler)
 }
 
 func (s *store) GetStats() map[string]interface{} {
@@ -226,9 +822,16 @@ func (s *store) GetStats() map[string]interface{} {
 	defer s.mu.RUnlock()
 
 	return map[string]interface{}{
-		"memtable_size": s.memtable.GetSize(),
-		"data_dir":      s.dataDir,
-		"wal_enabled":   true,
-		"bloom_filter":  "enabled",
+		"memtable_size":       s.memtable.GetSize(),
+		"memtable_bytes":      s.memtable.GetBytes(),
+		"memory_bytes":        s.memBytes.Load(),
+		"immutable_memtables": len(s.immutables),
+		"write_stalls":        s.stalls,
+		"data_dir":            s.dataDir,
+		"wal_enabled":         true,
+		"wal":                 s.wal.Stats(),
+		"bloom_filter":        "enabled",
+		"engine":              s.opts.Engine,
+		s.opts.Engine:         s.engine.Stats(),
 	}
 }
@@ -0,0 +1,273 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	dberrors "halo-db/pkg/errors"
+	"halo-db/pkg/memtable"
+	"halo-db/pkg/options"
+	"halo-db/pkg/types"
+	"halo-db/pkg/wal"
+	"math"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStoreGroupCommit(t *testing.T) {
+	dataDir := "test_data_group_commit"
+	_ = os.RemoveAll(dataDir)
+	defer func() { _ = os.RemoveAll(dataDir) }()
+
+	opts := options.Default()
+	opts.SyncMode = "group"
+	s, err := NewStoreWithOptions(dataDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	defer func() { _ = s.Close() }()
+
+	// A short fsync does not give up the only P, so on one CPU no other
+	// writer would get to append while it runs.
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+
+	const numWriters = 32
+	const writesPerWriter = 20
+
+	var wg sync.WaitGroup
+	errs := make(chan error, numWriters)
+	for i := 0; i < numWriters; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			for j := 0; j < writesPerWriter; j++ {
+				key := types.Key(fmt.Sprintf("writer_%d_key_%d", id, j))
+				if err := s.Put(key, types.Value("value")); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	writes := uint64(numWriters * writesPerWriter)
+	syncs := s.GetStats()["wal"].(map[string]interface{})["syncs"].(uint64)
+	if syncs == 0 || syncs >= writes {
+		t.Fatalf("Expected concurrent writers to share fsyncs, got %d syncs for %d writes", syncs, writes)
+	}
+	t.Logf("%d syncs for %d writes", syncs, writes)
+}
+
+func TestSnapshotMemory(t *testing.T) {
+	dataDir := "test_data_snapshot_memory"
+	_ = os.RemoveAll(dataDir)
+	defer func() { _ = os.RemoveAll(dataDir) }()
+
+	memory := NewMemoryBudget(0)
+	s, err := NewStoreWithMemory(dataDir, options.Default(), memory)
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	defer func() { _ = s.Close() }()
+
+	for i := 0; i < 100; i++ {
+		if err := s.Put(types.Key(fmt.Sprintf("key_%03d", i)), make(types.Value, 100)); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+
+	snap := s.Snapshot()
+	if err := s.Clear(); err != nil {
+		t.Fatalf("Failed to clear: %v", err)
+	}
+	// The memtables are empty, but the snapshot still holds every value.
+	if used := memory.Used(); used < 100*100 {
+		t.Errorf("Expected the snapshot's values to count against memory, got %d bytes", used)
+	}
+
+	snap.Release()
+	if used := memory.Used(); used != 0 {
+		t.Errorf("Expected released snapshot to give its memory back, got %d bytes", used)
+	}
+}
+
+func TestTTLReap(t *testing.T) {
+	dataDir := "test_data_ttl_reap"
+	_ = os.RemoveAll(dataDir)
+	defer func() { _ = os.RemoveAll(dataDir) }()
+
+	opts := options.Default()
+	opts.MemtableSize = 100
+	opts.SyncMode = "none"
+	opts.TTLReapInterval = time.Hour
+	s, err := NewStoreWithOptions(dataDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+
+	// More keys than one reaping chunk, most of them flushed to the engine
+	// on close.
+	const numKeys = 2500
+	expiresAt := time.Now().Add(time.Second).UnixNano()
+	for i := 0; i < numKeys; i++ {
+		if err := s.PutWithExpiry(types.Key(fmt.Sprintf("key_%04d", i)), types.Value("value"), expiresAt); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	if err := s.PutWithTTL("long", types.Value("value"), time.Hour); err != nil {
+		t.Fatalf("Failed to put with TTL: %v", err)
+	}
+	_ = s.Close()
+
+	opts.TTLReapInterval = 10 * time.Millisecond
+	s, err = NewStoreWithOptions(dataDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	defer func() { _ = s.Close() }()
+
+	st := s.(*store)
+	tracked := func() int {
+		st.mu.RLock()
+		defer st.mu.RUnlock()
+		return len(st.expiries.deadlines)
+	}
+	if n := tracked(); n != numKeys+1 {
+		t.Fatalf("Expected the reopened store to track %d deadlines, got %d", numKeys+1, n)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for tracked() > 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected expired keys to be reaped, %d left", tracked()-1)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Each reaped key is now either a tombstone in a memtable or, once that
+	// was flushed, gone from the engine.
+	st.mu.RLock()
+	inEngine := make(map[types.Key]bool)
+	for _, key := range st.engine.Expired(math.MaxInt64) {
+		inEngine[key] = true
+	}
+	for i := 0; i < numKeys; i++ {
+		key := types.Key(fmt.Sprintf("key_%04d", i))
+		entry, found := getAt(st.memtables(), key, math.MaxUint64)
+		if found && entry.Kind != types.KindTombstone || !found && inEngine[key] {
+			t.Errorf("Expected %s to be deleted by the reaper", key)
+		}
+	}
+	st.mu.RUnlock()
+
+	if _, err := s.Get("key_0000"); !errors.Is(err, dberrors.ErrNotFound) {
+		t.Errorf("Expected key_0000 to have expired, got %v", err)
+	}
+	if value, err := s.Get("long"); err != nil || string(value) != "value" {
+		t.Errorf("Expected long to survive, got %q (%v)", value, err)
+	}
+}
+
+// failingEngine fails every flush, as a full disk would.
+type failingEngine struct {
+	engine
+}
+
+func (failingEngine) Flush([]memtable.Entry) error {
+	return errors.New("disk full")
+}
+
+func TestMemoryWaitFlushFailure(t *testing.T) {
+	dataDir := "test_data_flush_failure"
+	_ = os.RemoveAll(dataDir)
+	defer func() { _ = os.RemoveAll(dataDir) }()
+
+	opts := options.Default()
+	opts.SyncMode = "none"
+	memory := NewMemoryBudget(8 << 10)
+	s, err := NewStoreWithMemory(dataDir, opts, memory)
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	defer func() { _ = s.Close() }()
+
+	st := s.(*store)
+	st.flushMu.Lock()
+	st.engine = failingEngine{st.engine}
+	st.flushMu.Unlock()
+
+	// Once the budget is exceeded a writer waits for the memtable it hands
+	// to the flusher, which fails.
+	result := make(chan error, 1)
+	go func() {
+		for i := 0; ; i++ {
+			if err := s.Put(types.Key(fmt.Sprintf("key_%03d", i)), make(types.Value, 1<<10)); err != nil {
+				result <- err
+				return
+			}
+		}
+	}()
+
+	select {
+	case err := <-result:
+		if err == nil || !strings.Contains(err.Error(), "disk full") {
+			t.Errorf("Expected the flush error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Writer is still waiting for memory after the flush failed")
+	}
+	if memory.Stalls() == 0 {
+		t.Error("Expected the writer to have waited for memory")
+	}
+}
+
+// failingWAL fails every wait for durability, as an fsync returning EIO
+// would.
+type failingWAL struct {
+	wal.WAL
+}
+
+func (failingWAL) WaitDurable(uint64) error {
+	return errors.New("input/output error")
+}
+
+func TestWALSyncFailureReadOnly(t *testing.T) {
+	dataDir := "test_data_sync_failure"
+	_ = os.RemoveAll(dataDir)
+	defer func() { _ = os.RemoveAll(dataDir) }()
+
+	s, err := NewStoreWithOptions(dataDir, options.Default())
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	defer func() { _ = s.Close() }()
+
+	st := s.(*store)
+	st.mu.Lock()
+	log := st.wal
+	st.wal = failingWAL{log}
+	st.mu.Unlock()
+
+	if err := s.Put("key1", types.Value("value")); err == nil {
+		t.Fatal("Expected the failed sync to fail the write")
+	}
+	st.mu.Lock()
+	st.wal = log
+	st.mu.Unlock()
+
+	if err := s.Put("key2", types.Value("value")); !errors.Is(err, dberrors.ErrReadOnly) {
+		t.Errorf("Expected ErrReadOnly after a failed sync, got %v", err)
+	}
+	if err := st.flushQueued(); err == nil {
+		t.Error("Expected nothing to be flushed after a failed sync")
+	}
+}
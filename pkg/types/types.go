@@ -3,7 +3,30 @@ package types
 type Key = string
 type Value = []byte
 
+// Kind says what a stored version of a key is. A tombstone records a
+// deletion; a value may be empty, and is still a value.
+type Kind byte
+
+const (
+	KindValue     Kind = 1
+	KindTombstone Kind = 2
+	// KindMerge is an operand to combine with the key's older versions.
+	// Nothing writes one yet; the formats that carry a kind accept it so
+	// they do not have to change when something does.
+	KindMerge Kind = 3
+)
+
+func (k Kind) Valid() bool {
+	return k >= KindValue && k <= KindMerge
+}
+
 type Entry struct {
 	Key   Key
 	Value Value
 }
+
+// Expired reports whether an entry with the given expiry, in Unix
+// nanoseconds, is gone at now. An expiry of 0 means the entry never expires.
+func Expired(expiresAt, now int64) bool {
+	return expiresAt != 0 && expiresAt <= now
+}
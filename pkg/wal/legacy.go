@@ -0,0 +1,116 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"halo-db/pkg/types"
+	"io"
+	"os"
+)
+
+type legacyEntry struct {
+	Operation  string      `json:"op"`
+	LSN        uint64      `json:"lsn"`
+	Key        types.Key   `json:"key"`
+	Value      types.Value `json:"value,omitempty"`
+	Checkpoint uint64      `json:"checkpoint,omitempty"`
+}
+
+var legacyOps = map[string]OpType{
+	"INSERT":     OpInsert,
+	"DELETE":     OpDelete,
+	"CHECKPOINT": OpCheckpoint,
+}
+
+func isLegacySegment(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to open WAL file: %w", err)
+	}
+	defer func() { _ = file.Close() }()
+
+	header := make([]byte, segmentHeaderSize)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false, fmt.Errorf("failed to read WAL header: %w", err)
+	}
+	if n == 0 {
+		return false, nil
+	}
+	return !bytes.HasPrefix(segmentMagic, header[:n]), nil
+}
+
+// migrateLegacySegment rewrites a length-prefixed JSON segment in the binary
+// format. Records written before LSNs existed are numbered after lastLSN. The
+// legacy reader keeps its old behaviour of stopping at the first record it
+// cannot decode.
+func migrateLegacySegment(path string, lastLSN uint64) (uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return lastLSN, fmt.Errorf("failed to read legacy WAL file: %w", err)
+	}
+
+	var out []byte
+	for len(data) >= 4 {
+		length := binary.BigEndian.Uint32(data[:4])
+		if uint64(len(data)-4) < uint64(length) {
+			break
+		}
+
+		var legacy legacyEntry
+		if err := json.Unmarshal(data[4:4+length], &legacy); err != nil {
+			break
+		}
+		data = data[4+length:]
+
+		op, ok := legacyOps[legacy.Operation]
+		if !ok {
+			continue
+		}
+		if legacy.LSN <= lastLSN {
+			legacy.LSN = lastLSN + 1
+		}
+		lastLSN = legacy.LSN
+
+		if len(out) == 0 {
+			out = append(out, segmentMagic...)
+		}
+		out = append(out, encodeRecord(&LogEntry{
+			LSN:        legacy.LSN,
+			Operation:  op,
+			Key:        legacy.Key,
+			Value:      legacy.Value,
+			Checkpoint: legacy.Checkpoint,
+		})...)
+	}
+
+	tmpPath := path + ".migrate"
+	if err := writeFileSync(tmpPath, out); err != nil {
+		return lastLSN, err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return lastLSN, fmt.Errorf("failed to replace legacy WAL file: %w", err)
+	}
+	return lastLSN, nil
+}
+
+func writeFileSync(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create WAL file: %w", err)
+	}
+	if _, err := file.Write(data); err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to write WAL file: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to sync WAL file: %w", err)
+	}
+	return file.Close()
+}
@@ -0,0 +1,305 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"halo-db/pkg/constants"
+	dberrors "halo-db/pkg/errors"
+	"halo-db/pkg/types"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+type OpType byte
+
+const (
+	OpInsert      OpType = 1
+	OpDelete      OpType = 2
+	OpCheckpoint  OpType = 3
+	OpBatchInsert OpType = 4
+	OpBatchDelete OpType = 5
+	OpCommit      OpType = 6
+	OpAbort       OpType = 7
+	OpInsertTTL   OpType = 8
+)
+
+const (
+	segmentHeaderSize = 8
+	recordHeaderSize  = 8
+	formatVersion     = 1
+	// maxPayloadSize bounds the payload of any record appendLocked accepts:
+	// the largest key and value plus the LSN, operation and varints.
+	maxPayloadSize = constants.MaxKeySize + constants.MaxValueSize + 64
+)
+
+var segmentMagic = []byte{'H', 'A', 'L', 'O', 'W', 'A', 'L', formatVersion}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+var ErrCorrupted = fmt.Errorf("wal %w", dberrors.ErrCorrupted)
+
+var errTornTail = errors.New("torn wal tail")
+
+// LogEntry is one WAL record. Kind is filled in from the operation when a
+// record is read back: inserts hold values, which may be empty, and deletes
+// hold tombstones.
+type LogEntry struct {
+	LSN        uint64
+	Operation  OpType
+	Kind       types.Kind
+	BatchID    uint64
+	Key        types.Key
+	Value      types.Value
+	ExpiresAt  int64
+	Checkpoint uint64
+}
+
+// encodeRecord lays out a record as
+//
+//	crc32c(4) | payload length(4) | LSN(8) | op(1) | body
+//
+// where the body is a varint-prefixed key and value for inserts, a
+// varint-prefixed key for deletes and a varint LSN for checkpoints. Inserts
+// with a TTL append the expiry, in Unix nanoseconds, as a varint. Batch
+// records carry a varint batch ID ahead of the same body, and commit and
+// abort markers carry only the batch ID. The checksum covers everything
+// after itself.
+func encodeRecord(entry *LogEntry) []byte {
+	buf := make([]byte, recordHeaderSize, recordHeaderSize+17+len(entry.Key)+len(entry.Value))
+	buf = binary.BigEndian.AppendUint64(buf, entry.LSN)
+	buf = append(buf, byte(entry.Operation))
+
+	switch entry.Operation {
+	case OpBatchInsert, OpBatchDelete, OpCommit, OpAbort:
+		buf = binary.AppendUvarint(buf, entry.BatchID)
+	}
+
+	switch entry.Operation {
+	case OpInsert, OpBatchInsert, OpInsertTTL:
+		buf = binary.AppendUvarint(buf, uint64(len(entry.Key)))
+		buf = append(buf, entry.Key...)
+		buf = binary.AppendUvarint(buf, uint64(len(entry.Value)))
+		buf = append(buf, entry.Value...)
+		if entry.Operation == OpInsertTTL {
+			buf = binary.AppendUvarint(buf, uint64(entry.ExpiresAt))
+		}
+	case OpDelete, OpBatchDelete:
+		buf = binary.AppendUvarint(buf, uint64(len(entry.Key)))
+		buf = append(buf, entry.Key...)
+	case OpCheckpoint:
+		buf = binary.AppendUvarint(buf, entry.Checkpoint)
+	}
+
+	binary.BigEndian.PutUint32(buf[4:8], uint32(len(buf)-recordHeaderSize))
+	binary.BigEndian.PutUint32(buf[0:4], crc32.Checksum(buf[4:], castagnoli))
+	return buf
+}
+
+func decodePayload(payload []byte) (LogEntry, error) {
+	var entry LogEntry
+	if len(payload) < 9 {
+		return entry, fmt.Errorf("%w: record payload too short", ErrCorrupted)
+	}
+
+	entry.LSN = binary.BigEndian.Uint64(payload[:8])
+	entry.Operation = OpType(payload[8])
+	body := payload[9:]
+
+	var err error
+	switch entry.Operation {
+	case OpBatchInsert, OpBatchDelete, OpCommit, OpAbort:
+		var n int
+		entry.BatchID, n = binary.Uvarint(body)
+		if n <= 0 {
+			return entry, fmt.Errorf("%w: bad batch ID", ErrCorrupted)
+		}
+		body = body[n:]
+	}
+
+	switch entry.Operation {
+	case OpInsert, OpBatchInsert, OpInsertTTL:
+		entry.Kind = types.KindValue
+		var key []byte
+		if key, body, err = readBytes(body); err == nil {
+			entry.Key = types.Key(key)
+			entry.Value, body, err = readBytes(body)
+		}
+		if err == nil && entry.Operation == OpInsertTTL {
+			expiresAt, n := binary.Uvarint(body)
+			if n <= 0 {
+				err = fmt.Errorf("%w: bad expiry", ErrCorrupted)
+			} else {
+				entry.ExpiresAt = int64(expiresAt)
+				body = body[n:]
+			}
+		}
+	case OpDelete, OpBatchDelete:
+		entry.Kind = types.KindTombstone
+		var key []byte
+		if key, body, err = readBytes(body); err == nil {
+			entry.Key = types.Key(key)
+		}
+	case OpCheckpoint:
+		var n int
+		entry.Checkpoint, n = binary.Uvarint(body)
+		if n <= 0 {
+			err = fmt.Errorf("%w: bad checkpoint LSN", ErrCorrupted)
+		} else {
+			body = body[n:]
+		}
+	case OpCommit, OpAbort:
+	default:
+		err = fmt.Errorf("%w: unknown operation %d", ErrCorrupted, entry.Operation)
+	}
+	if err != nil {
+		return entry, err
+	}
+	if len(body) != 0 {
+		return entry, fmt.Errorf("%w: %d trailing bytes in record", ErrCorrupted, len(body))
+	}
+	return entry, nil
+}
+
+func readBytes(data []byte) ([]byte, []byte, error) {
+	length, n := binary.Uvarint(data)
+	if n <= 0 || uint64(len(data)-n) < length {
+		return nil, nil, fmt.Errorf("%w: bad length prefix", ErrCorrupted)
+	}
+	value := make([]byte, length)
+	copy(value, data[n:])
+	return value, data[n+int(length):], nil
+}
+
+// readSegment calls fn for every record in a binary segment and returns the
+// offset just past the last valid record. A damaged final record is treated
+// as a torn write and ends the segment when tolerateTail is set; damage that
+// is followed by more records, or a length no record can have, is always
+// reported as ErrCorrupted.
+func readSegment(path string, tolerateTail bool, fn func(LogEntry) error) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to open WAL file for replay: %w", err)
+	}
+	defer func() { _ = file.Close() }()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat WAL file: %w", err)
+	}
+	size := info.Size()
+	if size == 0 {
+		return 0, nil
+	}
+
+	reader := bufio.NewReader(file)
+	offset, err := readSegmentHeader(reader, size)
+	for err == nil && offset < size {
+		var entry LogEntry
+		var recordSize int64
+		entry, recordSize, err = readRecord(reader, size-offset)
+		if err != nil {
+			break
+		}
+		if err = fn(entry); err != nil {
+			return 0, err
+		}
+		offset += recordSize
+	}
+
+	if errors.Is(err, errTornTail) {
+		if !tolerateTail {
+			return 0, fmt.Errorf("%w: sealed segment %s ends mid-record at offset %d", ErrCorrupted, path, offset)
+		}
+		return offset, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("%s at offset %d: %w", path, offset, err)
+	}
+	return offset, nil
+}
+
+func readSegmentHeader(reader io.Reader, size int64) (int64, error) {
+	if size < segmentHeaderSize {
+		return 0, errTornTail
+	}
+	header := make([]byte, segmentHeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return 0, fmt.Errorf("failed to read WAL segment header: %w", err)
+	}
+	if string(header) != string(segmentMagic) {
+		return 0, fmt.Errorf("%w: bad segment header", ErrCorrupted)
+	}
+	return segmentHeaderSize, nil
+}
+
+func readRecord(reader io.Reader, remaining int64) (LogEntry, int64, error) {
+	if remaining < recordHeaderSize {
+		return LogEntry{}, 0, errTornTail
+	}
+
+	header := make([]byte, recordHeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return LogEntry{}, 0, fmt.Errorf("failed to read record header: %w", err)
+	}
+	checksum := binary.BigEndian.Uint32(header[0:4])
+	length := int64(binary.BigEndian.Uint32(header[4:8]))
+
+	if length > maxPayloadSize {
+		return LogEntry{}, 0, fmt.Errorf("%w: record length %d", ErrCorrupted, length)
+	}
+	recordSize := recordHeaderSize + length
+	if recordSize > remaining {
+		// A write cut short leaves nothing valid after it; a damaged length
+		// that happens to point past the end can be told apart by the
+		// records still following.
+		rest := make([]byte, remaining-recordHeaderSize)
+		if _, err := io.ReadFull(reader, rest); err != nil {
+			return LogEntry{}, 0, fmt.Errorf("failed to read record payload: %w", err)
+		}
+		if containsRecord(rest) {
+			return LogEntry{}, 0, fmt.Errorf("%w: record length %d runs past valid records", ErrCorrupted, length)
+		}
+		return LogEntry{}, 0, errTornTail
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return LogEntry{}, 0, fmt.Errorf("failed to read record payload: %w", err)
+	}
+
+	crc := crc32.Update(crc32.Checksum(header[4:8], castagnoli), castagnoli, payload)
+	if crc != checksum {
+		if recordSize == remaining {
+			return LogEntry{}, 0, errTornTail
+		}
+		return LogEntry{}, 0, fmt.Errorf("%w: checksum mismatch", ErrCorrupted)
+	}
+
+	entry, err := decodePayload(payload)
+	if err != nil {
+		return LogEntry{}, 0, err
+	}
+	return entry, recordSize, nil
+}
+
+// containsRecord reports whether a record with a valid checksum starts
+// anywhere in data.
+func containsRecord(data []byte) bool {
+	for i := 0; i+recordHeaderSize <= len(data); i++ {
+		length := int(binary.BigEndian.Uint32(data[i+4 : i+8]))
+		end := i + recordHeaderSize + length
+		if length > maxPayloadSize || end > len(data) {
+			continue
+		}
+		if crc32.Checksum(data[i+4:end], castagnoli) == binary.BigEndian.Uint32(data[i:i+4]) {
+			return true
+		}
+	}
+	return false
+}
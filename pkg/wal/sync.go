@@ -0,0 +1,161 @@
+package wal
+
+import (
+	"fmt"
+	dberrors "halo-db/pkg/errors"
+	"time"
+)
+
+type SyncMode int
+
+const (
+	// SyncAlways fsyncs every write on its own before returning.
+	SyncAlways SyncMode = iota
+	// SyncGroup blocks writers until their record is durable, but lets
+	// writers that arrive during an fsync share the next one.
+	SyncGroup
+	// SyncInterval fsyncs in the background, so a crash can lose the
+	// writes of the last interval.
+	SyncInterval
+	// SyncNone leaves flushing to the operating system.
+	SyncNone
+)
+
+func ParseSyncMode(mode string) (SyncMode, error) {
+	switch mode {
+	case "always":
+		return SyncAlways, nil
+	case "group":
+		return SyncGroup, nil
+	case "interval":
+		return SyncInterval, nil
+	case "none":
+		return SyncNone, nil
+	}
+	return 0, fmt.Errorf("unknown WAL sync mode %q", mode)
+}
+
+func (m SyncMode) String() string {
+	switch m {
+	case SyncAlways:
+		return "always"
+	case SyncGroup:
+		return "group"
+	case SyncInterval:
+		return "interval"
+	case SyncNone:
+		return "none"
+	}
+	return fmt.Sprintf("SyncMode(%d)", int(m))
+}
+
+// waitDurableLocked returns once every record up to lsn has been fsynced, as
+// far as the sync mode promises. In group mode one writer becomes the leader
+// and fsyncs with the mutex released; everyone who appended in the meantime
+// waits for that fsync or leads the next one.
+func (w *wal) waitDurableLocked(lsn uint64) error {
+	if w.syncErr != nil {
+		return w.syncErr
+	}
+	switch w.syncMode {
+	case SyncInterval, SyncNone:
+		return nil
+	case SyncAlways:
+		if w.syncedLSN >= lsn {
+			return nil
+		}
+		if w.closed {
+			return dberrors.ErrClosed
+		}
+		if err := w.file.Sync(); err != nil {
+			return w.failSyncLocked(err)
+		}
+		w.syncs++
+		w.syncedLSN = w.lastLSN
+		return nil
+	}
+	return w.syncToLocked(lsn)
+}
+
+func (w *wal) syncToLocked(lsn uint64) error {
+	for w.syncedLSN < lsn {
+		if w.syncing {
+			w.syncCond.Wait()
+			continue
+		}
+		if w.syncErr != nil {
+			return w.syncErr
+		}
+		if w.closed {
+			return dberrors.ErrClosed
+		}
+		if err := w.syncLocked(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncLocked fsyncs the active segment with the mutex released. Rotation,
+// Close and Clear wait for it through waitSyncLocked before touching the
+// file.
+func (w *wal) syncLocked() error {
+	if w.syncErr != nil {
+		return w.syncErr
+	}
+	w.syncing = true
+	target := w.lastLSN
+	file := w.file
+
+	w.mu.Unlock()
+	err := file.Sync()
+	w.mu.Lock()
+
+	w.syncs++
+	w.syncing = false
+	if err == nil && target > w.syncedLSN {
+		w.syncedLSN = target
+	}
+	if err != nil {
+		err = w.failSyncLocked(err)
+	}
+	w.syncCond.Broadcast()
+	return err
+}
+
+// failSyncLocked records a failed fsync and returns the error every later
+// append and wait gets. Only the first failure is kept: a writer that
+// retried and succeeded would otherwise be told records were durable that
+// the kernel already dropped.
+func (w *wal) failSyncLocked(err error) error {
+	if w.syncErr == nil {
+		w.syncErr = fmt.Errorf("failed to sync WAL: %w", err)
+	}
+	return w.syncErr
+}
+
+func (w *wal) waitSyncLocked() {
+	for w.syncing {
+		w.syncCond.Wait()
+	}
+}
+
+func (w *wal) syncPeriodically(interval time.Duration, stop <-chan struct{}) {
+	defer close(w.syncDone)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			w.mu.Lock()
+			if w.file != nil && !w.syncing && w.syncedLSN < w.lastLSN {
+				_ = w.syncLocked()
+			}
+			w.mu.Unlock()
+		}
+	}
+}
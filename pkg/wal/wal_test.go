@@ -1,9 +1,16 @@
 package wal
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"halo-db/pkg/batch"
+	dberrors "halo-db/pkg/errors"
 	"halo-db/pkg/types"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
 )
 
@@ -176,3 +183,613 @@ func TestWALNewDatabase(t *testing.T) {
 		t.Errorf("Expected no operations to be replayed, got %d inserts and %d deletes", insertCount, deleteCount)
 	}
 }
+
+func TestWALCheckpoint(t *testing.T) {
+
+	tempDir := t.TempDir()
+
+	wal, err := NewWAL(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+
+	for _, key := range []types.Key{"key1", "key2", "key3"} {
+		if err := wal.LogInsert(key, types.Value("value")); err != nil {
+			t.Fatalf("Failed to log insert: %v", err)
+		}
+	}
+
+	if err := wal.Checkpoint(2); err != nil {
+		t.Fatalf("Failed to checkpoint: %v", err)
+	}
+
+	if err := wal.LogInsert("key4", types.Value("value")); err != nil {
+		t.Fatalf("Failed to log insert: %v", err)
+	}
+
+	if err := wal.Checkpoint(100); err == nil {
+		t.Error("Expected error for checkpoint beyond last LSN")
+	}
+
+	_ = wal.Close()
+
+	wal2, err := NewWAL(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to reopen WAL: %v", err)
+	}
+	defer func() { _ = wal2.Close() }()
+
+	var replayed []types.Key
+	insertHandler := func(key types.Key, value types.Value) error {
+		replayed = append(replayed, key)
+		return nil
+	}
+	deleteHandler := func(key types.Key) error {
+		return nil
+	}
+
+	if err := wal2.Replay(insertHandler, deleteHandler); err != nil {
+		t.Fatalf("Failed to replay WAL: %v", err)
+	}
+
+	if len(replayed) != 2 || replayed[0] != "key3" || replayed[1] != "key4" {
+		t.Errorf("Expected replay of [key3 key4] after checkpoint, got %v", replayed)
+	}
+
+	if wal2.LastLSN() != 5 {
+		t.Errorf("Expected last LSN 5 after reopen, got %d", wal2.LastLSN())
+	}
+}
+
+func TestWALCheckpointRemovesSegments(t *testing.T) {
+
+	tempDir := t.TempDir()
+
+	wal, err := NewWAL(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer func() { _ = wal.Close() }()
+
+	for i := 0; i < 3; i++ {
+		if err := wal.LogInsert(types.Key("key"), types.Value("value")); err != nil {
+			t.Fatalf("Failed to log insert: %v", err)
+		}
+		if err := wal.Rotate(); err != nil {
+			t.Fatalf("Failed to rotate WAL: %v", err)
+		}
+	}
+
+	segments, _ := filepath.Glob(filepath.Join(tempDir, "wal-*.log"))
+	if len(segments) != 3 {
+		t.Fatalf("Expected 3 sealed segments, got %d", len(segments))
+	}
+
+	if err := wal.Checkpoint(2); err != nil {
+		t.Fatalf("Failed to checkpoint: %v", err)
+	}
+
+	segments, _ = filepath.Glob(filepath.Join(tempDir, "wal-*.log"))
+	if len(segments) != 1 {
+		t.Fatalf("Expected 1 sealed segment after checkpoint, got %v", segments)
+	}
+
+	replayed := 0
+	err = wal.Replay(func(key types.Key, value types.Value) error {
+		replayed++
+		return nil
+	}, func(key types.Key) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to replay WAL: %v", err)
+	}
+	if replayed != 1 {
+		t.Errorf("Expected 1 entry after checkpoint, got %d", replayed)
+	}
+}
+
+func replayKeys(t *testing.T, w WAL) []types.Key {
+	t.Helper()
+	var keys []types.Key
+	err := w.Replay(func(key types.Key, value types.Value) error {
+		keys = append(keys, key)
+		return nil
+	}, func(key types.Key) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to replay WAL: %v", err)
+	}
+	return keys
+}
+
+func TestWALTornTail(t *testing.T) {
+
+	tempDir := t.TempDir()
+
+	wal, err := NewWAL(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	for _, key := range []types.Key{"key1", "key2"} {
+		if err := wal.LogInsert(key, types.Value("value")); err != nil {
+			t.Fatalf("Failed to log insert: %v", err)
+		}
+	}
+	_ = wal.Close()
+
+	walPath := filepath.Join(tempDir, "wal.log")
+	intact, _ := os.Stat(walPath)
+
+	partial := encodeRecord(&LogEntry{LSN: 3, Operation: OpInsert, Key: "key3", Value: types.Value("value")})
+	file, _ := os.OpenFile(walPath, os.O_APPEND|os.O_WRONLY, 0644)
+	_, _ = file.Write(partial[:len(partial)-3])
+	_ = file.Close()
+
+	wal2, err := NewWAL(tempDir)
+	if err != nil {
+		t.Fatalf("Expected torn tail to be tolerated: %v", err)
+	}
+	defer func() { _ = wal2.Close() }()
+
+	keys := replayKeys(t, wal2)
+	if len(keys) != 2 {
+		t.Errorf("Expected 2 intact records, got %v", keys)
+	}
+
+	info, _ := os.Stat(walPath)
+	if info.Size() != intact.Size() {
+		t.Errorf("Expected torn tail to be truncated to %d bytes, got %d", intact.Size(), info.Size())
+	}
+
+	if err := wal2.LogInsert("key4", types.Value("value")); err != nil {
+		t.Fatalf("Failed to log insert after truncation: %v", err)
+	}
+	if keys := replayKeys(t, wal2); len(keys) != 3 || keys[2] != "key4" {
+		t.Errorf("Expected new record after intact ones, got %v", keys)
+	}
+}
+
+func TestWALMidLogCorruption(t *testing.T) {
+
+	tempDir := t.TempDir()
+
+	wal, err := NewWAL(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	for _, key := range []types.Key{"key1", "key2", "key3"} {
+		if err := wal.LogInsert(key, types.Value("value")); err != nil {
+			t.Fatalf("Failed to log insert: %v", err)
+		}
+	}
+	_ = wal.Close()
+
+	walPath := filepath.Join(tempDir, "wal.log")
+	data, err := os.ReadFile(walPath)
+	if err != nil {
+		t.Fatalf("Failed to read WAL: %v", err)
+	}
+	data[segmentHeaderSize+recordHeaderSize+10] ^= 0xff
+	if err := os.WriteFile(walPath, data, 0644); err != nil {
+		t.Fatalf("Failed to write WAL: %v", err)
+	}
+
+	_, err = NewWAL(tempDir)
+	if !errors.Is(err, ErrCorrupted) || !errors.Is(err, dberrors.ErrCorrupted) {
+		t.Fatalf("Expected ErrCorrupted for mid-log damage, got %v", err)
+	}
+}
+
+func TestWALCorruptedLength(t *testing.T) {
+
+	tempDir := t.TempDir()
+
+	wal, err := NewWAL(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	for _, key := range []types.Key{"key1", "key2", "key3", "key4"} {
+		if err := wal.LogInsert(key, types.Value("value")); err != nil {
+			t.Fatalf("Failed to log insert: %v", err)
+		}
+	}
+	_ = wal.Close()
+
+	walPath := filepath.Join(tempDir, "wal.log")
+	intact, err := os.ReadFile(walPath)
+	if err != nil {
+		t.Fatalf("Failed to read WAL: %v", err)
+	}
+
+	// Each flip leaves the first record's length pointing past the end of
+	// the file, within it, or beyond any record's size.
+	for _, bit := range []int{7, 2, 31} {
+		data := append([]byte(nil), intact...)
+		lengthAt := segmentHeaderSize + 4
+		length := binary.BigEndian.Uint32(data[lengthAt:])
+		binary.BigEndian.PutUint32(data[lengthAt:], length^1<<bit)
+		if err := os.WriteFile(walPath, data, 0644); err != nil {
+			t.Fatalf("Failed to write WAL: %v", err)
+		}
+
+		_, err = NewWAL(tempDir)
+		if !errors.Is(err, ErrCorrupted) {
+			t.Errorf("Expected ErrCorrupted with bit %d of the length flipped, got %v", bit, err)
+		}
+		info, _ := os.Stat(walPath)
+		if info.Size() != int64(len(intact)) {
+			t.Errorf("Expected the damaged WAL to be left at %d bytes, got %d", len(intact), info.Size())
+		}
+	}
+}
+
+func TestWALEmptyValue(t *testing.T) {
+
+	tempDir := t.TempDir()
+
+	wal, err := NewWAL(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	if err := wal.LogInsert("empty", types.Value{}); err != nil {
+		t.Fatalf("Failed to log insert: %v", err)
+	}
+	_ = wal.Close()
+
+	wal2, err := NewWAL(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to reopen WAL: %v", err)
+	}
+	defer func() { _ = wal2.Close() }()
+
+	var replayed types.Value
+	err = wal2.Replay(func(key types.Key, value types.Value) error {
+		replayed = value
+		return nil
+	}, func(key types.Key) error {
+		t.Errorf("Empty value replayed as delete")
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to replay WAL: %v", err)
+	}
+	if replayed == nil || len(replayed) != 0 {
+		t.Errorf("Expected empty non-nil value, got %v", replayed)
+	}
+}
+
+func TestRecordKinds(t *testing.T) {
+	records := []struct {
+		entry LogEntry
+		kind  types.Kind
+	}{
+		{LogEntry{Operation: OpInsert, Key: "key", Value: types.Value{}}, types.KindValue},
+		{LogEntry{Operation: OpInsertTTL, Key: "key", Value: types.Value("value"), ExpiresAt: 1}, types.KindValue},
+		{LogEntry{Operation: OpBatchInsert, BatchID: 1, Key: "key"}, types.KindValue},
+		{LogEntry{Operation: OpDelete, Key: "key"}, types.KindTombstone},
+		{LogEntry{Operation: OpBatchDelete, BatchID: 1, Key: "key"}, types.KindTombstone},
+	}
+	for _, record := range records {
+		data := encodeRecord(&record.entry)
+		entry, err := decodePayload(data[recordHeaderSize:])
+		if err != nil {
+			t.Fatalf("Failed to decode op %d: %v", record.entry.Operation, err)
+		}
+		if entry.Kind != record.kind {
+			t.Errorf("Expected kind %d for op %d, got %d", record.kind, record.entry.Operation, entry.Kind)
+		}
+		if entry.Kind == types.KindValue && entry.Value == nil {
+			t.Errorf("Expected op %d to decode a non-nil value", record.entry.Operation)
+		}
+	}
+}
+
+func TestWALLegacyMigration(t *testing.T) {
+
+	tempDir := t.TempDir()
+	walPath := filepath.Join(tempDir, "wal.log")
+
+	var legacy []byte
+	for _, record := range []string{
+		`{"op":"INSERT","key":"key1","value":"dmFsdWUx","timestamp":0}`,
+		`{"op":"INSERT","key":"key2","value":"dmFsdWUy","timestamp":0}`,
+		`{"op":"DELETE","key":"key1","timestamp":0}`,
+	} {
+		length := make([]byte, 4)
+		binary.BigEndian.PutUint32(length, uint32(len(record)))
+		legacy = append(legacy, length...)
+		legacy = append(legacy, record...)
+	}
+	if err := os.WriteFile(walPath, legacy, 0644); err != nil {
+		t.Fatalf("Failed to write legacy WAL: %v", err)
+	}
+
+	wal, err := NewWAL(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to open legacy WAL: %v", err)
+	}
+	defer func() { _ = wal.Close() }()
+
+	var ops []string
+	err = wal.Replay(func(key types.Key, value types.Value) error {
+		ops = append(ops, "insert:"+key+"="+string(value))
+		return nil
+	}, func(key types.Key) error {
+		ops = append(ops, "delete:"+key)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to replay migrated WAL: %v", err)
+	}
+
+	expected := []string{"insert:key1=value1", "insert:key2=value2", "delete:key1"}
+	if len(ops) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, ops)
+	}
+	for i := range expected {
+		if ops[i] != expected[i] {
+			t.Errorf("Operation %d: expected %s, got %s", i, expected[i], ops[i])
+		}
+	}
+
+	if wal.LastLSN() != 3 {
+		t.Errorf("Expected migrated records to be numbered up to LSN 3, got %d", wal.LastLSN())
+	}
+
+	data, _ := os.ReadFile(walPath)
+	if !bytes.HasPrefix(data, segmentMagic) {
+		t.Error("Expected WAL to be rewritten in the binary format")
+	}
+}
+
+func TestWALBatches(t *testing.T) {
+
+	tempDir := t.TempDir()
+
+	wal, err := NewWAL(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+
+	committed := batch.NewWriteBatch()
+	committed.Put("key1", types.Value("value1"))
+	committed.Delete("key2")
+	if err := wal.LogBatch(committed.Ops()); err != nil {
+		t.Fatalf("Failed to log batch: %v", err)
+	}
+
+	inDoubt := batch.NewWriteBatch()
+	inDoubt.Put("key3", types.Value("value3"))
+	if err := wal.LogPrepare(7, inDoubt.Ops()); err != nil {
+		t.Fatalf("Failed to prepare batch: %v", err)
+	}
+
+	aborted := batch.NewWriteBatch()
+	aborted.Put("key4", types.Value("value4"))
+	if err := wal.LogPrepare(8, aborted.Ops()); err != nil {
+		t.Fatalf("Failed to prepare batch: %v", err)
+	}
+	if err := wal.LogAbort(8); err != nil {
+		t.Fatalf("Failed to abort batch: %v", err)
+	}
+	_ = wal.Close()
+
+	wal, err = NewWAL(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to reopen WAL: %v", err)
+	}
+	defer func() { _ = wal.Close() }()
+
+	keys := replayKeys(t, wal)
+	if len(keys) != 2 || keys[0] != "key1" || keys[1] != "key2" {
+		t.Fatalf("Expected only the committed batch to replay, got %v", keys)
+	}
+
+	prepared := wal.Prepared()
+	if len(prepared) != 1 {
+		t.Fatalf("Expected 1 in-doubt batch, got %d", len(prepared))
+	}
+	b, ok := prepared[7]
+	if !ok || b.Len() != 1 || b.Ops()[0].Key != "key3" {
+		t.Fatalf("Unexpected in-doubt batch: %v", prepared)
+	}
+
+	if err := wal.LogCommit(7); err != nil {
+		t.Fatalf("Failed to commit batch: %v", err)
+	}
+	if len(wal.Prepared()) != 0 {
+		t.Fatal("Expected no in-doubt batches after commit")
+	}
+}
+
+func TestWALTornBatch(t *testing.T) {
+	tempDir := t.TempDir()
+
+	wal, err := NewWAL(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	torn := batch.NewWriteBatch()
+	torn.Put("torn1", types.Value("value"))
+	torn.Put("torn2", types.Value("value"))
+	if err := wal.LogBatch(torn.Ops()); err != nil {
+		t.Fatalf("Failed to log batch: %v", err)
+	}
+	_ = wal.Close()
+
+	// Cut off the group's commit marker, as a crash between the writes of
+	// the group and its marker would.
+	walPath := filepath.Join(tempDir, "wal.log")
+	info, _ := os.Stat(walPath)
+	marker := encodeRecord(&LogEntry{LSN: 3, Operation: OpCommit, BatchID: batchGroupFlag | 1})
+	if err := os.Truncate(walPath, info.Size()-int64(len(marker))); err != nil {
+		t.Fatalf("Failed to truncate WAL: %v", err)
+	}
+
+	wal, err = NewWAL(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to reopen WAL: %v", err)
+	}
+	good := batch.NewWriteBatch()
+	good.Put("good", types.Value("value"))
+	if err := wal.LogBatch(good.Ops()); err != nil {
+		t.Fatalf("Failed to log batch: %v", err)
+	}
+	_ = wal.Close()
+
+	wal, err = NewWAL(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to reopen WAL: %v", err)
+	}
+	defer func() { _ = wal.Close() }()
+
+	if keys := replayKeys(t, wal); len(keys) != 1 || keys[0] != "good" {
+		t.Errorf("Expected only the committed batch to replay, got %v", keys)
+	}
+	if len(wal.Prepared()) != 0 {
+		t.Errorf("Expected the torn batch not to be left in doubt, got %v", wal.Prepared())
+	}
+}
+
+func TestWALSyncModes(t *testing.T) {
+	for _, name := range []string{"always", "group", "interval", "none"} {
+		t.Run(name, func(t *testing.T) {
+			mode, err := ParseSyncMode(name)
+			if err != nil {
+				t.Fatalf("Failed to parse sync mode: %v", err)
+			}
+			if mode.String() != name {
+				t.Fatalf("Expected %s, got %s", name, mode)
+			}
+
+			tempDir := t.TempDir()
+			wal, err := NewWALWithSyncMode(tempDir, mode)
+			if err != nil {
+				t.Fatalf("Failed to create WAL: %v", err)
+			}
+
+			const writers, perWriter = 8, 50
+			var wg sync.WaitGroup
+			for i := 0; i < writers; i++ {
+				wg.Add(1)
+				go func(writer int) {
+					defer wg.Done()
+					for j := 0; j < perWriter; j++ {
+						key := types.Key(fmt.Sprintf("key_%d_%d", writer, j))
+						if err := wal.LogInsert(key, types.Value("value")); err != nil {
+							t.Errorf("Failed to log insert: %v", err)
+							return
+						}
+					}
+				}(i)
+			}
+			wg.Wait()
+
+			if err := wal.Checkpoint(0); err != nil {
+				t.Fatalf("Failed to checkpoint: %v", err)
+			}
+			if got := wal.LastLSN(); got != writers*perWriter+1 {
+				t.Fatalf("Expected last LSN %d, got %d", writers*perWriter+1, got)
+			}
+			_ = wal.Close()
+
+			wal, err = NewWALWithSyncMode(tempDir, mode)
+			if err != nil {
+				t.Fatalf("Failed to reopen WAL: %v", err)
+			}
+			defer func() { _ = wal.Close() }()
+
+			if keys := replayKeys(t, wal); len(keys) != writers*perWriter {
+				t.Fatalf("Expected %d keys after reopen, got %d", writers*perWriter, len(keys))
+			}
+		})
+	}
+
+	if _, err := ParseSyncMode("sometimes"); err == nil {
+		t.Fatal("Expected an error for an unknown sync mode")
+	}
+}
+
+func TestWALSyncFailure(t *testing.T) {
+
+	tempDir := t.TempDir()
+	log, err := NewWALWithSyncMode(tempDir, SyncGroup)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	w := log.(*wal)
+
+	lsn, err := w.AppendInsert("key1", types.Value("value"), 0)
+	if err != nil {
+		t.Fatalf("Failed to append: %v", err)
+	}
+
+	// A closed file fails its fsync, as a disk returning EIO would.
+	w.mu.Lock()
+	file := w.file
+	closed, _ := os.Open(w.filePath)
+	_ = closed.Close()
+	w.file = closed
+	w.mu.Unlock()
+
+	if err := w.WaitDurable(lsn); err == nil {
+		t.Fatal("Expected the failed fsync to be reported")
+	}
+
+	// The next fsync would succeed, but the record may already be lost.
+	w.mu.Lock()
+	w.file = file
+	w.mu.Unlock()
+	defer func() { _ = w.Close() }()
+
+	if err := w.WaitDurable(lsn); err == nil {
+		t.Error("Expected a later wait to keep failing after a failed fsync")
+	}
+	if err := w.Sync(); err == nil {
+		t.Error("Expected Sync to keep failing after a failed fsync")
+	}
+	if _, err := w.AppendInsert("key2", types.Value("value"), 0); err == nil {
+		t.Error("Expected appends to fail after a failed fsync")
+	}
+}
+
+func TestWALExpiry(t *testing.T) {
+
+	tempDir := t.TempDir()
+
+	wal, err := NewWAL(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	if err := wal.LogInsert("plain", types.Value("value")); err != nil {
+		t.Fatalf("Failed to log insert: %v", err)
+	}
+	if err := wal.LogInsertWithExpiry("ttl", types.Value("value"), 1234567890); err != nil {
+		t.Fatalf("Failed to log insert with expiry: %v", err)
+	}
+	_ = wal.Close()
+
+	wal, err = NewWAL(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to reopen WAL: %v", err)
+	}
+	defer func() { _ = wal.Close() }()
+
+	expiries := make(map[types.Key]int64)
+	err = wal.ReplayWithExpiry(func(key types.Key, value types.Value, expiresAt int64) error {
+		expiries[key] = expiresAt
+		return nil
+	}, func(key types.Key) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to replay WAL: %v", err)
+	}
+
+	if expiries["plain"] != 0 || expiries["ttl"] != 1234567890 {
+		t.Errorf("Unexpected expiries after replay: %v", expiries)
+	}
+}